@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mozilla-services/autograph/formats"
+	"github.com/mozilla-services/autograph/signer"
+	"github.com/mozilla-services/autograph/signer/apk2"
+	"github.com/mozilla-services/autograph/signer/contentsignature"
+	"github.com/mozilla-services/autograph/signer/contentsignaturepki"
+	"github.com/mozilla-services/autograph/signer/genericrsa"
+	"github.com/mozilla-services/autograph/signer/mar"
+	"github.com/mozilla-services/autograph/signer/xpi"
+)
+
+const adminAuthID = "admin"
+
+// rotatableSignerTypes are the types of signers that load a single
+// software key and certificate from their configuration, and can
+// have them replaced at runtime
+var rotatableSignerTypes = map[string]bool{
+	apk2.Type:             true,
+	contentsignature.Type: true,
+	genericrsa.Type:       true,
+	mar.Type:              true,
+	xpi.Type:              true,
+}
+
+// readAdminRequest reads the body of a request to an admin endpoint
+// and checks it is authorized with the admin HAWK ID. It writes an
+// error response and returns false when the request is not valid.
+func (a *autographer) readAdminRequest(w http.ResponseWriter, r *http.Request) (body []byte, userid, signerID string, ok bool) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "failed to read request body: %s", err)
+		return
+	}
+	userid, err = a.authorize(r, body)
+	if err != nil {
+		httpError(w, r, http.StatusUnauthorized, "authorization verification failed: %v", err)
+		return
+	}
+	if userid != adminAuthID {
+		httpError(w, r, http.StatusForbidden, "user is not permitted to call this endpoint")
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/json" {
+		httpError(w, r, http.StatusBadRequest, "invalid content type, expected application/json")
+		return
+	}
+	signerID, ok = mux.Vars(r)["signer_id"]
+	if !ok {
+		httpError(w, r, http.StatusInternalServerError, "route is improperly configured")
+		return
+	}
+	return body, userid, signerID, true
+}
+
+// handleRotateSignerKey replaces the software key and certificate of
+// a configured signer without restarting autograph
+func (a *autographer) handleRotateSignerKey(w http.ResponseWriter, r *http.Request) {
+	rid := getRequestID(r)
+	body, userid, signerID, ok := a.readAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	var rotreq formats.KeyRotationRequest
+	err := json.Unmarshal(body, &rotreq)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "failed to parse request body: %v", err)
+		return
+	}
+
+	a.rotationLock.Lock()
+	defer a.rotationLock.Unlock()
+
+	signerConf, ok := a.getSignerConf(signerID)
+	if !ok {
+		httpError(w, r, http.StatusNotFound, "signer %q was not found", signerID)
+		return
+	}
+	publicKey, err := verifyKeyRotationRequest(signerConf, rotreq)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "cannot rotate key of signer %q: %v", signerID, err)
+		return
+	}
+	signerConf.PrivateKey = rotreq.PrivateKey
+	signerConf.PublicKey = rotreq.PublicKey
+	signerConf.Certificate = rotreq.Certificate
+
+	var statsClient *signer.StatsClient
+	if a.stats != nil {
+		statsClient, err = signer.NewStatsClient(signerConf, a.stats)
+		if statsClient == nil || err != nil {
+			httpError(w, r, http.StatusInternalServerError, "failed to create stats client for signer %q: %v", signerID, err)
+			return
+		}
+	}
+	s, err := newSigner(signerConf, statsClient)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "failed to initialize signer %q with the new key: %v", signerID, err)
+		return
+	}
+	oldSigner, err := a.swapSigner(signerConf, s)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to replace signer %q: %v", signerID, err)
+		return
+	}
+	if statefulSigner, ok := oldSigner.(signer.StatefulSigner); ok {
+		err = statefulSigner.AtExit()
+		if err != nil {
+			log.Errorf("error in replaced signer %s AtExit fn: %s", signerID, err)
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"rid":        rid,
+		"user_id":    userid,
+		"signer_id":  signerID,
+		"public_key": publicKey,
+	}).Info("signer key rotation succeeded")
+
+	respdata, err := json.Marshal(formats.KeyRotationResponse{
+		SignerID:  signerID,
+		PublicKey: publicKey,
+	})
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "error marshaling response JSON: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respdata)
+}
+
+// handleRotateSignerChain issues a new end-entity and chain to a
+// contentsignaturepki signer, uploads the chain and replaces the
+// signer once the chain verifies at its new x5u, so a renewed issuer
+// is picked up without restarting autograph
+func (a *autographer) handleRotateSignerChain(w http.ResponseWriter, r *http.Request) {
+	rid := getRequestID(r)
+	body, userid, signerID, ok := a.readAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	var rotreq formats.ChainRotationRequest
+	if len(body) > 0 {
+		err := json.Unmarshal(body, &rotreq)
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, "failed to parse request body: %v", err)
+			return
+		}
+	}
+
+	a.rotationLock.Lock()
+	defer a.rotationLock.Unlock()
+
+	signerConf, ok := a.getSignerConf(signerID)
+	if !ok {
+		httpError(w, r, http.StatusNotFound, "signer %q was not found", signerID)
+		return
+	}
+	if signerConf.Type != contentsignaturepki.Type {
+		httpError(w, r, http.StatusBadRequest, "cannot rotate chain of signer %q: signers of type %q do not have a chain to rotate", signerID, signerConf.Type)
+		return
+	}
+	if len(signerConf.Standby) > 0 {
+		httpError(w, r, http.StatusBadRequest, "cannot rotate chain of signer %q: signers with standby backends are not supported", signerID)
+		return
+	}
+	if rotreq.IssuerCert != "" {
+		signerConf.IssuerCert = rotreq.IssuerCert
+	}
+	rotated, err := contentsignaturepki.RotateChain(signerConf)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to rotate chain of signer %q: %v", signerID, err)
+		return
+	}
+	s, err := wrapPolicies(signerConf, rotated)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to configure policies of signer %q: %v", signerID, err)
+		return
+	}
+	oldSigner, err := a.swapSigner(signerConf, s)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "failed to replace signer %q: %v", signerID, err)
+		return
+	}
+	if statefulSigner, ok := oldSigner.(signer.StatefulSigner); ok {
+		err = statefulSigner.AtExit()
+		if err != nil {
+			log.Errorf("error in replaced signer %s AtExit fn: %s", signerID, err)
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"rid":       rid,
+		"user_id":   userid,
+		"signer_id": signerID,
+		"x5u":       rotated.X5U,
+	}).Info("signer chain rotation succeeded")
+
+	respdata, err := json.Marshal(formats.ChainRotationResponse{
+		SignerID: signerID,
+		X5U:      rotated.X5U,
+	})
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "error marshaling response JSON: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respdata)
+}
+
+// verifyKeyRotationRequest checks that a signer can have its key
+// rotated, and that the new private key matches the new public key
+// and certificate. It returns the base64 encoded DER public key of
+// the new private key.
+func verifyKeyRotationRequest(signerConf signer.Configuration, rotreq formats.KeyRotationRequest) (string, error) {
+	if !rotatableSignerTypes[signerConf.Type] {
+		return "", fmt.Errorf("signers of type %q do not support key rotation", signerConf.Type)
+	}
+	if signerConf.KeystorePath != "" {
+		return "", fmt.Errorf("signer uses a keystore key")
+	}
+	if signerConf.PrivateKeyHasAWSPrefix() {
+		return "", fmt.Errorf("signer uses an AWS key reference")
+	}
+	if signerConf.PrivateKeyHasAzurePrefix() {
+		return "", fmt.Errorf("signer uses an Azure Key Vault key reference")
+	}
+	if !signerConf.PrivateKeyHasPEMPrefix() {
+		return "", fmt.Errorf("signer uses an HSM key")
+	}
+	if signerConf.Certificate != "" && rotreq.Certificate == "" {
+		return "", fmt.Errorf("signer is configured with a certificate but none was provided")
+	}
+	if signerConf.PublicKey != "" && rotreq.PublicKey == "" {
+		return "", fmt.Errorf("signer is configured with a public key but none was provided")
+	}
+	// parse the new key with the signer configuration to decrypt it
+	// with the configured passphrase when it is encrypted
+	keyConf := signerConf
+	keyConf.PrivateKey = rotreq.PrivateKey
+	if !keyConf.PrivateKeyHasPEMPrefix() {
+		return "", fmt.Errorf("private key must be PEM encoded")
+	}
+	priv, err := keyConf.GetPrivateKey()
+	if err != nil {
+		return "", fmt.Errorf("failed to parse private key: %w", err)
+	}
+	privSigner, ok := priv.(crypto.Signer)
+	if !ok {
+		return "", fmt.Errorf("unsupported private key type %T", priv)
+	}
+	pub := privSigner.Public()
+	if rotreq.Certificate != "" {
+		block, _ := pem.Decode([]byte(rotreq.Certificate))
+		if block == nil || block.Type != "CERTIFICATE" {
+			return "", fmt.Errorf("failed to PEM decode certificate")
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		if !publicKeysEqual(pub, cert.PublicKey) {
+			return "", fmt.Errorf("private key does not match the certificate public key")
+		}
+	}
+	if rotreq.PublicKey != "" {
+		confPub, err := parsePublicKey(rotreq.PublicKey)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse public key: %w", err)
+		}
+		if !publicKeysEqual(pub, confPub) {
+			return "", fmt.Errorf("private key does not match the public key")
+		}
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal public key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(pubBytes), nil
+}
+
+// parsePublicKey parses a PEM or base64 encoded DER PKIX public key
+func parsePublicKey(publicKey string) (crypto.PublicKey, error) {
+	var der []byte
+	block, _ := pem.Decode([]byte(publicKey))
+	if block != nil {
+		der = block.Bytes
+	} else {
+		var err error
+		der, err = base64.StdEncoding.DecodeString(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("public key is neither PEM nor base64 encoded: %w", err)
+		}
+	}
+	return x509.ParsePKIXPublicKey(der)
+}
+
+// publicKeysEqual returns whether two public keys are the same
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	eq, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && eq.Equal(b)
+}
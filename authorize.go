@@ -91,8 +91,13 @@ func (a *autographer) authorizeHeader(r *http.Request) (auth *hawk.Auth, userid
 }
 
 // authorizeBody validates the body within the request and returns
-// an error which will be nil if the authorization is successful
+// an error which will be nil if the authorization is successful. The
+// hash field of the HAWK header is covered by the MAC, so checking it
+// against the body binds the body to the authorization header.
 func (a *autographer) authorizeBody(auth *hawk.Auth, r *http.Request, body []byte) (err error) {
+	if len(auth.Hash) == 0 {
+		return fmt.Errorf("missing payload hash in Authorization header")
+	}
 	payloadhash := auth.PayloadHash(r.Header.Get("Content-Type"))
 	payloadhash.Write(body)
 	if a.stats != nil {
@@ -77,6 +77,37 @@ func TestBadPayload(t *testing.T) {
 	}
 }
 
+func TestMissingPayloadHash(t *testing.T) {
+	t.Parallel()
+
+	body := []byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	bodyrdr := bytes.NewReader(body)
+	req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bodyrdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := ag.getAuthByID(conf.Authorizations[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// make a valid header without a payload hash
+	hawkauth := hawk.NewRequestAuth(req,
+		&hawk.Credentials{
+			ID:   auth.ID,
+			Key:  auth.Key,
+			Hash: sha256.New},
+		0)
+	hawkauth.Ext = id()
+	req.Header.Set("Authorization", hawkauth.RequestHeader())
+	_, err = ag.authorize(req, body)
+	if err == nil {
+		t.Errorf("expected auth to fail with missing payload hash but succeeded")
+	}
+	if err.Error() != "missing payload hash in Authorization header" {
+		t.Errorf("expected auth to fail with missing payload hash but got error: %v", err)
+	}
+}
+
 func TestExpiredAuth(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,206 @@
+// Package client is a Go client of the autograph signing endpoints
+// that handles the hawk authorization of requests
+package client // import "github.com/mozilla-services/autograph/client"
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/autograph/formats"
+
+	"go.mozilla.org/hawk"
+)
+
+const (
+	// DefaultMaxRetries is the number of times a request is retried
+	// by default after a network error or a retryable status
+	DefaultMaxRetries = 2
+
+	// DefaultRetryWait is the wait before the first retry of a
+	// request by default, it grows linearly with each retry
+	DefaultRetryWait = time.Second
+
+	// contentType is the content type of the requests and the
+	// payload hash of their hawk authorization
+	contentType = "application/json"
+)
+
+// Client signs data, files and hashes with an autograph server
+type Client struct {
+	// HTTPClient sends the requests, it defaults to a client with a
+	// one minute timeout
+	HTTPClient *http.Client
+
+	// MaxRetries is the number of times a request is retried after
+	// a network error or a 429, 502, 503 or 504 response
+	MaxRetries int
+
+	// RetryWait is the wait before the first retry of a request,
+	// the wait before the nth retry is n times RetryWait
+	RetryWait time.Duration
+
+	baseURL string
+	authID  string
+	key     string
+}
+
+// New returns a client of the autograph server at baseURL, e.g.
+// http://localhost:8000, that authenticates as authID with the hawk key
+func New(baseURL, authID, key string) *Client {
+	return &Client{
+		HTTPClient: &http.Client{Timeout: time.Minute},
+		MaxRetries: DefaultMaxRetries,
+		RetryWait:  DefaultRetryWait,
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		authID:     authID,
+		key:        key,
+	}
+}
+
+// SignData signs input with the signer keyID, or the default signer of
+// the authorization when empty, at the /sign/data endpoint
+func (c *Client) SignData(input []byte, keyID string, options interface{}) (formats.SignatureResponse, error) {
+	return c.signOne(context.Background(), "/sign/data", input, keyID, options)
+}
+
+// SignFile signs the file input with the signer keyID, or the default
+// signer of the authorization when empty, at the /sign/file endpoint.
+// The signed file is base64 encoded in the SignedFile field of the
+// response.
+func (c *Client) SignFile(input []byte, keyID string, options interface{}) (formats.SignatureResponse, error) {
+	return c.signOne(context.Background(), "/sign/file", input, keyID, options)
+}
+
+// SignHash signs the digest input with the signer keyID, or the default
+// signer of the authorization when empty, at the /sign/hash endpoint
+func (c *Client) SignHash(input []byte, keyID string, options interface{}) (formats.SignatureResponse, error) {
+	return c.signOne(context.Background(), "/sign/hash", input, keyID, options)
+}
+
+// signOne sends a single base64 encoded input to endpoint and returns
+// its signature response
+func (c *Client) signOne(ctx context.Context, endpoint string, input []byte, keyID string, options interface{}) (formats.SignatureResponse, error) {
+	sigreqs := []formats.SignatureRequest{{
+		Input:   base64.StdEncoding.EncodeToString(input),
+		KeyID:   keyID,
+		Options: options,
+	}}
+	sigresps, err := c.Sign(ctx, endpoint, sigreqs)
+	if err != nil {
+		return formats.SignatureResponse{}, err
+	}
+	if len(sigresps) != 1 {
+		return formats.SignatureResponse{}, fmt.Errorf("client: expected 1 signature response from %s but got %d", endpoint, len(sigresps))
+	}
+	return sigresps[0], nil
+}
+
+// Sign sends the signature requests to the signing endpoint, e.g.
+// /sign/data, and returns the signature responses. It retries the
+// request after network errors and retryable statuses until the
+// context is done.
+func (c *Client) Sign(ctx context.Context, endpoint string, sigreqs []formats.SignatureRequest) ([]formats.SignatureResponse, error) {
+	body, err := json.Marshal(sigreqs)
+	if err != nil {
+		return nil, fmt.Errorf("client: failed to marshal signature requests: %w", err)
+	}
+	respBody, err := c.do(ctx, http.MethodPost, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	var sigresps []formats.SignatureResponse
+	err = json.Unmarshal(respBody, &sigresps)
+	if err != nil {
+		return nil, fmt.Errorf("client: failed to unmarshal signature responses from %s: %w", endpoint, err)
+	}
+	return sigresps, nil
+}
+
+// do sends the request with retries and returns the body of the
+// first 200 response
+func (c *Client) do(ctx context.Context, method, endpoint string, body []byte) ([]byte, error) {
+	var lastErr error
+	for attempt := 0; attempt <= c.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(attempt) * c.RetryWait):
+			case <-ctx.Done():
+				return nil, fmt.Errorf("client: %s %s canceled after %d attempts: %w", method, endpoint, attempt, lastErr)
+			}
+		}
+		respBody, retry, err := c.doOnce(ctx, method, endpoint, body)
+		if err == nil {
+			return respBody, nil
+		}
+		if !retry {
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("client: %s %s failed after %d attempts: %w", method, endpoint, c.MaxRetries+1, lastErr)
+}
+
+// doOnce sends the request once and returns the body of a 200
+// response, or an error and whether the request can be retried
+func (c *Client) doOnce(ctx context.Context, method, endpoint string, body []byte) (respBody []byte, retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, fmt.Errorf("client: failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	// each attempt gets a new timestamp and nonce, the server
+	// rejects replayed nonces
+	req.Header.Set("Authorization", AuthHeader(req, c.authID, c.key, body))
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		// retry network errors unless the context is done
+		return nil, ctx.Err() == nil, fmt.Errorf("client: failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, fmt.Errorf("client: failed to read response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, isRetryableStatus(resp.StatusCode), fmt.Errorf("client: %s %s returned %s: %s", method, endpoint, resp.Status, bytes.TrimSpace(respBody))
+	}
+	return respBody, false, nil
+}
+
+// isRetryableStatus returns whether a request that got a response
+// with the status code can succeed when sent again
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// AuthHeader returns the hawk Authorization header of the request
+// with the hash of its JSON payload, as autograph requires
+func AuthHeader(req *http.Request, authID, key string, payload []byte) string {
+	auth := hawk.NewRequestAuth(req,
+		&hawk.Credentials{
+			ID:   authID,
+			Key:  key,
+			Hash: sha256.New},
+		0)
+	payloadhash := auth.PayloadHash(contentType)
+	payloadhash.Write(payload)
+	auth.SetHash(payloadhash)
+	return auth.RequestHeader()
+}
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/autograph/formats"
+
+	"go.mozilla.org/hawk"
+)
+
+const (
+	testAuthID = "alice"
+	testKey    = "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu"
+)
+
+// newTestServer returns a server that checks the hawk authorization
+// and payload hash of requests like autograph does and replies to
+// signature requests with their input, after failing the first
+// failures requests with failStatus
+func newTestServer(t *testing.T, failures int32, failStatus int) (*httptest.Server, *int32) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := atomic.AddInt32(&calls, 1)
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth, err := hawk.NewAuthFromRequest(r, func(creds *hawk.Credentials) error {
+			if creds.ID != testAuthID {
+				return &hawk.CredentialError{Type: hawk.UnknownID, Credentials: creds}
+			}
+			creds.Key = testKey
+			creds.Hash = sha256.New
+			return nil
+		}, nil)
+		if err == nil {
+			err = auth.Valid()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		payloadhash := auth.PayloadHash(r.Header.Get("Content-Type"))
+		payloadhash.Write(body)
+		if !auth.ValidHash(payloadhash) {
+			http.Error(w, "payload validation failed", http.StatusUnauthorized)
+			return
+		}
+		if call <= failures {
+			http.Error(w, "try again", failStatus)
+			return
+		}
+		var sigreqs []formats.SignatureRequest
+		err = json.Unmarshal(body, &sigreqs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sigresps := make([]formats.SignatureResponse, len(sigreqs))
+		for i, sigreq := range sigreqs {
+			sigresps[i] = formats.SignatureResponse{
+				Ref:       r.URL.Path,
+				SignerID:  sigreq.KeyID,
+				Signature: sigreq.Input,
+			}
+		}
+		json.NewEncoder(w).Encode(sigresps)
+	}))
+	return ts, &calls
+}
+
+func TestSign(t *testing.T) {
+	ts, _ := newTestServer(t, 0, 0)
+	defer ts.Close()
+	c := New(ts.URL+"/", testAuthID, testKey)
+
+	input := []byte("foobarbaz1234abcd")
+	for endpoint, sign := range map[string]func([]byte, string, interface{}) (formats.SignatureResponse, error){
+		"/sign/data": c.SignData,
+		"/sign/file": c.SignFile,
+		"/sign/hash": c.SignHash,
+	} {
+		sigresp, err := sign(input, "testsigner", nil)
+		if err != nil {
+			t.Fatalf("failed to sign at %s: %v", endpoint, err)
+		}
+		if sigresp.Ref != endpoint {
+			t.Fatalf("expected request to %s but got %s", endpoint, sigresp.Ref)
+		}
+		if sigresp.SignerID != "testsigner" {
+			t.Fatalf("expected signer testsigner but got %q", sigresp.SignerID)
+		}
+		if sigresp.Signature != base64.StdEncoding.EncodeToString(input) {
+			t.Fatalf("expected base64 input in request but got %q", sigresp.Signature)
+		}
+	}
+
+	_, err := New(ts.URL, testAuthID, "wrongkey").SignData(input, "", nil)
+	if err == nil || !strings.Contains(err.Error(), "401 Unauthorized") {
+		t.Fatalf("expected unauthorized error with the wrong key but got %v", err)
+	}
+}
+
+func TestSignRetries(t *testing.T) {
+	testcases := []struct {
+		failures      int32
+		failStatus    int
+		expectedCalls int32
+		expectedErr   bool
+	}{
+		{1, http.StatusServiceUnavailable, 2, false},
+		{2, http.StatusBadGateway, 3, false},
+		{3, http.StatusTooManyRequests, 3, true},
+		{1, http.StatusBadRequest, 1, true},
+	}
+	for i, testcase := range testcases {
+		testcase := testcase
+		t.Run(fmt.Sprintf("%d failed with %d", testcase.failures, testcase.failStatus), func(t *testing.T) {
+			ts, calls := newTestServer(t, testcase.failures, testcase.failStatus)
+			defer ts.Close()
+			c := New(ts.URL, testAuthID, testKey)
+			c.RetryWait = time.Millisecond
+
+			_, err := c.SignData([]byte("foo"), "", nil)
+			if testcase.expectedErr != (err != nil) {
+				t.Fatalf("testcase %d expected error %t but got %v", i, testcase.expectedErr, err)
+			}
+			if *calls != testcase.expectedCalls {
+				t.Fatalf("testcase %d expected %d requests but got %d", i, testcase.expectedCalls, *calls)
+			}
+		})
+	}
+}
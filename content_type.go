@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/mozilla-services/autograph/signer"
+	"github.com/mozilla-services/autograph/signer/apk2"
+	"github.com/mozilla-services/autograph/signer/xpi"
+)
+
+const (
+	// jsonContentType is the content type of signature responses
+	jsonContentType = "application/json"
+
+	// octetStreamContentType is the content type of signed files
+	// of signer types without a more specific content type
+	octetStreamContentType = "application/octet-stream"
+)
+
+// signedFileContentTypes are the content types of the files signed
+// by signer types, signers can override them with their
+// SignedFileContentType
+var signedFileContentTypes = map[string]string{
+	apk2.Type: "application/vnd.android.package-archive",
+	xpi.Type:  "application/x-xpinstall",
+}
+
+// validateSignedFileContentType returns an error when the signed file
+// content type of a configuration is set but is not a valid media type
+func validateSignedFileContentType(conf signer.Configuration) error {
+	if conf.SignedFileContentType == "" {
+		return nil
+	}
+	_, _, err := mime.ParseMediaType(conf.SignedFileContentType)
+	if err != nil {
+		return fmt.Errorf("invalid signed file content type %q: %w", conf.SignedFileContentType, err)
+	}
+	return nil
+}
+
+// signedFileContentType returns the content type of the files a
+// signer signs
+func signedFileContentType(conf signer.Configuration) string {
+	if conf.SignedFileContentType != "" {
+		return conf.SignedFileContentType
+	}
+	if contentType, ok := signedFileContentTypes[conf.Type]; ok {
+		return contentType
+	}
+	return octetStreamContentType
+}
+
+// negotiateContentType returns the offered content type the Accept
+// header prefers, the first offer when the header is empty, or an
+// empty string when it accepts none of the offers. Offers preferred
+// equally are picked in the order they are offered.
+func negotiateContentType(accept string, offers []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+	var (
+		best  string
+		bestQ float64
+	)
+	for _, offer := range offers {
+		q := acceptQuality(accept, offer)
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the quality value the Accept header gives to
+// a content type from its most specific matching media range, or 0
+// when no media range matches
+func acceptQuality(accept, contentType string) float64 {
+	var (
+		q           float64
+		specificity = -1
+	)
+	contentType = strings.ToLower(contentType)
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+		var rangeSpecificity int
+		switch {
+		case mediaType == contentType:
+			rangeSpecificity = 2
+		case strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(mediaType, "*")):
+			rangeSpecificity = 1
+		case mediaType == "*/*":
+			rangeSpecificity = 0
+		default:
+			continue
+		}
+		if rangeSpecificity <= specificity {
+			continue
+		}
+		specificity = rangeSpecificity
+		q = 1
+		if qParam, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(qParam, 64)
+			if err != nil || q < 0 || q > 1 {
+				q = 0
+			}
+		}
+	}
+	return q
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mozilla-services/autograph/signer"
+)
+
+func TestNegotiateContentType(t *testing.T) {
+	t.Parallel()
+
+	apk := "application/vnd.android.package-archive"
+	offers := []string{jsonContentType, apk}
+	var TESTCASES = []struct {
+		accept   string
+		expected string
+	}{
+		{"", jsonContentType},
+		{"*/*", jsonContentType},
+		{"application/*", jsonContentType},
+		{"application/json", jsonContentType},
+		{apk, apk},
+		{"Application/Vnd.Android.Package-Archive", apk},
+		{apk + ", application/json", jsonContentType},
+		{"application/json;q=0.5, " + apk, apk},
+		{apk + ";q=0.9, */*;q=0.1", apk},
+		{"*/*;q=0.5, application/json;q=0", apk},
+		{"image/png", ""},
+		{"application/json;q=0", ""},
+		{"not a media type", ""},
+	}
+	for i, testcase := range TESTCASES {
+		contentType := negotiateContentType(testcase.accept, offers)
+		if contentType != testcase.expected {
+			t.Fatalf("testcase %d expected Accept %q to negotiate %q but got %q", i, testcase.accept, testcase.expected, contentType)
+		}
+	}
+}
+
+func TestSignedFileContentType(t *testing.T) {
+	t.Parallel()
+
+	var TESTCASES = []struct {
+		conf     signer.Configuration
+		expected string
+	}{
+		{signer.Configuration{Type: "apk2"}, "application/vnd.android.package-archive"},
+		{signer.Configuration{Type: "xpi"}, "application/x-xpinstall"},
+		{signer.Configuration{Type: "mar"}, octetStreamContentType},
+		{signer.Configuration{Type: "mar", SignedFileContentType: "application/x-mar"}, "application/x-mar"},
+	}
+	for i, testcase := range TESTCASES {
+		contentType := signedFileContentType(testcase.conf)
+		if contentType != testcase.expected {
+			t.Fatalf("testcase %d expected signed file content type %q but got %q", i, testcase.expected, contentType)
+		}
+	}
+	err := validateSignedFileContentType(signer.Configuration{SignedFileContentType: "not a media type"})
+	if err == nil {
+		t.Fatalf("expected invalid signed file content type to fail validation but it succeeded")
+	}
+}
@@ -35,3 +35,10 @@ func httpError(w http.ResponseWriter, r *http.Request, errorCode int, errorMessa
 	}
 	http.Error(w, msg, errorCode)
 }
+
+// isRequestBodyTooLarge returns whether err is the error of reading
+// past the limit of an http.MaxBytesReader, which has no type or
+// variable to compare it with before Go 1.19
+func isRequestBodyTooLarge(err error) bool {
+	return err != nil && err.Error() == "http: request body too large"
+}
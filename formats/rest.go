@@ -1,5 +1,7 @@
 package formats
 
+import "time"
+
 // SigningFile is a file to sign when included in a request to sign
 // multiple files or a signed file when included in a response to
 // signing multiple files
@@ -14,6 +16,20 @@ type SignatureRequest struct {
 	Files   []SigningFile `json:"files,omitempty"`
 	KeyID   string        `json:"keyid,omitempty"`
 	Options interface{}
+
+	// SignedDataHashOnly requests the hash of the data the signer
+	// would sign instead of a signature
+	SignedDataHashOnly bool `json:"signed_data_hash_only,omitempty"`
+
+	// UploadSignedFile requests the signed file to be uploaded to
+	// the upload location of the signer and a manifest of the
+	// upload instead of the signed file
+	UploadSignedFile bool `json:"upload_signed_file,omitempty"`
+
+	// Minimal requests a MinimalSignatureResponse without the public
+	// key, x5u and certificate of the signer, for clients that already
+	// trust it
+	Minimal bool `json:"minimal,omitempty"`
 }
 
 // SignatureResponse is returned by autograph to a client with
@@ -29,4 +45,203 @@ type SignatureResponse struct {
 	SignedFiles []SigningFile `json:"signed_files,omitempty"`
 	X5U         string        `json:"x5u,omitempty"`
 	SignerOpts  interface{}   `json:"signer_opts,omitempty"`
+
+	// Options are the signing options of the responses of the
+	// monitor for the option variants of a signer, they are omitted
+	// for its default options
+	Options map[string]interface{} `json:"options,omitempty"`
+
+	// Chain holds the PEM certificates of the chain at the X5U,
+	// end-entity first, when the request options ask for it
+	Chain []string `json:"chain,omitempty"`
+
+	// SignedFileSidecar is the base64 encoded sidecar file the
+	// signer output next to the signed file, e.g. the v4 .idsig
+	// signature of an APK
+	SignedFileSidecar string `json:"signed_file_sidecar,omitempty"`
+
+	// SignedDataHash is the hex encoded hash of the data the signer
+	// would sign when the request sets SignedDataHashOnly
+	SignedDataHash string `json:"signed_data_hash,omitempty"`
+
+	// SignatureFormat is the form of the signature of signers that
+	// return several, e.g. "armored_detached", "binary_detached" or
+	// "clearsign" for gpg2 signers
+	SignatureFormat string `json:"signature_format,omitempty"`
+
+	// ToolVersion is the version of the external tool the signer
+	// shells out to e.g. apksigner, when it reports one
+	ToolVersion string `json:"tool_version,omitempty"`
+
+	// CertFingerprint is the hex encoded SHA-256 fingerprint of the
+	// certificate the signer embeds in signed files e.g. APKs
+	CertFingerprint string `json:"cert_fingerprint,omitempty"`
+
+	// CertificateInfo are the parsed fields of the certificate of
+	// the signer, when it has one
+	CertificateInfo *CertificateInfo `json:"certificate_info,omitempty"`
+
+	// SignedFileManifest describes the uploaded signed file when
+	// the request sets UploadSignedFile
+	SignedFileManifest *SignedFileManifest `json:"signed_file_manifest,omitempty"`
+
+	// TimedOut is set in the responses of the monitor for the
+	// signers that did not complete their check within the monitor
+	// timeout, they do not have a signature
+	TimedOut bool `json:"timed_out,omitempty"`
+
+	// Skipped is set in the responses of the monitor for the signers
+	// excluded from its checks, they do not have a signature
+	Skipped bool `json:"skipped,omitempty"`
+
+	// SignedAt is the time of the autograph server clock when the
+	// signature was issued
+	SignedAt time.Time `json:"signed_at"`
+
+	// AutographVersion is the version of autograph that issued the
+	// signature, it is omitted when autograph was built without one
+	AutographVersion string `json:"autograph_version,omitempty"`
+
+	// FileName is the name of the input file of the responses to
+	// multipart /sign/files requests
+	FileName string `json:"file_name,omitempty"`
+
+	// Error is why the file of a multipart /sign/files request was
+	// not signed, the response then has no signed file
+	Error string `json:"error,omitempty"`
+}
+
+// MinimalSignatureResponse is returned by autograph in place of a
+// SignatureResponse to requests that set Minimal
+type MinimalSignatureResponse struct {
+	SignerID  string `json:"signer_id"`
+	Type      string `json:"type"`
+	Signature string `json:"signature"`
+}
+
+// SignedFileManifest describes a signed file uploaded by autograph
+type SignedFileManifest struct {
+	URL      string `json:"url"`
+	Size     int    `json:"size"`
+	SHA256   string `json:"sha256"`
+	SHA512   string `json:"sha512"`
+	SignerID string `json:"signer_id"`
+	Type     string `json:"type"`
+	Mode     string `json:"mode"`
+}
+
+// CertificateInfo holds the fields of a signer certificate
+type CertificateInfo struct {
+	Subject         string    `json:"subject"`
+	Issuer          string    `json:"issuer"`
+	SerialNumber    string    `json:"serial_number"`
+	NotBefore       time.Time `json:"not_before"`
+	NotAfter        time.Time `json:"not_after"`
+	SubjectAltNames []string  `json:"subject_alt_names,omitempty"`
+
+	// SHA1Fingerprint and SHA256Fingerprint are the hex encoded
+	// fingerprints of the DER certificate
+	SHA1Fingerprint   string `json:"sha1_fingerprint"`
+	SHA256Fingerprint string `json:"sha256_fingerprint"`
+}
+
+// KeyRotationRequest is sent by an admin to replace the key of an
+// existing signer
+type KeyRotationRequest struct {
+	PrivateKey  string `json:"privatekey"`
+	PublicKey   string `json:"publickey,omitempty"`
+	Certificate string `json:"certificate,omitempty"`
+
+	// CertificateInfo are the parsed fields of the certificate of
+	// the signer, when it has one
+	CertificateInfo *CertificateInfo `json:"certificate_info,omitempty"`
+}
+
+// KeyRotationResponse is returned by autograph after the key of a
+// signer was rotated
+type KeyRotationResponse struct {
+	SignerID  string `json:"signer_id"`
+	PublicKey string `json:"public_key"`
+}
+
+// ChainRotationRequest is sent by an admin to issue a new end-entity
+// and chain to a contentsignaturepki signer
+type ChainRotationRequest struct {
+	// IssuerCert is the PEM certificate of the issuer of the new
+	// chain, e.g. a renewed intermediate. The configured issuer
+	// certificate is used when it is empty.
+	IssuerCert string `json:"issuercert,omitempty"`
+}
+
+// ChainRotationResponse is returned by autograph after the chain of
+// a signer was rotated
+type ChainRotationResponse struct {
+	SignerID string `json:"signer_id"`
+	X5U      string `json:"x5u"`
+}
+
+// VerificationRequest is sent by a client to verify a signature
+// response on the input it was computed on. Clients that do not have
+// the signature response can set its type, signer_id, signature, x5u
+// and public_key fields on the request instead.
+type VerificationRequest struct {
+	Input    string            `json:"input"`
+	Response SignatureResponse `json:"response"`
+
+	Type      string `json:"type,omitempty"`
+	SignerID  string `json:"signer_id,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	X5U       string `json:"x5u,omitempty"`
+	PublicKey string `json:"public_key,omitempty"`
+}
+
+// SignatureResponse returns the signature response of the request to
+// verify, or one made of the fields of the request when it has none
+func (v VerificationRequest) SignatureResponse() SignatureResponse {
+	if v.Response.SignerID != "" || v.SignerID == "" {
+		return v.Response
+	}
+	return SignatureResponse{
+		Type:      v.Type,
+		SignerID:  v.SignerID,
+		Signature: v.Signature,
+		X5U:       v.X5U,
+		PublicKey: v.PublicKey,
+	}
+}
+
+// VerificationResponse is returned by autograph with the result of
+// verifying a signature response
+type VerificationResponse struct {
+	Ref      string `json:"ref"`
+	SignerID string `json:"signer_id"`
+	Verified bool   `json:"verified"`
+	Error    string `json:"error,omitempty"`
+}
+
+// SignerHealth is the result of the latest monitoring check of a
+// signer returned by /__monitor__/health
+type SignerHealth struct {
+	OK        bool   `json:"ok"`
+	Error     string `json:"error"`
+	LatencyMs int64  `json:"latency_ms"`
+	Skipped   bool   `json:"skipped,omitempty"`
+
+	// CertExpiresSoon is set when the certificate of the signer
+	// expires within the monitor certificate expiry warning period
+	CertExpiresSoon bool `json:"cert_expires_soon,omitempty"`
+}
+
+// SignerKey holds the public key material of a signer returned by
+// /keys
+type SignerKey struct {
+	SignerID    string `json:"signer_id"`
+	Type        string `json:"type"`
+	PublicKey   string `json:"public_key,omitempty"`
+	X5U         string `json:"x5u,omitempty"`
+	Certificate string `json:"certificate,omitempty"`
+
+	// CertificateInfo are the parsed fields of the certificate of
+	// the signer, when it has one
+	CertificateInfo *CertificateInfo `json:"certificate_info,omitempty"`
 }
@@ -3,9 +3,10 @@ module github.com/mozilla-services/autograph
 go 1.16
 
 require (
-	github.com/Azure/azure-sdk-for-go v32.6.0+incompatible // indirect
+	cloud.google.com/go/storage v1.10.0
+	github.com/Azure/azure-sdk-for-go v32.6.0+incompatible
 	github.com/Azure/go-autorest/autorest/adal v0.8.0 // indirect
-	github.com/Azure/go-autorest/autorest/azure/auth v0.4.0 // indirect
+	github.com/Azure/go-autorest/autorest/azure/auth v0.4.0
 	github.com/Azure/go-autorest/autorest/to v0.3.0 // indirect
 	github.com/Azure/go-autorest/autorest/validation v0.2.0 // indirect
 	github.com/DataDog/datadog-go v3.7.2+incompatible
@@ -29,12 +30,10 @@ require (
 	go.mozilla.org/mozlogrus v2.0.0+incompatible
 	go.mozilla.org/pkcs7 v0.0.0-20210730143726-725912489c62
 	go.mozilla.org/sops v0.0.0-20190912205235-14a22d7a7060
-	go.opencensus.io v0.22.1 // indirect
-	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9 // indirect
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	golang.org/x/net v0.0.0-20210805182204-aaa1db679c0d // indirect
 	golang.org/x/sys v0.0.0-20210809222454-d867a43fc93e // indirect
-	google.golang.org/api v0.11.0 // indirect
-	google.golang.org/grpc v1.24.0 // indirect
+	google.golang.org/api v0.28.0
 )
 
 replace github.com/mozilla-services/autograph/verifier => ./verifier/
@@ -11,17 +11,20 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 
 	"github.com/mozilla-services/autograph/formats"
 	"github.com/mozilla-services/autograph/signer"
+	"github.com/mozilla-services/autograph/signer/policy"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -33,8 +36,24 @@ const (
 	// MaxNamedFiles is the maximum number of named files a single
 	// multi-file signing request can include
 	MaxNamedFiles = 32
+
+	// defaultMaxDataRequestBytes is the default max size of the
+	// bodies of /sign/data and /sign/hash requests
+	defaultMaxDataRequestBytes = 10485760
+
+	// defaultMaxFileRequestBytes is the default max size of the
+	// bodies of /sign/file and /sign/files requests
+	defaultMaxFileRequestBytes = 1048576000
 )
 
+// DefaultHeartbeatSignerCheckTimeout is how long the heartbeat handler
+// waits for each of its signers to sign a test input by default
+const DefaultHeartbeatSignerCheckTimeout = 5 * time.Second
+
+// DefaultHeartbeatSignerCheckInterval is how long the heartbeat handler
+// reuses the results of its signer checks by default
+const DefaultHeartbeatSignerCheckInterval = 30 * time.Second
+
 // heartbeatConfig configures the heartbeat handler. It sets timeouts
 // for each backing service to check.
 //
@@ -43,12 +62,47 @@ type heartbeatConfig struct {
 	HSMCheckTimeout time.Duration
 	DBCheckTimeout  time.Duration
 
+	// Signers are the IDs of the signers the heartbeat signs and
+	// verifies a test input with, none by default. Unlike the
+	// monitor, it only checks this subset so readiness does not
+	// depend on slow or HSM-backed signers.
+	Signers []string
+
+	// SignerCheckTimeout is how long the heartbeat waits for each
+	// of its signers, DefaultHeartbeatSignerCheckTimeout when zero
+	SignerCheckTimeout time.Duration
+
+	// SignerCheckInterval is how long the results of the signer
+	// checks are reused for, so heartbeat requests do not sign with
+	// each signer, DefaultHeartbeatSignerCheckInterval when zero
+	SignerCheckInterval time.Duration
+
 	// hsmSignerConf is the signer conf to use to check
 	// HSM connectivity (set to the first signer with an HSM label
 	// in initHSM) when it is non-nil
 	hsmSignerConf *signer.Configuration
 }
 
+// heartbeatSignerChecks are the results of the latest heartbeat
+// signer checks. Its lock only guards its fields: the checks run
+// without it, and concurrent heartbeat requests wait for the running
+// checks instead of starting more.
+type heartbeatSignerChecks struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	errs      map[string]error
+
+	// running is closed when the running checks complete, and is
+	// nil when no checks are running
+	running chan struct{}
+
+	// hung are the IDs of the signers whose check is running. Those
+	// found when new checks start did not return by their timeout,
+	// and are not checked again until they return so a hung signer
+	// does not pile up checks.
+	hung map[string]bool
+}
+
 // hashSHA256AsHex returns the hex encoded string of the SHA256 sum
 // the arg toHash bytes
 func hashSHA256AsHex(toHash []byte) string {
@@ -57,8 +111,31 @@ func hashSHA256AsHex(toHash []byte) string {
 	return fmt.Sprintf("%X", h.Sum(nil))
 }
 
+// signingErrorStatus returns the HTTP status of a failed signing
+// operation: 403 when a signer policy denied it, 429 when a signer
+// policy rate limited it, 503 when it gave up waiting for an external
+// signer, 400 when the input hash has the wrong length or a file signer
+// does not sign inputs of its format and 500 otherwise
+func signingErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, policy.ErrDenied):
+		return http.StatusForbidden
+	case errors.Is(err, policy.ErrRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, signer.ErrExternalSignersBusy):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, signer.ErrInvalidHashLength), errors.Is(err, signer.ErrInvalidInput):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// logSigningRequestFailure logs a failed signing operation, with the
+// name, version and output of the tool of signers that shell out in
+// fields of their own
 func logSigningRequestFailure(sigreq formats.SignatureRequest, sigresp formats.SignatureResponse, rid, userid, inputHash string, inputHashes []string, starttime time.Time, err error) {
-	log.WithFields(log.Fields{
+	fields := log.Fields{
 		"rid":           rid,
 		"options":       sigreq.Options,
 		"mode":          sigresp.Mode,
@@ -71,7 +148,15 @@ func logSigningRequestFailure(sigreq formats.SignatureRequest, sigresp formats.S
 		"output_hashes": nil,
 		"user_id":       userid,
 		"t":             int32(time.Since(starttime) / time.Millisecond), //  request processing time in ms
-	}).Info(fmt.Sprintf("signing operation failed with error: %v", err))
+	}
+	var toolErr *signer.ToolError
+	if errors.As(err, &toolErr) {
+		fields["tool"] = toolErr.Tool
+		fields["tool_version"] = toolErr.Version
+		fields["tool_output"] = toolErr.Output
+		err = fmt.Errorf("%s: %w", toolErr.Msg, toolErr.Err)
+	}
+	log.WithFields(fields).Info(fmt.Sprintf("signing operation failed with error: %v", err))
 }
 
 // handleSignature endpoint accepts a list of signature requests in a HAWK authenticated POST request
@@ -90,8 +175,17 @@ func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
 		httpError(w, r, http.StatusUnauthorized, "authorization verification failed: %v", err)
 		return
 	}
+	maxRequestBytes := a.maxDataRequestBytes
+	if r.URL.RequestURI() == "/sign/file" || r.URL.RequestURI() == "/sign/files" {
+		maxRequestBytes = a.maxFileRequestBytes
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBytes)
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
+		if isRequestBodyTooLarge(err) {
+			httpError(w, r, http.StatusRequestEntityTooLarge, "request exceeds max size of %d bytes", maxRequestBytes)
+			return
+		}
 		httpError(w, r, http.StatusBadRequest, "failed to read request body: %s", err)
 		return
 	}
@@ -104,11 +198,6 @@ func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
 		httpError(w, r, http.StatusBadRequest, "empty or invalid request request body")
 		return
 	}
-	if len(body) > 1048576000 {
-		// the max body size is hardcoded to 1GB. Seriously, what are you trying to sign?
-		httpError(w, r, http.StatusBadRequest, "request exceeds max size of 1GB")
-		return
-	}
 	err = a.authorizeBody(auth, r, body)
 	if a.stats != nil {
 		sendStatsErr := a.stats.Timing("authorize_finished", time.Since(starttime), nil, 1.0)
@@ -150,6 +239,46 @@ func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
 		} else if sigreq.Input == "" {
 			httpError(w, r, http.StatusBadRequest, fmt.Sprintf("missing input in signature request %d", i))
 		}
+		if sigreq.UploadSignedFile && (r.URL.RequestURI() != "/sign/file" || sigreq.SignedDataHashOnly) {
+			httpError(w, r, http.StatusBadRequest, "signature request %d can only upload the signed file of a /sign/file request", i)
+			return
+		}
+		if sigreq.Minimal && ((r.URL.RequestURI() != "/sign/data" && r.URL.RequestURI() != "/sign/hash") || sigreq.SignedDataHashOnly) {
+			httpError(w, r, http.StatusBadRequest, "signature request %d can only ask for a minimal response to a /sign/data or /sign/hash request", i)
+			return
+		}
+	}
+	// the raw signed file is only returned to a single /sign/file
+	// request, other requests must accept JSON
+	accept := r.Header.Get("Accept")
+	rawFileRequest := r.URL.RequestURI() == "/sign/file" && len(sigreqs) == 1 && !sigreqs[0].SignedDataHashOnly && !sigreqs[0].UploadSignedFile
+	if !rawFileRequest && negotiateContentType(accept, []string{jsonContentType}) == "" {
+		httpError(w, r, http.StatusNotAcceptable, "request must accept %s responses", jsonContentType)
+		return
+	}
+	// retries of a request with an idempotency key get the responses
+	// of the first request instead of signing again
+	idempotencyKey := r.Header.Get(idempotencyKeyHeader)
+	if idempotencyKey != "" {
+		err = checkIdempotencyKey(idempotencyKey)
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, "%v", err)
+			return
+		}
+		cachedSigresps, err := a.getIdempotentResponses(userid, idempotencyKey, r.URL.RequestURI(), body)
+		if err != nil {
+			httpError(w, r, http.StatusUnprocessableEntity, "%v", err)
+			return
+		}
+		if cachedSigresps != nil {
+			log.WithFields(log.Fields{
+				"rid":             rid,
+				"user_id":         userid,
+				"idempotency_key": idempotencyKey,
+			}).Info("replaying cached signing responses of idempotency key")
+			a.writeSignatureResponses(w, r, sigreqs, cachedSigresps, rawFileRequest)
+			return
+		}
 	}
 	if a.debug {
 		fmt.Printf("signature request\n-----------------\n%s\n", body)
@@ -186,7 +315,7 @@ func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
 			// Decode the base64 input data
 			input, err = base64.StdEncoding.DecodeString(sigreq.Input)
 			if err != nil {
-				httpError(w, r, http.StatusBadRequest, "%v", err)
+				httpError(w, r, http.StatusBadRequest, "failed to base64 decode input of signature request %d: %v", i, err)
 				return
 			}
 		}
@@ -199,6 +328,10 @@ func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		requestedSignerConfig := requestedSigner.Config()
+		if signerConf, ok := a.getSignerConf(requestedSignerConfig.ID); ok && signerConf.MaxRequestBytes > 0 && int64(len(body)) > signerConf.MaxRequestBytes {
+			httpError(w, r, http.StatusRequestEntityTooLarge, "request exceeds max size of %d bytes of signer %q", signerConf.MaxRequestBytes, requestedSignerConfig.ID)
+			return
+		}
 		sigresps[i] = formats.SignatureResponse{
 			Ref:        id(),
 			Type:       requestedSignerConfig.Type,
@@ -209,21 +342,35 @@ func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
 			X5U:        requestedSignerConfig.X5U,
 			SignerOpts: requestedSignerConfig.SignerOpts,
 		}
+		if toolVersioner, ok := signer.Unwrap(requestedSigner).(signer.ToolVersioner); ok {
+			sigresps[i].ToolVersion = toolVersioner.ToolVersion()
+		}
+		if certFingerprinter, ok := signer.Unwrap(requestedSigner).(signer.CertFingerprinter); ok {
+			sigresps[i].CertFingerprint = certFingerprinter.CertFingerprint()
+		}
+		if chainIncluder, ok := signer.Unwrap(requestedSigner).(signer.ChainIncluder); ok {
+			sigresps[i].Chain, err = chainIncluder.IncludedChain(sigreq.Options)
+			if err != nil {
+				httpError(w, r, http.StatusBadRequest, "invalid options in signature request %d: %v", i, err)
+				return
+			}
+		}
 		// Make sure the signer implements the right interface, then sign the data
 		switch r.URL.RequestURI() {
 		case "/sign/hash":
-			hashSigner, ok := requestedSigner.(signer.HashSigner)
-			if !ok {
+			if _, ok := signer.Unwrap(requestedSigner).(signer.HashSigner); !ok {
 				httpError(w, r, http.StatusBadRequest, "requested signer %q does not implement hash signing", requestedSignerConfig.ID)
 				return
 			}
 			// the input is already a hash just convert it to hex
 			inputHash = fmt.Sprintf("%X", input)
 
-			sig, err = hashSigner.SignHash(input, sigreq.Options)
+			signStart := time.Now()
+			sig, err = requestedSigner.(signer.HashSigner).SignHash(input, sigreq.Options)
+			signer.ObserveSign(requestedSignerConfig, signStart, err)
 			if err != nil {
 				logSigningRequestFailure(sigreq, sigresps[i], rid, userid, inputHash, inputHashes, starttime, err)
-				httpError(w, r, http.StatusInternalServerError, "signing request %s failed with error: %v", sigresps[i].Ref, err)
+				httpError(w, r, signingErrorStatus(err), "signing request %s failed with error: %v", sigresps[i].Ref, err)
 				return
 			}
 			sigresps[i].Signature, err = sig.Marshal()
@@ -231,20 +378,39 @@ func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
 				httpError(w, r, http.StatusInternalServerError, "encoding failed with error: %v", err)
 				return
 			}
+			if optsSig, ok := sig.(signer.SignerOptsSignature); ok {
+				sigresps[i].SignerOpts = optsSig.SignerOpts()
+			}
 			outputHash = "unimplemented"
 		case "/sign/data":
-			dataSigner, ok := requestedSigner.(signer.DataSigner)
-			if !ok {
+			if sigreq.SignedDataHashOnly {
+				if _, ok := signer.Unwrap(requestedSigner).(signer.SignedDataHasher); !ok {
+					httpError(w, r, http.StatusBadRequest, "requested signer %q does not implement signed data hashing", requestedSignerConfig.ID)
+					return
+				}
+				inputHash = hashSHA256AsHex(input)
+				sigresps[i].SignedDataHash, err = requestedSigner.(signer.SignedDataHasher).SignedDataHash(input, sigreq.Options)
+				if err != nil {
+					logSigningRequestFailure(sigreq, sigresps[i], rid, userid, inputHash, inputHashes, starttime, err)
+					httpError(w, r, signingErrorStatus(err), "signed data hash request %s failed with error: %v", sigresps[i].Ref, err)
+					return
+				}
+				outputHash = sigresps[i].SignedDataHash
+				break
+			}
+			if _, ok := signer.Unwrap(requestedSigner).(signer.DataSigner); !ok {
 				httpError(w, r, http.StatusBadRequest, "requested signer %q does not implement data signing", requestedSignerConfig.ID)
 				return
 			}
 			// calculate a hash of the input to store in the signing logs
 			inputHash = hashSHA256AsHex(input)
 
-			sig, err = dataSigner.SignData(input, sigreq.Options)
+			signStart := time.Now()
+			sig, err = requestedSigner.(signer.DataSigner).SignData(input, sigreq.Options)
+			signer.ObserveSign(requestedSignerConfig, signStart, err)
 			if err != nil {
 				logSigningRequestFailure(sigreq, sigresps[i], rid, userid, inputHash, inputHashes, starttime, err)
-				httpError(w, r, http.StatusInternalServerError, "signing request %s failed with error: %v", sigresps[i].Ref, err)
+				httpError(w, r, signingErrorStatus(err), "signing request %s failed with error: %v", sigresps[i].Ref, err)
 				return
 			}
 			sigresps[i].Signature, err = sig.Marshal()
@@ -252,27 +418,72 @@ func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
 				httpError(w, r, http.StatusInternalServerError, "encoding failed with error: %v", err)
 				return
 			}
+			if optsSig, ok := sig.(signer.SignerOptsSignature); ok {
+				sigresps[i].SignerOpts = optsSig.SignerOpts()
+			}
+			if formattedSig, ok := sig.(signer.FormattedSignature); ok {
+				sigresps[i].SignatureFormat = formattedSig.Format()
+			}
 			outputHash = hashSHA256AsHex([]byte(sigresps[i].Signature))
 		case "/sign/file":
-			fileSigner, ok := requestedSigner.(signer.FileSigner)
-			if !ok {
+			if sigreq.SignedDataHashOnly {
+				if _, ok := signer.Unwrap(requestedSigner).(signer.SignedFileHasher); !ok {
+					httpError(w, r, http.StatusBadRequest, "requested signer %q does not implement signed file hashing", requestedSignerConfig.ID)
+					return
+				}
+				inputHash = hashSHA256AsHex(input)
+				sigresps[i].SignedDataHash, err = requestedSigner.(signer.SignedFileHasher).SignedFileHash(input, sigreq.Options)
+				if err != nil {
+					logSigningRequestFailure(sigreq, sigresps[i], rid, userid, inputHash, inputHashes, starttime, err)
+					httpError(w, r, signingErrorStatus(err), "signed data hash request %s failed with error: %v", sigresps[i].Ref, err)
+					return
+				}
+				outputHash = sigresps[i].SignedDataHash
+				break
+			}
+			if _, ok := signer.Unwrap(requestedSigner).(signer.FileSigner); !ok {
 				httpError(w, r, http.StatusBadRequest, "requested signer %q does not implement file signing", requestedSignerConfig.ID)
 				return
 			}
+			signerConf, hasSignerConf := a.getSignerConf(requestedSignerConfig.ID)
+			if sigreq.UploadSignedFile && signerConf.SignedFileUploadLocation == "" {
+				httpError(w, r, http.StatusBadRequest, "requested signer %q has no signed file upload location", requestedSignerConfig.ID)
+				return
+			}
 			// calculate a hash of the input to store in the signing logs
 			inputHash = hashSHA256AsHex(input)
 
-			signedfile, err = fileSigner.SignFile(input, sigreq.Options)
+			var sidecar []byte
+			signedfile, sidecar, err = signFileInput(r.Context(), requestedSigner, input, sigreq.Options)
 			if err != nil {
 				logSigningRequestFailure(sigreq, sigresps[i], rid, userid, inputHash, inputHashes, starttime, err)
-				httpError(w, r, http.StatusInternalServerError, "signing request %s failed with error: %v", sigresps[i].Ref, err)
+				httpError(w, r, signingErrorStatus(err), "signing request %s failed with error: %v", sigresps[i].Ref, err)
 				return
 			}
-			sigresps[i].SignedFile = base64.StdEncoding.EncodeToString(signedfile)
+			if hasSignerConf {
+				err = signerConf.CheckSignedFileSize(len(input), len(signedfile))
+				if err != nil {
+					logSigningRequestFailure(sigreq, sigresps[i], rid, userid, inputHash, inputHashes, starttime, err)
+					httpError(w, r, http.StatusInternalServerError, "signing request %s failed with error: %v", sigresps[i].Ref, err)
+					return
+				}
+			}
 			outputHash = hashSHA256AsHex(signedfile)
+			if sidecar != nil {
+				sigresps[i].SignedFileSidecar = base64.StdEncoding.EncodeToString(sidecar)
+			}
+			if sigreq.UploadSignedFile {
+				sigresps[i].SignedFileManifest, err = uploadSignedFile(signerConf, sigresps[i], signedfile)
+				if err != nil {
+					logSigningRequestFailure(sigreq, sigresps[i], rid, userid, inputHash, inputHashes, starttime, err)
+					httpError(w, r, http.StatusInternalServerError, "signing request %s failed with error: %v", sigresps[i].Ref, err)
+					return
+				}
+				break
+			}
+			sigresps[i].SignedFile = base64.StdEncoding.EncodeToString(signedfile)
 		case "/sign/files":
-			multiFileSigner, ok := requestedSigner.(signer.MultipleFileSigner)
-			if !ok {
+			if _, ok := signer.Unwrap(requestedSigner).(signer.MultipleFileSigner); !ok {
 				httpError(w, r, http.StatusBadRequest, "requested signer %q does not implement multiple file signing", requestedSignerConfig.ID)
 				return
 			}
@@ -281,17 +492,34 @@ func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
 				inputHashes = append(inputHashes, hashSHA256AsHex(inputFile.Bytes))
 			}
 
-			signedfiles, err = multiFileSigner.SignFiles(unsignedNamedFiles, sigreq.Options)
+			signStart := time.Now()
+			signedfiles, err = requestedSigner.(signer.MultipleFileSigner).SignFiles(unsignedNamedFiles, sigreq.Options)
+			signer.ObserveSign(requestedSignerConfig, signStart, err)
 			if err != nil {
 				logSigningRequestFailure(sigreq, sigresps[i], rid, userid, inputHash, inputHashes, starttime, err)
-				httpError(w, r, http.StatusInternalServerError, "signing request %s failed with error: %v", sigresps[i].Ref, err)
+				httpError(w, r, signingErrorStatus(err), "signing request %s failed with error: %v", sigresps[i].Ref, err)
 				return
 			}
+			if signerConf, ok := a.getSignerConf(requestedSignerConfig.ID); ok {
+				if len(signedfiles) != len(unsignedNamedFiles) {
+					err = fmt.Errorf("signer returned %d signed files for %d inputs", len(signedfiles), len(unsignedNamedFiles))
+				}
+				for j := 0; err == nil && j < len(signedfiles); j++ {
+					err = signerConf.CheckSignedFileSize(len(unsignedNamedFiles[j].Bytes), len(signedfiles[j].Bytes))
+				}
+				if err != nil {
+					logSigningRequestFailure(sigreq, sigresps[i], rid, userid, inputHash, inputHashes, starttime, err)
+					httpError(w, r, http.StatusInternalServerError, "signing request %s failed with error: %v", sigresps[i].Ref, err)
+					return
+				}
+			}
 			for _, signedFile := range signedfiles {
 				outputHashes = append(outputHashes, hashSHA256AsHex(signedFile.Bytes))
 				sigresps[i].SignedFiles = append(sigresps[i].SignedFiles, *signedFile.RESTSigningFile())
 			}
 		}
+		sigresps[i].SignedAt = a.now()
+		sigresps[i].AutographVersion = autographVersion
 		log.WithFields(log.Fields{
 			"rid":           rid,
 			"options":       sigreq.Options,
@@ -307,7 +535,56 @@ func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
 			"t":             int32(time.Since(starttime) / time.Millisecond), //  request processing time in ms
 		}).Info("signing operation succeeded")
 	}
-	respdata, err := json.Marshal(sigresps)
+	if idempotencyKey != "" && !a.cacheIdempotentResponses(userid, idempotencyKey, r.URL.RequestURI(), body, sigresps) {
+		log.WithFields(log.Fields{
+			"rid":             rid,
+			"idempotency_key": idempotencyKey,
+		}).Warnf("signing responses larger than %d bytes are not cached for replay", a.maxIdempotentResponseBytes)
+	}
+	a.writeSignatureResponses(w, r, sigreqs, sigresps, rawFileRequest)
+}
+
+// writeSignatureResponses writes the signing responses of a request
+// as JSON, or the raw signed file of a single /sign/file request that
+// prefers the signed file content type of its signer
+func (a *autographer) writeSignatureResponses(w http.ResponseWriter, r *http.Request, sigreqs []formats.SignatureRequest, sigresps []formats.SignatureResponse, rawFileRequest bool) {
+	rid := getRequestID(r)
+	accept := r.Header.Get("Accept")
+	if rawFileRequest {
+		signerConf, ok := a.getSignerConf(sigresps[0].SignerID)
+		if !ok {
+			signerConf = signer.Configuration{Type: sigresps[0].Type}
+		}
+		fileContentType := signedFileContentType(signerConf)
+		switch negotiateContentType(accept, []string{jsonContentType, fileContentType}) {
+		case jsonContentType:
+		case fileContentType:
+			if sigresps[0].SignedFileSidecar != "" {
+				httpError(w, r, http.StatusNotAcceptable, "signed file has a sidecar file that is only returned in %s responses", jsonContentType)
+				return
+			}
+			signedFile, err := base64.StdEncoding.DecodeString(sigresps[0].SignedFile)
+			if err != nil {
+				httpError(w, r, http.StatusInternalServerError, "failed to decode signed file: %v", err)
+				return
+			}
+			w.Header().Set("Content-Type", fileContentType)
+			w.Header().Set("X-Autograph-Ref", sigresps[0].Ref)
+			w.Header().Set("X-Autograph-Signer-Id", sigresps[0].SignerID)
+			w.WriteHeader(http.StatusCreated)
+			w.Write(signedFile)
+			log.WithFields(log.Fields{
+				"rid":                  rid,
+				"num_signing_requests": len(sigresps),
+				"content_type":         fileContentType,
+			}).Info("signing request completed successfully")
+			return
+		default:
+			httpError(w, r, http.StatusNotAcceptable, "request must accept %s or %s responses", jsonContentType, fileContentType)
+			return
+		}
+	}
+	respdata, err := marshalSignatureResponses(sigreqs, sigresps)
 	if err != nil {
 		httpError(w, r, http.StatusInternalServerError, "signing failed with error: %v", err)
 		return
@@ -315,15 +592,50 @@ func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
 	if a.debug {
 		fmt.Printf("signature response\n------------------\n%s\n", respdata)
 	}
-	w.Header().Add("Content-Type", "application/json")
+	w.Header().Add("Content-Type", jsonContentType)
 	w.WriteHeader(http.StatusCreated)
 	w.Write(respdata)
 	log.WithFields(log.Fields{
 		"rid":                  rid,
-		"num_signing_requests": sigReqsCount,
+		"num_signing_requests": len(sigresps),
 	}).Info("signing request completed successfully")
 }
 
+// signFileInput signs a file with a file signer. Signers that support
+// a context stop signing when it is done, e.g. when the client goes
+// away, and the sidecar file of signers that output one is returned.
+func signFileInput(ctx context.Context, fileSigner signer.Signer, input []byte, options interface{}) (signedfile signer.SignedFile, sidecar []byte, err error) {
+	signStart := time.Now()
+	if _, ok := signer.Unwrap(fileSigner).(signer.SidecarFileSigner); ok {
+		signedfile, sidecar, err = fileSigner.(signer.SidecarFileSigner).SignFileWithSidecar(ctx, input, options)
+	} else if _, ok := signer.Unwrap(fileSigner).(signer.ContextFileSigner); ok {
+		signedfile, err = fileSigner.(signer.ContextFileSigner).SignFileContext(ctx, input, options)
+	} else {
+		signedfile, err = fileSigner.(signer.FileSigner).SignFile(input, options)
+	}
+	signer.ObserveSign(fileSigner.Config(), signStart, err)
+	return signedfile, sidecar, err
+}
+
+// marshalSignatureResponses returns the JSON of the signature
+// responses, with the minimal form of the responses to the requests
+// that set Minimal
+func marshalSignatureResponses(sigreqs []formats.SignatureRequest, sigresps []formats.SignatureResponse) ([]byte, error) {
+	resps := make([]interface{}, len(sigresps))
+	for i, sigresp := range sigresps {
+		if sigreqs[i].Minimal {
+			resps[i] = formats.MinimalSignatureResponse{
+				SignerID:  sigresp.SignerID,
+				Type:      sigresp.Type,
+				Signature: sigresp.Signature,
+			}
+			continue
+		}
+		resps[i] = sigresp
+	}
+	return json.Marshal(resps)
+}
+
 // handleLBHeartbeat returns a simple message indicating that the API is alive and well
 func handleLBHeartbeat(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
@@ -388,6 +700,23 @@ func (a *autographer) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// sign a test input with each heartbeat signer, looked up on
+	// each check so that rotated keys are checked
+	if len(a.heartbeatConf.Signers) > 0 {
+		for id, err := range a.getHeartbeatSignerChecks() {
+			if err == nil {
+				result["signer:"+id] = true
+				continue
+			}
+			log.WithFields(log.Fields{
+				"rid":       rid,
+				"signer_id": id,
+			}).Errorf("error checking heartbeat signer: %s", err)
+			result["signer:"+id] = false
+			status = http.StatusInternalServerError
+		}
+	}
+
 	// check the database connection and return its status, but
 	// don't fail the heartbeat since we only care about DB
 	// connectivity on server start
@@ -420,6 +749,118 @@ func (a *autographer) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
 	w.Write(respdata)
 }
 
+// getHeartbeatSignerChecks returns the results of the heartbeat signer
+// checks, and checks the signers again when the results are older than
+// the signer check interval
+func (a *autographer) getHeartbeatSignerChecks() map[string]error {
+	interval := a.heartbeatConf.SignerCheckInterval
+	if interval == 0 {
+		interval = DefaultHeartbeatSignerCheckInterval
+	}
+	timeout := a.heartbeatConf.SignerCheckTimeout
+	if timeout == 0 {
+		timeout = DefaultHeartbeatSignerCheckTimeout
+	}
+	checks := &a.heartbeatSignerChecks
+	checks.mu.Lock()
+	if checks.errs != nil && time.Since(checks.checkedAt) < interval {
+		defer checks.mu.Unlock()
+		return checks.errs
+	}
+	if checks.running != nil {
+		// wait for the checks started by another request
+		running := checks.running
+		checks.mu.Unlock()
+		<-running
+		checks.mu.Lock()
+		defer checks.mu.Unlock()
+		return checks.errs
+	}
+	running := make(chan struct{})
+	checks.running = running
+	checks.mu.Unlock()
+
+	errs := a.checkHeartbeatSigners(timeout)
+
+	checks.mu.Lock()
+	checks.errs = errs
+	checks.checkedAt = time.Now()
+	checks.running = nil
+	checks.mu.Unlock()
+	close(running)
+	return errs
+}
+
+// checkHeartbeatSigners concurrently signs and verifies a test input
+// with each heartbeat signer, and returns the error of each signer by
+// ID, nil when it succeeded. Checks are canceled after the timeout,
+// and signers that do not return by then fail their check.
+func (a *autographer) checkHeartbeatSigners(timeout time.Duration) map[string]error {
+	type checkResult struct {
+		id  string
+		err error
+	}
+	ids := make(map[string]bool, len(a.heartbeatConf.Signers))
+	for _, id := range a.heartbeatConf.Signers {
+		ids[id] = true
+	}
+	// the checks are not bound to a request since their results
+	// are shared by the heartbeat requests
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	errs := make(map[string]error, len(a.heartbeatConf.Signers))
+	pending := make(map[string]bool, len(ids))
+	results := make(chan checkResult, len(ids))
+	checks := &a.heartbeatSignerChecks
+	for _, s := range a.getSigners() {
+		id := s.Config().ID
+		if !ids[id] {
+			continue
+		}
+		delete(ids, id)
+		checks.mu.Lock()
+		hung := checks.hung[id]
+		if !hung {
+			if checks.hung == nil {
+				checks.hung = make(map[string]bool)
+			}
+			checks.hung[id] = true
+		}
+		checks.mu.Unlock()
+		if hung {
+			errs[id] = fmt.Errorf("previous check did not complete within %s and is still running", timeout)
+			continue
+		}
+		pending[id] = true
+		go func(s signer.Signer) {
+			err := signer.TestSignerContext(ctx, s)
+			checks.mu.Lock()
+			delete(checks.hung, id)
+			checks.mu.Unlock()
+			// results is buffered for every check, so this
+			// does not block after the timeout
+			results <- checkResult{id, err}
+		}(s)
+	}
+	// signers removed from the configuration fail their check
+	for id := range ids {
+		errs[id] = fmt.Errorf("signer %q is not configured", id)
+	}
+	for len(pending) > 0 {
+		select {
+		case r := <-results:
+			delete(pending, r.id)
+			errs[r.id] = r.err
+		case <-ctx.Done():
+			for id := range pending {
+				errs[id] = fmt.Errorf("check did not complete within %s", timeout)
+			}
+			return errs
+		}
+	}
+	return errs
+}
+
 func handleVersion(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		httpError(w, r, http.StatusMethodNotAllowed, "%s method not allowed; endpoint accepts GET only", r.Method)
@@ -15,6 +15,7 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"hash"
 	"io/ioutil"
@@ -22,6 +23,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -29,9 +31,12 @@ import (
 
 	"github.com/mozilla-services/autograph/database"
 	"github.com/mozilla-services/autograph/formats"
+	"github.com/mozilla-services/autograph/signer"
 	"github.com/mozilla-services/autograph/signer/apk2"
 	"github.com/mozilla-services/autograph/signer/contentsignature"
+	"github.com/mozilla-services/autograph/signer/policy"
 	"github.com/mozilla-services/autograph/signer/xpi"
+	"github.com/mozilla-services/autograph/verifier"
 	csigverifier "github.com/mozilla-services/autograph/verifier/contentsignature"
 
 	"go.mozilla.org/hawk"
@@ -110,6 +115,9 @@ func TestBadRequest(t *testing.T) {
 
 		// asking for a xpi signature using /sign/hash fails
 		{`/sign/hash`, `POST`, `[{"input": "Y2FyaWJvdW1hdXJpY2UK", "keyid": "webextensions-rsa"}]`},
+
+		// signing a hash that is not a sha384 with a p384ecdsa signer fails
+		{`/sign/hash`, `POST`, `[{"input": "Y2FyaWJvdW1hdXJpY2UK", "keyid": "appkey1"}]`},
 	}
 	for i, testcase := range TESTCASES {
 		i := i
@@ -175,6 +183,68 @@ func TestRequestTooLarge(t *testing.T) {
 	}
 }
 
+func TestMaxRequestBytes(t *testing.T) {
+	t.Parallel()
+
+	signerConf := conf.Signers[0]
+	signerConf.MaxRequestBytes = 192
+	tmpag := newAutographer(10)
+	err := tmpag.addSigners([]signer.Configuration{signerConf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpag.addAuthorizations([]authorization{{ID: "alice", Key: "alicekey", Signers: []string{signerConf.ID}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	err = tmpag.setMaxRequestBytes(256, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpag.setMaxRequestBytes(-1, 0)
+	if err == nil {
+		t.Fatal("expected a negative max request size to fail")
+	}
+
+	var TESTCASES = []struct {
+		endpoint       string
+		inputLen       int
+		expectedStatus int
+	}{
+		{"/sign/data", 32, http.StatusCreated},
+		// over the limit of the signer
+		{"/sign/data", 160, http.StatusRequestEntityTooLarge},
+		// over the limit of the data endpoints
+		{"/sign/data", 320, http.StatusRequestEntityTooLarge},
+		// within the limit of the file endpoints, but not of the signer
+		{"/sign/file", 160, http.StatusRequestEntityTooLarge},
+		// over the limit of the file endpoints
+		{"/sign/file", 480, http.StatusRequestEntityTooLarge},
+	}
+	for i, testcase := range TESTCASES {
+		body, err := json.Marshal([]formats.SignatureRequest{{
+			Input: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("a"), testcase.inputLen)),
+			KeyID: signerConf.ID,
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://foo.bar"+testcase.endpoint, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, "alice", "alicekey",
+			sha256.New, id(), "application/json", body))
+		w := httptest.NewRecorder()
+		tmpag.handleSignature(w, req)
+		if w.Code != testcase.expectedStatus {
+			t.Fatalf("test case %d expected status %d for %d bytes to %s but got %d: %s", i, testcase.expectedStatus, len(body), testcase.endpoint, w.Code, w.Body.String())
+		}
+	}
+}
+
 func TestBadContentType(t *testing.T) {
 	t.Parallel()
 
@@ -328,6 +398,142 @@ func TestHeartbeatChecksHSMStatusFailsWhenNotConfigured(t *testing.T) {
 	checkHeartbeatReturnsExpectedStatusAndBody(t, "returns 500 for GET without heartbeat config HSM", `GET`, expectedStatus, expectedBody)
 }
 
+func TestHeartbeatChecksSigners(t *testing.T) {
+	// NB: do not run in parallel with TestHeartbeat*
+	ag.heartbeatConf = &heartbeatConfig{
+		Signers: []string{"appkey1", "testmar"},
+
+		// check the signers again on each request
+		SignerCheckInterval: time.Nanosecond,
+	}
+
+	expectedStatus := http.StatusOK
+	expectedBody := []byte("{\"signer:appkey1\":true,\"signer:testmar\":true}")
+	checkHeartbeatReturnsExpectedStatusAndBody(t, "returns 200 for GET with signers OK", `GET`, expectedStatus, expectedBody)
+
+	ag.heartbeatConf.Signers = []string{"appkey1", "doesnotexist"}
+	expectedStatus = http.StatusInternalServerError
+	expectedBody = []byte("{\"signer:appkey1\":true,\"signer:doesnotexist\":false}")
+	checkHeartbeatReturnsExpectedStatusAndBody(t, "returns 500 for GET with a missing signer", `GET`, expectedStatus, expectedBody)
+
+	ag.heartbeatConf.Signers = []string{"appkey1"}
+	ag.heartbeatConf.SignerCheckTimeout = time.Nanosecond
+	expectedBody = []byte("{\"signer:appkey1\":false}")
+	checkHeartbeatReturnsExpectedStatusAndBody(t, "returns 500 for GET with a signer timing out", `GET`, expectedStatus, expectedBody)
+
+	resetHeartbeatSignerChecks(t, ag)
+	ag.heartbeatConf = nil
+}
+
+// resetHeartbeatSignerChecks waits for the signer checks that timed
+// out to return and clears the heartbeat signer check results
+func resetHeartbeatSignerChecks(t *testing.T, a *autographer) {
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		a.heartbeatSignerChecks.mu.Lock()
+		if len(a.heartbeatSignerChecks.hung) == 0 {
+			a.heartbeatSignerChecks.errs = nil
+			a.heartbeatSignerChecks.mu.Unlock()
+			return
+		}
+		a.heartbeatSignerChecks.mu.Unlock()
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("heartbeat signer checks did not return")
+		}
+	}
+}
+
+func TestHeartbeatCachesSignerChecks(t *testing.T) {
+	// NB: do not run in parallel with TestHeartbeat*
+	ag.heartbeatConf = &heartbeatConfig{
+		Signers:             []string{"appkey1"},
+		SignerCheckInterval: time.Hour,
+	}
+
+	expectedStatus := http.StatusOK
+	expectedBody := []byte("{\"signer:appkey1\":true}")
+	checkHeartbeatReturnsExpectedStatusAndBody(t, "returns 200 for GET with signers OK", `GET`, expectedStatus, expectedBody)
+	checkedAt := ag.heartbeatSignerChecks.checkedAt
+
+	// the signer is not checked again within the interval, even
+	// though its check would now time out
+	ag.heartbeatConf.SignerCheckTimeout = time.Nanosecond
+	checkHeartbeatReturnsExpectedStatusAndBody(t, "returns cached 200 for GET within the check interval", `GET`, expectedStatus, expectedBody)
+	if !ag.heartbeatSignerChecks.checkedAt.Equal(checkedAt) {
+		t.Fatalf("expected heartbeat to reuse its signer checks within the check interval")
+	}
+
+	ag.heartbeatSignerChecks.checkedAt = time.Now().Add(-time.Hour)
+	expectedStatus = http.StatusInternalServerError
+	expectedBody = []byte("{\"signer:appkey1\":false}")
+	checkHeartbeatReturnsExpectedStatusAndBody(t, "returns 500 for GET after the check interval", `GET`, expectedStatus, expectedBody)
+
+	resetHeartbeatSignerChecks(t, ag)
+	ag.heartbeatConf = nil
+}
+
+// hangingVerifyingSigner is a hangingSigner that implements the
+// DataVerifier interface, so signer.TestSigner signs with it
+type hangingVerifyingSigner struct {
+	hangingSigner
+}
+
+func (s *hangingVerifyingSigner) VerifyData(data []byte, sig signer.Signature) error {
+	return nil
+}
+
+func TestHeartbeatSignerChecksTimeOutHangingSigners(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(1)
+	hanging := &hangingVerifyingSigner{hangingSigner{
+		Configuration: signer.Configuration{ID: "hanging", Type: "contentsignature"},
+		release:       make(chan interface{}),
+	}}
+	tmpag.addSigner(hanging)
+	tmpag.heartbeatConf = &heartbeatConfig{
+		Signers:             []string{"hanging"},
+		SignerCheckTimeout:  50 * time.Millisecond,
+		SignerCheckInterval: time.Nanosecond,
+	}
+
+	// concurrent heartbeats share the checks and return after the
+	// timeout even though the signer does not
+	done := make(chan map[string]error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			done <- tmpag.getHeartbeatSignerChecks()
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case errs := <-done:
+			if errs["hanging"] == nil || !strings.Contains(errs["hanging"].Error(), "did not complete within") {
+				t.Fatalf("expected hanging signer check to time out but got: %v", errs["hanging"])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("heartbeat signer checks blocked on a hanging signer")
+		}
+	}
+
+	// the hanging signer is not checked again while its check runs
+	errs := tmpag.getHeartbeatSignerChecks()
+	if errs["hanging"] == nil || !strings.Contains(errs["hanging"].Error(), "still running") {
+		t.Fatalf("expected hanging signer check to still be running but got: %v", errs["hanging"])
+	}
+
+	// and is checked again once it returns
+	close(hanging.release)
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		errs = tmpag.getHeartbeatSignerChecks()
+		if !strings.Contains(errs["hanging"].Error(), "still running") {
+			break
+		}
+	}
+	if errs["hanging"] == nil || !strings.Contains(errs["hanging"].Error(), "hanging signer released") {
+		t.Fatalf("expected released signer to be checked again but got: %v", errs["hanging"])
+	}
+}
+
 func TestHeartbeatChecksDBStatusOKAndTimesout(t *testing.T) {
 	// NB: do not run in parallel with TestHeartbeat* or DB tests
 	host := database.GetTestDBHost()
@@ -526,6 +732,569 @@ func TestSignerUnauthorized(t *testing.T) {
 	}
 }
 
+// verify that signed_data_hash_only returns the templated hash instead
+// of a signature, and is rejected by signers that do not support it
+func TestSignedDataHashOnly(t *testing.T) {
+	t.Parallel()
+
+	input := []byte("foobarbaz1234abcd")
+	var TESTCASES = []struct {
+		keyid          string
+		expectedStatus int
+	}{
+		{keyid: "appkey1", expectedStatus: http.StatusCreated},
+		{keyid: "dummyrsa", expectedStatus: http.StatusBadRequest},
+	}
+	for i, testcase := range TESTCASES {
+		body, err := json.Marshal([]formats.SignatureRequest{
+			formats.SignatureRequest{
+				Input:              base64.StdEncoding.EncodeToString(input),
+				KeyID:              testcase.keyid,
+				SignedDataHashOnly: true,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rdr := bytes.NewReader(body)
+		req, err := http.NewRequest("POST", "http://foo.bar/sign/data", rdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		authheader := getAuthHeader(req, conf.Authorizations[0].ID, conf.Authorizations[0].Key,
+			sha256.New, id(), "application/json", body)
+		req.Header.Set("Authorization", authheader)
+		w := httptest.NewRecorder()
+		ag.handleSignature(w, req)
+		if w.Code != testcase.expectedStatus {
+			t.Fatalf("test case %d expected status %d but got %d: %s",
+				i, testcase.expectedStatus, w.Code, w.Body.String())
+		}
+		if w.Code != http.StatusCreated {
+			continue
+		}
+		var responses []formats.SignatureResponse
+		err = json.Unmarshal(w.Body.Bytes(), &responses)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(responses) != 1 {
+			t.Fatalf("test case %d expected 1 response but got %d", i, len(responses))
+		}
+		if responses[0].Signature != "" {
+			t.Fatalf("test case %d expected no signature but got %q", i, responses[0].Signature)
+		}
+		expected := fmt.Sprintf("%x", sha512.Sum384(append([]byte("Content-Signature:\x00"), input...)))
+		if responses[0].SignedDataHash != expected {
+			t.Fatalf("test case %d expected signed data hash %q but got %q",
+				i, expected, responses[0].SignedDataHash)
+		}
+	}
+}
+
+func TestMinimalSignatureResponse(t *testing.T) {
+	t.Parallel()
+
+	input := []byte("foobarbaz1234abcd")
+	var testcases = []struct {
+		endpoint       string
+		sigreq         formats.SignatureRequest
+		expectedStatus int
+	}{
+		{"/sign/data", formats.SignatureRequest{Input: base64.StdEncoding.EncodeToString(input), KeyID: "appkey1", Minimal: true}, http.StatusCreated},
+		{"/sign/data", formats.SignatureRequest{Input: base64.StdEncoding.EncodeToString(input), KeyID: "appkey1", Minimal: true, SignedDataHashOnly: true}, http.StatusBadRequest},
+		{"/sign/file", formats.SignatureRequest{Input: base64.StdEncoding.EncodeToString(input), KeyID: "appkey1", Minimal: true}, http.StatusBadRequest},
+	}
+	for i, testcase := range testcases {
+		body, err := json.Marshal([]formats.SignatureRequest{testcase.sigreq, {Input: testcase.sigreq.Input, KeyID: "appkey1"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://foo.bar"+testcase.endpoint, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		authheader := getAuthHeader(req, conf.Authorizations[0].ID, conf.Authorizations[0].Key,
+			sha256.New, id(), "application/json", body)
+		req.Header.Set("Authorization", authheader)
+		w := httptest.NewRecorder()
+		ag.handleSignature(w, req)
+		if w.Code != testcase.expectedStatus {
+			t.Fatalf("test case %d expected status %d but got %d: %s",
+				i, testcase.expectedStatus, w.Code, w.Body.String())
+		}
+		if w.Code != http.StatusCreated {
+			continue
+		}
+		var responses []map[string]interface{}
+		err = json.Unmarshal(w.Body.Bytes(), &responses)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(responses) != 2 {
+			t.Fatalf("test case %d expected 2 responses but got %d", i, len(responses))
+		}
+		if len(responses[0]) != 3 || responses[0]["signer_id"] != "appkey1" || responses[0]["type"] != "contentsignature" || responses[0]["signature"] == "" {
+			t.Fatalf("test case %d expected a minimal response with the signer id, type and signature but got %v", i, responses[0])
+		}
+		if responses[1]["public_key"] == nil || responses[1]["ref"] == nil {
+			t.Fatalf("test case %d expected a full response to the request without minimal but got %v", i, responses[1])
+		}
+
+		// the minimal signature verifies with the public key of the
+		// full response
+		err = verifier.VerifyResponse(formats.SignatureResponse{
+			Type:      contentsignature.Type,
+			Mode:      contentsignature.P384ECDSA,
+			PublicKey: responses[1]["public_key"].(string),
+			Signature: responses[0]["signature"].(string),
+		}, input, verifier.VerifyOptions{})
+		if err != nil {
+			t.Fatalf("test case %d minimal signature does not verify: %v", i, err)
+		}
+	}
+}
+
+func TestSignedAtAndAutographVersion(t *testing.T) {
+	t.Parallel()
+
+	body, err := json.Marshal([]formats.SignatureRequest{
+		formats.SignatureRequest{
+			Input: base64.StdEncoding.EncodeToString([]byte("foobarbaz1234abcd")),
+			KeyID: "appkey1",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	authheader := getAuthHeader(req, conf.Authorizations[0].ID, conf.Authorizations[0].Key,
+		sha256.New, id(), "application/json", body)
+	req.Header.Set("Authorization", authheader)
+	before := time.Now()
+	w := httptest.NewRecorder()
+	ag.handleSignature(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var responses []formats.SignatureResponse
+	err = json.Unmarshal(w.Body.Bytes(), &responses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 1 {
+		t.Fatalf("expected 1 response but got %d", len(responses))
+	}
+	if responses[0].SignedAt.Before(before.Truncate(time.Second)) || responses[0].SignedAt.After(time.Now()) {
+		t.Fatalf("expected signed_at between %s and now but got %s", before, responses[0].SignedAt)
+	}
+	if responses[0].AutographVersion != autographVersion {
+		t.Fatalf("expected autograph_version %q but got %q", autographVersion, responses[0].AutographVersion)
+	}
+}
+
+func TestSignDataIncludeChain(t *testing.T) {
+	t.Parallel()
+
+	var normandyAuth authorization
+	for _, auth := range conf.Authorizations {
+		if auth.ID == "normandev" {
+			normandyAuth = auth
+		}
+	}
+	input := []byte("foobarbaz1234abcd")
+	for _, testcase := range []struct {
+		name         string
+		options      interface{}
+		expectStatus int
+		expectChain  bool
+	}{
+		{"without options", nil, http.StatusCreated, false},
+		{"include_chain false", map[string]interface{}{"include_chain": false}, http.StatusCreated, false},
+		{"include_chain true", map[string]interface{}{"include_chain": true}, http.StatusCreated, true},
+		{"invalid include_chain", map[string]interface{}{"include_chain": "yes"}, http.StatusBadRequest, false},
+	} {
+		body, err := json.Marshal([]formats.SignatureRequest{
+			formats.SignatureRequest{
+				Input:   base64.StdEncoding.EncodeToString(input),
+				KeyID:   "normandy",
+				Options: testcase.options,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		authheader := getAuthHeader(req, normandyAuth.ID, normandyAuth.Key,
+			sha256.New, id(), "application/json", body)
+		req.Header.Set("Authorization", authheader)
+		w := httptest.NewRecorder()
+		ag.handleSignature(w, req)
+		if w.Code != testcase.expectStatus {
+			t.Fatalf("%s: expected status %d but got %d: %s", testcase.name, testcase.expectStatus, w.Code, w.Body.String())
+		}
+		if w.Code != http.StatusCreated {
+			continue
+		}
+		var responses []formats.SignatureResponse
+		err = json.Unmarshal(w.Body.Bytes(), &responses)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if responses[0].X5U == "" {
+			t.Fatalf("%s: expected the response to keep its x5u", testcase.name)
+		}
+		if !testcase.expectChain {
+			if responses[0].Chain != nil {
+				t.Fatalf("%s: expected no inline chain but got %q", testcase.name, responses[0].Chain)
+			}
+			continue
+		}
+		if len(responses[0].Chain) < 3 {
+			t.Fatalf("%s: expected an inline chain of at least 3 certificates but got %q", testcase.name, responses[0].Chain)
+		}
+		// the inline chain verifies without fetching the x5u
+		normandyConf, _ := ag.getSignerConf("normandy")
+		block, _ := pem.Decode([]byte(normandyConf.CaCert))
+		rootHash := sha256.Sum256(block.Bytes)
+		err = verifier.VerifyResponse(responses[0], input, verifier.VerifyOptions{
+			RootHash: fmt.Sprintf("%X", rootHash),
+			FetchX5U: func(x5u string) ([]byte, error) {
+				return nil, fmt.Errorf("unexpected fetch of x5u %q", x5u)
+			},
+		})
+		if err != nil {
+			t.Fatalf("%s: failed to verify the response with its inline chain: %v", testcase.name, err)
+		}
+	}
+}
+
+func TestBase64DecodeInputError(t *testing.T) {
+	t.Parallel()
+
+	body := []byte(`[{"input": "Y2FyaWJvdW1hdXJpY2UK", "keyid": "appkey1"}, {"input": "Y2FyaWJvdW1hdXJpY2UK!!", "keyid": "appkey1"}]`)
+	req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	authheader := getAuthHeader(req, conf.Authorizations[0].ID, conf.Authorizations[0].Key,
+		sha256.New, id(), "application/json", body)
+	req.Header.Set("Authorization", authheader)
+	w := httptest.NewRecorder()
+	ag.handleSignature(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d but got %d: %s", http.StatusBadRequest, w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "failed to base64 decode input of signature request 1") {
+		t.Fatalf("expected a base64 decoding error for request 1 but got: %s", w.Body.String())
+	}
+}
+
+func TestSignedFileSizeBounds(t *testing.T) {
+	t.Parallel()
+
+	var marConf signer.Configuration
+	for _, signerConf := range conf.Signers {
+		if signerConf.ID == "testmar" {
+			marConf = signerConf
+		}
+	}
+	unsignedMar := margo.New()
+	err := unsignedMar.AddContent([]byte("hello"), "hello.txt", 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, err := unsignedMar.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var TESTCASES = []struct {
+		minRatio, maxRatio float64
+		expectedStatus     int
+	}{
+		{expectedStatus: http.StatusCreated},
+		{minRatio: 1, maxRatio: 100, expectedStatus: http.StatusCreated},
+		{minRatio: 100, expectedStatus: http.StatusInternalServerError},
+		{maxRatio: 1, expectedStatus: http.StatusInternalServerError},
+	}
+	for i, testcase := range TESTCASES {
+		tmpConf := marConf
+		tmpConf.SignedFileMinSizeRatio = testcase.minRatio
+		tmpConf.SignedFileMaxSizeRatio = testcase.maxRatio
+		tmpag := newAutographer(1)
+		err = tmpag.addSigners([]signer.Configuration{tmpConf})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tmpag.addAuthorizations([]authorization{{ID: "alice", Key: "alicekey", Signers: []string{tmpConf.ID}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpag.hawkMaxTimestampSkew = time.Minute
+
+		body, err := json.Marshal([]formats.SignatureRequest{
+			formats.SignatureRequest{
+				Input: base64.StdEncoding.EncodeToString(input),
+				KeyID: tmpConf.ID,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://foo.bar/sign/file", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, "alice", "alicekey",
+			sha256.New, id(), "application/json", body))
+		w := httptest.NewRecorder()
+		tmpag.handleSignature(w, req)
+		if w.Code != testcase.expectedStatus {
+			t.Fatalf("test case %d expected status %d but got %d: %s",
+				i, testcase.expectedStatus, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestSignedFileSizeBoundsConfigErrs(t *testing.T) {
+	t.Parallel()
+
+	var TESTCASES = []struct {
+		minRatio, maxRatio float64
+	}{
+		{minRatio: -1},
+		{maxRatio: -1},
+		{minRatio: 2, maxRatio: 1},
+	}
+	for i, testcase := range TESTCASES {
+		tmpConf := conf.Signers[0]
+		tmpConf.SignedFileMinSizeRatio = testcase.minRatio
+		tmpConf.SignedFileMaxSizeRatio = testcase.maxRatio
+		tmpag := newAutographer(1)
+		err := tmpag.addSigners([]signer.Configuration{tmpConf})
+		if err == nil {
+			t.Fatalf("test case %d expected adding signer with invalid size bounds to fail but succeeded", i)
+		}
+	}
+}
+
+func TestSignedFileContentNegotiation(t *testing.T) {
+	t.Parallel()
+
+	var marConf signer.Configuration
+	for _, signerConf := range conf.Signers {
+		if signerConf.ID == "testmar" {
+			marConf = signerConf
+		}
+	}
+	marConf.SignedFileContentType = "application/x-mar"
+	unsignedMar := margo.New()
+	err := unsignedMar.AddContent([]byte("hello"), "hello.txt", 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, err := unsignedMar.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpag := newAutographer(1)
+	err = tmpag.addSigners([]signer.Configuration{marConf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpag.addAuthorizations([]authorization{{ID: "alice", Key: "alicekey", Signers: []string{marConf.ID}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpag.hawkMaxTimestampSkew = time.Minute
+
+	var TESTCASES = []struct {
+		endpoint            string
+		accept              string
+		expectedStatus      int
+		expectedContentType string
+	}{
+		{"/sign/file", "", http.StatusCreated, "application/json"},
+		{"/sign/file", "application/json", http.StatusCreated, "application/json"},
+		{"/sign/file", "application/x-mar", http.StatusCreated, "application/x-mar"},
+		{"/sign/file", "application/json;q=0.5, application/x-mar", http.StatusCreated, "application/x-mar"},
+		{"/sign/file", "image/png", http.StatusNotAcceptable, ""},
+		{"/sign/data", "application/x-mar", http.StatusNotAcceptable, ""},
+	}
+	for i, testcase := range TESTCASES {
+		body, err := json.Marshal([]formats.SignatureRequest{
+			formats.SignatureRequest{
+				Input: base64.StdEncoding.EncodeToString(input),
+				KeyID: marConf.ID,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://foo.bar"+testcase.endpoint, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if testcase.accept != "" {
+			req.Header.Set("Accept", testcase.accept)
+		}
+		req.Header.Set("Authorization", getAuthHeader(req, "alice", "alicekey",
+			sha256.New, id(), "application/json", body))
+		w := httptest.NewRecorder()
+		tmpag.handleSignature(w, req)
+		if w.Code != testcase.expectedStatus {
+			t.Fatalf("test case %d expected status %d but got %d: %s",
+				i, testcase.expectedStatus, w.Code, w.Body.String())
+		}
+		if testcase.expectedContentType == "" {
+			continue
+		}
+		if w.Header().Get("Content-Type") != testcase.expectedContentType {
+			t.Fatalf("test case %d expected content type %q but got %q",
+				i, testcase.expectedContentType, w.Header().Get("Content-Type"))
+		}
+		if testcase.expectedContentType == "application/json" {
+			continue
+		}
+		// the raw response is the signed mar file
+		var signedMar margo.File
+		err = margo.Unmarshal(w.Body.Bytes(), &signedMar)
+		if err != nil {
+			t.Fatalf("test case %d failed to parse signed mar: %v", i, err)
+		}
+		if len(signedMar.Signatures) != 1 {
+			t.Fatalf("test case %d expected 1 signature in signed mar but got %d", i, len(signedMar.Signatures))
+		}
+		if w.Header().Get("X-Autograph-Signer-Id") != marConf.ID {
+			t.Fatalf("test case %d expected signer id header %q but got %q",
+				i, marConf.ID, w.Header().Get("X-Autograph-Signer-Id"))
+		}
+	}
+}
+
+func TestSignerPolicies(t *testing.T) {
+	t.Parallel()
+
+	tmpConf := conf.Signers[0]
+	tmpConf.Policies = []signer.PolicyConfiguration{
+		{Type: policy.LogType},
+		{Type: policy.RequireOptionType, Option: "audit_id"},
+		{Type: policy.RateLimitType, Rate: 0.001, Burst: 1},
+	}
+	tmpag := newAutographer(1)
+	err := tmpag.addSigners([]signer.Configuration{tmpConf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpag.addAuthorizations([]authorization{{ID: "alice", Key: "alicekey", Signers: []string{tmpConf.ID}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpag.hawkMaxTimestampSkew = time.Minute
+
+	var TESTCASES = []struct {
+		options        interface{}
+		expectedStatus int
+	}{
+		{options: nil, expectedStatus: http.StatusForbidden},
+		{options: map[string]interface{}{"audit_id": "CHG-1234"}, expectedStatus: http.StatusCreated},
+		{options: map[string]interface{}{"audit_id": "CHG-1234"}, expectedStatus: http.StatusTooManyRequests},
+	}
+	for i, testcase := range TESTCASES {
+		body, err := json.Marshal([]formats.SignatureRequest{
+			formats.SignatureRequest{
+				Input:   "Y2FyaWJvdXZpbmRpZXV4Cg==",
+				KeyID:   tmpConf.ID,
+				Options: testcase.options,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, "alice", "alicekey",
+			sha256.New, id(), "application/json", body))
+		w := httptest.NewRecorder()
+		tmpag.handleSignature(w, req)
+		if w.Code != testcase.expectedStatus {
+			t.Fatalf("test case %d expected status %d but got %d: %s",
+				i, testcase.expectedStatus, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestSignerMaxSignaturesPerSecond(t *testing.T) {
+	t.Parallel()
+
+	limitedConf := conf.Signers[0]
+	limitedConf.MaxSignaturesPerSecond = 0.001
+	otherConf := conf.Signers[1]
+	tmpag := newAutographer(1)
+	err := tmpag.addSigners([]signer.Configuration{limitedConf, otherConf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpag.addAuthorizations([]authorization{{ID: "alice", Key: "alicekey", Signers: []string{limitedConf.ID, otherConf.ID}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpag.hawkMaxTimestampSkew = time.Minute
+
+	// the limited signer allows one signature, and the other signer
+	// is not throttled once the limited one is
+	var TESTCASES = []struct {
+		keyid          string
+		expectedStatus int
+	}{
+		{limitedConf.ID, http.StatusCreated},
+		{limitedConf.ID, http.StatusTooManyRequests},
+		{otherConf.ID, http.StatusCreated},
+		{otherConf.ID, http.StatusCreated},
+	}
+	for i, testcase := range TESTCASES {
+		body, err := json.Marshal([]formats.SignatureRequest{
+			formats.SignatureRequest{
+				Input: "Y2FyaWJvdXZpbmRpZXV4Cg==",
+				KeyID: testcase.keyid,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, "alice", "alicekey",
+			sha256.New, id(), "application/json", body))
+		w := httptest.NewRecorder()
+		tmpag.handleSignature(w, req)
+		if w.Code != testcase.expectedStatus {
+			t.Fatalf("test case %d expected status %d but got %d: %s",
+				i, testcase.expectedStatus, w.Code, w.Body.String())
+		}
+	}
+}
+
 func TestContentType(t *testing.T) {
 	t.Parallel()
 
@@ -574,7 +1343,7 @@ func TestDebug(t *testing.T) {
 func TestHandleGetAuthKeyIDs(t *testing.T) {
 	t.Parallel()
 
-	const autographDevAliceKeyIDsJSON = "[\"apk_cert_with_ecdsa_sha256\",\"apk_cert_with_ecdsa_sha256_v3\",\"appkey1\",\"appkey2\",\"dummyrsa\",\"dummyrsapss\",\"extensions-ecdsa\",\"extensions-ecdsa-expired-chain\",\"legacy_apk_with_rsa\",\"normandy\",\"pgpsubkey\",\"pgpsubkey-debsign\",\"randompgp\",\"randompgp-debsign\",\"remote-settings\",\"testapp-android\",\"testapp-android-legacy\",\"testapp-android-v3\",\"testauthenticode\",\"testmar\",\"testmarecdsa\",\"webextensions-rsa\",\"webextensions-rsa-with-recommendation\"]"
+	const autographDevAliceKeyIDsJSON = "[\"apk_cert_with_ecdsa_sha256\",\"apk_cert_with_ecdsa_sha256_v3\",\"appkey1\",\"appkey2\",\"dummyed25519\",\"dummyrsa\",\"dummyrsapss\",\"extensions-ecdsa\",\"extensions-ecdsa-expired-chain\",\"legacy_apk_with_rsa\",\"normandy\",\"pgpsubkey\",\"pgpsubkey-debsign\",\"randompgp\",\"randompgp-debsign\",\"remote-settings\",\"testapp-android\",\"testapp-android-legacy\",\"testapp-android-v3\",\"testauthenticode\",\"testmar\",\"testmarecdsa\",\"testtsa\",\"webextensions-rsa\",\"webextensions-rsa-with-recommendation\"]"
 
 	var testcases = []struct {
 		name   string
@@ -850,6 +1619,10 @@ func verifyAPKManifestSignature(input, sig string) error {
 }
 
 func verifyAPKSignature(signedAPK []byte) error {
+	err := apk2.VerifySigningBlock(signedAPK)
+	if err != nil {
+		return fmt.Errorf("failed to verify apk signing block: %w", err)
+	}
 	zipReader := bytes.NewReader(signedAPK)
 	r, err := zip.NewReader(zipReader, int64(len(signedAPK)))
 	if err != nil {
@@ -858,6 +1631,7 @@ func verifyAPKSignature(signedAPK []byte) error {
 	var (
 		sigstr  string
 		sigdata []byte
+		ecSig   bool
 	)
 	for _, f := range r.File {
 		switch f.Name {
@@ -874,10 +1648,11 @@ func verifyAPKSignature(signedAPK []byte) error {
 			if err != nil {
 				return err
 			}
+		case "META-INF/APK2_APK.EC":
+			ecSig = true
 		case "META-INF/SIGNATURE.RSA",
 			"META-INF/APK2_TES.RSA",
-			"META-INF/APK2_LEG.RSA",
-			"META-INF/APK2_APK.EC":
+			"META-INF/APK2_LEG.RSA":
 			rc, err := f.Open()
 			defer rc.Close()
 			if err != nil {
@@ -890,6 +1665,11 @@ func verifyAPKSignature(signedAPK []byte) error {
 			sigstr = base64.StdEncoding.EncodeToString(rawsig)
 		}
 	}
+	if ecSig {
+		// mozilla/pkcs7 cannot verify the v1 signature of EC keys,
+		// the verified signing block covers them
+		return nil
+	}
 	// convert string format back to signature
 	sig, err := apk2.Unmarshal(sigstr, sigdata)
 	if err != nil {
@@ -921,3 +1701,280 @@ func verifyMARSignature(b64Input, b64Sig, b64Key string, sigalg uint32) error {
 	}
 	return margo.VerifySignature(input, sig, sigalg, key)
 }
+
+func TestSignerStandby(t *testing.T) {
+	t.Parallel()
+
+	tmpConf := conf.Signers[0]
+	tmpConf.Standby = []signer.Configuration{{PrivateKey: conf.Signers[1].PrivateKey}}
+	tmpag := newAutographer(1)
+	err := tmpag.addSigners([]signer.Configuration{tmpConf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpag.getSigners()[0].(signer.StatefulSigner).AtExit()
+	err = tmpag.addAuthorizations([]authorization{{ID: "alice", Key: "alicekey", Signers: []string{tmpConf.ID}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpag.hawkMaxTimestampSkew = time.Minute
+
+	body, err := json.Marshal([]formats.SignatureRequest{
+		formats.SignatureRequest{
+			Input: "Y2FyaWJvdXZpbmRpZXV4Cg==",
+			KeyID: tmpConf.ID,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", getAuthHeader(req, "alice", "alicekey",
+		sha256.New, id(), "application/json", body))
+	w := httptest.NewRecorder()
+	tmpag.handleSignature(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var responses []formats.SignatureResponse
+	err = json.Unmarshal(w.Body.Bytes(), &responses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responses[0].SignerID != tmpConf.ID {
+		t.Fatalf("expected response from signer %q but got %q", tmpConf.ID, responses[0].SignerID)
+	}
+
+	// standby backends must have the type of the signer
+	tmpConf.Standby = []signer.Configuration{{Type: "genericrsa", PrivateKey: conf.Signers[1].PrivateKey}}
+	err = newAutographer(1).addSigners([]signer.Configuration{tmpConf})
+	if err == nil {
+		t.Fatalf("expected adding a signer with a standby of another type to fail but it succeeded")
+	}
+}
+
+func TestUploadSignedFile(t *testing.T) {
+	t.Parallel()
+
+	var marConf signer.Configuration
+	for _, signerConf := range conf.Signers {
+		if signerConf.ID == "testmar" {
+			marConf = signerConf
+		}
+	}
+	uploadDir := t.TempDir()
+	uploadConf := marConf
+	uploadConf.ID = "testmarupload"
+	uploadConf.SignedFileUploadLocation = "file://" + uploadDir + "/"
+	unsignedMar := margo.New()
+	err := unsignedMar.AddContent([]byte("hello"), "hello.txt", 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, err := unsignedMar.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpag := newAutographer(1)
+	err = tmpag.addSigners([]signer.Configuration{marConf, uploadConf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpag.addAuthorizations([]authorization{{ID: "alice", Key: "alicekey", Signers: []string{marConf.ID, uploadConf.ID}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpag.hawkMaxTimestampSkew = time.Minute
+
+	var TESTCASES = []struct {
+		endpoint       string
+		keyID          string
+		hashOnly       bool
+		expectedStatus int
+	}{
+		{"/sign/file", uploadConf.ID, false, http.StatusCreated},
+		{"/sign/file", marConf.ID, false, http.StatusBadRequest},
+		{"/sign/file", uploadConf.ID, true, http.StatusBadRequest},
+		{"/sign/data", uploadConf.ID, false, http.StatusBadRequest},
+	}
+	for i, testcase := range TESTCASES {
+		body, err := json.Marshal([]formats.SignatureRequest{
+			formats.SignatureRequest{
+				Input:              base64.StdEncoding.EncodeToString(input),
+				KeyID:              testcase.keyID,
+				SignedDataHashOnly: testcase.hashOnly,
+				UploadSignedFile:   true,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://foo.bar"+testcase.endpoint, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, "alice", "alicekey",
+			sha256.New, id(), "application/json", body))
+		w := httptest.NewRecorder()
+		tmpag.handleSignature(w, req)
+		if w.Code != testcase.expectedStatus {
+			t.Fatalf("test case %d expected status %d but got %d: %s",
+				i, testcase.expectedStatus, w.Code, w.Body.String())
+		}
+		if w.Code != http.StatusCreated {
+			continue
+		}
+		var responses []formats.SignatureResponse
+		err = json.Unmarshal(w.Body.Bytes(), &responses)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest := responses[0].SignedFileManifest
+		if manifest == nil {
+			t.Fatalf("test case %d expected a signed file manifest in the response", i)
+		}
+		if responses[0].SignedFile != "" {
+			t.Fatalf("test case %d expected no signed file in the response of an upload", i)
+		}
+		if manifest.SignerID != uploadConf.ID || manifest.Type != uploadConf.Type {
+			t.Fatalf("test case %d unexpected manifest signer %q of type %q", i, manifest.SignerID, manifest.Type)
+		}
+		// the download location defaults to the upload location
+		expectedURL := uploadConf.SignedFileUploadLocation + uploadConf.ID + "-" + manifest.SHA256
+		if manifest.URL != expectedURL {
+			t.Fatalf("test case %d expected manifest url %q but got %q", i, expectedURL, manifest.URL)
+		}
+		signedFile, err := ioutil.ReadFile(strings.TrimPrefix(manifest.URL, "file://"))
+		if err != nil {
+			t.Fatalf("test case %d failed to read uploaded signed file: %v", i, err)
+		}
+		if len(signedFile) != manifest.Size || fmt.Sprintf("%x", sha256.Sum256(signedFile)) != manifest.SHA256 {
+			t.Fatalf("test case %d uploaded signed file does not match its manifest", i)
+		}
+		var signedMar margo.File
+		err = margo.Unmarshal(signedFile, &signedMar)
+		if err != nil || len(signedMar.Signatures) != 1 {
+			t.Fatalf("test case %d uploaded signed file is not a signed mar: %v", i, err)
+		}
+	}
+}
+
+func TestUploadSignedFileConfigErrs(t *testing.T) {
+	t.Parallel()
+
+	var TESTCASES = []struct {
+		uploadLocation, downloadLocation, s3ACL string
+	}{
+		{uploadLocation: "https://example.net/releases/"},
+		{uploadLocation: "%gh&%ij"},
+		{downloadLocation: "https://example.net/releases/"},
+		{uploadLocation: "s3://net.example.releases/signed/", s3ACL: "world-writable"},
+	}
+	for i, testcase := range TESTCASES {
+		tmpConf := conf.Signers[0]
+		tmpConf.SignedFileUploadLocation = testcase.uploadLocation
+		tmpConf.SignedFileDownloadLocation = testcase.downloadLocation
+		tmpConf.S3ACL = testcase.s3ACL
+		err := newAutographer(1).addSigners([]signer.Configuration{tmpConf})
+		if err == nil {
+			t.Fatalf("test case %d expected adding signer with invalid upload locations to fail but succeeded", i)
+		}
+	}
+}
+
+func TestSignedFileUploadOptions(t *testing.T) {
+	t.Parallel()
+
+	tmpConf := conf.Signers[0]
+	tmpConf.SignedFileUploadLocation = "gs://net-example-releases/signed/"
+	tmpConf.SignedFileContentType = "application/x-mar"
+	tmpConf.ChainContentType = "application/x-pem-file"
+	tmpConf.ChainContentDisposition = "inline"
+	tmpConf.S3ACL = "private"
+	tmpConf.S3SSE = "aws:kms"
+	tmpConf.S3KMSKeyID = "alias/releases"
+	err := validateSignedFileUpload(tmpConf)
+	if err != nil {
+		t.Fatalf("expected gs:// signed file upload location to be valid but got: %v", err)
+	}
+	opts := signedFileUploadOptions(tmpConf)
+	if opts.ACL != "private" || opts.SSE != "aws:kms" || opts.KMSKeyID != "alias/releases" {
+		t.Fatalf("expected signed file upload options to use the s3 options of the signer but got %+v", opts)
+	}
+	if opts.ContentType != "application/x-mar" || opts.ContentDisposition != "" {
+		t.Fatalf("expected signed file upload options to use the signed file content type but got %+v", opts)
+	}
+}
+
+// recordingMetricsCollector records the signing operations of a signer
+type recordingMetricsCollector struct {
+	signerID string
+
+	mu           sync.Mutex
+	observations []recordedSign
+}
+
+type recordedSign struct {
+	signerType string
+	d          time.Duration
+	err        error
+}
+
+func (c *recordingMetricsCollector) ObserveSign(signerID, signerType string, d time.Duration, err error) {
+	if signerID != c.signerID {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.observations = append(c.observations, recordedSign{signerType: signerType, d: d, err: err})
+}
+
+func TestSignMetrics(t *testing.T) {
+	collector := &recordingMetricsCollector{signerID: "appkey1"}
+	signer.SetMetricsCollector(collector)
+	defer signer.SetMetricsCollector(nil)
+
+	body, err := json.Marshal([]formats.SignatureRequest{
+		formats.SignatureRequest{
+			Input: base64.StdEncoding.EncodeToString([]byte("foobarbaz1234abcd")),
+			KeyID: "appkey1",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	authheader := getAuthHeader(req, conf.Authorizations[0].ID, conf.Authorizations[0].Key,
+		sha256.New, id(), "application/json", body)
+	req.Header.Set("Authorization", authheader)
+	w := httptest.NewRecorder()
+	ag.handleSignature(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	if len(collector.observations) != 1 {
+		t.Fatalf("expected 1 observed signing operation but got %d", len(collector.observations))
+	}
+	observation := collector.observations[0]
+	if observation.signerType != "contentsignature" {
+		t.Fatalf("expected observed signer type %q but got %q", "contentsignature", observation.signerType)
+	}
+	if observation.err != nil {
+		t.Fatalf("expected observed signing operation to succeed but got error: %v", observation.err)
+	}
+	if observation.d <= 0 {
+		t.Fatalf("expected a positive observed signing duration but got %s", observation.d)
+	}
+}
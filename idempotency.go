@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/mozilla-services/autograph/formats"
+)
+
+const (
+	// idempotencyKeyHeader is the header of the key clients set to
+	// get the responses of a signing request again when they retry it
+	idempotencyKeyHeader = "Idempotency-Key"
+
+	// maxIdempotencyKeyLength is the max length of idempotency keys
+	maxIdempotencyKeyLength = 255
+
+	// defaultIdempotencyCacheSize is the default number of signing
+	// responses cached by idempotency key
+	defaultIdempotencyCacheSize = 256
+
+	// defaultIdempotencyCacheTTL is the default time cached signing
+	// responses are replayed for
+	defaultIdempotencyCacheTTL = 10 * time.Minute
+
+	// defaultMaxIdempotentResponseBytes is the default max size of
+	// the cached signing responses of a request, so the cache holds
+	// at most 256MB by default
+	defaultMaxIdempotentResponseBytes = 1048576
+)
+
+// cachedSignatureResponses are the signing responses of a request with
+// an idempotency key
+type cachedSignatureResponses struct {
+	// requestHash is the hash of the endpoint and body of the request
+	requestHash [sha256.Size]byte
+	sigresps    []formats.SignatureResponse
+	cachedAt    time.Time
+}
+
+// setIdempotencyCache sets the number of signing responses cached by
+// idempotency key, how long they are replayed for and the max size of
+// the responses of a request to cache, zero keeps the default
+func (a *autographer) setIdempotencyCache(size int, ttl time.Duration, maxResponseBytes int64) (err error) {
+	if size < 0 || ttl < 0 || maxResponseBytes < 0 {
+		return fmt.Errorf("idempotency cache size, ttl and max response bytes must not be negative, got %d, %s and %d", size, ttl, maxResponseBytes)
+	}
+	if size > 0 {
+		a.idempotencyCache, err = lru.New(size)
+		if err != nil {
+			return err
+		}
+	}
+	if ttl > 0 {
+		a.idempotencyCacheTTL = ttl
+	}
+	if maxResponseBytes > 0 {
+		a.maxIdempotentResponseBytes = maxResponseBytes
+	}
+	return nil
+}
+
+// checkIdempotencyKey returns an error when an idempotency key is too
+// long or has characters other than printable ASCII
+func checkIdempotencyKey(key string) error {
+	if len(key) > maxIdempotencyKeyLength {
+		return fmt.Errorf("%s header is longer than %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength)
+	}
+	for _, c := range key {
+		if c < ' ' || c > '~' {
+			return fmt.Errorf("%s header must only contain printable ASCII characters", idempotencyKeyHeader)
+		}
+	}
+	return nil
+}
+
+// idempotencyCacheKey scopes idempotency keys to users, so users do
+// not get the responses of other users
+func idempotencyCacheKey(userid, key string) string {
+	return userid + "\x00" + key
+}
+
+// idempotencyRequestHash returns the hash of the endpoint and body of a
+// signing request
+func idempotencyRequestHash(endpoint string, body []byte) (requestHash [sha256.Size]byte) {
+	h := sha256.New()
+	h.Write([]byte(endpoint + "\x00"))
+	h.Write(body)
+	copy(requestHash[:], h.Sum(nil))
+	return requestHash
+}
+
+// getIdempotentResponses returns the cached signing responses of the
+// idempotency key of a user, nil when there are none or they are older
+// than the cache TTL. It errors when the key was used for a request to
+// another endpoint or with another body.
+func (a *autographer) getIdempotentResponses(userid, key, endpoint string, body []byte) ([]formats.SignatureResponse, error) {
+	cached, ok := a.idempotencyCache.Get(idempotencyCacheKey(userid, key))
+	if !ok {
+		return nil, nil
+	}
+	responses := cached.(cachedSignatureResponses)
+	if a.now().Sub(responses.cachedAt) >= a.idempotencyCacheTTL {
+		a.idempotencyCache.Remove(idempotencyCacheKey(userid, key))
+		return nil, nil
+	}
+	if responses.requestHash != idempotencyRequestHash(endpoint, body) {
+		return nil, fmt.Errorf("%s %q was already used for another signing request", idempotencyKeyHeader, key)
+	}
+	return responses.sigresps, nil
+}
+
+// cacheIdempotentResponses caches the signing responses of a request
+// with an idempotency key, unless they are larger than the max
+// idempotent response size. It returns whether they were cached.
+func (a *autographer) cacheIdempotentResponses(userid, key, endpoint string, body []byte, sigresps []formats.SignatureResponse) bool {
+	if signatureResponsesSize(sigresps) > a.maxIdempotentResponseBytes {
+		return false
+	}
+	a.idempotencyCache.Add(idempotencyCacheKey(userid, key), cachedSignatureResponses{
+		requestHash: idempotencyRequestHash(endpoint, body),
+		sigresps:    sigresps,
+		cachedAt:    a.now(),
+	})
+	return true
+}
+
+// signatureResponsesSize returns the size of the signatures and signed
+// files of signing responses, which make up most of their size
+func signatureResponsesSize(sigresps []formats.SignatureResponse) (size int64) {
+	for _, sigresp := range sigresps {
+		size += int64(len(sigresp.Signature) + len(sigresp.SignedFile) + len(sigresp.SignedFileSidecar))
+		for _, signedFile := range sigresp.SignedFiles {
+			size += int64(len(signedFile.Content))
+		}
+	}
+	return size
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/autograph/formats"
+	"github.com/mozilla-services/autograph/signer"
+)
+
+func idempotentSignatureRequest(t *testing.T, tmpag *autographer, user, key, idempotencyKey string, input []byte) *httptest.ResponseRecorder {
+	body, err := json.Marshal([]formats.SignatureRequest{
+		formats.SignatureRequest{
+			Input: base64.StdEncoding.EncodeToString(input),
+			KeyID: "appkey1",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if idempotencyKey != "" {
+		req.Header.Set(idempotencyKeyHeader, idempotencyKey)
+	}
+	req.Header.Set("Authorization", getAuthHeader(req, user, key, sha256.New, id(), "application/json", body))
+	w := httptest.NewRecorder()
+	tmpag.handleSignature(w, req)
+	return w
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	t.Parallel()
+
+	var csConf signer.Configuration
+	for _, signerConf := range conf.Signers {
+		if signerConf.ID == "appkey1" {
+			csConf = signerConf
+		}
+	}
+	tmpag := newAutographer(100)
+	err := tmpag.addSigners([]signer.Configuration{csConf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpag.addAuthorizations([]authorization{
+		{ID: "alice", Key: "alicekey", Signers: []string{csConf.ID}},
+		{ID: "bob", Key: "bobkey", Signers: []string{csConf.ID}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	now := time.Now()
+	tmpag.now = func() time.Time { return now }
+
+	input := []byte("foobarbaz1234abcd")
+	sign := func(user, key, idempotencyKey string, input []byte, expectedStatus int) string {
+		w := idempotentSignatureRequest(t, tmpag, user, key, idempotencyKey, input)
+		if w.Code != expectedStatus {
+			t.Fatalf("expected status %d signing as %q with idempotency key %q but got %d: %s",
+				expectedStatus, user, idempotencyKey, w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+
+	// content signatures are randomized, so responses only match when
+	// they are replayed
+	first := sign("alice", "alicekey", "build-1234", input, http.StatusCreated)
+	if replay := sign("alice", "alicekey", "build-1234", input, http.StatusCreated); replay != first {
+		t.Fatalf("expected the replayed response of the idempotency key to be the first one\n%s\n%s", first, replay)
+	}
+	if other := sign("alice", "alicekey", "", input, http.StatusCreated); other == first {
+		t.Fatal("expected a request without idempotency key to be signed again")
+	}
+	if bobs := sign("bob", "bobkey", "build-1234", input, http.StatusCreated); bobs == first {
+		t.Fatal("expected idempotency keys of other users to be signed again")
+	}
+
+	body := sign("alice", "alicekey", "build-1234", []byte("some other input"), http.StatusUnprocessableEntity)
+	if !strings.Contains(body, "was already used for another signing request") {
+		t.Fatalf("expected reusing an idempotency key for another input to fail but got %q", body)
+	}
+	sign("alice", "alicekey", strings.Repeat("a", maxIdempotencyKeyLength+1), input, http.StatusBadRequest)
+	sign("alice", "alicekey", "build\t1234", input, http.StatusBadRequest)
+
+	// cached responses expire after the TTL
+	now = now.Add(defaultIdempotencyCacheTTL)
+	if expired := sign("alice", "alicekey", "build-1234", input, http.StatusCreated); expired == first {
+		t.Fatal("expected the responses of an expired idempotency key to be signed again")
+	}
+
+	// responses larger than the max are signed on every request
+	err = tmpag.setIdempotencyCache(0, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first = sign("alice", "alicekey", "build-5678", input, http.StatusCreated)
+	if replay := sign("alice", "alicekey", "build-5678", input, http.StatusCreated); replay == first {
+		t.Fatal("expected responses larger than the max idempotent response size not to be cached")
+	}
+}
+
+func TestSetIdempotencyCache(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(1)
+	err := tmpag.setIdempotencyCache(0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tmpag.idempotencyCacheTTL != defaultIdempotencyCacheTTL || tmpag.maxIdempotentResponseBytes != defaultMaxIdempotentResponseBytes {
+		t.Fatalf("expected zero values to keep the default idempotency cache settings")
+	}
+	err = tmpag.setIdempotencyCache(2, time.Minute, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tmpag.idempotencyCacheTTL != time.Minute || tmpag.maxIdempotentResponseBytes != 10 {
+		t.Fatalf("expected idempotency cache settings to be set")
+	}
+	for i, key := range []string{"a", "b", "c"} {
+		tmpag.cacheIdempotentResponses("alice", key, "/sign/data", []byte(key), []formats.SignatureResponse{{Ref: key}})
+		if i < 2 && tmpag.idempotencyCache.Len() != i+1 {
+			t.Fatalf("expected %d cached responses but got %d", i+1, tmpag.idempotencyCache.Len())
+		}
+	}
+	if tmpag.idempotencyCache.Len() != 2 {
+		t.Fatalf("expected the cache to evict the oldest responses at its size but it holds %d", tmpag.idempotencyCache.Len())
+	}
+	cached, err := tmpag.getIdempotentResponses("alice", "a", "/sign/data", []byte("a"))
+	if err != nil || cached != nil {
+		t.Fatalf("expected the evicted responses not to be replayed but got %v: %v", cached, err)
+	}
+	_, err = tmpag.getIdempotentResponses("alice", "c", "/sign/hash", []byte("c"))
+	if err == nil {
+		t.Fatal("expected an idempotency key used on another endpoint to fail")
+	}
+	for _, invalid := range [][3]int64{{-1, 0, 0}, {0, -1, 0}, {0, 0, -1}} {
+		err = tmpag.setIdempotencyCache(int(invalid[0]), time.Duration(invalid[1]), invalid[2])
+		if err == nil {
+			t.Fatalf("expected negative idempotency cache settings %v to fail", invalid)
+		}
+	}
+}
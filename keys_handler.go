@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mozilla-services/autograph/formats"
+	"github.com/mozilla-services/autograph/signer"
+)
+
+// signerKey returns the public key, x5u and certificate of a signer,
+// and never its private key
+func signerKey(s signer.Signer) formats.SignerKey {
+	conf := s.Config()
+	return formats.SignerKey{
+		SignerID:    conf.ID,
+		Type:        conf.Type,
+		PublicKey:   conf.PublicKey,
+		X5U:         conf.X5U,
+		Certificate: conf.Certificate,
+
+		CertificateInfo: getSignerCertificateInfo(s),
+	}
+}
+
+// handleGetKeys returns the public keys of all signers, or of the
+// signer in the signer_id route var when it is set, to any
+// authenticated user
+func (a *autographer) handleGetKeys(w http.ResponseWriter, r *http.Request) {
+	rid := getRequestID(r)
+	if r.Body != nil {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, "failed to read request body: %s", err)
+			return
+		}
+		if len(body) > 0 {
+			httpError(w, r, http.StatusBadRequest, "endpoint received unexpected request body")
+			return
+		}
+	}
+	_, userid, err := a.authorizeHeader(r)
+	if err != nil {
+		httpError(w, r, http.StatusUnauthorized, "authorization verification failed: %v", err)
+		return
+	}
+
+	var keys []formats.SignerKey
+	signerID, hasSignerID := mux.Vars(r)["signer_id"]
+	for _, s := range a.getSigners() {
+		if hasSignerID && s.Config().ID != signerID {
+			continue
+		}
+		keys = append(keys, signerKey(s))
+	}
+	if hasSignerID && len(keys) == 0 {
+		httpError(w, r, http.StatusNotFound, "signer %q was not found", signerID)
+		return
+	}
+
+	var respdata []byte
+	if hasSignerID {
+		respdata, err = json.Marshal(keys[0])
+	} else {
+		respdata, err = json.Marshal(keys)
+	}
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "error marshaling response JSON: %v", err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"rid":       rid,
+		"user_id":   userid,
+		"signer_id": signerID,
+	}).Info("returned signer keys")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respdata)
+}
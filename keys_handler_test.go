@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.mozilla.org/hawk"
+
+	"github.com/mozilla-services/autograph/formats"
+)
+
+func keysRequest(t *testing.T, user string, urlRouteVars map[string]string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", "http://foo.bar/keys", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = mux.SetURLVars(req, urlRouteVars)
+	if user != "" {
+		auth, err := ag.getAuthByID(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", hawk.NewRequestAuth(req,
+			&hawk.Credentials{
+				ID:   auth.ID,
+				Key:  auth.Key,
+				Hash: sha256.New},
+			0).RequestHeader())
+	}
+	w := httptest.NewRecorder()
+	ag.handleGetKeys(w, req)
+	return w
+}
+
+func TestHandleGetKeys(t *testing.T) {
+	t.Parallel()
+
+	w := keysRequest(t, conf.Authorizations[0].ID, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed to get keys: %d %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "PRIVATE KEY") {
+		t.Fatalf("keys response contains a private key: %s", w.Body.String())
+	}
+	var keys []formats.SignerKey
+	err := json.Unmarshal(w.Body.Bytes(), &keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(ag.getSigners()) {
+		t.Fatalf("expected the keys of %d signers but got %d", len(ag.getSigners()), len(keys))
+	}
+	for i, s := range ag.getSigners() {
+		if keys[i].SignerID != s.Config().ID || keys[i].Type != s.Config().Type || keys[i].PublicKey != s.Config().PublicKey {
+			t.Fatalf("key %d %+v does not match signer %q", i, keys[i], s.Config().ID)
+		}
+	}
+
+	w = keysRequest(t, conf.Authorizations[0].ID, map[string]string{"signer_id": "appkey1"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed to get key of appkey1: %d %s", w.Code, w.Body.String())
+	}
+	var key formats.SignerKey
+	err = json.Unmarshal(w.Body.Bytes(), &key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appkey1Conf, _ := ag.getSignerConf("appkey1")
+	if key.SignerID != "appkey1" || key.Type != "contentsignature" || key.PublicKey == "" || key.X5U != appkey1Conf.X5U {
+		t.Fatalf("unexpected key of appkey1 %+v", key)
+	}
+
+	// signers with a certificate return its fields and fingerprints
+	w = keysRequest(t, conf.Authorizations[0].ID, map[string]string{"signer_id": "testapp-android"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed to get key of testapp-android: %d %s", w.Code, w.Body.String())
+	}
+	key = formats.SignerKey{}
+	err = json.Unmarshal(w.Body.Bytes(), &key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.CertificateInfo == nil || key.CertificateInfo.Subject == "" || len(key.CertificateInfo.SHA1Fingerprint) != 40 || len(key.CertificateInfo.SHA256Fingerprint) != 64 {
+		t.Fatalf("expected the certificate info of testapp-android but got %+v", key.CertificateInfo)
+	}
+
+	w = keysRequest(t, conf.Authorizations[0].ID, map[string]string{"signer_id": "unknown"})
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected unknown signer to return 404 but got %d %s", w.Code, w.Body.String())
+	}
+
+	w = keysRequest(t, "", nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected request without authorization to return 401 but got %d %s", w.Code, w.Body.String())
+	}
+}
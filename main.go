@@ -18,6 +18,7 @@ import (
 	"os/signal"
 	"regexp"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -30,12 +31,18 @@ import (
 
 	"github.com/mozilla-services/autograph/database"
 	"github.com/mozilla-services/autograph/signer"
+	"github.com/mozilla-services/autograph/signer/aab"
 	"github.com/mozilla-services/autograph/signer/apk2"
 	"github.com/mozilla-services/autograph/signer/contentsignature"
 	"github.com/mozilla-services/autograph/signer/contentsignaturepki"
+	"github.com/mozilla-services/autograph/signer/ed25519"
 	"github.com/mozilla-services/autograph/signer/genericrsa"
 	"github.com/mozilla-services/autograph/signer/gpg2"
 	"github.com/mozilla-services/autograph/signer/mar"
+	"github.com/mozilla-services/autograph/signer/multisig"
+	"github.com/mozilla-services/autograph/signer/policy"
+	"github.com/mozilla-services/autograph/signer/rfc3161"
+	"github.com/mozilla-services/autograph/signer/standby"
 	"github.com/mozilla-services/autograph/signer/xpi"
 
 	"go.mozilla.org/sops"
@@ -45,6 +52,11 @@ import (
 	"github.com/ThalesIgnite/crypto11"
 )
 
+// autographVersion is the version of autograph returned in signature
+// responses, it is set at build time with
+// -ldflags "-X main.autographVersion=<commit hash>"
+var autographVersion string
+
 // configuration loads a yaml file that contains the configuration of Autograph
 type configuration struct {
 	Server struct {
@@ -53,20 +65,51 @@ type configuration struct {
 		IdleTimeout    time.Duration
 		ReadTimeout    time.Duration
 		WriteTimeout   time.Duration
+		// LogFormat is the format of the log entries, "json" (the
+		// default) or "text"
+		LogFormat string
+		// MaxConcurrentExternalSigners is the maximum number of
+		// signing tool processes the signers that shell out run at
+		// the same time, 0 (the default) does not limit it
+		MaxConcurrentExternalSigners int
+		// MaxRequestBytes bounds the size of the bodies of signing
+		// requests to the data endpoints (/sign/data and /sign/hash)
+		// and the file endpoints (/sign/file and /sign/files), they
+		// default to 10MB and 1GB
+		MaxRequestBytes struct {
+			Data int64
+			File int64
+		}
+		// IdempotencyCache bounds the cache of the responses of
+		// signing requests with an Idempotency-Key header: at most
+		// Size requests with responses of up to MaxResponseBytes are
+		// replayed for TTL, they default to 256, 1MB and 10 minutes
+		IdempotencyCache struct {
+			Size             int
+			TTL              time.Duration
+			MaxResponseBytes int64
+		}
+		// X5UCacheTTL is how long the x5u chains fetched to verify
+		// contentsignaturepki responses on /verify are reused, it
+		// defaults to contentsignaturepki.DefaultX5UCacheTTL
+		X5UCacheTTL time.Duration
 	}
 	Statsd struct {
 		Addr      string
 		Namespace string
 		Buflen    int
 	}
+	Prometheus            prometheusConfig
 	HSM                   crypto11.PKCS11Config
 	Database              database.Config
 	Signers               []signer.Configuration
 	Authorizations        []authorization
-	Monitoring            authorization
+	Monitoring            monitoringConfig
+	Admin                 authorization
 	Heartbeat             heartbeatConfig
 	HawkTimestampValidity string
 	MonitorInterval       time.Duration
+	MonitorTimeout        time.Duration
 }
 
 // An autographer is a running instance of an autograph service,
@@ -80,6 +123,41 @@ type autographer struct {
 	authBackend          authBackend
 	hawkMaxTimestampSkew time.Duration
 
+	// maxDataRequestBytes and maxFileRequestBytes bound the size of
+	// the bodies of requests to the data and file signing endpoints
+	maxDataRequestBytes int64
+	maxFileRequestBytes int64
+
+	// x5uCache holds the x5u chains fetched to verify content
+	// signatures
+	x5uCache *contentsignaturepki.X5UCache
+
+	// idempotencyCache holds the responses of signing requests with
+	// an idempotency key for idempotencyCacheTTL, when they are at
+	// most maxIdempotentResponseBytes
+	idempotencyCache           *lru.Cache
+	idempotencyCacheTTL        time.Duration
+	maxIdempotentResponseBytes int64
+
+	// now returns the current time x5u chains and their certificates
+	// are verified at, it is time.Now outside of tests
+	now func() time.Time
+
+	// signerConfs holds the configuration each signer was
+	// initialized from, so key rotation can rebuild it
+	signerConfs map[string]signer.Configuration
+
+	// Serializes signer key and chain rotations. It is held while
+	// the new signer is built, so it must not be taken on signing.
+	rotationLock sync.Mutex
+
+	// Guards signerConfs and the swap of rotated signers.
+	signerConfsLock sync.RWMutex
+
+	// heartbeatSignerChecks holds the latest results of the
+	// heartbeat signer checks
+	heartbeatSignerChecks heartbeatSignerChecks
+
 	// Used to signal the monitor on exit of the autographer instance.
 	exit chan interface{}
 }
@@ -90,6 +168,15 @@ func main() {
 	if len(args) > 0 {
 		args = os.Args[1:]
 	}
+	if len(args) > 0 && args[0] == testSignersCommand {
+		conf, _, _ := parseArgsAndLoadConfig(args[1:])
+		failed := testSigners(conf)
+		if len(failed) > 0 {
+			log.Fatalf("%d signers failed their test: %s", len(failed), strings.Join(failed, ", "))
+		}
+		log.Infof("all %d signers passed their test", len(conf.Signers))
+		return
+	}
 	run(parseArgsAndLoadConfig(args))
 }
 
@@ -151,10 +238,31 @@ func run(conf configuration, listen string, debug bool) {
 		err error
 	)
 
+	err = signer.SetLogFormat(conf.Server.LogFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = signer.SetMaxConcurrentExternalSigners(conf.Server.MaxConcurrentExternalSigners)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// initialize signers from the configuration
 	// and store them into the autographer handler
 	ag = newAutographer(conf.Server.NonceCacheSize)
 	ag.heartbeatConf = &conf.Heartbeat
+	err = ag.setMaxRequestBytes(conf.Server.MaxRequestBytes.Data, conf.Server.MaxRequestBytes.File)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ag.setIdempotencyCache(conf.Server.IdempotencyCache.Size, conf.Server.IdempotencyCache.TTL, conf.Server.IdempotencyCache.MaxResponseBytes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ag.setX5UCacheTTL(conf.Server.X5UCacheTTL)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	if conf.Database.Name != "" {
 		// ignore the monitor close chan since it will stop
@@ -178,11 +286,20 @@ func run(conf configuration, listen string, debug bool) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	for _, id := range conf.Heartbeat.Signers {
+		if _, ok := ag.getSignerConf(id); !ok {
+			log.Fatalf("heartbeat signer %q is not configured", id)
+		}
+	}
 	err = ag.addAuthorizations(conf.Authorizations)
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = ag.addMonitoring(conf.Monitoring)
+	err = ag.addMonitoring(conf.Monitoring.authorization)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ag.addAdmin(conf.Admin)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -203,18 +320,33 @@ func run(conf configuration, listen string, debug bool) {
 	ag.startCleanupHandler()
 
 	// Initialize a monitor.
-	monitor := newMonitor(ag, conf.MonitorInterval)
+	monitor := newMonitor(ag, conf.MonitorInterval, conf.MonitorTimeout, conf.Monitoring.ExcludedSigners, conf.Monitoring.RootHash, conf.Monitoring.RootSPKIHash, conf.Monitoring.OptionVariants)
 
 	router := mux.NewRouter().StrictSlash(true)
 	router.HandleFunc("/__heartbeat__", ag.handleHeartbeat).Methods("GET")
 	router.HandleFunc("/__lbheartbeat__", handleLBHeartbeat).Methods("GET")
 	router.HandleFunc("/__version__", handleVersion).Methods("GET")
 	router.HandleFunc("/__monitor__", monitor.handleMonitor).Methods("GET")
+	router.HandleFunc("/__monitor__/health", monitor.handleMonitorHealth).Methods("GET")
+	// multipart requests sign every file of the form with a file
+	// signer, JSON requests sign named files with a multiple file signer
+	router.HandleFunc("/sign/files", ag.handleMultipartSignFiles).Methods("POST").HeadersRegexp("Content-Type", "^multipart/form-data")
 	router.HandleFunc("/sign/files", ag.handleSignature).Methods("POST")
 	router.HandleFunc("/sign/file", ag.handleSignature).Methods("POST")
 	router.HandleFunc("/sign/data", ag.handleSignature).Methods("POST")
 	router.HandleFunc("/sign/hash", ag.handleSignature).Methods("POST")
+	router.HandleFunc("/verify", ag.handleVerification).Methods("POST")
 	router.HandleFunc("/auths/{auth_id:[a-zA-Z0-9-_]{1,255}}/keyids", ag.handleGetAuthKeyIDs).Methods("GET")
+	router.HandleFunc("/keys", ag.handleGetKeys).Methods("GET")
+	router.HandleFunc("/keys/{signer_id:[a-zA-Z0-9-_]{1,64}}", ag.handleGetKeys).Methods("GET")
+	router.HandleFunc("/admin/signers/{signer_id:[a-zA-Z0-9-_]{1,64}}/key", ag.handleRotateSignerKey).Methods("POST")
+	router.HandleFunc("/admin/rotate-chain/{signer_id:[a-zA-Z0-9-_]{1,64}}", ag.handleRotateSignerChain).Methods("POST")
+	if conf.Prometheus.Enabled {
+		collector := newPrometheusCollector()
+		signer.SetMetricsCollector(collector)
+		router.HandleFunc("/metrics", collector.handleMetrics).Methods("GET")
+		log.Infof("enabled prometheus metrics at /metrics")
+	}
 	if os.Getenv("AUTOGRAPH_PROFILE") == "1" {
 		err = setRuntimeConfig()
 		if err != nil {
@@ -235,6 +367,8 @@ func run(conf configuration, listen string, debug bool) {
 			setRequestStartTime(),
 			setResponseHeaders(),
 			logRequest(),
+			compressResponseBody(),
+			decompressRequestBody(),
 		),
 	}
 	log.Infof("starting autograph on %s with timeouts: idle %s read %s write %s", listen, conf.Server.IdleTimeout, conf.Server.ReadTimeout, conf.Server.WriteTimeout)
@@ -291,14 +425,43 @@ func newAutographer(cachesize int) (a *autographer) {
 	var err error
 	a = new(autographer)
 	a.authBackend = newInMemoryAuthBackend()
+	a.signerConfs = make(map[string]signer.Configuration)
 	a.nonces, err = lru.New(cachesize)
 	a.exit = make(chan interface{})
 	if err != nil {
 		log.Fatal(err)
 	}
+	a.idempotencyCache, err = lru.New(defaultIdempotencyCacheSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	a.idempotencyCacheTTL = defaultIdempotencyCacheTTL
+	a.maxIdempotentResponseBytes = defaultMaxIdempotentResponseBytes
+	a.now = time.Now
+	err = a.setX5UCacheTTL(0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	a.maxDataRequestBytes = defaultMaxDataRequestBytes
+	a.maxFileRequestBytes = defaultMaxFileRequestBytes
 	return a
 }
 
+// setMaxRequestBytes sets the max size of the bodies of requests to
+// the data and file signing endpoints, zero keeps the default
+func (a *autographer) setMaxRequestBytes(data, file int64) error {
+	if data < 0 || file < 0 {
+		return fmt.Errorf("max request bytes must not be negative, got %d for data and %d for files", data, file)
+	}
+	if data > 0 {
+		a.maxDataRequestBytes = data
+	}
+	if file > 0 {
+		a.maxFileRequestBytes = file
+	}
+	return nil
+}
+
 // enableDebug enables debug logging
 func (a *autographer) enableDebug() {
 	a.debug = true
@@ -376,7 +539,7 @@ func (a *autographer) initHSM(conf configuration) {
 
 			// save the first signer with an HSM label as
 			// the key to test from the heartbeat handler
-			if a.heartbeatConf != nil && a.heartbeatConf.hsmSignerConf == nil && !signerConf.PrivateKeyHasPEMPrefix() {
+			if a.heartbeatConf != nil && a.heartbeatConf.hsmSignerConf == nil && !signerConf.PrivateKeyHasPEMPrefix() && !signerConf.PrivateKeyHasAWSPrefix() && !signerConf.PrivateKeyHasAzurePrefix() {
 				a.heartbeatConf.hsmSignerConf = &signerConf
 			}
 		}
@@ -413,57 +576,117 @@ func (a *autographer) addSigners(signerConfs []signer.Configuration) error {
 				return fmt.Errorf("failed to add signer stats client %q or got back nil statsClient: %w", signerConf.ID, err)
 			}
 		}
+		err = signerConf.ValidateSignedFileSizeBounds()
+		if err != nil {
+			return fmt.Errorf("failed to add signer %q: %w", signerConf.ID, err)
+		}
+		err = validateSignedFileContentType(signerConf)
+		if err != nil {
+			return fmt.Errorf("failed to add signer %q: %w", signerConf.ID, err)
+		}
+		err = validateSignedFileUpload(signerConf)
+		if err != nil {
+			return fmt.Errorf("failed to add signer %q: %w", signerConf.ID, err)
+		}
 		// give the database handler to the signer configuration
 		if a.db != nil {
 			signerConf.DB = a.db
 		}
-		switch signerConf.Type {
-		case contentsignature.Type:
-			s, err = contentsignature.New(signerConf)
-			if err != nil {
-				return fmt.Errorf("failed to add signer %q: %w", signerConf.ID, err)
-			}
-		case contentsignaturepki.Type:
-			s, err = contentsignaturepki.New(signerConf)
-			if err != nil {
-				return fmt.Errorf("failed to add signer %q: %w", signerConf.ID, err)
-			}
-		case xpi.Type:
-			s, err = xpi.New(signerConf, statsClient)
-			if err != nil {
-				return fmt.Errorf("failed to add signer %q: %w", signerConf.ID, err)
-			}
-		case apk2.Type:
-			s, err = apk2.New(signerConf)
-			if err != nil {
-				return fmt.Errorf("failed to add signer %q: %w", signerConf.ID, err)
-			}
-		case mar.Type:
-			s, err = mar.New(signerConf)
-			if err != nil && strings.HasPrefix(err.Error(), "mar: failed to parse private key: no suitable key found") {
-				log.Infof("Skipping signer %q from HSM", signerConf.ID)
-				continue
-			} else if err != nil {
-				return fmt.Errorf("failed to add signer %q: %w", signerConf.ID, err)
-			}
-		case gpg2.Type:
-			s, err = gpg2.New(signerConf)
-			if err != nil {
-				return fmt.Errorf("failed to add signer %q: %w", signerConf.ID, err)
-			}
-		case genericrsa.Type:
-			s, err = genericrsa.New(signerConf)
-			if err != nil {
-				return fmt.Errorf("failed to add signer %q: %w", signerConf.ID, err)
-			}
-		default:
-			return fmt.Errorf("unknown signer type %q", signerConf.Type)
+		s, err = newSigner(signerConf, statsClient)
+		if err != nil && signerConf.Type == mar.Type && strings.HasPrefix(err.Error(), "mar: failed to parse private key: no suitable key found") {
+			log.Infof("Skipping signer %q from HSM", signerConf.ID)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to add signer %q: %w", signerConf.ID, err)
 		}
+		a.signerConfs[signerConf.ID] = signerConf
 		a.addSigner(s)
 	}
 	return nil
 }
 
+// getSignerConf returns the configuration a signer was initialized
+// with
+func (a *autographer) getSignerConf(signerID string) (signer.Configuration, bool) {
+	a.signerConfsLock.RLock()
+	defer a.signerConfsLock.RUnlock()
+	signerConf, ok := a.signerConfs[signerID]
+	return signerConf, ok
+}
+
+// swapSigner replaces a signer with a rotated one and records the
+// configuration it was initialized with. It returns the replaced
+// signer.
+func (a *autographer) swapSigner(signerConf signer.Configuration, s signer.Signer) (signer.Signer, error) {
+	a.signerConfsLock.Lock()
+	defer a.signerConfsLock.Unlock()
+	oldSigner, err := a.authBackend.replaceSigner(s)
+	if err != nil {
+		return nil, err
+	}
+	a.signerConfs[signerConf.ID] = signerConf
+	return oldSigner, nil
+}
+
+// newSigner initializes a signer of the configured type, with its
+// standby backends when it has some, and wraps it with its
+// configured policies
+func newSigner(signerConf signer.Configuration, statsClient *signer.StatsClient) (s signer.Signer, err error) {
+	if len(signerConf.Standby) > 0 {
+		s, err = standby.New(signerConf, func(backendConf signer.Configuration) (signer.Signer, error) {
+			return newSigner(backendConf, statsClient)
+		})
+	} else {
+		s, err = newBackendSigner(signerConf, statsClient)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return wrapPolicies(signerConf, s)
+}
+
+// wrapPolicies wraps a signer with the policies of its configuration
+func wrapPolicies(signerConf signer.Configuration, s signer.Signer) (signer.Signer, error) {
+	policies, err := policy.Configured(signerConf)
+	if err != nil {
+		return nil, err
+	}
+	return policy.Wrap(s, policies)
+}
+
+// newBackendSigner initializes a signer of the configured type
+func newBackendSigner(signerConf signer.Configuration, statsClient *signer.StatsClient) (s signer.Signer, err error) {
+	switch signerConf.Type {
+	case contentsignature.Type:
+		s, err = contentsignature.New(signerConf)
+	case contentsignaturepki.Type:
+		s, err = contentsignaturepki.New(signerConf)
+	case xpi.Type:
+		s, err = xpi.New(signerConf, statsClient)
+	case apk2.Type:
+		s, err = apk2.New(signerConf)
+	case aab.Type:
+		s, err = aab.New(signerConf)
+	case mar.Type:
+		s, err = mar.New(signerConf)
+	case gpg2.Type:
+		s, err = gpg2.New(signerConf)
+	case genericrsa.Type:
+		s, err = genericrsa.New(signerConf)
+	case ed25519.Type:
+		s, err = ed25519.New(signerConf)
+	case rfc3161.Type:
+		s, err = rfc3161.New(signerConf)
+	case multisig.Type:
+		s, err = multisig.New(signerConf, func(memberConf signer.Configuration) (signer.Signer, error) {
+			return newSigner(memberConf, statsClient)
+		})
+	default:
+		return nil, fmt.Errorf("unknown signer type %q", signerConf.Type)
+	}
+	return
+}
+
 // addMonitoring adds an authorization to enable the
 // tools/autograph-monitor
 func (a *autographer) addMonitoring(auth authorization) (err error) {
@@ -474,6 +697,15 @@ func (a *autographer) addMonitoring(auth authorization) (err error) {
 	return a.authBackend.addMonitoringAuth(auth.Key)
 }
 
+// addAdmin adds an authorization to enable the admin endpoints
+func (a *autographer) addAdmin(auth authorization) (err error) {
+	if auth.Key == "" {
+		log.Infof("admin endpoints are disabled. No key found")
+		return nil
+	}
+	return a.authBackend.addAdminAuth(auth.Key)
+}
+
 // addAuthorizations reads a list of authorizations from the configuration and
 // stores them into the autographer handler as a map indexed by user id, for fast lookup.
 func (a *autographer) addAuthorizations(auths []authorization) (err error) {
@@ -37,7 +37,7 @@ func TestMain(m *testing.M) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = ag.addMonitoring(conf.Monitoring)
+	err = ag.addMonitoring(conf.Monitoring.authorization)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -61,7 +61,7 @@ func TestMain(m *testing.M) {
 	time.Sleep(time.Second)
 
 	// Initialize a monitor.
-	mo = newMonitor(ag, conf.MonitorInterval)
+	mo = newMonitor(ag, conf.MonitorInterval, conf.MonitorTimeout, conf.Monitoring.ExcludedSigners, conf.Monitoring.RootHash, conf.Monitoring.RootSPKIHash, conf.Monitoring.OptionVariants)
 
 	// run the tests and exit
 	r := m.Run()
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 
@@ -15,9 +16,11 @@ import (
 type authBackend interface {
 	addAuth(*authorization) error
 	addMonitoringAuth(string) error
+	addAdminAuth(string) error
 	getAuthByID(id string) (authorization, error)
 	addSigner(signer.Signer)
 	getSigners() []signer.Signer
+	replaceSigner(signer.Signer) (signer.Signer, error)
 	getSignerForUser(userID, signerID string) (signer.Signer, error)
 	getSignerIDsForUser(userID string) []string
 }
@@ -28,6 +31,9 @@ type inMemoryBackend struct {
 	auths       map[string]authorization
 	signerIndex map[string]int
 	signers     []signer.Signer
+
+	// Protects signers from concurrent replacement.
+	sync.RWMutex
 }
 
 // newInMemoryAuthBackend returns an empty inMemoryBackend
@@ -83,6 +89,22 @@ func (b *inMemoryBackend) addMonitoringAuth(monitorKey string) error {
 	})
 }
 
+// addAdminAuth adds an authorization to enable the admin endpoints
+func (b *inMemoryBackend) addAdminAuth(adminKey string) error {
+	_, err := b.getAuthByID(adminAuthID)
+	switch err {
+	case ErrAuthNotFound:
+	case nil:
+		return fmt.Errorf("user 'admin' is reserved for administration, duplication is not permitted")
+	default:
+		return fmt.Errorf("error fetching 'admin' auth: %q", err)
+	}
+	return b.addAuth(&authorization{
+		ID:  adminAuthID,
+		Key: adminKey,
+	})
+}
+
 // getSignerId returns the signer identifier for the user. If a keyid
 // is specified, the corresponding signer is returned. If no signer is
 // found, an error is returned and the signer identifier is set to -1.
@@ -99,12 +121,32 @@ func (b *inMemoryBackend) getSignerID(userid, keyid string) (int, error) {
 
 // addSigner adds a newly configured signer
 func (b *inMemoryBackend) addSigner(signer signer.Signer) {
+	b.Lock()
+	defer b.Unlock()
 	b.signers = append(b.signers, signer)
 }
 
-// getSigners returns all configured signers
+// getSigners returns a copy of all configured signers
 func (b *inMemoryBackend) getSigners() []signer.Signer {
-	return b.signers
+	b.RLock()
+	defer b.RUnlock()
+	signers := make([]signer.Signer, len(b.signers))
+	copy(signers, b.signers)
+	return signers
+}
+
+// replaceSigner swaps the configured signer with the same ID as the
+// provided signer and returns the replaced signer or an error
+func (b *inMemoryBackend) replaceSigner(newSigner signer.Signer) (signer.Signer, error) {
+	b.Lock()
+	defer b.Unlock()
+	for pos, s := range b.signers {
+		if s.Config().ID == newSigner.Config().ID {
+			b.signers[pos] = newSigner
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("signer id %q was not found in the list of known signers", newSigner.Config().ID)
 }
 
 // getSignerForUser returns the signer with the given ID for the
@@ -114,7 +156,9 @@ func (b *inMemoryBackend) getSignerForUser(userID, signerID string) (signer.Sign
 	if err != nil || signerIndexID < 0 {
 		return nil, err
 	}
-	return b.getSigners()[signerIndexID], nil
+	b.RLock()
+	defer b.RUnlock()
+	return b.signers[signerIndexID], nil
 }
 
 // getSignerIDsForUser returns all the signer IDs a user can sign with as a sorted slice
@@ -145,8 +189,8 @@ func splitSignerIndexTag(tag string) (authID, signerID string) {
 
 // addAuthToSignerIndex
 func (b *inMemoryBackend) addAuthToSignerIndex(auth *authorization) error {
-	// the "monitor" authorization is doesn't need a signer index
-	if auth.ID == monitorAuthID {
+	// the "monitor" and "admin" authorizations don't need a signer index
+	if auth.ID == monitorAuthID || auth.ID == adminAuthID {
 		return nil
 	}
 	// authorization must have a signer configured
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"compress/gzip"
+	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// maxDecompressedBodySize is the maximum size of a decompressed
+// request body, the maximum size of a signing request
+const maxDecompressedBodySize = 1048576000
+
 // Middleware wraps an http.Handler with additional functionality
 type Middleware func(http.Handler) http.Handler
 
@@ -48,6 +57,131 @@ func setRequestStartTime() Middleware {
 	}
 }
 
+// decompressRequestBody is a middleware that decompresses the body of
+// requests with a gzip Content-Encoding, so handlers read and HAWK
+// authorizes the decompressed body. Requests with another encoding
+// are refused.
+func decompressRequestBody() Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+			case "", "identity":
+			case "gzip":
+				gz, err := gzip.NewReader(r.Body)
+				if err != nil {
+					httpError(w, r, http.StatusBadRequest, "failed to decompress gzip request body: %s", err)
+					return
+				}
+				defer gz.Close()
+				r.Body = http.MaxBytesReader(w, gzipRequestBody{gz, r.Body}, maxDecompressedBodySize)
+				r.Header.Del("Content-Encoding")
+				r.Header.Del("Content-Length")
+				r.ContentLength = -1
+			default:
+				httpError(w, r, http.StatusUnsupportedMediaType, "unsupported content encoding %q, expected gzip", r.Header.Get("Content-Encoding"))
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// gzipRequestBody reads the decompressed body of a request and closes
+// its compressed body
+type gzipRequestBody struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (b gzipRequestBody) Close() error {
+	return b.body.Close()
+}
+
+// compressResponseBody is a middleware that gzips the response bodies
+// of requests whose Accept-Encoding accepts gzip
+func compressResponseBody() Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			gzw := &gzipResponseWriter{ResponseWriter: w}
+			defer gzw.Close()
+			h.ServeHTTP(gzw, r)
+		})
+	}
+}
+
+// acceptsGzip returns whether an Accept-Encoding header accepts gzip,
+// which it does when it lists gzip or * without a zero quality value
+func acceptsGzip(acceptEncoding string) bool {
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		accepted := true
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+			accepted = err == nil && q > 0
+		}
+		if accepted {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter gzips the body of a response, unless the response
+// has no body or is already encoded
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if status != http.StatusNoContent && status != http.StatusNotModified && w.Header().Get("Content-Encoding") == "" {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+// Close flushes the gzipped body of the response
+func (w *gzipResponseWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	err := w.gz.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close gzip response writer: %w", err)
+	}
+	return nil
+}
+
 //  Run the request through all middlewares
 func handleMiddlewares(h http.Handler, adapters ...Middleware) http.Handler {
 	// To make the middleware run in the order in which they are specified,
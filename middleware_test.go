@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func mustGzip(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gz.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompressRequestBody(t *testing.T) {
+	t.Parallel()
+
+	input := []byte(`[{"input": "Y2FyaWJvdW1hdXJpY2UK", "keyid": "appkey1"}]`)
+	echo := handleMiddlewares(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			http.Error(w, "content encoding was not removed", http.StatusInternalServerError)
+			return
+		}
+		w.Write(body)
+	}), decompressRequestBody())
+
+	var TESTCASES = []struct {
+		contentEncoding string
+		body            []byte
+		expectedStatus  int
+		expectedBody    []byte
+	}{
+		{"", input, http.StatusOK, input},
+		{"identity", input, http.StatusOK, input},
+		{"gzip", mustGzip(t, input), http.StatusOK, input},
+		{"GZIP", mustGzip(t, input), http.StatusOK, input},
+		{"gzip", input, http.StatusBadRequest, nil},
+		{"br", input, http.StatusUnsupportedMediaType, nil},
+	}
+	for i, testcase := range TESTCASES {
+		req := httptest.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(testcase.body))
+		if testcase.contentEncoding != "" {
+			req.Header.Set("Content-Encoding", testcase.contentEncoding)
+		}
+		w := httptest.NewRecorder()
+		echo.ServeHTTP(w, req)
+		if w.Code != testcase.expectedStatus {
+			t.Fatalf("test case %d expected status %d but got %d: %s", i, testcase.expectedStatus, w.Code, w.Body.String())
+		}
+		if testcase.expectedBody != nil && !bytes.Equal(w.Body.Bytes(), testcase.expectedBody) {
+			t.Fatalf("test case %d expected body %q but got %q", i, testcase.expectedBody, w.Body.Bytes())
+		}
+	}
+}
+
+func TestCompressResponseBody(t *testing.T) {
+	t.Parallel()
+
+	output := []byte(`[{"ref": "7khgpu4gcfdv30w8joqxjy1cc", "signature": "MIIGPQYJKoZIhvcN"}]`)
+	handler := handleMiddlewares(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/empty" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(output)
+	}), compressResponseBody())
+
+	var TESTCASES = []struct {
+		path           string
+		acceptEncoding string
+		expectGzip     bool
+	}{
+		{"/sign/data", "", false},
+		{"/sign/data", "gzip", true},
+		{"/sign/data", "deflate, gzip;q=0.5", true},
+		{"/sign/data", "*", true},
+		{"/sign/data", "gzip;q=0", false},
+		{"/sign/data", "deflate, br", false},
+		{"/empty", "gzip", false},
+	}
+	for i, testcase := range TESTCASES {
+		req := httptest.NewRequest("GET", "http://foo.bar"+testcase.path, nil)
+		if testcase.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", testcase.acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("test case %d expected Vary: Accept-Encoding header but got %q", i, w.Header().Get("Vary"))
+		}
+		if !testcase.expectGzip {
+			if w.Header().Get("Content-Encoding") != "" {
+				t.Fatalf("test case %d expected no content encoding but got %q", i, w.Header().Get("Content-Encoding"))
+			}
+			continue
+		}
+		if w.Header().Get("Content-Encoding") != "gzip" {
+			t.Fatalf("test case %d expected gzip content encoding but got %q", i, w.Header().Get("Content-Encoding"))
+		}
+		gz, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("test case %d failed to read gzip response: %v", i, err)
+		}
+		body, err := ioutil.ReadAll(gz)
+		if err != nil {
+			t.Fatalf("test case %d failed to decompress response: %v", i, err)
+		}
+		if !bytes.Equal(body, output) {
+			t.Fatalf("test case %d expected body %q but got %q", i, output, body)
+		}
+	}
+}
+
+func TestGzipSignatureRequest(t *testing.T) {
+	t.Parallel()
+
+	body := []byte(`[{"input": "Y2FyaWJvdW1hdXJpY2UK", "keyid": "` + conf.Signers[0].ID + `"}]`)
+	auth, err := ag.getAuthByID(conf.Authorizations[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := handleMiddlewares(http.HandlerFunc(ag.handleSignature), decompressRequestBody())
+	for i, hashedBody := range [][]byte{body, mustGzip(t, body)} {
+		req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(mustGzip(t, body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key,
+			sha256.New, id(), "application/json", hashedBody))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		// the payload hash covers the decompressed body
+		expectedStatus := http.StatusCreated
+		if i == 1 {
+			expectedStatus = http.StatusUnauthorized
+		}
+		if w.Code != expectedStatus {
+			t.Fatalf("test case %d expected status %d but got %d: %s", i, expectedStatus, w.Code, w.Body.String())
+		}
+	}
+}
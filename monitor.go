@@ -1,35 +1,102 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"github.com/mozilla-services/autograph/formats"
 	"github.com/mozilla-services/autograph/signer"
+	"github.com/mozilla-services/autograph/signer/apk2"
+	"github.com/mozilla-services/autograph/signer/contentsignaturepki"
+	"github.com/mozilla-services/autograph/verifier"
 	log "github.com/sirupsen/logrus"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
 
+// DefaultMonitorTimeout is how long the monitor handler waits for the
+// results of the signers by default, it is below the 30s timeout of
+// common scrapers
+const DefaultMonitorTimeout = 20 * time.Second
+
+// monitoringConfig is the authorization of the monitor user and the
+// signers the monitor does not check
+type monitoringConfig struct {
+	authorization `yaml:",inline"`
+
+	// ExcludedSigners are the IDs of the signers excluded from the
+	// monitor checks, e.g. while their HSM is under maintenance
+	ExcludedSigners []string
+
+	// RootHash is the hex encoded SHA256 fingerprint of the root
+	// certificate the chains of contentsignaturepki signers must
+	// chain to. When empty, each chain is verified against the root
+	// in the cacert of its signer.
+	RootHash string
+
+	// RootSPKIHash is the hex encoded SHA256 of the
+	// SubjectPublicKeyInfo of the root certificate the chains of
+	// contentsignaturepki signers must chain to. When it and
+	// RootHash are empty, each chain is pinned to the key of the
+	// root in the cacert of its signer.
+	RootSPKIHash string
+
+	// OptionVariants are, by signer ID, the signing options the
+	// monitor checks a signer with in addition to its default
+	// options, so a broken non-default mode like the v3 signatures
+	// of an apk2 signer fails its check before a client uses it
+	OptionVariants map[string][]map[string]interface{}
+}
+
 // A monitor of signer health
 type monitor struct {
-	// Read-only.
-	signers []signer.Signer
+	// Proxy to autographer.getSigners, signers are looked up on
+	// every check so that rotated keys are monitored.
+	getSigners func() []signer.Signer
+
+	// IDs of the signers that are not checked.
+	excluded map[string]bool
+
+	// Signing options each signer is also checked with, by ID.
+	optionVariants map[string][]map[string]interface{}
 
-	// Results from checking signers.
+	// Results from checking signers, with a signature response for
+	// the default options and each option variant of a signer.
 	sigerrstrs []string
-	sigresps   []formats.SignatureResponse
+	sigresps   [][]formats.SignatureResponse
 
-	// Protects sigerrstrs and sigresps.
+	// Whether each signer has completed a check, and the start
+	// time of its running check or zero when it is not running.
+	checked     []bool
+	checkStarts []time.Time
+
+	// Duration of the latest completed check of each signer.
+	latencies []time.Duration
+
+	// Protects sigerrstrs, sigresps, checked, checkStarts and latencies.
 	sync.RWMutex
 
 	// Used to signal, by closing it, that the results
 	// have been populated with an initial check
 	initialized chan interface{}
 
+	// How long the handler waits for the initial check, and after
+	// which a running check is reported as timed out.
+	timeout time.Duration
+
 	// Proxy to autographer.authorize.
 	authorize func(r *http.Request, body []byte) (userid string, err error)
 
+	// Verifies the chain and signature of a contentsignaturepki
+	// response against the monitoring root hash.
+	verifyContentSignaturePKI func(sigresp formats.SignatureResponse) error
+
 	// Copy of autographer.debug.
 	debug bool
 
@@ -47,8 +114,11 @@ func (m *monitor) start(duration time.Duration) {
 	defer ticker.Stop()
 
 	// Perform an initial check.
-	m.checkSigners()
-	close(m.initialized)
+	initialCheck := m.checkSigners()
+	go func() {
+		<-initialCheck
+		close(m.initialized)
+	}()
 
 	for {
 		select {
@@ -60,82 +130,249 @@ func (m *monitor) start(duration time.Duration) {
 	}
 }
 
-func (m *monitor) checkSigners() {
+// checkSigners checks each signer concurrently and returns a channel
+// closed when the checks complete. Signers whose previous check is
+// still running are not checked again, so a hung signer does not pile
+// up checks.
+func (m *monitor) checkSigners() (done chan interface{}) {
 	m.Lock()
 	defer m.Unlock()
 
-	for i, s := range m.signers {
-		// First try the DataSigner interface. If the signer doesn't
-		// implement it, try the FileSigner interface. If that's still
-		// not implemented, return an error.
-		if _, ok := s.(signer.DataSigner); ok {
-			// sign with data set to the base64 of the string 'AUTOGRAPH MONITORING'
-			sig, err := s.(signer.DataSigner).SignData(MonitoringInputData, s.(signer.DataSigner).GetDefaultOptions())
-			if err != nil {
-				m.sigerrstrs[i] = fmt.Sprintf("signing failed with error: %v", err)
-				continue
+	var wg sync.WaitGroup
+	for i, s := range m.getSigners() {
+		if m.excluded[s.Config().ID] {
+			continue
+		}
+		if !m.checkStarts[i].IsZero() {
+			log.Warnf("monitor: signer %q is still running the check started at %s", s.Config().ID, m.checkStarts[i])
+			continue
+		}
+		m.checkStarts[i] = time.Now()
+		wg.Add(1)
+		go func(i int, s signer.Signer, start time.Time) {
+			defer wg.Done()
+			sigresps, errstr := m.checkSignerVariants(s)
+			var checkErr error
+			if errstr != "" {
+				checkErr = errors.New(errstr)
 			}
+			signer.ObserveMonitorCheck(s.Config(), start, checkErr)
 
-			encodedsig, err := sig.Marshal()
+			m.Lock()
+			defer m.Unlock()
+			m.sigresps[i] = sigresps
+			m.sigerrstrs[i] = errstr
+			m.checked[i] = true
+			m.checkStarts[i] = time.Time{}
+			m.latencies[i] = time.Since(start)
+		}(i, s, m.checkStarts[i])
+	}
+	done = make(chan interface{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// checkSignerVariants checks a signer with its default options, then
+// with each of its option variants, and returns their signature
+// responses or the error of the first check that failed
+func (m *monitor) checkSignerVariants(s signer.Signer) (sigresps []formats.SignatureResponse, errstr string) {
+	variants := append([]map[string]interface{}{nil}, m.optionVariants[s.Config().ID]...)
+	for i, options := range variants {
+		sigresp, errstr := checkSigner(s, options)
+		if errstr == "" && sigresp.Type == contentsignaturepki.Type {
+			err := m.verifyContentSignaturePKI(sigresp)
 			if err != nil {
-				m.sigerrstrs[i] = fmt.Sprintf("encoding failed with error: %v", err)
-				continue
+				errstr = fmt.Sprintf("verification failed with error: %v", err)
 			}
-			m.sigerrstrs[i] = ""
-			m.sigresps[i] = formats.SignatureResponse{
-				Ref:        id(),
-				Type:       s.Config().Type,
-				Mode:       s.Config().Mode,
-				SignerID:   s.Config().ID,
-				PublicKey:  s.Config().PublicKey,
-				Signature:  encodedsig,
-				X5U:        s.Config().X5U,
-				SignerOpts: s.Config().SignerOpts,
-			}
-			continue
 		}
-
-		if _, ok := s.(signer.FileSigner); ok {
-			// Signers that only implement the FileSigner interface must
-			// also implement the TestFileGetter interface to return a valid
-			// test file that can be used here to monitor the signer.
-			if _, ok := s.(signer.TestFileGetter); !ok {
-				m.sigerrstrs[i] = fmt.Sprintf("signer %q implements FileSigner but not the TestFileGetter interface", s.Config().ID)
-				continue
-			}
-			output, err := s.(signer.FileSigner).SignFile(s.(signer.TestFileGetter).GetTestFile(), s.(signer.FileSigner).GetDefaultOptions())
+		if errstr == "" && sigresp.Type == apk2.Type {
+			err := verifyAPKSourceStamp(s, sigresp, m.timeout)
 			if err != nil {
-				m.sigerrstrs[i] = fmt.Sprintf("signing failed with error: %v", err)
-				continue
+				errstr = fmt.Sprintf("source stamp verification failed with error: %v", err)
 			}
-			signedfile := base64.StdEncoding.EncodeToString(output)
-			m.sigerrstrs[i] = ""
-			m.sigresps[i] = formats.SignatureResponse{
-				Ref:        id(),
-				Type:       s.Config().Type,
-				Mode:       s.Config().Mode,
-				SignerID:   s.Config().ID,
-				PublicKey:  s.Config().PublicKey,
-				SignedFile: signedfile,
-				X5U:        s.Config().X5U,
-				SignerOpts: s.Config().SignerOpts,
+		}
+		if errstr != "" {
+			if i > 0 {
+				errstr = fmt.Sprintf("option variant %d: %s", i, errstr)
 			}
-			continue
+			return sigresps, errstr
+		}
+		sigresps = append(sigresps, sigresp)
+	}
+	return sigresps, ""
+}
+
+// checkSigner signs the monitoring input or test file with a signer
+// and options, or its default options when they are nil, and returns
+// the signature response or the error of the check
+func checkSigner(s signer.Signer, options map[string]interface{}) (sigresp formats.SignatureResponse, errstr string) {
+	// bypass the signer policies, they apply to signing requests
+	s = signer.Unwrap(s)
+
+	// First try the DataSigner interface. If the signer doesn't
+	// implement it or prefers its test file, try the FileSigner
+	// interface. If that's still not implemented, return an error.
+	if _, ok := s.(signer.DataSigner); ok && !signer.UsesTestFile(s) {
+		// sign with data set to the base64 of the string 'AUTOGRAPH MONITORING'
+		var opts interface{} = s.(signer.DataSigner).GetDefaultOptions()
+		if options != nil {
+			opts = options
+		}
+		sig, err := s.(signer.DataSigner).SignData(MonitoringInputData, opts)
+		if err != nil {
+			return sigresp, fmt.Sprintf("signing failed with error: %v", err)
+		}
+
+		encodedsig, err := sig.Marshal()
+		if err != nil {
+			return sigresp, fmt.Sprintf("encoding failed with error: %v", err)
+		}
+		sigresp = formats.SignatureResponse{
+			Ref:        id(),
+			Type:       s.Config().Type,
+			Mode:       s.Config().Mode,
+			SignerID:   s.Config().ID,
+			PublicKey:  s.Config().PublicKey,
+			Signature:  encodedsig,
+			X5U:        s.Config().X5U,
+			SignerOpts: s.Config().SignerOpts,
+			Options:    options,
 		}
+		sigresp.CertificateInfo = getSignerCertificateInfo(s)
+		if toolVersioner, ok := s.(signer.ToolVersioner); ok {
+			sigresp.ToolVersion = toolVersioner.ToolVersion()
+		}
+		sigresp.SignedAt = time.Now()
+		sigresp.AutographVersion = autographVersion
+		return sigresp, ""
+	}
+
+	if _, ok := s.(signer.FileSigner); ok {
+		// Signers that only implement the FileSigner interface must
+		// also implement the TestFileGetter interface to return a valid
+		// test file that can be used here to monitor the signer.
+		if _, ok := s.(signer.TestFileGetter); !ok {
+			return sigresp, fmt.Sprintf("signer %q implements FileSigner but not the TestFileGetter interface", s.Config().ID)
+		}
+		var opts interface{} = s.(signer.FileSigner).GetDefaultOptions()
+		if options != nil {
+			opts = options
+		}
+		output, err := s.(signer.FileSigner).SignFile(s.(signer.TestFileGetter).GetTestFile(), opts)
+		if err != nil {
+			return sigresp, fmt.Sprintf("signing failed with error: %v", err)
+		}
+		signedfile := base64.StdEncoding.EncodeToString(output)
+		sigresp = formats.SignatureResponse{
+			Ref:        id(),
+			Type:       s.Config().Type,
+			Mode:       s.Config().Mode,
+			SignerID:   s.Config().ID,
+			PublicKey:  s.Config().PublicKey,
+			SignedFile: signedfile,
+			X5U:        s.Config().X5U,
+			SignerOpts: s.Config().SignerOpts,
+			Options:    options,
+		}
+		sigresp.CertificateInfo = getSignerCertificateInfo(s)
+		if toolVersioner, ok := s.(signer.ToolVersioner); ok {
+			sigresp.ToolVersion = toolVersioner.ToolVersion()
+		}
+		sigresp.SignedAt = time.Now()
+		sigresp.AutographVersion = autographVersion
+		return sigresp, ""
+	}
+
+	return sigresp, fmt.Sprintf("signer %q does not implement DataSigner or FileSigner interfaces", s.Config().ID)
+}
+
+// verifyAPKSourceStamp verifies the source stamp of the signed file of
+// an apk2 signer that adds source stamps, so the monitor checks the
+// stamp signer works and not just the main signature
+func verifyAPKSourceStamp(s signer.Signer, sigresp formats.SignatureResponse, timeout time.Duration) error {
+	apkSigner, ok := signer.Unwrap(s).(*apk2.APK2Signer)
+	if !ok || !apkSigner.HasSourceStamp() {
+		return nil
+	}
+	signedAPK, err := base64.StdEncoding.DecodeString(sigresp.SignedFile)
+	if err != nil {
+		return fmt.Errorf("failed to decode signed file: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return apkSigner.VerifySourceStamp(ctx, signedAPK)
+}
+
+// timedOut returns whether the check of signer i has not completed
+// within the monitor timeout. The caller must hold the lock.
+func (m *monitor) timedOut(i int) bool {
+	if !m.checked[i] {
+		return true
+	}
+	return !m.checkStarts[i].IsZero() && time.Since(m.checkStarts[i]) > m.timeout
+}
 
-		m.sigerrstrs[i] = fmt.Sprintf("signer %q does not implement DataSigner or FileSigner interfaces", s.Config().ID)
+// getSignerCertificateInfo returns the fields of the certificate a
+// signer parsed at initialization, or the fields of the certificate
+// of its configuration for signers that do not parse it
+func getSignerCertificateInfo(s signer.Signer) *formats.CertificateInfo {
+	if certificateInfoer, ok := signer.Unwrap(s).(signer.CertificateInfoer); ok {
+		return certificateInfoer.CertificateInfo()
 	}
+	return signerCertificateInfo(s.Config())
 }
 
-func newMonitor(ag *autographer, duration time.Duration) *monitor {
+// signerCertificateInfo returns the fields of the certificate of a
+// signer, or nil when it has no certificate or it fails to parse
+func signerCertificateInfo(conf signer.Configuration) *formats.CertificateInfo {
+	if conf.Certificate == "" {
+		return nil
+	}
+	info, err := signer.ParseCertificateInfo(conf.Certificate)
+	if err != nil {
+		log.Warnf("monitor: failed to parse the certificate of signer %q: %v", conf.ID, err)
+		return nil
+	}
+	return info
+}
+
+func newMonitor(ag *autographer, duration, timeout time.Duration, excludedSigners []string, rootHash, rootSPKIHash string, optionVariants map[string][]map[string]interface{}) *monitor {
 	m := new(monitor)
 	m.authorize = func(r *http.Request, body []byte) (userid string, err error) {
 		return ag.authorize(r, body)
 	}
+	m.verifyContentSignaturePKI = func(sigresp formats.SignatureResponse) error {
+		return ag.verifyMonitoringContentSignaturePKI(sigresp, rootHash, rootSPKIHash)
+	}
+	m.getSigners = ag.getSigners
 	signers := ag.getSigners()
-	m.signers = signers
+	m.excluded = make(map[string]bool, len(excludedSigners))
+	for _, id := range excludedSigners {
+		if _, ok := ag.getSignerConf(id); !ok {
+			log.Warnf("monitor: excluded signer %q is not configured", id)
+		}
+		log.Infof("monitor: excluding signer %q from the monitor checks", id)
+		m.excluded[id] = true
+	}
+	m.optionVariants = optionVariants
+	for id, variants := range optionVariants {
+		if _, ok := ag.getSignerConf(id); !ok {
+			log.Warnf("monitor: signer %q with option variants is not configured", id)
+		}
+		log.Infof("monitor: checking signer %q with %d option variants", id, len(variants))
+	}
 	m.sigerrstrs = make([]string, len(signers))
-	m.sigresps = make([]formats.SignatureResponse, len(signers))
+	m.sigresps = make([][]formats.SignatureResponse, len(signers))
+	m.checked = make([]bool, len(signers))
+	m.checkStarts = make([]time.Time, len(signers))
+	m.latencies = make([]time.Duration, len(signers))
+	m.timeout = timeout
+	if m.timeout <= 0 {
+		m.timeout = DefaultMonitorTimeout
+	}
 	m.initialized = make(chan interface{})
 	m.exit = ag.exit
 	m.debug = ag.debug
@@ -144,3 +381,42 @@ func newMonitor(ag *autographer, duration time.Duration) *monitor {
 
 	return m
 }
+
+// verifyMonitoringContentSignaturePKI verifies the signature of a
+// contentsignaturepki monitoring response with the chain at its x5u,
+// and that the chain goes to the root with rootHash, or to the cacert
+// of the signer when rootHash is empty, and to the key with
+// rootSPKIHash, or the key of the cacert when both are empty
+func (a *autographer) verifyMonitoringContentSignaturePKI(sigresp formats.SignatureResponse, rootHash, rootSPKIHash string) error {
+	signerConf, ok := a.getSignerConf(sigresp.SignerID)
+	if !ok {
+		return fmt.Errorf("signer %q is not configured", sigresp.SignerID)
+	}
+	if rootHash == "" {
+		block, _ := pem.Decode([]byte(signerConf.CaCert))
+		if block == nil {
+			return fmt.Errorf("failed to parse the root certificate of signer %q", sigresp.SignerID)
+		}
+		root, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("failed to parse the root certificate of signer %q: %w", sigresp.SignerID, err)
+		}
+		hash := sha256.Sum256(block.Bytes)
+		rootHash = fmt.Sprintf("%X", hash[:])
+		if rootSPKIHash == "" {
+			rootSPKIHash = contentsignaturepki.SPKIFingerprint(root)
+		}
+	}
+	err := verifier.VerifyResponse(sigresp, MonitoringInputData, verifier.VerifyOptions{
+		RootHash:     strings.ToUpper(rootHash),
+		RootSPKIHash: rootSPKIHash,
+		FetchX5U: func(x5u string) ([]byte, error) {
+			return a.getX5U(x5u, signerConf.X5UMaxChainSize)
+		},
+		Now: a.now,
+	})
+	if err != nil {
+		return fmt.Errorf("content signature of signer %q does not verify with root hash %s: %w", sigresp.SignerID, rootHash, err)
+	}
+	return nil
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"time"
 
+	"github.com/mozilla-services/autograph/formats"
+
 	log "github.com/sirupsen/logrus"
 )
 
@@ -13,43 +16,85 @@ const monitorAuthID = "monitor"
 // MonitoringInputData is the data signed by the monitoring handler
 var MonitoringInputData = []byte(`AUTOGRAPH MONITORING`)
 
-func (m *monitor) handleMonitor(w http.ResponseWriter, r *http.Request) {
-	rid := getRequestID(r)
-	starttime := time.Now()
+// authorizeMonitor verifies the request is made by the monitor user,
+// and writes an error response otherwise
+func (m *monitor) authorizeMonitor(w http.ResponseWriter, r *http.Request) (userid string, ok bool) {
 	userid, err := m.authorize(r, []byte(""))
 	if err != nil {
 		httpError(w, r, http.StatusUnauthorized, "authorization verification failed: %v", err)
-		return
+		return "", false
 	}
 	if userid != monitorAuthID {
 		httpError(w, r, http.StatusUnauthorized, "user is not permitted to call this endpoint")
-		return
+		return "", false
 	}
+	return userid, true
+}
+
+// waitInitialized waits until the results have been populated with an
+// initial check, or until the timeout to report the signers that have
+// not completed it as timed out
+func (m *monitor) waitInitialized() {
+	timeout := time.NewTimer(m.timeout)
+	defer timeout.Stop()
+	select {
+	case <-m.initialized:
+	case <-timeout.C:
+		log.Warnf("monitor: initial check did not complete within %s", m.timeout)
+	}
+}
 
-	// Wait until the results have been populated with an initial check
-	<-m.initialized
+func (m *monitor) handleMonitor(w http.ResponseWriter, r *http.Request) {
+	rid := getRequestID(r)
+	starttime := time.Now()
+	userid, ok := m.authorizeMonitor(w, r)
+	if !ok {
+		return
+	}
+	m.waitInitialized()
 
+	signers := m.getSigners()
 	m.RLock()
 	defer m.RUnlock()
 
-	for _, errstr := range m.sigerrstrs {
-		if errstr != "" {
+	for i, errstr := range m.sigerrstrs {
+		if errstr != "" && !m.timedOut(i) {
 			httpError(w, r, http.StatusInternalServerError, errstr)
 			return
 		}
 	}
 
 	if m.debug {
-		log.Printf("signature response: %s", m.sigresps)
+		log.Printf("signature response: %v", m.sigresps)
 	}
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 
 	enc := json.NewEncoder(w)
-	for _, response := range m.sigresps {
-		if err := enc.Encode(&response); err != nil {
-			httpError(w, r, http.StatusInternalServerError, "encoding failed with error: %v", err)
-			return
+	for i, responses := range m.sigresps {
+		if i < len(signers) && m.excluded[signers[i].Config().ID] {
+			conf := signers[i].Config()
+			responses = []formats.SignatureResponse{{
+				Type:     conf.Type,
+				Mode:     conf.Mode,
+				SignerID: conf.ID,
+				Skipped:  true,
+			}}
+		} else if m.timedOut(i) && i < len(signers) {
+			conf := signers[i].Config()
+			log.Warnf("monitor: signer %q did not complete its check within %s", conf.ID, m.timeout)
+			responses = []formats.SignatureResponse{{
+				Type:     conf.Type,
+				Mode:     conf.Mode,
+				SignerID: conf.ID,
+				TimedOut: true,
+			}}
+		}
+		for _, response := range responses {
+			if err := enc.Encode(&response); err != nil {
+				httpError(w, r, http.StatusInternalServerError, "encoding failed with error: %v", err)
+				return
+			}
 		}
 	}
 
@@ -59,3 +104,76 @@ func (m *monitor) handleMonitor(w http.ResponseWriter, r *http.Request) {
 		"t":       int32(time.Since(starttime) / time.Millisecond), //  request processing time in ms
 	}).Info("monitoring operation succeeded")
 }
+
+// handleMonitorHealth returns the result of the latest check of each
+// signer by signer ID, without their signatures. It returns a 500
+// status when a signer failed or timed out its check, excluded signers
+// are returned as skipped.
+func (m *monitor) handleMonitorHealth(w http.ResponseWriter, r *http.Request) {
+	rid := getRequestID(r)
+	starttime := time.Now()
+	userid, ok := m.authorizeMonitor(w, r)
+	if !ok {
+		return
+	}
+	m.waitInitialized()
+
+	signers := m.getSigners()
+	m.RLock()
+	health := make(map[string]formats.SignerHealth, len(signers))
+	status := http.StatusOK
+	for i, s := range signers {
+		if i >= len(m.checked) {
+			break
+		}
+		id := s.Config().ID
+		switch {
+		case m.excluded[id]:
+			health[id] = formats.SignerHealth{
+				Error:   "excluded from the monitor checks",
+				Skipped: true,
+			}
+			continue
+		case m.timedOut(i):
+			var latency time.Duration
+			if !m.checkStarts[i].IsZero() {
+				latency = time.Since(m.checkStarts[i])
+			}
+			health[id] = formats.SignerHealth{
+				Error:     fmt.Sprintf("check did not complete within %s", m.timeout),
+				LatencyMs: int64(latency / time.Millisecond),
+			}
+		default:
+			health[id] = formats.SignerHealth{
+				OK:        m.sigerrstrs[i] == "",
+				Error:     m.sigerrstrs[i],
+				LatencyMs: int64(m.latencies[i] / time.Millisecond),
+			}
+		}
+		conf := s.Config()
+		if info := getSignerCertificateInfo(s); info != nil && time.Until(info.NotAfter) < conf.CertExpiryWarningPeriod() {
+			signerHealth := health[id]
+			signerHealth.CertExpiresSoon = true
+			health[id] = signerHealth
+		}
+		if !health[id].OK {
+			status = http.StatusInternalServerError
+		}
+	}
+	m.RUnlock()
+
+	respdata, err := json.Marshal(health)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "encoding failed with error: %v", err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(respdata)
+
+	log.WithFields(log.Fields{
+		"rid":     rid,
+		"user_id": userid,
+		"t":       int32(time.Since(starttime) / time.Millisecond), //  request processing time in ms
+	}).Info("monitoring health operation succeeded")
+}
@@ -6,12 +6,10 @@ package main
 import (
 	"bytes"
 	"crypto/sha256"
-	"encoding/base64"
 	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
-	"strings"
 	"testing"
 
 	"github.com/mozilla-services/autograph/formats"
@@ -22,12 +20,9 @@ import (
 	"github.com/mozilla-services/autograph/signer/gpg2"
 	"github.com/mozilla-services/autograph/signer/mar"
 	"github.com/mozilla-services/autograph/signer/xpi"
-	csigverifier "github.com/mozilla-services/autograph/verifier/contentsignature"
-	margo "go.mozilla.org/mar"
+	"github.com/mozilla-services/autograph/verifier"
 )
 
-const autographDevRootHash = `5E:36:F2:14:DE:82:3F:8B:29:96:89:23:5F:03:41:AC:AF:A0:75:AF:82:CB:4C:D4:30:7C:3D:B3:43:39:2A:FE`
-
 func TestMonitorPass(t *testing.T) {
 	t.Parallel()
 
@@ -57,63 +52,28 @@ func TestMonitorPass(t *testing.T) {
 		}
 
 		switch response.Type {
-		case contentsignature.Type:
-			err = verifyContentSignatureResponse(
-				base64.StdEncoding.EncodeToString(MonitoringInputData),
-				response,
-				"/__monitor__")
-			if err != nil {
-				t.Logf("%+v", response)
-				t.Fatalf("verification of monitoring response failed: %v", err)
-			}
-		case contentsignaturepki.Type:
-			body, _, err := contentsignaturepki.GetX5U(&http.Client{}, response.X5U)
-			if err != nil {
-				t.Fatal(err)
-			}
-			err = csigverifier.Verify(MonitoringInputData, body, response.Signature, autographDevRootHash)
-			if err != nil {
-				t.Logf("%+v", response)
-				t.Fatalf("verification of monitoring response failed: %v", err)
-			}
-		case xpi.Type:
-			err = verifyXPISignature(
-				base64.StdEncoding.EncodeToString(MonitoringInputData),
-				response.Signature)
-			if err != nil {
-				t.Logf("%+v", response)
-				t.Fatalf("verification of monitoring response failed: %v", err)
-			}
-		case apk2.Type:
-			signedfile, err := base64.StdEncoding.DecodeString(response.SignedFile)
-			if err != nil {
-				t.Fatalf("failed to base64 decode signed file")
-			}
-			// TODO: add support for EC keys and verification to mozilla/pkcs7
-			if !strings.HasPrefix(response.SignerID, "apk_cert_with_ecdsa") {
-				err = verifyAPKSignature(signedfile)
-				if err != nil {
-					t.Fatalf("verification of monitoring response failed: %v", err)
+		case contentsignature.Type, contentsignaturepki.Type, xpi.Type, mar.Type, genericrsa.Type, apk2.Type:
+			opts := verifier.VerifyOptions{RootHash: conf.Monitoring.RootHash}
+			if response.Type == apk2.Type {
+				for _, s := range ag.getSigners() {
+					if s.Config().ID == response.SignerID {
+						opts.APKCertificate, err = parsePEMCertificate(s.Config().Certificate)
+						if err != nil {
+							t.Fatal(err)
+						}
+					}
 				}
 			}
-		case mar.Type:
-			err = verifyMARSignature(base64.StdEncoding.EncodeToString(MonitoringInputData),
-				response.Signature, response.PublicKey, margo.SigAlgRsaPkcs1Sha384)
+			err = verifier.VerifyResponse(response, MonitoringInputData, opts)
 			if err != nil {
 				t.Logf("%+v", response)
-				t.Fatalf("verification of monitoring response failed: %v", err)
+				t.Fatalf("verification of monitoring response of %q failed: %v", response.SignerID, err)
 			}
-		case genericrsa.Type:
-			err = genericrsa.VerifyGenericRsaSignatureResponse(MonitoringInputData, response)
+		case gpg2.Type:
+			err = gpg2.VerifyGPG2SignatureResponse(MonitoringInputData, response)
 			if err != nil {
-				t.Logf("%+v", response)
-				t.Fatalf("verification of monitoring response failed: %v", err)
+				t.Fatalf("verification of monitoring response of %q failed: %v", response.SignerID, err)
 			}
-		case gpg2.Type:
-			// we don't verify pgp signatures. I don't feel good about this, but the openpgp
-			// package is very much a pain to deal with and requires putting the public key
-			// into a keyring to verify a signature.
-			continue
 		default:
 			t.Fatalf("unsupported signature type %q", response.Type)
 		}
@@ -1,11 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/mozilla-services/autograph/formats"
+	"github.com/mozilla-services/autograph/signer"
 )
 
 func TestMonitorNoConfig(t *testing.T) {
@@ -13,7 +31,7 @@ func TestMonitorNoConfig(t *testing.T) {
 
 	tmpag := newAutographer(1)
 	var nomonitor configuration
-	tmpag.addMonitoring(nomonitor.Monitoring)
+	tmpag.addMonitoring(nomonitor.Monitoring.authorization)
 	_, err := tmpag.getAuthByID(monitorAuthID)
 	if err == nil {
 		t.Fatal("monitor configuration found when none was passed")
@@ -35,8 +53,8 @@ func TestMonitorAddDuplicate(t *testing.T) {
 		}
 	}()
 	// Adding the first one will pass, adding the second one will trigger the panic
-	tmpag.addMonitoring(monitorconf.Monitoring)
-	tmpag.addMonitoring(monitorconf.Monitoring)
+	tmpag.addMonitoring(monitorconf.Monitoring.authorization)
+	tmpag.addMonitoring(monitorconf.Monitoring.authorization)
 }
 
 func TestMonitorBadRequest(t *testing.T) {
@@ -77,3 +95,498 @@ func TestMonitorBadRequest(t *testing.T) {
 		}
 	}
 }
+
+// hangingSigner is a data signer that blocks signing until release
+// is closed
+type hangingSigner struct {
+	signer.Configuration
+	release chan interface{}
+}
+
+func (s *hangingSigner) Config() signer.Configuration {
+	return s.Configuration
+}
+
+func (s *hangingSigner) SignData(data []byte, options interface{}) (signer.Signature, error) {
+	<-s.release
+	return nil, fmt.Errorf("hanging signer released")
+}
+
+func (s *hangingSigner) GetDefaultOptions() interface{} {
+	return nil
+}
+
+// monitorResponses requests the monitor as the monitor user and
+// returns the status and the decoded signature responses
+func monitorResponses(t *testing.T, m *monitor, key string) (int, []formats.SignatureResponse) {
+	var empty []byte
+	req, err := http.NewRequest("GET", "http://foo.bar/__monitor__", bytes.NewReader(empty))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", getAuthHeader(req, monitorAuthID, key, sha256.New, id(), "application/json", empty))
+	w := httptest.NewRecorder()
+	m.handleMonitor(w, req)
+	var responses []formats.SignatureResponse
+	dec := json.NewDecoder(w.Body)
+	for w.Code == http.StatusCreated {
+		var response formats.SignatureResponse
+		if err := dec.Decode(&response); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		responses = append(responses, response)
+	}
+	return w.Code, responses
+}
+
+func TestMonitorTimeout(t *testing.T) {
+	t.Parallel()
+
+	var appkeyConf signer.Configuration
+	for _, signerConf := range conf.Signers {
+		if signerConf.ID == "appkey1" {
+			appkeyConf = signerConf
+		}
+	}
+	tmpag := newAutographer(1)
+	err := tmpag.addSigners([]signer.Configuration{appkeyConf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hanging := &hangingSigner{
+		Configuration: signer.Configuration{ID: "hanging", Type: "contentsignature"},
+		release:       make(chan interface{}),
+	}
+	tmpag.addSigner(hanging)
+	err = tmpag.addMonitoring(authorization{Key: "monitorkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	defer close(tmpag.exit)
+	m := newMonitor(tmpag, time.Hour, 100*time.Millisecond, nil, "", "", nil)
+
+	// the hanging signer is reported as timed out once the timeout expires
+	starttime := time.Now()
+	code, responses := monitorResponses(t, m, "monitorkey")
+	if code != http.StatusCreated {
+		t.Fatalf("expected monitor status %d but got %d", http.StatusCreated, code)
+	}
+	if time.Since(starttime) > 5*time.Second {
+		t.Fatalf("expected the monitor to return after its timeout but it took %s", time.Since(starttime))
+	}
+	if len(responses) != 2 {
+		t.Fatalf("expected 2 monitor responses but got %d", len(responses))
+	}
+	if responses[0].SignerID != appkeyConf.ID || responses[0].TimedOut || responses[0].Signature == "" {
+		t.Fatalf("expected a signature from %q but got %+v", appkeyConf.ID, responses[0])
+	}
+	if responses[1].SignerID != hanging.ID || !responses[1].TimedOut || responses[1].Signature != "" {
+		t.Fatalf("expected the check of %q to time out but got %+v", hanging.ID, responses[1])
+	}
+
+	// once released the check of the hanging signer completes and fails
+	close(hanging.release)
+	<-m.initialized
+	code, _ = monitorResponses(t, m, "monitorkey")
+	if code != http.StatusInternalServerError {
+		t.Fatalf("expected monitor status %d after the hanging signer fails but got %d", http.StatusInternalServerError, code)
+	}
+}
+
+// monitorHealth requests the monitor health as a user and returns the
+// status and the decoded signer health
+func monitorHealth(t *testing.T, m *monitor, user, key string) (int, map[string]formats.SignerHealth) {
+	var empty []byte
+	req, err := http.NewRequest("GET", "http://foo.bar/__monitor__/health", bytes.NewReader(empty))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", getAuthHeader(req, user, key, sha256.New, id(), "application/json", empty))
+	w := httptest.NewRecorder()
+	m.handleMonitorHealth(w, req)
+	if w.Code == http.StatusUnauthorized {
+		return w.Code, nil
+	}
+	var health map[string]formats.SignerHealth
+	err = json.Unmarshal(w.Body.Bytes(), &health)
+	if err != nil {
+		t.Fatalf("failed to decode monitor health %q: %v", w.Body.String(), err)
+	}
+	return w.Code, health
+}
+
+func TestMonitorHealth(t *testing.T) {
+	t.Parallel()
+
+	var appkeyConf signer.Configuration
+	for _, signerConf := range conf.Signers {
+		if signerConf.ID == "appkey1" {
+			appkeyConf = signerConf
+		}
+	}
+	tmpag := newAutographer(1)
+	err := tmpag.addSigners([]signer.Configuration{appkeyConf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hanging := &hangingSigner{
+		Configuration: signer.Configuration{ID: "hanging", Type: "contentsignature"},
+		release:       make(chan interface{}),
+	}
+	tmpag.addSigner(hanging)
+	err = tmpag.addMonitoring(authorization{Key: "monitorkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	defer close(tmpag.exit)
+	m := newMonitor(tmpag, time.Hour, 100*time.Millisecond, nil, "", "", nil)
+
+	code, _ := monitorHealth(t, m, monitorAuthID, "wrongkey")
+	if code != http.StatusUnauthorized {
+		t.Fatalf("expected monitor health status %d with the wrong key but got %d", http.StatusUnauthorized, code)
+	}
+
+	// the hanging signer is reported as timed out once the timeout expires
+	code, health := monitorHealth(t, m, monitorAuthID, "monitorkey")
+	if code != http.StatusInternalServerError {
+		t.Fatalf("expected monitor health status %d with a hanging signer but got %d", http.StatusInternalServerError, code)
+	}
+	if len(health) != 2 {
+		t.Fatalf("expected the health of 2 signers but got %+v", health)
+	}
+	if health[hanging.ID].OK || !strings.Contains(health[hanging.ID].Error, "did not complete within 100ms") || health[hanging.ID].LatencyMs < 100 {
+		t.Fatalf("expected the check of %q to time out but got %+v", hanging.ID, health[hanging.ID])
+	}
+
+	// once released the check of the hanging signer completes and fails
+	close(hanging.release)
+	<-m.initialized
+	code, health = monitorHealth(t, m, monitorAuthID, "monitorkey")
+	if code != http.StatusInternalServerError {
+		t.Fatalf("expected monitor health status %d after the hanging signer fails but got %d", http.StatusInternalServerError, code)
+	}
+	if !health[appkeyConf.ID].OK || health[appkeyConf.ID].Error != "" {
+		t.Fatalf("expected %q to be healthy but got %+v", appkeyConf.ID, health[appkeyConf.ID])
+	}
+	if health[hanging.ID].OK || !strings.Contains(health[hanging.ID].Error, "hanging signer released") {
+		t.Fatalf("expected the check of %q to fail but got %+v", hanging.ID, health[hanging.ID])
+	}
+}
+
+func TestMonitorExcludedSigners(t *testing.T) {
+	t.Parallel()
+
+	var appkeyConf signer.Configuration
+	for _, signerConf := range conf.Signers {
+		if signerConf.ID == "appkey1" {
+			appkeyConf = signerConf
+		}
+	}
+	tmpag := newAutographer(1)
+	err := tmpag.addSigners([]signer.Configuration{appkeyConf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hanging := &hangingSigner{
+		Configuration: signer.Configuration{ID: "hanging", Type: "contentsignature"},
+		release:       make(chan interface{}),
+	}
+	defer close(hanging.release)
+	tmpag.addSigner(hanging)
+	err = tmpag.addMonitoring(authorization{Key: "monitorkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	defer close(tmpag.exit)
+	m := newMonitor(tmpag, time.Hour, time.Minute, []string{hanging.ID}, "", "", nil)
+
+	// the excluded signer is not checked, so the initial check
+	// completes without waiting for the timeout
+	code, responses := monitorResponses(t, m, "monitorkey")
+	if code != http.StatusCreated {
+		t.Fatalf("expected monitor status %d but got %d", http.StatusCreated, code)
+	}
+	if len(responses) != 2 {
+		t.Fatalf("expected 2 monitor responses but got %d", len(responses))
+	}
+	if responses[0].SignerID != appkeyConf.ID || responses[0].Skipped || responses[0].Signature == "" {
+		t.Fatalf("expected a signature from %q but got %+v", appkeyConf.ID, responses[0])
+	}
+	if responses[1].SignerID != hanging.ID || !responses[1].Skipped || responses[1].TimedOut || responses[1].Signature != "" {
+		t.Fatalf("expected %q to be skipped but got %+v", hanging.ID, responses[1])
+	}
+
+	code, health := monitorHealth(t, m, monitorAuthID, "monitorkey")
+	if code != http.StatusOK {
+		t.Fatalf("expected monitor health status %d but got %d", http.StatusOK, code)
+	}
+	if !health[appkeyConf.ID].OK || health[appkeyConf.ID].Skipped {
+		t.Fatalf("expected %q to be healthy but got %+v", appkeyConf.ID, health[appkeyConf.ID])
+	}
+	if health[hanging.ID].OK || !health[hanging.ID].Skipped {
+		t.Fatalf("expected %q to be skipped but got %+v", hanging.ID, health[hanging.ID])
+	}
+}
+
+func TestMonitorOptionVariants(t *testing.T) {
+	t.Parallel()
+
+	var marConf signer.Configuration
+	for _, signerConf := range conf.Signers {
+		if signerConf.ID == "testmar" {
+			marConf = signerConf
+		}
+	}
+	for _, testcase := range []struct {
+		variants       []map[string]interface{}
+		expectedStatus int
+		expectedError  string
+	}{
+		// RSA PKCS1 with SHA1 is not the default SHA384 of the signer
+		{[]map[string]interface{}{{"sigalg": 1}}, http.StatusCreated, ""},
+		// ECDSA cannot be signed with the RSA key of the signer
+		{[]map[string]interface{}{{"sigalg": 1}, {"sigalg": 3}}, http.StatusInternalServerError, "option variant 2: signing failed"},
+	} {
+		tmpag := newAutographer(1)
+		err := tmpag.addSigners([]signer.Configuration{marConf})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tmpag.addMonitoring(authorization{Key: "monitorkey"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpag.hawkMaxTimestampSkew = time.Minute
+		m := newMonitor(tmpag, time.Hour, time.Minute, nil, "", "", map[string][]map[string]interface{}{marConf.ID: testcase.variants})
+
+		code, responses := monitorResponses(t, m, "monitorkey")
+		close(tmpag.exit)
+		if code != testcase.expectedStatus {
+			t.Fatalf("expected monitor status %d with variants %v but got %d", testcase.expectedStatus, testcase.variants, code)
+		}
+		if code != http.StatusCreated {
+			_, health := monitorHealth(t, m, monitorAuthID, "monitorkey")
+			if health[marConf.ID].OK || !strings.Contains(health[marConf.ID].Error, testcase.expectedError) {
+				t.Fatalf("expected the check of %q to fail with %q but got %+v", marConf.ID, testcase.expectedError, health[marConf.ID])
+			}
+			continue
+		}
+		if len(responses) != 1+len(testcase.variants) {
+			t.Fatalf("expected %d monitor responses but got %d", 1+len(testcase.variants), len(responses))
+		}
+		if responses[0].Options != nil {
+			t.Fatalf("expected no options in the response of the default options but got %v", responses[0].Options)
+		}
+		for i, response := range responses {
+			if response.SignerID != marConf.ID || response.Signature == "" {
+				t.Fatalf("expected a signature from %q but got %+v", marConf.ID, response)
+			}
+			if i > 0 && response.Options["sigalg"] != float64(1) {
+				t.Fatalf("expected the options of variant %d in its response but got %v", i, response.Options)
+			}
+		}
+		if responses[0].Signature == responses[1].Signature {
+			t.Fatal("expected the option variant to sign with another algorithm than the default options")
+		}
+	}
+}
+
+func TestCertificateInfo(t *testing.T) {
+	t.Parallel()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notBefore := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := time.Date(2031, 1, 1, 0, 0, 0, 0, time.UTC)
+	tpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(1234),
+		Subject:        pkix.Name{CommonName: "testsigner", Organization: []string{"Mozilla"}},
+		NotBefore:      notBefore,
+		NotAfter:       notAfter,
+		DNSNames:       []string{"signer.example.net"},
+		EmailAddresses: []string{"signer@example.net"},
+		IPAddresses:    []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+
+	info := signerCertificateInfo(signer.Configuration{ID: "testsigner", Certificate: certPEM})
+	if info == nil {
+		t.Fatalf("expected certificate info but got nil")
+	}
+	if info.Subject != "CN=testsigner,O=Mozilla" || info.Issuer != info.Subject {
+		t.Fatalf("unexpected certificate subject %q and issuer %q", info.Subject, info.Issuer)
+	}
+	if info.SerialNumber != "1234" {
+		t.Fatalf("expected serial number 1234 but got %q", info.SerialNumber)
+	}
+	if !info.NotBefore.Equal(notBefore) || !info.NotAfter.Equal(notAfter) {
+		t.Fatalf("unexpected certificate validity from %s to %s", info.NotBefore, info.NotAfter)
+	}
+	expectedSANs := []string{"signer.example.net", "signer@example.net", "127.0.0.1"}
+	if strings.Join(info.SubjectAltNames, ",") != strings.Join(expectedSANs, ",") {
+		t.Fatalf("expected subject alt names %q but got %q", expectedSANs, info.SubjectAltNames)
+	}
+	sha1Fingerprint, sha256Fingerprint := sha1.Sum(der), sha256.Sum256(der)
+	if info.SHA1Fingerprint != hex.EncodeToString(sha1Fingerprint[:]) || info.SHA256Fingerprint != hex.EncodeToString(sha256Fingerprint[:]) {
+		t.Fatalf("unexpected certificate fingerprints %q and %q", info.SHA1Fingerprint, info.SHA256Fingerprint)
+	}
+
+	if signerCertificateInfo(signer.Configuration{ID: "testsigner"}) != nil {
+		t.Fatalf("expected no certificate info for a signer without a certificate")
+	}
+	if signerCertificateInfo(signer.Configuration{ID: "testsigner", Certificate: "not a certificate"}) != nil {
+		t.Fatalf("expected no certificate info for a signer with an invalid certificate")
+	}
+}
+
+func TestMonitorHealthFlagsExpiringCertificates(t *testing.T) {
+	t.Parallel()
+
+	var appkeyConf signer.Configuration
+	for _, signerConf := range conf.Signers {
+		if signerConf.ID == "appkey1" {
+			appkeyConf = signerConf
+		}
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "expiring"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpag := newAutographer(1)
+	err = tmpag.addSigners([]signer.Configuration{appkeyConf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiring := &hangingSigner{
+		Configuration: signer.Configuration{
+			ID:          "expiring",
+			Type:        "contentsignature",
+			Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		},
+		release: make(chan interface{}),
+	}
+	defer close(expiring.release)
+	tmpag.addSigner(expiring)
+	err = tmpag.addMonitoring(authorization{Key: "monitorkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	defer close(tmpag.exit)
+	m := newMonitor(tmpag, time.Hour, 100*time.Millisecond, nil, "", "", nil)
+
+	_, health := monitorHealth(t, m, monitorAuthID, "monitorkey")
+	if !health[expiring.ID].CertExpiresSoon {
+		t.Fatalf("expected the certificate of %q to be flagged as expiring soon but got %+v", expiring.ID, health[expiring.ID])
+	}
+	if health[appkeyConf.ID].CertExpiresSoon {
+		t.Fatalf("expected %q without a certificate not to be flagged but got %+v", appkeyConf.ID, health[appkeyConf.ID])
+	}
+}
+
+func TestMonitorContentSignaturePKIRootHash(t *testing.T) {
+	t.Parallel()
+
+	var normandyConf signer.Configuration
+	for _, signerConf := range conf.Signers {
+		if signerConf.ID == "normandy" {
+			normandyConf = signerConf
+		}
+	}
+	block, _ := pem.Decode([]byte(normandyConf.CaCert))
+	if block == nil {
+		t.Fatal("failed to parse the cacert of the normandy signer")
+	}
+	rootHash := fmt.Sprintf("%X", sha256.Sum256(block.Bytes))
+	for _, testcase := range []struct {
+		name     string
+		rootHash string
+		healthy  bool
+	}{
+		{"cacert of the signer", "", true},
+		{"monitoring root hash", rootHash, true},
+		{"lowercase monitoring root hash", strings.ToLower(rootHash), true},
+		{"other root hash", strings.Repeat("AB:", 31) + "AB", false},
+	} {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			tmpag := newAutographer(1)
+			err := tmpag.addSigners([]signer.Configuration{normandyConf})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tmpag.addMonitoring(authorization{Key: "monitorkey"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tmpag.hawkMaxTimestampSkew = time.Minute
+			defer close(tmpag.exit)
+			m := newMonitor(tmpag, time.Hour, time.Minute, nil, testcase.rootHash, "", nil)
+
+			_, health := monitorHealth(t, m, monitorAuthID, "monitorkey")
+			if health[normandyConf.ID].OK != testcase.healthy {
+				t.Fatalf("expected %q to be healthy %v but got %+v", normandyConf.ID, testcase.healthy, health[normandyConf.ID])
+			}
+			if !testcase.healthy && !strings.Contains(health[normandyConf.ID].Error, "does not verify with root hash") {
+				t.Fatalf("expected a root hash mismatch error but got %q", health[normandyConf.ID].Error)
+			}
+		})
+	}
+}
+
+func TestMonitorAPKSourceStamp(t *testing.T) {
+	t.Parallel()
+
+	var apkConf signer.Configuration
+	for _, signerConf := range conf.Signers {
+		if signerConf.ID == "testapp-android" {
+			apkConf = signerConf
+		}
+	}
+	s, err := newSigner(apkConf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// signers without source stamp are not checked
+	err = verifyAPKSourceStamp(s, formats.SignatureResponse{SignedFile: "not base64"}, time.Second)
+	if err != nil {
+		t.Fatalf("expected apk2 signers without source stamp to pass but got %v", err)
+	}
+
+	apkConf.SourceStampKey = apkConf.PrivateKey
+	apkConf.SourceStampCert = apkConf.Certificate
+	s, err = newSigner(apkConf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifyAPKSourceStamp(s, formats.SignatureResponse{SignedFile: "not base64"}, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "failed to decode signed file") {
+		t.Fatalf("expected the source stamp of apk2 signers with a stamp cert to be verified but got %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prometheusConfig enables the /metrics endpoint Prometheus scrapes
+// the signing metrics from. It does not require authorization, and
+// should only be exposed to the cluster.
+type prometheusConfig struct {
+	Enabled bool
+}
+
+// prometheusContentType is the content type of the Prometheus text
+// exposition format
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// prometheusDurationBuckets are the upper bounds in seconds of the
+// buckets of the duration histograms, the Prometheus client defaults
+var prometheusDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// prometheusSignerKey identifies the metrics of a signer
+type prometheusSignerKey struct {
+	signerID   string
+	signerType string
+}
+
+// prometheusHistogram is a histogram of durations in seconds
+type prometheusHistogram struct {
+	// buckets are the non-cumulative counts of the observations in
+	// each of the prometheusDurationBuckets, followed by +Inf
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *prometheusHistogram) observe(d time.Duration) {
+	if h.buckets == nil {
+		h.buckets = make([]uint64, len(prometheusDurationBuckets)+1)
+	}
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(prometheusDurationBuckets, seconds)
+	h.buckets[i]++
+	h.sum += seconds
+	h.count++
+}
+
+// prometheusCollector is a signer.MetricsCollector that counts the
+// signing operations and monitor checks of the signers and records
+// histograms of their durations, and serves them to Prometheus
+type prometheusCollector struct {
+	sync.Mutex
+
+	// signatures and monitorChecks count the operations by signer
+	// and result, "success" or "error"
+	signatures    map[prometheusSignerKey]map[string]uint64
+	monitorChecks map[prometheusSignerKey]map[string]uint64
+
+	signingDurations map[prometheusSignerKey]*prometheusHistogram
+}
+
+func newPrometheusCollector() *prometheusCollector {
+	return &prometheusCollector{
+		signatures:       make(map[prometheusSignerKey]map[string]uint64),
+		monitorChecks:    make(map[prometheusSignerKey]map[string]uint64),
+		signingDurations: make(map[prometheusSignerKey]*prometheusHistogram),
+	}
+}
+
+// ObserveSign counts a signing operation and records its duration
+func (c *prometheusCollector) ObserveSign(signerID, signerType string, d time.Duration, err error) {
+	key := prometheusSignerKey{signerID: signerID, signerType: signerType}
+	c.Lock()
+	defer c.Unlock()
+	incrementResult(c.signatures, key, err)
+	histogram, ok := c.signingDurations[key]
+	if !ok {
+		histogram = new(prometheusHistogram)
+		c.signingDurations[key] = histogram
+	}
+	histogram.observe(d)
+}
+
+// ObserveMonitorCheck counts a monitor check of a signer
+func (c *prometheusCollector) ObserveMonitorCheck(signerID, signerType string, d time.Duration, err error) {
+	key := prometheusSignerKey{signerID: signerID, signerType: signerType}
+	c.Lock()
+	defer c.Unlock()
+	incrementResult(c.monitorChecks, key, err)
+}
+
+// incrementResult increments the counter of the signer with the result
+// of an operation that returned err
+func incrementResult(counters map[prometheusSignerKey]map[string]uint64, key prometheusSignerKey, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	if counters[key] == nil {
+		counters[key] = make(map[string]uint64)
+	}
+	counters[key][result]++
+}
+
+// handleMetrics writes the metrics in the Prometheus text format
+func (c *prometheusCollector) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+	w.Header().Set("Content-Type", prometheusContentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(c.render())
+}
+
+// render returns the metrics in the Prometheus text format, sorted by
+// signer so scrapes are stable
+func (c *prometheusCollector) render() []byte {
+	c.Lock()
+	defer c.Unlock()
+	var buf bytes.Buffer
+	renderCounters(&buf, "autograph_signatures_total",
+		"Signing operations by signer and result.", c.signatures)
+	renderCounters(&buf, "autograph_monitor_checks_total",
+		"Monitor checks of the signers by signer and result.", c.monitorChecks)
+
+	const name = "autograph_signing_duration_seconds"
+	fmt.Fprintf(&buf, "# HELP %s Duration of the signing operations by signer.\n", name)
+	fmt.Fprintf(&buf, "# TYPE %s histogram\n", name)
+	for _, key := range sortedSignerKeys(c.signingDurations) {
+		histogram := c.signingDurations[key]
+		labels := signerLabels(key)
+		var cumulative uint64
+		for i, count := range histogram.buckets {
+			cumulative += count
+			le := "+Inf"
+			if i < len(prometheusDurationBuckets) {
+				le = strconv.FormatFloat(prometheusDurationBuckets[i], 'g', -1, 64)
+			}
+			fmt.Fprintf(&buf, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, le, cumulative)
+		}
+		fmt.Fprintf(&buf, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(histogram.sum, 'g', -1, 64))
+		fmt.Fprintf(&buf, "%s_count{%s} %d\n", name, labels, histogram.count)
+	}
+	return buf.Bytes()
+}
+
+// renderCounters writes the counters of a metric by signer and result
+func renderCounters(buf *bytes.Buffer, name, help string, counters map[prometheusSignerKey]map[string]uint64) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s counter\n", name)
+	for _, key := range sortedSignerKeys(counters) {
+		results := make([]string, 0, len(counters[key]))
+		for result := range counters[key] {
+			results = append(results, result)
+		}
+		sort.Strings(results)
+		for _, result := range results {
+			fmt.Fprintf(buf, "%s{%s,result=\"%s\"} %d\n", name, signerLabels(key), result, counters[key][result])
+		}
+	}
+}
+
+// sortedSignerKeys returns the keys of a map of metrics by signer
+// sorted by signer ID and type
+func sortedSignerKeys(metrics interface{}) (keys []prometheusSignerKey) {
+	switch m := metrics.(type) {
+	case map[prometheusSignerKey]map[string]uint64:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[prometheusSignerKey]*prometheusHistogram:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].signerID != keys[j].signerID {
+			return keys[i].signerID < keys[j].signerID
+		}
+		return keys[i].signerType < keys[j].signerType
+	})
+	return keys
+}
+
+// signerLabels returns the signer_id and type labels of a signer
+func signerLabels(key prometheusSignerKey) string {
+	return fmt.Sprintf("signer_id=\"%s\",type=\"%s\"", escapeLabelValue(key.signerID), escapeLabelValue(key.signerType))
+}
+
+// labelValueEscaper escapes the backslashes, double quotes and line
+// feeds of label values as the text format requires
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/autograph/signer"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	t.Parallel()
+
+	collector := newPrometheusCollector()
+	collector.ObserveSign("appkey1", "contentsignature", 3*time.Millisecond, nil)
+	collector.ObserveSign("appkey1", "contentsignature", 200*time.Millisecond, nil)
+	collector.ObserveSign("appkey1", "contentsignature", time.Minute, fmt.Errorf("failed"))
+	collector.ObserveSign(`odd"id`, "mar", 10*time.Millisecond, nil)
+	collector.ObserveMonitorCheck("appkey1", "contentsignature", time.Millisecond, fmt.Errorf("failed"))
+
+	req := httptest.NewRequest("GET", "http://foo.bar/metrics", nil)
+	w := httptest.NewRecorder()
+	collector.handleMetrics(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, w.Code)
+	}
+	if w.Header().Get("Content-Type") != prometheusContentType {
+		t.Fatalf("expected content type %q but got %q", prometheusContentType, w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	for _, expected := range []string{
+		"# TYPE autograph_signatures_total counter\n",
+		`autograph_signatures_total{signer_id="appkey1",type="contentsignature",result="error"} 1` + "\n",
+		`autograph_signatures_total{signer_id="appkey1",type="contentsignature",result="success"} 2` + "\n",
+		`autograph_signatures_total{signer_id="odd\"id",type="mar",result="success"} 1` + "\n",
+		`autograph_monitor_checks_total{signer_id="appkey1",type="contentsignature",result="error"} 1` + "\n",
+		"# TYPE autograph_signing_duration_seconds histogram\n",
+		`autograph_signing_duration_seconds_bucket{signer_id="appkey1",type="contentsignature",le="0.005"} 1` + "\n",
+		`autograph_signing_duration_seconds_bucket{signer_id="appkey1",type="contentsignature",le="0.25"} 2` + "\n",
+		`autograph_signing_duration_seconds_bucket{signer_id="appkey1",type="contentsignature",le="10"} 2` + "\n",
+		`autograph_signing_duration_seconds_bucket{signer_id="appkey1",type="contentsignature",le="+Inf"} 3` + "\n",
+		`autograph_signing_duration_seconds_sum{signer_id="appkey1",type="contentsignature"} 60.203` + "\n",
+		`autograph_signing_duration_seconds_count{signer_id="appkey1",type="contentsignature"} 3` + "\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("expected %q in metrics:\n%s", expected, body)
+		}
+	}
+}
+
+func TestPrometheusObservesSignaturesAndMonitorChecks(t *testing.T) {
+	collector := newPrometheusCollector()
+	signer.SetMetricsCollector(collector)
+	defer signer.SetMetricsCollector(nil)
+
+	conf := signer.Configuration{ID: "testsigner", Type: "genericrsa"}
+	signer.ObserveSign(conf, time.Now(), nil)
+	signer.ObserveMonitorCheck(conf, time.Now(), nil)
+
+	body := string(collector.render())
+	for _, expected := range []string{
+		`autograph_signatures_total{signer_id="testsigner",type="genericrsa",result="success"} 1`,
+		`autograph_monitor_checks_total{signer_id="testsigner",type="genericrsa",result="success"} 1`,
+		`autograph_signing_duration_seconds_count{signer_id="testsigner",type="genericrsa"} 1`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("expected %q in metrics:\n%s", expected, body)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mozilla-services/autograph/formats"
+	"github.com/mozilla-services/autograph/signer"
+)
+
+// multipartSigningConcurrency is the number of files of a single
+// multipart request to /sign/files signed in parallel
+const multipartSigningConcurrency = 4
+
+// multipartFile is an input file of a multipart /sign/files request
+type multipartFile struct {
+	name  string
+	input []byte
+}
+
+// handleMultipartSignFiles signs every file of a multipart/form-data
+// request to /sign/files with a file signer, and returns a signature
+// response with the signed file for each of them. The form has a
+// keyid field, an optional options field with the JSON signing
+// options, and a file field per file to sign. Files are signed
+// concurrently, and the response of a file that fails to sign has an
+// error instead of a signed file.
+func (a *autographer) handleMultipartSignFiles(w http.ResponseWriter, r *http.Request) {
+	rid := getRequestID(r)
+	starttime := getRequestStartTime(r)
+	auth, userid, err := a.authorizeHeader(r)
+	if err != nil {
+		httpError(w, r, http.StatusUnauthorized, "authorization verification failed: %v", err)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, a.maxFileRequestBytes)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		if isRequestBodyTooLarge(err) {
+			httpError(w, r, http.StatusRequestEntityTooLarge, "request exceeds max size of %d bytes", a.maxFileRequestBytes)
+			return
+		}
+		httpError(w, r, http.StatusBadRequest, "failed to read request body: %s", err)
+		return
+	}
+	err = a.authorizeBody(auth, r, body)
+	if err != nil {
+		httpError(w, r, http.StatusUnauthorized, "authorization verification failed: %v", err)
+		return
+	}
+	keyID, options, files, err := parseMultipartSignFiles(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "failed to parse multipart request body: %v", err)
+		return
+	}
+
+	requestedSigner, err := a.authBackend.getSignerForUser(userid, keyID)
+	if err != nil {
+		httpError(w, r, http.StatusUnauthorized, "%v", err)
+		return
+	}
+	requestedSignerConfig := requestedSigner.Config()
+	if _, ok := signer.Unwrap(requestedSigner).(signer.FileSigner); !ok {
+		httpError(w, r, http.StatusBadRequest, "requested signer %q does not implement file signing", requestedSignerConfig.ID)
+		return
+	}
+	signerConf, hasSignerConf := a.getSignerConf(requestedSignerConfig.ID)
+	if hasSignerConf && signerConf.MaxRequestBytes > 0 && int64(len(body)) > signerConf.MaxRequestBytes {
+		httpError(w, r, http.StatusRequestEntityTooLarge, "request exceeds max size of %d bytes of signer %q", signerConf.MaxRequestBytes, requestedSignerConfig.ID)
+		return
+	}
+
+	var (
+		sigreq   = formats.SignatureRequest{KeyID: keyID, Options: options}
+		sigresps = make([]formats.SignatureResponse, len(files))
+		wg       sync.WaitGroup
+		slots    = make(chan struct{}, multipartSigningConcurrency)
+	)
+	for i, file := range files {
+		sigresps[i] = formats.SignatureResponse{
+			Ref:        id(),
+			Type:       requestedSignerConfig.Type,
+			Mode:       requestedSignerConfig.Mode,
+			SignerID:   requestedSignerConfig.ID,
+			PublicKey:  requestedSignerConfig.PublicKey,
+			X5U:        requestedSignerConfig.X5U,
+			SignerOpts: requestedSignerConfig.SignerOpts,
+			FileName:   file.name,
+		}
+		if toolVersioner, ok := signer.Unwrap(requestedSigner).(signer.ToolVersioner); ok {
+			sigresps[i].ToolVersion = toolVersioner.ToolVersion()
+		}
+		if certFingerprinter, ok := signer.Unwrap(requestedSigner).(signer.CertFingerprinter); ok {
+			sigresps[i].CertFingerprint = certFingerprinter.CertFingerprint()
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(sigresp *formats.SignatureResponse, file multipartFile) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			inputHash := hashSHA256AsHex(file.input)
+			signedfile, sidecar, err := signFileInput(r.Context(), requestedSigner, file.input, options)
+			if err == nil && hasSignerConf {
+				err = signerConf.CheckSignedFileSize(len(file.input), len(signedfile))
+			}
+			if err != nil {
+				logSigningRequestFailure(sigreq, *sigresp, rid, userid, inputHash, nil, starttime, err)
+				sigresp.Error = err.Error()
+				return
+			}
+			sigresp.SignedFile = base64.StdEncoding.EncodeToString(signedfile)
+			if sidecar != nil {
+				sigresp.SignedFileSidecar = base64.StdEncoding.EncodeToString(sidecar)
+			}
+			sigresp.SignedAt = a.now()
+			sigresp.AutographVersion = autographVersion
+			log.WithFields(log.Fields{
+				"rid":         rid,
+				"options":     options,
+				"mode":        sigresp.Mode,
+				"ref":         sigresp.Ref,
+				"type":        sigresp.Type,
+				"signer_id":   sigresp.SignerID,
+				"file_name":   sigresp.FileName,
+				"input_hash":  inputHash,
+				"output_hash": hashSHA256AsHex(signedfile),
+				"user_id":     userid,
+				"t":           int32(time.Since(starttime) / time.Millisecond), //  request processing time in ms
+			}).Info("signing operation succeeded")
+		}(&sigresps[i], file)
+	}
+	wg.Wait()
+
+	failedCount := 0
+	for _, sigresp := range sigresps {
+		if sigresp.Error != "" {
+			failedCount++
+		}
+	}
+	respdata, err := json.Marshal(sigresps)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "signing failed with error: %v", err)
+		return
+	}
+	w.Header().Add("Content-Type", jsonContentType)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(respdata)
+	log.WithFields(log.Fields{
+		"rid":                  rid,
+		"num_signing_requests": len(files),
+		"num_failed":           failedCount,
+	}).Info("multipart signing request completed")
+}
+
+// parseMultipartSignFiles parses the keyid and options fields and the
+// files of the multipart/form-data body of a /sign/files request. It
+// requires a keyid and between MinNamedFiles and MaxNamedFiles files.
+func parseMultipartSignFiles(contentType string, body []byte) (keyID string, options interface{}, files []multipartFile, err error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("invalid content type: %w", err)
+	}
+	if mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return "", nil, nil, fmt.Errorf("invalid content type %q, expected multipart/form-data with a boundary", contentType)
+	}
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", nil, nil, err
+		}
+		value, err := ioutil.ReadAll(part)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("failed to read field %q: %w", part.FormName(), err)
+		}
+		switch part.FormName() {
+		case "keyid":
+			keyID = string(value)
+		case "options":
+			err = json.Unmarshal(value, &options)
+			if err != nil {
+				return "", nil, nil, fmt.Errorf("failed to parse options: %w", err)
+			}
+		case "file":
+			if part.FileName() == "" {
+				return "", nil, nil, fmt.Errorf("file %d has no file name", len(files))
+			}
+			err = signer.CheckUnsignedFilename(part.FileName())
+			if err != nil {
+				return "", nil, nil, fmt.Errorf("file %d has an invalid file name: %w", len(files), err)
+			}
+			if len(files) == MaxNamedFiles {
+				return "", nil, nil, fmt.Errorf("received too many files to sign (max is %d)", MaxNamedFiles)
+			}
+			files = append(files, multipartFile{name: part.FileName(), input: value})
+		default:
+			return "", nil, nil, fmt.Errorf("unknown field %q", part.FormName())
+		}
+	}
+	if keyID == "" {
+		return "", nil, nil, fmt.Errorf("missing keyid field")
+	}
+	if len(files) < MinNamedFiles {
+		return "", nil, nil, fmt.Errorf("did not receive enough files to sign, need at least %d", MinNamedFiles)
+	}
+	return keyID, options, files, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/autograph/formats"
+	"github.com/mozilla-services/autograph/signer"
+
+	margo "go.mozilla.org/mar"
+)
+
+// multipartField is a field of a multipart test request, with a file
+// name for file fields
+type multipartField struct {
+	name     string
+	fileName string
+	value    []byte
+}
+
+func makeMultipartBody(t *testing.T, fields []multipartField) (contentType string, body []byte) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	for _, field := range fields {
+		var (
+			part interface{ Write([]byte) (int, error) }
+			err  error
+		)
+		if field.fileName != "" {
+			part, err = writer.CreateFormFile(field.name, field.fileName)
+		} else {
+			part, err = writer.CreateFormField(field.name)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = part.Write(field.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writer.FormDataContentType(), buf.Bytes()
+}
+
+func TestMultipartSignFiles(t *testing.T) {
+	t.Parallel()
+
+	var marConf, csConf signer.Configuration
+	for _, signerConf := range conf.Signers {
+		switch signerConf.ID {
+		case "testmar":
+			marConf = signerConf
+		case "appkey1":
+			csConf = signerConf
+		}
+	}
+	unsignedMar := margo.New()
+	err := unsignedMar.AddContent([]byte("hello"), "hello.txt", 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, err := unsignedMar.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpag := newAutographer(1)
+	err = tmpag.addSigners([]signer.Configuration{marConf, csConf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpag.addAuthorizations([]authorization{{ID: "alice", Key: "alicekey", Signers: []string{marConf.ID, csConf.ID}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpag.hawkMaxTimestampSkew = time.Minute
+
+	var TESTCASES = []struct {
+		fields         []multipartField
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			[]multipartField{
+				{"keyid", "", []byte(marConf.ID)},
+				{"file", "a.mar", input},
+				{"file", "b.mar", []byte("not a mar")},
+				{"file", "c.mar", input},
+			},
+			http.StatusCreated, "",
+		},
+		{
+			[]multipartField{{"file", "a.mar", input}},
+			http.StatusBadRequest, "missing keyid field",
+		},
+		{
+			[]multipartField{{"keyid", "", []byte(marConf.ID)}},
+			http.StatusBadRequest, "did not receive enough files to sign",
+		},
+		{
+			[]multipartField{
+				{"keyid", "", []byte(marConf.ID)},
+				{"input", "", input},
+			},
+			http.StatusBadRequest, `unknown field "input"`,
+		},
+		{
+			[]multipartField{
+				{"keyid", "", []byte(marConf.ID)},
+				{"options", "", []byte("{")},
+				{"file", "a.mar", input},
+			},
+			http.StatusBadRequest, "failed to parse options",
+		},
+		{
+			[]multipartField{
+				{"keyid", "", []byte(csConf.ID)},
+				{"file", "a.txt", []byte("hello")},
+			},
+			http.StatusBadRequest, "does not implement file signing",
+		},
+		{
+			[]multipartField{
+				{"keyid", "", []byte("unknownsigner")},
+				{"file", "a.mar", input},
+			},
+			http.StatusUnauthorized, "",
+		},
+	}
+	for i, testcase := range TESTCASES {
+		contentType, body := makeMultipartBody(t, testcase.fields)
+		req, err := http.NewRequest("POST", "http://foo.bar/sign/files", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Authorization", getAuthHeader(req, "alice", "alicekey",
+			sha256.New, id(), contentType, body))
+		w := httptest.NewRecorder()
+		tmpag.handleMultipartSignFiles(w, req)
+		if w.Code != testcase.expectedStatus {
+			t.Fatalf("test case %d expected status %d but got %d: %s",
+				i, testcase.expectedStatus, w.Code, w.Body.String())
+		}
+		if !strings.Contains(w.Body.String(), testcase.expectedBody) {
+			t.Fatalf("test case %d expected response body to contain %q but got %q",
+				i, testcase.expectedBody, w.Body.String())
+		}
+		if w.Code != http.StatusCreated {
+			continue
+		}
+		var responses []formats.SignatureResponse
+		err = json.Unmarshal(w.Body.Bytes(), &responses)
+		if err != nil {
+			t.Fatalf("test case %d failed to parse response: %v", i, err)
+		}
+		if len(responses) != 3 {
+			t.Fatalf("test case %d expected 3 responses but got %d", i, len(responses))
+		}
+		for j, expectedName := range []string{"a.mar", "b.mar", "c.mar"} {
+			if responses[j].FileName != expectedName {
+				t.Fatalf("test case %d expected response %d for file %q but got %q",
+					i, j, expectedName, responses[j].FileName)
+			}
+			if responses[j].SignerID != marConf.ID {
+				t.Fatalf("test case %d expected response %d signer id %q but got %q",
+					i, j, marConf.ID, responses[j].SignerID)
+			}
+		}
+		// the invalid file fails alone
+		if responses[1].Error == "" || responses[1].SignedFile != "" {
+			t.Fatalf("test case %d expected an error and no signed file for invalid file but got %+v", i, responses[1])
+		}
+		for _, j := range []int{0, 2} {
+			if responses[j].Error != "" {
+				t.Fatalf("test case %d expected response %d to succeed but got error %q", i, j, responses[j].Error)
+			}
+			signedInput, err := base64.StdEncoding.DecodeString(responses[j].SignedFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var signedMar margo.File
+			err = margo.Unmarshal(signedInput, &signedMar)
+			if err != nil {
+				t.Fatalf("test case %d failed to parse signed mar %d: %v", i, j, err)
+			}
+			if len(signedMar.Signatures) != 1 {
+				t.Fatalf("test case %d expected 1 signature in signed mar %d but got %d", i, j, len(signedMar.Signatures))
+			}
+		}
+	}
+}
+
+func TestParseMultipartSignFiles(t *testing.T) {
+	t.Parallel()
+
+	contentType, body := makeMultipartBody(t, []multipartField{
+		{"keyid", "", []byte("testmar")},
+		{"options", "", []byte(`{"id": "foo"}`)},
+		{"file", "a.mar", []byte("aaa")},
+		{"file", "b.mar", []byte("bbb")},
+	})
+	keyID, options, files, err := parseMultipartSignFiles(contentType, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID != "testmar" {
+		t.Fatalf("expected keyid %q but got %q", "testmar", keyID)
+	}
+	if options.(map[string]interface{})["id"] != "foo" {
+		t.Fatalf("expected options with id foo but got %v", options)
+	}
+	if len(files) != 2 || files[0].name != "a.mar" || string(files[1].input) != "bbb" {
+		t.Fatalf("unexpected files %+v", files)
+	}
+
+	tooMany := []multipartField{{"keyid", "", []byte("testmar")}}
+	for i := 0; i <= MaxNamedFiles; i++ {
+		tooMany = append(tooMany, multipartField{"file", "a.mar", []byte("aaa")})
+	}
+	tooManyContentType, tooManyBody := makeMultipartBody(t, tooMany)
+	badNameContentType, badNameBody := makeMultipartBody(t, []multipartField{
+		{"keyid", "", []byte("testmar")},
+		{"file", "a.mar", []byte("aaa")},
+		{"file", "b\nlog injection.mar", []byte("bbb")},
+	})
+	dotsContentType, dotsBody := makeMultipartBody(t, []multipartField{
+		{"keyid", "", []byte("testmar")},
+		{"file", "a..mar", []byte("aaa")},
+	})
+	for i, testcase := range []struct {
+		contentType string
+		body        []byte
+		err         string
+	}{
+		{"application/json", body, "expected multipart/form-data with a boundary"},
+		{"multipart/form-data", body, "expected multipart/form-data with a boundary"},
+		{"multipart/form-data; boundary=\"", body, "invalid content type"},
+		{tooManyContentType, tooManyBody, "received too many files to sign"},
+		{badNameContentType, badNameBody, "file 1 has an invalid file name"},
+		{dotsContentType, dotsBody, "file 0 has an invalid file name"},
+	} {
+		_, _, _, err = parseMultipartSignFiles(testcase.contentType, testcase.body)
+		if err == nil || !strings.Contains(err.Error(), testcase.err) {
+			t.Fatalf("test case %d expected error %q but got %v", i, testcase.err, err)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package aab
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/mozilla-services/autograph/formats"
+	"github.com/mozilla-services/autograph/signer"
+)
+
+const (
+	// Type of this signer is "aab" represents a signer that shells
+	// out to jarsigner to sign Android App Bundles
+	Type = "aab"
+
+	// DefaultJarsignerPath is the jarsigner binary to run when the
+	// signer configuration does not set one
+	DefaultJarsignerPath = "jarsigner"
+
+	// opensslPath is the openssl binary that packs a PEM private key
+	// and certificate in the PKCS12 keystore jarsigner reads
+	opensslPath = "openssl"
+
+	// pemKeyAlias is the alias of the key in the PKCS12 keystore
+	// packed from a PEM private key
+	pemKeyAlias = "aab"
+)
+
+// AABSigner holds the configuration of the signer
+type AABSigner struct {
+	signer.Configuration
+
+	pkcs8Key []byte
+
+	// certFingerprint is the hex encoded SHA-256 fingerprint of the
+	// DER certificate of the signer
+	certFingerprint string
+
+	// certInfo are the fields of the certificate of the signer
+	certInfo *formats.CertificateInfo
+}
+
+// New initializes an aab signer using a configuration
+func New(conf signer.Configuration) (s *AABSigner, err error) {
+	s = new(AABSigner)
+
+	if conf.Type != Type {
+		return nil, fmt.Errorf("aab: invalid type %q, must be %q", conf.Type, Type)
+	}
+	s.Type = conf.Type
+
+	if conf.ID == "" {
+		return nil, fmt.Errorf("aab: missing signer ID in signer configuration")
+	}
+	s.ID = conf.ID
+
+	s.JarsignerPath = conf.JarsignerPath
+	if s.JarsignerPath == "" {
+		s.JarsignerPath = DefaultJarsignerPath
+	} else if _, err = exec.LookPath(s.JarsignerPath); err != nil {
+		return nil, fmt.Errorf("aab: invalid jarsigner path in signer configuration: %w", err)
+	}
+
+	// the signing key is either a PEM private key or a key jarsigner
+	// reads by alias from a keystore
+	hasKeystore := conf.KeystorePath != "" || conf.KeystorePassword != "" || conf.KeyAlias != ""
+	switch {
+	case conf.PrivateKey != "" && hasKeystore:
+		return nil, fmt.Errorf("aab: signer configuration must set either a private key or a keystore, not both")
+	case hasKeystore:
+		if conf.KeystorePath == "" || conf.KeystorePassword == "" || conf.KeyAlias == "" {
+			return nil, fmt.Errorf("aab: keystore signer configuration must set the keystore path, password and key alias")
+		}
+		if _, err = os.Stat(conf.KeystorePath); err != nil {
+			return nil, fmt.Errorf("aab: invalid keystore path in signer configuration: %w", err)
+		}
+		s.KeystorePath = conf.KeystorePath
+		s.KeystorePassword = conf.KeystorePassword
+		s.KeyAlias = conf.KeyAlias
+	case conf.PrivateKey == "":
+		return nil, fmt.Errorf("aab: missing private key or keystore in signer configuration")
+	default:
+		// the key is packed in a keystore file, which HSM keys
+		// cannot be exported to
+		_, s.pkcs8Key, err = conf.GetPKCS8PrivateKey()
+		if errors.Is(err, signer.ErrNonExportableKey) {
+			return nil, fmt.Errorf("aab: use a keystore key instead: %w", err)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("aab: failed to get private key from configuration: %w", err)
+		}
+		s.PrivateKey = conf.PrivateKey
+	}
+
+	if conf.Certificate == "" {
+		return nil, fmt.Errorf("aab: missing public cert in signer configuration")
+	}
+	s.Certificate = conf.Certificate
+	s.certInfo, err = signer.ParseCertificateInfo(s.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("aab: failed to parse public cert in signer configuration: %w", err)
+	}
+	s.CertExpiryWarningDays = conf.CertExpiryWarningDays
+	err = signer.CheckCertificateValidity(s.Configuration, s.certInfo, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("aab: invalid public cert in signer configuration: %w", err)
+	}
+	s.certFingerprint = s.certInfo.SHA256Fingerprint
+	return
+}
+
+// Config returns the configuration of the current signer
+func (s *AABSigner) Config() signer.Configuration {
+	return signer.Configuration{
+		ID:          s.ID,
+		Type:        s.Type,
+		PrivateKey:  s.PrivateKey,
+		Certificate: s.Certificate,
+
+		CertExpiryWarningDays: s.CertExpiryWarningDays,
+
+		JarsignerPath: s.JarsignerPath,
+
+		KeystorePath:     s.KeystorePath,
+		KeystorePassword: s.KeystorePassword,
+		KeyAlias:         s.KeyAlias,
+	}
+}
+
+// SignFile signs an Android App Bundle with jarsigner, which adds the
+// JAR signature files of the signer to its META-INF directory
+func (s *AABSigner) SignFile(file []byte, options interface{}) (signer.SignedFile, error) {
+	return s.SignFileContext(context.Background(), file, options)
+}
+
+// SignFileContext signs an Android App Bundle like SignFile, and kills
+// jarsigner and returns an error wrapping the context error when the
+// context is done before it completes
+func (s *AABSigner) SignFileContext(ctx context.Context, file []byte, options interface{}) (signer.SignedFile, error) {
+	// the key and bundle are written to a directory only the
+	// autograph user can read that is removed on every return, so
+	// failures do not leave the private key on disk
+	tmpDir, err := os.MkdirTemp("", "aab_sign_")
+	if err != nil {
+		return nil, fmt.Errorf("aab: failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	bundlePath := filepath.Join(tmpDir, "input.aab")
+	err = ioutil.WriteFile(bundlePath, file, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("aab: failed to write tempfile for input to sign: %w", err)
+	}
+
+	// openssl and jarsigner run in the external signer slot, which
+	// requests wait for until their context is done
+	release, err := signer.AcquireExternalSigner(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("aab: failed to start signing: %w", err)
+	}
+	defer release()
+
+	keystoreArgs, alias, err := s.keystoreArgs(tmpDir)
+	if err != nil {
+		return nil, err
+	}
+	args := append(keystoreArgs, "-digestalg", "SHA-256", bundlePath, alias)
+	signer.Log(s.Configuration, "sign").WithField("input_hash", fmt.Sprintf("%x", sha256.Sum256(file))).Debug("aab: running jarsigner")
+
+	// the jarsigner output is logged and returned in errors without
+	// the paths of the key files and the keystore password
+	outputSecrets := []string{tmpDir, s.KeystorePath, s.KeystorePassword}
+	out, err := exec.CommandContext(ctx, s.JarsignerPath, args...).CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("aab: signing stopped before jarsigner completed: %w", ctx.Err())
+		}
+		return nil, fmt.Errorf("aab: failed to sign\n%s: %w", signer.LogOutput(out, outputSecrets...), err)
+	}
+	signer.Log(s.Configuration, "sign").Debugf("aab: signed as:\n%s", signer.LogOutput(out, outputSecrets...))
+
+	signed, err := ioutil.ReadFile(bundlePath)
+	if err != nil {
+		return nil, fmt.Errorf("aab: failed to read signed file: %w", err)
+	}
+	return signed, nil
+}
+
+// keystoreArgs returns the jarsigner flags selecting the keystore and
+// its password file, and the alias of the signing key. A PEM private
+// key and its certificate are packed with openssl in a PKCS12
+// keystore written to tmpDir.
+func (s *AABSigner) keystoreArgs(tmpDir string) (args []string, alias string, err error) {
+	passPath := filepath.Join(tmpDir, "keystore.pass")
+	if s.KeystorePath != "" {
+		err = ioutil.WriteFile(passPath, []byte(s.KeystorePassword), 0400)
+		if err != nil {
+			return nil, "", fmt.Errorf("aab: failed to write keystore password to tempfile: %w", err)
+		}
+		return []string{"-keystore", s.KeystorePath, "-storepass:file", passPath}, s.KeyAlias, nil
+	}
+
+	// the keystore only lives in tmpDir, so its password only
+	// needs to be unguessable by other users
+	password := make([]byte, 32)
+	_, err = rand.Read(password)
+	if err != nil {
+		return nil, "", fmt.Errorf("aab: failed to generate keystore password: %w", err)
+	}
+	err = ioutil.WriteFile(passPath, []byte(hex.EncodeToString(password)), 0400)
+	if err != nil {
+		return nil, "", fmt.Errorf("aab: failed to write keystore password to tempfile: %w", err)
+	}
+	keyPath := filepath.Join(tmpDir, "key.pem")
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: s.pkcs8Key}), 0400)
+	if err != nil {
+		return nil, "", fmt.Errorf("aab: failed to write private key to tempfile: %w", err)
+	}
+	certPath := filepath.Join(tmpDir, "cert.pem")
+	err = ioutil.WriteFile(certPath, []byte(s.Certificate), 0400)
+	if err != nil {
+		return nil, "", fmt.Errorf("aab: failed to write public cert to tempfile: %w", err)
+	}
+	keystorePath := filepath.Join(tmpDir, "keystore.p12")
+	out, err := exec.Command(opensslPath, "pkcs12", "-export",
+		"-inkey", keyPath,
+		"-in", certPath,
+		"-name", pemKeyAlias,
+		"-out", keystorePath,
+		"-passout", "file:"+passPath,
+	).CombinedOutput()
+	if err != nil {
+		return nil, "", fmt.Errorf("aab: failed to pack private key in keystore\n%s: %w", signer.LogOutput(out, tmpDir), err)
+	}
+	return []string{"-keystore", keystorePath, "-storetype", "PKCS12", "-storepass:file", passPath}, pemKeyAlias, nil
+}
+
+// VerifyFile verifies the JAR signature of a signed bundle, and that
+// it was made with the certificate of the signer
+func (s *AABSigner) VerifyFile(file []byte, signed signer.SignedFile) error {
+	certs, err := verifyJARSignature(signed)
+	if err != nil {
+		return err
+	}
+	for _, cert := range certs {
+		fingerprint := sha256.Sum256(cert)
+		if hex.EncodeToString(fingerprint[:]) != s.certFingerprint {
+			return fmt.Errorf("aab: signed bundle has certificate with SHA-256 fingerprint %x, expected %s", fingerprint, s.certFingerprint)
+		}
+	}
+	return nil
+}
+
+// CertFingerprint returns the hex encoded SHA-256 fingerprint of the
+// certificate jarsigner embeds in the signed bundles
+func (s *AABSigner) CertFingerprint() string {
+	return s.certFingerprint
+}
+
+// CertificateInfo returns the fields of the certificate of the signer
+// parsed at initialization
+func (s *AABSigner) CertificateInfo() *formats.CertificateInfo {
+	return s.certInfo
+}
+
+// Options are the options of the signer, it has none
+type Options struct {
+}
+
+// GetDefaultOptions returns default options of the signer
+func (s *AABSigner) GetDefaultOptions() interface{} {
+	return Options{}
+}
+
+// GetTestFile returns a minimal Android App Bundle for monitoring
+func (s *AABSigner) GetTestFile() []byte {
+	return testAAB
+}
+
+// testAAB is a minimal unsigned Android App Bundle with the bundle
+// config and the manifest of its base module
+var testAAB = makeTestAAB()
+
+// makeTestAAB returns a zip with the entries of a minimal Android App
+// Bundle
+func makeTestAAB() []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, name := range []string{"BundleConfig.pb", "base/manifest/AndroidManifest.xml", "base/dex/classes.dex"} {
+		f, err := w.Create(name)
+		if err != nil {
+			panic(err)
+		}
+		f.Write([]byte("autograph monitoring test bundle"))
+	}
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,185 @@
+package aab
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"go.mozilla.org/pkcs7"
+)
+
+// signatureBlockExts are the extensions of the PKCS7 signature block
+// files jarsigner writes next to a signature file, by key type
+var signatureBlockExts = []string{".RSA", ".EC", ".DSA"}
+
+// VerifyJARSignature verifies the JAR signatures jarsigner adds to a
+// signed Android App Bundle: the PKCS7 signature of every signature
+// file, the SHA-256 digest of the manifest in the signature files and
+// the SHA-256 digests of the bundle entries in the manifest.
+//
+// It verifies the signatures with the certificates in the bundle, so
+// callers must check the certificates are the expected ones.
+func VerifyJARSignature(signedAAB []byte) error {
+	_, err := verifyJARSignature(signedAAB)
+	return err
+}
+
+// verifyJARSignature verifies the JAR signatures of a signed bundle
+// like VerifyJARSignature, and returns the DER certificates of its
+// signers
+func verifyJARSignature(signedAAB []byte) (certs [][]byte, err error) {
+	zipReader, err := zip.NewReader(bytes.NewReader(signedAAB), int64(len(signedAAB)))
+	if err != nil {
+		return nil, fmt.Errorf("aab: failed to read bundle as zip: %w", err)
+	}
+	files := make(map[string][]byte)
+	for _, f := range zipReader.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		if _, ok := files[f.Name]; ok {
+			return nil, fmt.Errorf("aab: duplicate bundle entry %q", f.Name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("aab: failed to open bundle entry %q: %w", f.Name, err)
+		}
+		files[f.Name], err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("aab: failed to read bundle entry %q: %w", f.Name, err)
+		}
+	}
+
+	manifest, ok := files["META-INF/MANIFEST.MF"]
+	if !ok {
+		return nil, fmt.Errorf("aab: bundle has no META-INF/MANIFEST.MF")
+	}
+	manifestDigest := sha256.Sum256(manifest)
+	for name, sigfile := range files {
+		dir, base := path.Split(name)
+		if dir != "META-INF/" || path.Ext(base) != ".SF" {
+			continue
+		}
+		cert, err := verifySignatureFile(files, name, sigfile, manifestDigest[:])
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("aab: bundle has no JAR signature file")
+	}
+
+	_, entries, err := parseManifest(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("aab: failed to parse manifest: %w", err)
+	}
+	for name, contents := range files {
+		if strings.HasPrefix(name, "META-INF/") {
+			continue
+		}
+		attrs, ok := entries[name]
+		if !ok {
+			return nil, fmt.Errorf("aab: bundle entry %q is not in the manifest", name)
+		}
+		digest := sha256.Sum256(contents)
+		if attrs["SHA-256-Digest"] != base64.StdEncoding.EncodeToString(digest[:]) {
+			return nil, fmt.Errorf("aab: SHA-256 digest of bundle entry %q does not match the manifest", name)
+		}
+	}
+	for name := range entries {
+		if _, ok := files[name]; !ok {
+			return nil, fmt.Errorf("aab: manifest entry %q is not in the bundle", name)
+		}
+	}
+	return certs, nil
+}
+
+// verifySignatureFile verifies the PKCS7 signature block of the
+// signature file at name and that it has the digest of the manifest,
+// and returns the DER certificate of its signer
+func verifySignatureFile(files map[string][]byte, name string, sigfile, manifestDigest []byte) (cert []byte, err error) {
+	var block []byte
+	for _, ext := range signatureBlockExts {
+		if b, ok := files[strings.TrimSuffix(name, ".SF")+ext]; ok {
+			block = b
+			break
+		}
+	}
+	if block == nil {
+		return nil, fmt.Errorf("aab: signature file %q has no signature block", name)
+	}
+	p7, err := pkcs7.Parse(block)
+	if err != nil {
+		return nil, fmt.Errorf("aab: failed to parse signature block of %q: %w", name, err)
+	}
+	p7.Content = sigfile
+	err = p7.Verify()
+	if err != nil {
+		return nil, fmt.Errorf("aab: signature of %q does not verify: %w", name, err)
+	}
+	signerCert := p7.GetOnlySigner()
+	if signerCert == nil {
+		return nil, fmt.Errorf("aab: signature block of %q must have exactly one signer", name)
+	}
+
+	mainAttrs, _, err := parseManifest(sigfile)
+	if err != nil {
+		return nil, fmt.Errorf("aab: failed to parse signature file %q: %w", name, err)
+	}
+	if mainAttrs["SHA-256-Digest-Manifest"] != base64.StdEncoding.EncodeToString(manifestDigest) {
+		return nil, fmt.Errorf("aab: signature file %q does not have the SHA-256 digest of the manifest", name)
+	}
+	return signerCert.Raw, nil
+}
+
+// parseManifest parses the main attributes and the attributes of the
+// named entries of a JAR manifest or signature file. Its sections are
+// separated by empty lines, and lines starting with a space continue
+// the previous line.
+func parseManifest(manifest []byte) (mainAttrs map[string]string, entries map[string]map[string]string, err error) {
+	entries = make(map[string]map[string]string)
+	sections := strings.Split(strings.ReplaceAll(string(manifest), "\r\n", "\n"), "\n\n")
+	for i, section := range sections {
+		attrs := make(map[string]string)
+		var lines []string
+		for _, line := range strings.Split(section, "\n") {
+			if strings.HasPrefix(line, " ") && len(lines) > 0 {
+				lines[len(lines)-1] += line[1:]
+				continue
+			}
+			if line != "" {
+				lines = append(lines, line)
+			}
+		}
+		for _, line := range lines {
+			parts := strings.SplitN(line, ": ", 2)
+			if len(parts) != 2 {
+				return nil, nil, fmt.Errorf("invalid attribute line %q", line)
+			}
+			attrs[parts[0]] = parts[1]
+		}
+		if i == 0 {
+			mainAttrs = attrs
+			continue
+		}
+		if len(attrs) == 0 {
+			continue
+		}
+		name, ok := attrs["Name"]
+		if !ok {
+			return nil, nil, fmt.Errorf("section %d has no Name attribute", i)
+		}
+		if _, ok := entries[name]; ok {
+			return nil, nil, fmt.Errorf("duplicate entry %q", name)
+		}
+		entries[name] = attrs
+	}
+	return mainAttrs, entries, nil
+}
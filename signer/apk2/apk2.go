@@ -1,11 +1,25 @@
 package apk2
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"crypto/ecdsa"
+	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
@@ -13,6 +27,7 @@ import (
 	"os"
 	"os/exec"
 
+	"github.com/mozilla-services/autograph/formats"
 	"github.com/mozilla-services/autograph/signer"
 
 	log "github.com/sirupsen/logrus"
@@ -26,8 +41,76 @@ const (
 
 	// ModeV3Enabled enables APK v3 signing
 	ModeV3Enabled = "v3enabled"
+
+	// ecdsaMinSdkVersion is the first Android SDK version that
+	// verifies ECDSA signatures
+	ecdsaMinSdkVersion = 18
+
+	// v1OptionalMinSdkVersion is the first Android SDK version that
+	// installs APKs without v1 signatures
+	v1OptionalMinSdkVersion = 24
+
+	// DefaultJavaPath is the java binary apksigner runs with when
+	// the signer configuration does not set one
+	DefaultJavaPath = "java"
+
+	// DefaultAPKSignerPath is the apksigner jar to run when the
+	// signer configuration does not set one
+	DefaultAPKSignerPath = "/usr/share/java/apksigner.jar"
+
+	// ReSignPolicyStrip strips the existing signatures of a signed
+	// input and signs it, apksigner replaces the v1 signature files
+	// and the APK Signing Block. It is the default policy.
+	ReSignPolicyStrip = "strip"
+
+	// ReSignPolicyReject refuses to sign an already signed input
+	ReSignPolicyReject = "reject"
+
+	// ContentDigestSHA256 and ContentDigestSHA512 are the content
+	// digest algorithms of the v2 and v3 signatures
+	ContentDigestSHA256 = "sha256"
+	ContentDigestSHA512 = "sha512"
+
+	// v1SHA256MinSdkVersion is the first Android SDK version that
+	// verifies SHA-256 digests in v1 signatures, apksigner uses
+	// SHA-1 digests for APKs supporting older versions
+	v1SHA256MinSdkVersion = 18
 )
 
+// redactedArgFlags are the apksigner flags whose values are redacted
+// from the logged command line
+var redactedArgFlags = map[string]bool{
+	"--key":      true,
+	"--cert":     true,
+	"--ks":       true,
+	"--ks-pass":  true,
+	"--key-pass": true,
+}
+
+var (
+	// apksignerVersions are the outputs of `apksigner --version`
+	// by java and apksigner paths, they are read once for all the
+	// apk2 signers running the same apksigner
+	apksignerVersions   = make(map[[2]string]string)
+	apksignerVersionsMu sync.Mutex
+)
+
+// v1SignerNameRegexp matches the JAR signature file basenames apksigner
+// accepts for --v1-signer-name
+var v1SignerNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// apkSigBlockMagic ends the APK Signing Block holding the v2 and v3
+// signatures of an APK, right before its central directory
+var apkSigBlockMagic = []byte("APK Sig Block 42")
+
+// zipLocalFileHeaderMagic starts the first local file header of a ZIP
+// file such as an APK
+var zipLocalFileHeaderMagic = []byte("PK\x03\x04")
+
+// apksignerVersionRegexp matches the versions printed by
+// `apksigner --version` e.g. "0.9" or "31.0.0-rc1"
+var apksignerVersionRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*(-[a-zA-Z0-9.]+)?$`)
+
 // APK2Signer holds the configuration of the signer
 type APK2Signer struct {
 	signer.Configuration
@@ -41,6 +124,46 @@ type APK2Signer struct {
 
 	// v3Enabled indicates whether to issue v3 signatures
 	v3Enabled bool
+
+	// commandLogLevel is the level at which the apksigner command
+	// line is logged
+	commandLogLevel log.Level
+
+	// certFingerprint is the hex encoded SHA-256 fingerprint of the
+	// DER certificate apksigner embeds in the signed APKs
+	certFingerprint string
+
+	// rotationCertFingerprint is the hex encoded SHA-256 fingerprint
+	// of the rotation certificate apksigner signs the v3 signature
+	// with, empty without a rotation key
+	rotationCertFingerprint string
+
+	// certInfo are the fields of the certificate of the signer
+	certInfo *formats.CertificateInfo
+
+	// rotationPKCS8Key is the pkcs8 encoded rotation key apksigner
+	// signs with as the next signer, nil without key rotation
+	rotationPKCS8Key []byte
+
+	// sourceStampPKCS8Key is the pkcs8 encoded key apksigner signs
+	// source stamps with, nil without source stamps
+	sourceStampPKCS8Key []byte
+
+	// sourceStampCertDigest is the lower case hex SHA-256 digest of
+	// the DER source stamp certificate as printed by apksigner
+	sourceStampCertDigest string
+
+	// apkSignerVersion is the output of `apksigner --version` read
+	// at initialization, empty when it could not be read
+	apkSignerVersion string
+
+	// contentDigest and rotationContentDigest are the content digest
+	// algorithms apksigner selects for the signing and rotation keys
+	contentDigest, rotationContentDigest string
+
+	// ecdsaKey indicates whether the signing or rotation key is an
+	// ECDSA key, whose signatures are randomized
+	ecdsaKey bool
 }
 
 // New initializes an apk signer using a configuration
@@ -59,7 +182,7 @@ func New(conf signer.Configuration) (s *APK2Signer, err error) {
 
 	switch conf.Mode {
 	case ModeV3Enabled:
-		log.Printf("apk2: %s: v3 signing enabled", s.ID)
+		signer.Log(s.Configuration, "init").Info("apk2: v3 signing enabled")
 		s.v3Enabled = true
 	case "":
 		s.v3Enabled = false
@@ -68,36 +191,226 @@ func New(conf signer.Configuration) (s *APK2Signer, err error) {
 	}
 	s.Mode = conf.Mode
 
-	if conf.PrivateKey == "" {
-		return nil, fmt.Errorf("apk2: missing private key in signer configuration")
+	s.commandLogLevel = log.DebugLevel
+	if conf.CommandLogLevel != "" {
+		s.commandLogLevel, err = log.ParseLevel(conf.CommandLogLevel)
+		if err != nil {
+			return nil, fmt.Errorf("apk2: invalid command log level in signer configuration: %w", err)
+		}
 	}
-	s.PrivateKey = conf.PrivateKey
-	priv, err := conf.GetPrivateKey()
-	if err != nil {
-		return nil, fmt.Errorf("apk2: failed to get private key from configuration: %w", err)
+	s.CommandLogLevel = conf.CommandLogLevel
+
+	s.JavaPath = conf.JavaPath
+	if s.JavaPath == "" {
+		s.JavaPath = DefaultJavaPath
+	} else if _, err = exec.LookPath(s.JavaPath); err != nil {
+		return nil, fmt.Errorf("apk2: invalid java path in signer configuration: %w", err)
+	}
+	s.APKSignerPath = conf.APKSignerPath
+	if s.APKSignerPath == "" {
+		s.APKSignerPath = DefaultAPKSignerPath
+	} else if _, err = os.Stat(s.APKSignerPath); err != nil {
+		return nil, fmt.Errorf("apk2: invalid apksigner path in signer configuration: %w", err)
+	}
+	s.ZipalignPath = conf.ZipalignPath
+	if s.ZipalignPath != "" {
+		if _, err = exec.LookPath(s.ZipalignPath); err != nil {
+			return nil, fmt.Errorf("apk2: invalid zipalign path in signer configuration: %w", err)
+		}
+	}
+
+	s.apkSignerVersion = getApksignerVersion(s.JavaPath, s.APKSignerPath)
+	if s.apkSignerVersion != "" {
+		signer.Log(s.Configuration, "init").Infof("apk2: using apksigner version %s", s.apkSignerVersion)
 	}
-	switch priv.(type) {
-	case *ecdsa.PrivateKey:
-		// ecdsa is only supported in sdk 18 and higher
+
+	// the signing key is either a PEM private key or a key apksigner
+	// reads by alias from a keystore
+	hasKeystore := conf.KeystorePath != "" || conf.KeystorePassword != "" || conf.KeyAlias != ""
+	var isECDSA bool
+	switch {
+	case conf.PrivateKey != "" && hasKeystore:
+		return nil, fmt.Errorf("apk2: signer configuration must set either a private key or a keystore, not both")
+	case hasKeystore:
+		if conf.KeystorePath == "" || conf.KeystorePassword == "" || conf.KeyAlias == "" {
+			return nil, fmt.Errorf("apk2: keystore signer configuration must set the keystore path, password and key alias")
+		}
+		if _, err = os.Stat(conf.KeystorePath); err != nil {
+			return nil, fmt.Errorf("apk2: invalid keystore path in signer configuration: %w", err)
+		}
+		s.KeystorePath = conf.KeystorePath
+		s.KeystorePassword = conf.KeystorePassword
+		s.KeyAlias = conf.KeyAlias
+		// the key stays in the keystore, so its type is read from
+		// the certificate
+		block, _ := pem.Decode([]byte(conf.Certificate))
+		if block == nil {
+			return nil, fmt.Errorf("apk2: failed to parse PEM public cert in signer configuration")
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("apk2: failed to parse public cert in signer configuration: %w", err)
+		}
+		_, isECDSA = cert.PublicKey.(*ecdsa.PublicKey)
+	case conf.PrivateKey == "":
+		return nil, fmt.Errorf("apk2: missing private key or keystore in signer configuration")
+	default:
+		s.PrivateKey = conf.PrivateKey
+		// apksigner wants a pkcs8 encoded privkey in a file, which
+		// HSM keys cannot be exported to
+		priv, pkcs8Key, err := conf.GetPKCS8PrivateKey()
+		if errors.Is(err, signer.ErrNonExportableKey) {
+			return nil, fmt.Errorf("apk2: use a keystore key instead: %w", err)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("apk2: failed to get private key from configuration: %w", err)
+		}
+		_, isECDSA = priv.(*ecdsa.PrivateKey)
+		s.pkcs8Key = pkcs8Key
+	}
+
+	// the rotation key is the next signer apksigner signs with to
+	// rotate the signing key of an app
+	switch {
+	case conf.RotationKey == "" && conf.RotationCert == "":
+		if conf.RotationLineagePath != "" {
+			return nil, fmt.Errorf("apk2: rotation lineage path in signer configuration requires a rotation key")
+		}
+	case conf.RotationKey == "" || conf.RotationCert == "":
+		return nil, fmt.Errorf("apk2: rotation signer configuration must set both the rotation key and cert")
+	default:
+		rotationConf := signer.Configuration{ID: conf.ID, PrivateKey: conf.RotationKey}
+		priv, pkcs8Key, err := rotationConf.GetPKCS8PrivateKey()
+		if err != nil {
+			return nil, fmt.Errorf("apk2: failed to get rotation key from configuration: %w", err)
+		}
+		if _, ok := priv.(*ecdsa.PrivateKey); ok {
+			isECDSA = true
+		}
+		s.RotationKey = conf.RotationKey
+		s.rotationPKCS8Key = pkcs8Key
+		s.RotationCert = conf.RotationCert
+		// apksigner needs the lineage proving the rotation key is
+		// trusted by the current key to rotate it in v3 signatures
+		err = checkRotationLineage(conf.RotationLineagePath)
+		if err != nil {
+			return nil, err
+		}
+		s.RotationLineagePath = conf.RotationLineagePath
+	}
+
+	// the source stamp is signed with its own key, which does not
+	// change the content digests of the v2 and v3 signatures
+	switch {
+	case conf.SourceStampKey == "" && conf.SourceStampCert == "":
+	case conf.SourceStampKey == "" || conf.SourceStampCert == "":
+		return nil, fmt.Errorf("apk2: source stamp signer configuration must set both the source stamp key and cert")
+	default:
+		stampConf := signer.Configuration{ID: conf.ID, PrivateKey: conf.SourceStampKey}
+		_, pkcs8Key, err := stampConf.GetPKCS8PrivateKey()
+		if err != nil {
+			return nil, fmt.Errorf("apk2: failed to get source stamp key from configuration: %w", err)
+		}
+		block, _ := pem.Decode([]byte(conf.SourceStampCert))
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("apk2: failed to PEM decode source stamp certificate")
+		}
+		s.SourceStampKey = conf.SourceStampKey
+		s.SourceStampCert = conf.SourceStampCert
+		s.sourceStampPKCS8Key = pkcs8Key
+		s.sourceStampCertDigest = fmt.Sprintf("%x", sha256.Sum256(block.Bytes))
+	}
+
+	s.ecdsaKey = isECDSA
+
+	// ecdsa is only supported in sdk 18 and higher
+	minSdkFloor := 1
+	if isECDSA {
+		minSdkFloor = ecdsaMinSdkVersion
+	}
+	switch {
+	case conf.MinSDKVersion != "":
+		version, err := strconv.Atoi(conf.MinSDKVersion)
+		if err != nil {
+			return nil, fmt.Errorf("apk2: min sdk version %q in signer configuration is not a number", conf.MinSDKVersion)
+		}
+		if version < minSdkFloor {
+			return nil, fmt.Errorf("apk2: min sdk version %d in signer configuration is lower than %d, the minimum for the key type", version, minSdkFloor)
+		}
+		s.minSdkVersion = strconv.Itoa(version)
+		signer.Log(s.Configuration, "init").Infof("apk2: setting min android sdk version to configured %s", s.minSdkVersion)
+	case minSdkFloor == ecdsaMinSdkVersion:
 		s.minSdkVersion = "18"
-		log.Printf("apk2: setting min android sdk version to 18 as required to sign with ecdsa")
+		signer.Log(s.Configuration, "init").Info("apk2: setting min android sdk version to 18 as required to sign with ecdsa")
 	default:
-		log.Printf("apk2: setting min android sdk version to 9")
+		signer.Log(s.Configuration, "init").Info("apk2: setting min android sdk version to 9")
 		s.minSdkVersion = "9"
 	}
-	//apksigner wants a pkcs8 encoded privkey
-	s.pkcs8Key, err = x509.MarshalPKCS8PrivateKey(priv)
-	if err != nil {
-		return nil, fmt.Errorf("apk2: failed to encode private key to pkcs8: %w", err)
-	}
+	s.MinSDKVersion = conf.MinSDKVersion
 
 	if conf.Certificate == "" {
 		return nil, fmt.Errorf("apk2: missing public cert in signer configuration")
 	}
 	s.Certificate = conf.Certificate
+	s.certInfo, err = signer.ParseCertificateInfo(s.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("apk2: failed to parse public cert in signer configuration: %w", err)
+	}
+	s.CertExpiryWarningDays = conf.CertExpiryWarningDays
+	err = signer.CheckCertificateValidity(s.Configuration, s.certInfo, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("apk2: invalid public cert in signer configuration: %w", err)
+	}
+	s.certFingerprint = s.certInfo.SHA256Fingerprint
+	s.contentDigest, err = certContentDigest(s.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("apk2: failed to parse public cert in signer configuration: %w", err)
+	}
+
+	if s.RotationCert != "" {
+		rotationCertInfo, err := signer.ParseCertificateInfo(s.RotationCert)
+		if err != nil {
+			return nil, fmt.Errorf("apk2: failed to parse rotation cert in signer configuration: %w", err)
+		}
+		err = signer.CheckCertificateValidity(s.Configuration, rotationCertInfo, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("apk2: invalid rotation cert in signer configuration: %w", err)
+		}
+		s.rotationContentDigest, err = certContentDigest(s.RotationCert)
+		if err != nil {
+			return nil, fmt.Errorf("apk2: failed to parse rotation cert in signer configuration: %w", err)
+		}
+		s.rotationCertFingerprint = rotationCertInfo.SHA256Fingerprint
+	}
 	return
 }
 
+// certContentDigest returns the content digest algorithm apksigner
+// selects for the key of a PEM certificate: SHA-512 for RSA keys
+// larger than 3072 bits and ECDSA keys on curves larger than 256 bits,
+// and SHA-256 otherwise
+func certContentDigest(certPEM string) (string, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return "", fmt.Errorf("failed to PEM decode certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() > 3072 {
+			return ContentDigestSHA512, nil
+		}
+	case *ecdsa.PublicKey:
+		if pub.Curve.Params().BitSize > 256 {
+			return ContentDigestSHA512, nil
+		}
+	}
+	return ContentDigestSHA256, nil
+}
+
 // Config returns the configuration of the current signer
 func (s *APK2Signer) Config() signer.Configuration {
 	return signer.Configuration{
@@ -106,87 +419,724 @@ func (s *APK2Signer) Config() signer.Configuration {
 		Mode:        s.Mode,
 		PrivateKey:  s.PrivateKey,
 		Certificate: s.Certificate,
+
+		CertExpiryWarningDays: s.CertExpiryWarningDays,
+
+		CommandLogLevel: s.CommandLogLevel,
+		JavaPath:        s.JavaPath,
+		APKSignerPath:   s.APKSignerPath,
+		ZipalignPath:    s.ZipalignPath,
+		MinSDKVersion:   s.MinSDKVersion,
+
+		KeystorePath:     s.KeystorePath,
+		KeystorePassword: s.KeystorePassword,
+		KeyAlias:         s.KeyAlias,
+
+		RotationKey:         s.RotationKey,
+		RotationCert:        s.RotationCert,
+		RotationLineagePath: s.RotationLineagePath,
+
+		SourceStampKey:  s.SourceStampKey,
+		SourceStampCert: s.SourceStampCert,
 	}
 }
 
-// SignFile signs a whole aligned APK file with v1 and v2 signatures
+// SignFile signs a whole aligned APK file with the signature schemes
+// enabled by the signer and the options, v1 and v2 by default. It
+// errors when the options enable v4 signing, whose signature is a
+// sidecar file only SignFileWithSidecar returns.
 func (s *APK2Signer) SignFile(file []byte, options interface{}) (signer.SignedFile, error) {
-	keyPath, err := ioutil.TempFile("", fmt.Sprintf("apk2_%s.key", s.ID))
+	return s.SignFileContext(context.Background(), file, options)
+}
+
+// SignFileContext signs a whole aligned APK file like SignFile, and
+// kills apksigner and returns an error wrapping the context error when
+// the context is done before it completes
+func (s *APK2Signer) SignFileContext(ctx context.Context, file []byte, options interface{}) (signer.SignedFile, error) {
+	opt, err := GetOptions(options)
 	if err != nil {
-		return nil, fmt.Errorf("apk2: failed to create tempfile with private key: %w", err)
+		return nil, fmt.Errorf("apk2: failed to get options: %w", err)
+	}
+	if opt.V4Enabled != nil && *opt.V4Enabled {
+		return nil, fmt.Errorf("apk2: v4 signing outputs an idsig sidecar file that SignFile cannot return")
 	}
-	defer os.Remove(keyPath.Name())
-	err = ioutil.WriteFile(keyPath.Name(), []byte(s.pkcs8Key), 0400)
+	signed, _, err := s.signFile(ctx, file, opt)
+	return signed, err
+}
+
+// SignFileWithSidecar signs a whole aligned APK file like
+// SignFileContext, and returns the .idsig file apksigner outputs next
+// to it when the options enable v4 signing
+func (s *APK2Signer) SignFileWithSidecar(ctx context.Context, file []byte, options interface{}) (signed signer.SignedFile, idsig []byte, err error) {
+	opt, err := GetOptions(options)
 	if err != nil {
-		return nil, fmt.Errorf("apk2: failed to write private key to tempfile: %w", err)
+		return nil, nil, fmt.Errorf("apk2: failed to get options: %w", err)
 	}
+	return s.signFile(ctx, file, opt)
+}
 
-	certPath, err := ioutil.TempFile("", fmt.Sprintf("apk2_%s.cert", s.ID))
+// SignFileStream signs an aligned APK read from input like SignFile,
+// and writes the signed APK to output. The input is spooled to the
+// temp file apksigner signs in place without being held in memory,
+// and nothing is written to output when signing fails. The signing
+// endpoints do not use it, it is for library callers.
+func (s *APK2Signer) SignFileStream(input io.Reader, output io.Writer, options interface{}) error {
+	opt, err := GetOptions(options)
 	if err != nil {
-		return nil, fmt.Errorf("apk2: failed to create tempfile for input to sign: %w", err)
+		return fmt.Errorf("apk2: failed to get options: %w", err)
+	}
+	if opt.V4Enabled != nil && *opt.V4Enabled {
+		return fmt.Errorf("apk2: v4 signing outputs an idsig sidecar file that SignFileStream cannot return")
+	}
+	_, err = s.signStream(context.Background(), input, output, opt)
+	return err
+}
+
+// InputFormats returns the format of the APKs the signer signs, which
+// are ZIP files starting with a local file header
+func (s *APK2Signer) InputFormats() []signer.InputFormat {
+	return []signer.InputFormat{{
+		ContentType: "application/vnd.android.package-archive",
+		Magic:       zipLocalFileHeaderMagic,
+	}}
+}
+
+// checkRotationLineage checks the rotation lineage path of a signer
+// configuration is set to a regular file the signer can read
+func checkRotationLineage(lineagePath string) error {
+	if lineagePath == "" {
+		return fmt.Errorf("apk2: rotation signer configuration must set the rotation lineage path of the lineage output by apksigner rotate")
 	}
-	defer os.Remove(certPath.Name())
-	err = ioutil.WriteFile(certPath.Name(), []byte(s.Certificate), 0400)
+	lineage, err := os.Open(lineagePath)
 	if err != nil {
-		return nil, fmt.Errorf("apk2: failed to write public cert to tempfile: %w", err)
+		return fmt.Errorf("apk2: invalid rotation lineage path in signer configuration: %w", err)
 	}
+	defer lineage.Close()
+	info, err := lineage.Stat()
+	if err != nil {
+		return fmt.Errorf("apk2: invalid rotation lineage path in signer configuration: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("apk2: invalid rotation lineage path %q in signer configuration is not a regular file", lineagePath)
+	}
+	_, err = lineage.Read(make([]byte, 1))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("apk2: failed to read rotation lineage %q: %w", lineagePath, err)
+	}
+	return nil
+}
 
-	// write the input to a temp file
-	h := sha256.New()
-	h.Write(file)
-	tmpAPKFile, err := ioutil.TempFile("", fmt.Sprintf("apk2_input_%x.apk", h.Sum(nil)))
+// signFile signs an APK held in memory and returns the signed APK and
+// its v4 signature when enabled
+func (s *APK2Signer) signFile(ctx context.Context, file []byte, opt Options) (signer.SignedFile, []byte, error) {
+	var signed bytes.Buffer
+	signed.Grow(len(file))
+	idsig, err := s.signStream(ctx, bytes.NewReader(file), &signed, opt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return signer.SignedFile(signed.Bytes()), idsig, nil
+}
+
+// signStream copies an APK to a temp file, signs it with apksigner,
+// writes the signed APK to output and returns its v4 signature when
+// the options enable it
+func (s *APK2Signer) signStream(ctx context.Context, input io.Reader, output io.Writer, opt Options) (idsig []byte, err error) {
+	switch opt.ReSignPolicy {
+	case "", ReSignPolicyStrip, ReSignPolicyReject:
+	default:
+		return nil, fmt.Errorf("apk2: invalid re-sign policy %q, must be empty, %q or %q",
+			opt.ReSignPolicy, ReSignPolicyStrip, ReSignPolicyReject)
+	}
+	schemeArgs, err := s.signingSchemeArgs(opt)
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkContentDigestOption(opt)
+	if err != nil {
+		return nil, err
+	}
+	deterministicArgs, err := s.deterministicArgs(opt)
+	if err != nil {
+		return nil, err
+	}
+	// the key, cert and APK are written to a directory only the
+	// autograph user can read that is removed on every return, so
+	// failures do not leave the private key on disk
+	tmpDir, err := os.MkdirTemp("", "apk2_sign_")
+	if err != nil {
+		return nil, fmt.Errorf("apk2: failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// copy the input to a temp file, hashing it on the way
+	tmpAPKFile, err := os.OpenFile(filepath.Join(tmpDir, "input.apk"), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
 		return nil, fmt.Errorf("apk2: failed to create tempfile for input to sign: %w", err)
 	}
-	defer os.Remove(tmpAPKFile.Name())
-	err = ioutil.WriteFile(tmpAPKFile.Name(), file, 0755)
+	defer tmpAPKFile.Close()
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmpAPKFile, h), input)
 	if err != nil {
 		return nil, fmt.Errorf("apk2: failed to write tempfile for input to sign: %w", err)
 	}
+	inputHash := fmt.Sprintf("%x", h.Sum(nil))
 
-	args := []string{
-		"-jar", "/usr/share/java/apksigner.jar", "sign",
-		"--v1-signing-enabled", "true",
-		"--v2-signing-enabled", "true",
+	// misrouted inputs fail here with a clear error rather than
+	// with the output of apksigner
+	header := make([]byte, len(zipLocalFileHeaderMagic))
+	n, err := tmpAPKFile.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("apk2: failed to read input header: %w", err)
+	}
+	err = signer.CheckInputFormat(header[:n], s.InputFormats())
+	if err != nil {
+		return nil, fmt.Errorf("apk2: refusing to sign input: %w", err)
+	}
+
+	// the checks of the input read the temp file rather than the
+	// input, which a stream may not allow reading twice
+	if opt.ReSignPolicy == ReSignPolicyReject {
+		signed, err := isSigned(tmpAPKFile, size)
+		if err != nil {
+			return nil, fmt.Errorf("apk2: failed to check whether input is signed: %w", err)
+		}
+		if signed {
+			return nil, fmt.Errorf("apk2: refusing to sign already signed input with re-sign policy %q", ReSignPolicyReject)
+		}
+	}
+	if opt.V1Enabled != nil && !*opt.V1Enabled {
+		err = s.checkV1Optional(tmpAPKFile, size)
+		if err != nil {
+			return nil, err
+		}
+	} else if opt.ContentDigest == ContentDigestSHA256 {
+		err = s.checkV1SHA256Digest(tmpAPKFile, size)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var v1SignerName string
+	if opt.PreserveV1SignerName {
+		v1SignerName, err = getV1SignerName(tmpAPKFile, size)
+		if err != nil {
+			return nil, fmt.Errorf("apk2: failed to read v1 signer name from input: %w", err)
+		}
+		signer.Log(s.Configuration, "sign").WithField("input_hash", inputHash).Debugf("apk2: preserving v1 signer name %q", v1SignerName)
+	}
+
+	// zipalign and apksigner run in the external signer slot, which
+	// requests wait for until their context is done
+	release, err := signer.AcquireExternalSigner(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("apk2: failed to start signing: %w", err)
 	}
-	if s.v3Enabled {
-		args = append(args, "--v3-signing-enabled", "true")
+	defer release()
+
+	if s.ZipalignPath != "" {
+		err = s.zipalign(ctx, tmpAPKFile.Name())
+		if err != nil {
+			return nil, err
+		}
 	} else {
-		// apksigner signs with v3 if the minsdk version supports it
-		args = append(args, "--v3-signing-enabled", "false")
+		aligned, err := isAligned(tmpAPKFile, size)
+		if err != nil {
+			return nil, fmt.Errorf("apk2: failed to check whether input is aligned: %w", err)
+		}
+		if !aligned {
+			signer.Log(s.Configuration, "sign").WithField("input_hash", inputHash).Warn("apk2: signing unaligned input without a zipalign path in the signer configuration")
+		}
+	}
+
+	keyArgs, err := s.keyArgs(tmpDir)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"-jar", s.APKSignerPath, "sign"}
+	args = append(args, schemeArgs...)
+	args = append(args, deterministicArgs...)
+	if v1SignerName != "" {
+		args = append(args, "--v1-signer-name", v1SignerName)
+	}
+	args = append(args, keyArgs...)
+	args = append(args, tmpAPKFile.Name())
+	s.logCommand(args, inputHash)
+	apkSigCmd := exec.CommandContext(ctx, s.JavaPath, args...)
+	if opt.Deterministic {
+		apkSigCmd.Env = deterministicEnv(os.Environ())
 	}
-	args = append(args,
-		"--key", keyPath.Name(),
-		"--cert", certPath.Name(),
-		tmpAPKFile.Name(),
-	)
-	apkSigCmd := exec.Command("java", args...)
 
+	// the apksigner output is logged and returned in errors without
+	// the paths of the key files and the keystore password
+	outputSecrets := []string{tmpDir, s.KeystorePath, s.KeystorePassword}
 	out, err := apkSigCmd.CombinedOutput()
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("apk2: signing stopped before apksigner completed: %w", ctx.Err())
+		}
 		if !bytes.Contains(out, []byte("com.android.apksig.apk.MinSdkVersionException")) {
-			return nil, fmt.Errorf("apk2: failed to sign\n%s: %w", out, err)
+			return nil, s.toolError("apk2: failed to sign", out, outputSecrets, err)
 		} else {
-			log.Printf("apk2: APK does not provide minSdkVersion. Attempting to sign again with: --min-sdk-version %s", s.minSdkVersion)
+			signer.Log(s.Configuration, "sign").WithField("input_hash", inputHash).Infof("apk2: APK does not provide minSdkVersion. Attempting to sign again with: --min-sdk-version %s", s.minSdkVersion)
 
 			args = insertIntoSliceAtIndex(args, "--min-sdk-version", len(args)-1)
 			args = insertIntoSliceAtIndex(args, s.minSdkVersion, len(args)-1)
 
-			apkSigCmd = exec.Command("java", args...)
+			s.logCommand(args, inputHash)
+			apkSigCmd = exec.CommandContext(ctx, s.JavaPath, args...)
+			if opt.Deterministic {
+				apkSigCmd.Env = deterministicEnv(os.Environ())
+			}
 			out, err = apkSigCmd.CombinedOutput()
 
 			if err != nil {
-				return nil, fmt.Errorf("apk2: failed to sign even when forcing --min-sdk-version\n%s: %w", out, err)
+				if ctx.Err() != nil {
+					return nil, fmt.Errorf("apk2: signing stopped before apksigner completed: %w", ctx.Err())
+				}
+				return nil, s.toolError("apk2: failed to sign even when forcing --min-sdk-version", out, outputSecrets, err)
 			}
 		}
 	}
-	log.Debugf("signed as:\n%s\n", string(out))
+	signer.Log(s.Configuration, "sign").WithField("input_hash", inputHash).Debugf("apk2: signed as:\n%s", signer.LogOutput(out, outputSecrets...))
 
-	signedApk, err := ioutil.ReadFile(tmpAPKFile.Name())
+	if opt.V4Enabled != nil && *opt.V4Enabled {
+		// apksigner writes the v4 signature next to the output APK
+		idsig, err = ioutil.ReadFile(tmpAPKFile.Name() + ".idsig")
+		if err != nil {
+			return nil, fmt.Errorf("apk2: failed to read v4 signature file: %w", err)
+		}
+	}
+	// apksigner replaces the temp file, so the signed APK is read
+	// from its path rather than the open descriptor
+	signedAPK, err := os.Open(tmpAPKFile.Name())
 	if err != nil {
 		return nil, fmt.Errorf("apk2: failed to read signed file: %w", err)
 	}
-	return signer.SignedFile(signedApk), nil
+	defer signedAPK.Close()
+	_, err = io.Copy(output, signedAPK)
+	if err != nil {
+		return nil, fmt.Errorf("apk2: failed to write signed file: %w", err)
+	}
+	return idsig, nil
+}
+
+// zipalign aligns the uncompressed entries of the APK at apkPath on 4
+// bytes and its uncompressed shared libraries on memory pages, and
+// replaces the APK with the aligned one
+func (s *APK2Signer) zipalign(ctx context.Context, apkPath string) error {
+	alignedPath := apkPath + ".aligned"
+	out, err := exec.CommandContext(ctx, s.ZipalignPath, "-p", "-f", "4", apkPath, alignedPath).CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("apk2: signing stopped before zipalign completed: %w", ctx.Err())
+		}
+		return fmt.Errorf("apk2: failed to zipalign\n%s: %w", signer.LogOutput(out), err)
+	}
+	err = os.Rename(alignedPath, apkPath)
+	if err != nil {
+		return fmt.Errorf("apk2: failed to replace input with aligned APK: %w", err)
+	}
+	return nil
+}
+
+// keyArgs writes the signing key files to tmpDir and returns the
+// apksigner flags selecting them: --key and --cert for a PEM private
+// key, or --ks, --ks-key-alias and --ks-pass for a keystore key. The
+// keystore password is passed in a file so it does not show on the
+// command line of apksigner. With a rotation key, the flags are
+// followed by --next-signer with the --key and --cert of the rotation
+// key, and --lineage with the rotation lineage.
+func (s *APK2Signer) keyArgs(tmpDir string) (args []string, err error) {
+	if s.KeystorePath != "" {
+		passPath := filepath.Join(tmpDir, "keystore.pass")
+		err = ioutil.WriteFile(passPath, []byte(s.KeystorePassword), 0400)
+		if err != nil {
+			return nil, fmt.Errorf("apk2: failed to write keystore password to tempfile: %w", err)
+		}
+		args = []string{
+			"--ks", s.KeystorePath,
+			"--ks-key-alias", s.KeyAlias,
+			"--ks-pass", "file:" + passPath,
+		}
+	} else {
+		args, err = writeKeyFiles(tmpDir, "", s.pkcs8Key, s.Certificate)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.rotationPKCS8Key != nil {
+		rotationArgs, err := writeKeyFiles(tmpDir, "rotation_", s.rotationPKCS8Key, s.RotationCert)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--next-signer")
+		args = append(args, rotationArgs...)
+		args = append(args, "--lineage", s.RotationLineagePath)
+	}
+	if s.sourceStampPKCS8Key != nil {
+		stampArgs, err := writeKeyFiles(tmpDir, "stamp_", s.sourceStampPKCS8Key, s.SourceStampCert)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--stamp-signer")
+		args = append(args, stampArgs...)
+	}
+	return args, nil
+}
+
+// writeKeyFiles writes a pkcs8 private key and its PEM certificate to
+// tmpDir with the file name prefix, and returns the --key and --cert
+// apksigner flags selecting them
+func writeKeyFiles(tmpDir, prefix string, pkcs8Key []byte, cert string) ([]string, error) {
+	keyPath := filepath.Join(tmpDir, prefix+"key.pk8")
+	err := ioutil.WriteFile(keyPath, pkcs8Key, 0400)
+	if err != nil {
+		return nil, fmt.Errorf("apk2: failed to write private key to tempfile: %w", err)
+	}
+
+	certPath := filepath.Join(tmpDir, prefix+"cert.pem")
+	err = ioutil.WriteFile(certPath, []byte(cert), 0400)
+	if err != nil {
+		return nil, fmt.Errorf("apk2: failed to write public cert to tempfile: %w", err)
+	}
+	return []string{"--key", keyPath, "--cert", certPath}, nil
+}
+
+// signingSchemeArgs returns the apksigner flags enabling or disabling
+// the v1, v2, v3 and v4 signature schemes. Schemes the options do not
+// set keep the defaults of the signer: v1 and v2 are enabled, v3 is
+// enabled in the v3enabled mode and v4 is disabled. It errors when no
+// scheme is enabled, or v4 is enabled without v2 or v3.
+func (s *APK2Signer) signingSchemeArgs(opt Options) ([]string, error) {
+	v1Enabled, v2Enabled, v3Enabled := true, true, s.v3Enabled
+	if opt.V1Enabled != nil {
+		v1Enabled = *opt.V1Enabled
+	}
+	if opt.V2Enabled != nil {
+		v2Enabled = *opt.V2Enabled
+	}
+	if opt.V3Enabled != nil {
+		v3Enabled = *opt.V3Enabled
+	}
+	if !v1Enabled && !v2Enabled && !v3Enabled {
+		return nil, fmt.Errorf("apk2: at least one of the v1, v2 and v3 signature schemes must be enabled")
+	}
+	// the v3 flag is always set, apksigner signs with v3 by default
+	// when the min sdk version supports it
+	args := []string{
+		"--v1-signing-enabled", strconv.FormatBool(v1Enabled),
+		"--v2-signing-enabled", strconv.FormatBool(v2Enabled),
+		"--v3-signing-enabled", strconv.FormatBool(v3Enabled),
+	}
+	if opt.V4Enabled != nil && *opt.V4Enabled {
+		// the v4 signature covers the digest of the v2 or v3
+		// signature, and is not supported by older apksigner
+		// versions so the flag is only set to enable it
+		if !v2Enabled && !v3Enabled {
+			return nil, fmt.Errorf("apk2: v4 signing requires the v2 or v3 signature scheme to be enabled")
+		}
+		args = append(args, "--v4-signing-enabled", "true")
+	}
+	return args, nil
+}
+
+// deterministicArgs returns the apksigner flags signing the same input
+// to the same output when the options ask for deterministic signing.
+// apksigner dates the entries it adds with the latest date of the
+// input entries and RSA signatures do not vary, but DSA signatures
+// must be made with RFC 6979 nonces and ECDSA signatures are always
+// randomized, so ECDSA signers refuse deterministic requests.
+func (s *APK2Signer) deterministicArgs(opt Options) ([]string, error) {
+	if !opt.Deterministic {
+		return nil, nil
+	}
+	if s.ecdsaKey {
+		return nil, fmt.Errorf("apk2: deterministic signing is not supported by signers with ECDSA keys, whose signatures are randomized")
+	}
+	return []string{"--deterministic-dsa-signing", "true"}, nil
+}
+
+// deterministicEnv returns the environment of the apksigner process of
+// deterministic requests: env without SOURCE_DATE_EPOCH, and with the
+// UTC timezone and C locale, so the output does not depend on the
+// environment of the server
+func deterministicEnv(env []string) []string {
+	var out []string
+	for _, kv := range env {
+		switch strings.SplitN(kv, "=", 2)[0] {
+		case "SOURCE_DATE_EPOCH", "TZ", "LC_ALL":
+			continue
+		}
+		out = append(out, kv)
+	}
+	return append(out, "TZ=UTC", "LC_ALL=C")
+}
+
+// checkV1Optional returns an error when an APK of size bytes can be
+// installed on Android versions that require v1 signatures, i.e. its
+// minSdkVersion, or the min sdk version of the signer when it declares
+// none, is lower than 24
+func (s *APK2Signer) checkV1Optional(apk io.ReaderAt, size int64) error {
+	minSdkVersion, err := s.getSigningMinSdkVersion(apk, size)
+	if err != nil {
+		return err
+	}
+	if minSdkVersion < v1OptionalMinSdkVersion {
+		return fmt.Errorf("apk2: refusing to disable v1 signing of an APK with min sdk version %d, Android versions below %d require v1 signatures", minSdkVersion, v1OptionalMinSdkVersion)
+	}
+	return nil
+}
+
+// getSigningMinSdkVersion returns the min sdk version apksigner signs
+// an APK of size bytes for: its minSdkVersion, or the min sdk version
+// of the signer when it declares none
+func (s *APK2Signer) getSigningMinSdkVersion(apk io.ReaderAt, size int64) (int, error) {
+	minSdkVersion, found, err := getMinSdkVersion(apk, size)
+	if err != nil {
+		return 0, fmt.Errorf("apk2: failed to read minSdkVersion from input: %w", err)
+	}
+	if !found {
+		minSdkVersion, err = strconv.Atoi(s.minSdkVersion)
+		if err != nil {
+			return 0, fmt.Errorf("apk2: invalid min sdk version %q of signer: %w", s.minSdkVersion, err)
+		}
+	}
+	return minSdkVersion, nil
+}
+
+// checkContentDigestOption returns an error when the content digest
+// option is not the digest apksigner selects for the keys of the
+// signer. apksigner has no flag to choose the digest, so the option
+// makes the choice explicit and refuses requests that would be signed
+// with another digest. The v1 scheme never uses SHA-512 digests.
+func (s *APK2Signer) checkContentDigestOption(opt Options) error {
+	switch opt.ContentDigest {
+	case "":
+		return nil
+	case ContentDigestSHA256, ContentDigestSHA512:
+	default:
+		return fmt.Errorf("apk2: invalid content digest %q, must be empty, %q or %q",
+			opt.ContentDigest, ContentDigestSHA256, ContentDigestSHA512)
+	}
+	if s.contentDigest != opt.ContentDigest {
+		return fmt.Errorf("apk2: signer %q signs with %s content digests, apksigner selects the digest from the key size and cannot use %s",
+			s.ID, s.contentDigest, opt.ContentDigest)
+	}
+	v3Enabled := s.v3Enabled
+	if opt.V3Enabled != nil {
+		v3Enabled = *opt.V3Enabled
+	}
+	if v3Enabled && s.rotationContentDigest != "" && s.rotationContentDigest != opt.ContentDigest {
+		return fmt.Errorf("apk2: signer %q signs v3 signatures with %s content digests of its rotation key, apksigner selects the digest from the key size and cannot use %s",
+			s.ID, s.rotationContentDigest, opt.ContentDigest)
+	}
+	if opt.ContentDigest == ContentDigestSHA512 && (opt.V1Enabled == nil || *opt.V1Enabled) {
+		return fmt.Errorf("apk2: v1 signatures do not support %s digests, disable v1 signing to use them", ContentDigestSHA512)
+	}
+	return nil
+}
+
+// checkV1SHA256Digest returns an error when apksigner would sign an
+// APK of size bytes with SHA-1 digests in its v1 signature, i.e. its
+// signing min sdk version is lower than 18
+func (s *APK2Signer) checkV1SHA256Digest(apk io.ReaderAt, size int64) error {
+	minSdkVersion, err := s.getSigningMinSdkVersion(apk, size)
+	if err != nil {
+		return err
+	}
+	if minSdkVersion < v1SHA256MinSdkVersion {
+		return fmt.Errorf("apk2: refusing to sign an APK with min sdk version %d with %s content digests, its v1 signature uses SHA-1 digests below min sdk version %d",
+			minSdkVersion, ContentDigestSHA256, v1SHA256MinSdkVersion)
+	}
+	return nil
+}
+
+// logCommand logs the apksigner command line with the values of the
+// key and cert flags redacted at the configured command log level
+func (s *APK2Signer) logCommand(args []string, inputHash string) {
+	signer.Log(s.Configuration, "sign").WithFields(log.Fields{
+		"input_hash":        inputHash,
+		"command":           s.JavaPath,
+		"args":              redactArgs(args),
+		"apksigner_version": s.ToolVersion(),
+	}).Log(s.commandLogLevel, "apk2: running apksigner")
+}
+
+// VerifyFile verifies the v1, v2 and v3 signatures of a signed APK
+// like Verify, and that they were made with the certificate of the
+// signer. With a rotation key, the v3 signature can also be made with
+// the rotation certificate, which apksigner signs it with.
+func (s *APK2Signer) VerifyFile(file []byte, signed signer.SignedFile) error {
+	certs, err := verifyAPK(signed)
+	if err != nil {
+		return err
+	}
+	return checkCertFingerprints(certs, s.certFingerprint, s.rotationCertFingerprint)
+}
+
+// CertFingerprint returns the hex encoded SHA-256 fingerprint of the
+// certificate of the signer, as printed by `apksigner verify
+// --print-certs`
+func (s *APK2Signer) CertFingerprint() string {
+	return s.certFingerprint
+}
+
+// CertificateInfo returns the fields of the certificate of the signer
+// parsed at initialization
+func (s *APK2Signer) CertificateInfo() *formats.CertificateInfo {
+	return s.certInfo
+}
+
+// ToolVersion returns the apksigner version read at initialization
+// or an empty string when it could not be read
+func (s *APK2Signer) ToolVersion() string {
+	return s.apkSignerVersion
+}
+
+// toolError returns the error of a failed apksigner run with its
+// output redacted of the secrets and the apksigner version
+func (s *APK2Signer) toolError(msg string, out []byte, secrets []string, err error) error {
+	return &signer.ToolError{
+		Msg:     msg,
+		Tool:    "apksigner",
+		Version: s.apkSignerVersion,
+		Output:  signer.LogOutput(out, secrets...),
+		Err:     err,
+	}
+}
+
+// getApksignerVersion returns the version of an apksigner jar, running
+// `apksigner --version` on the first call for the java and apksigner
+// paths. It logs and returns an empty string when the version cannot
+// be read, since signing reports its own error when apksigner is not
+// available.
+func getApksignerVersion(javaPath, apksignerPath string) string {
+	apksignerVersionsMu.Lock()
+	defer apksignerVersionsMu.Unlock()
+
+	key := [2]string{javaPath, apksignerPath}
+	if version, ok := apksignerVersions[key]; ok {
+		return version
+	}
+	apksignerVersions[key] = ""
+	out, err := exec.Command(javaPath, "-jar", apksignerPath, "--version").CombinedOutput()
+	if err != nil {
+		log.Warnf("apk2: failed to get apksigner version of %s\n%s: %v", apksignerPath, signer.LogOutput(out), err)
+		return ""
+	}
+	version, err := parseApksignerVersion(out)
+	if err != nil {
+		log.Warnf("apk2: failed to get apksigner version of %s: %v", apksignerPath, err)
+		return ""
+	}
+	apksignerVersions[key] = version
+	return version
+}
+
+// parseApksignerVersion returns the version from the output of
+// `apksigner --version` e.g. "0.9" or "30.0.3"
+func parseApksignerVersion(out []byte) (string, error) {
+	version := strings.TrimSpace(string(out))
+	if !apksignerVersionRegexp.MatchString(version) {
+		return "", fmt.Errorf("unexpected apksigner version output %q", out)
+	}
+	return version, nil
+}
+
+// redactArgs returns a copy of the apksigner args with the values of
+// the flags in redactedArgFlags replaced
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		if i > 0 && redactedArgFlags[args[i-1]] {
+			redacted[i] = "[redacted]"
+			continue
+		}
+		redacted[i] = arg
+	}
+	return redacted
+}
+
+// HasSourceStamp returns whether the signer adds a source stamp to the
+// APKs it signs
+func (s *APK2Signer) HasSourceStamp() bool {
+	return s.sourceStampCertDigest != ""
+}
+
+// VerifySourceStamp runs the apksigner of the signer to verify the
+// source stamp of a signed APK, and checks that the stamp was signed
+// with the source stamp certificate of the signer. It returns an error
+// when the signer has no source stamp certificate, the APK has no
+// source stamp, or the stamp does not verify or was signed with
+// another certificate. apksigner runs in the external signer slot
+// until it completes or the context is done.
+//
+// apksigner does not expose source stamp results in its exit code, so
+// this parses the output of `apksigner verify --verbose --print-certs`
+func (s *APK2Signer) VerifySourceStamp(ctx context.Context, signedAPK []byte) error {
+	if !s.HasSourceStamp() {
+		return fmt.Errorf("apk2: signer %q has no source stamp certificate", s.ID)
+	}
+	tmpDir, err := os.MkdirTemp("", "apk2_verify_stamp_")
+	if err != nil {
+		return fmt.Errorf("apk2: failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpAPKFile, err := os.OpenFile(filepath.Join(tmpDir, "signed.apk"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("apk2: failed to create tempfile for APK to verify: %w", err)
+	}
+	_, err = tmpAPKFile.Write(signedAPK)
+	if closeErr := tmpAPKFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("apk2: failed to write tempfile for APK to verify: %w", err)
+	}
+
+	release, err := signer.AcquireExternalSigner(ctx)
+	if err != nil {
+		return fmt.Errorf("apk2: failed to start source stamp verification: %w", err)
+	}
+	defer release()
+	out, err := exec.CommandContext(ctx, s.JavaPath, "-jar", s.APKSignerPath, "verify",
+		"--verbose", "--print-certs", tmpAPKFile.Name()).CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("apk2: source stamp verification stopped before apksigner completed: %w", ctx.Err())
+		}
+		return s.toolError("apk2: failed to verify APK", out, []string{tmpDir}, err)
+	}
+	verified, digest := parseSourceStampVerifyOutput(out)
+	if !verified {
+		return fmt.Errorf("apk2: source stamp did not verify\n%s", signer.LogOutput(out, tmpDir))
+	}
+	if digest != s.sourceStampCertDigest {
+		return fmt.Errorf("apk2: source stamp signer certificate SHA-256 digest %q does not match expected %q", digest, s.sourceStampCertDigest)
+	}
+	return nil
+}
+
+// parseSourceStampVerifyOutput returns whether apksigner reported a
+// verified source stamp and the lower case hex SHA-256 digest of the
+// stamp signer certificate
+func parseSourceStampVerifyOutput(out []byte) (verified bool, certDigest string) {
+	const (
+		verifiedPrefix = "Verified for SourceStamp: "
+		digestPrefix   = "Source Stamp Signer certificate SHA-256 digest: "
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, verifiedPrefix):
+			verified = strings.TrimPrefix(line, verifiedPrefix) == "true"
+		case strings.HasPrefix(line, digestPrefix):
+			certDigest = strings.ToLower(strings.TrimPrefix(line, digestPrefix))
+		}
+	}
+	return
 }
 
 // go 1.16 doesn't support generics.
@@ -202,8 +1152,132 @@ func insertIntoSliceAtIndex(destination []string, element string, index int) []s
 	return destination
 }
 
-// Options are not implemented for this signer
+// getV1SignerName returns the basename of the v1 JAR signature file
+// in the META-INF directory of an APK e.g. "CERT" for META-INF/CERT.SF
+//
+// It errors when the APK has zero or multiple v1 signers or the
+// signer name is not a valid --v1-signer-name
+func getV1SignerName(apk io.ReaderAt, size int64) (string, error) {
+	names, err := getV1SignerNames(apk, size)
+	if err != nil {
+		return "", err
+	}
+	switch len(names) {
+	case 0:
+		return "", fmt.Errorf("no v1 signature file found in META-INF")
+	case 1:
+	default:
+		return "", fmt.Errorf("found %d v1 signature files in META-INF, expected one: %q", len(names), names)
+	}
+	if !v1SignerNameRegexp.MatchString(names[0]) {
+		return "", fmt.Errorf("v1 signer name %q does not match %s", names[0], v1SignerNameRegexp.String())
+	}
+	return names[0], nil
+}
+
+// getV1SignerNames returns the basenames of the v1 JAR signature
+// files in the META-INF directory of an APK of size bytes
+func getV1SignerNames(apk io.ReaderAt, size int64) (names []string, err error) {
+	zipReader, err := zip.NewReader(apk, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read APK as zip: %w", err)
+	}
+	for _, f := range zipReader.File {
+		dir, base := path.Split(f.Name)
+		if dir != "META-INF/" || !strings.EqualFold(path.Ext(base), ".SF") {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(base, path.Ext(base)))
+	}
+	return names, nil
+}
+
+// hasAPKSigningBlock returns whether an APK of size bytes has an APK
+// Signing Block before its central directory, which holds v2 and v3
+// signatures
+func hasAPKSigningBlock(apk io.ReaderAt, size int64) (bool, error) {
+	cdOffset, _, found, err := findCentralDirectory(apk, size)
+	if err != nil || !found || cdOffset < int64(len(apkSigBlockMagic)) {
+		return false, err
+	}
+	magic := make([]byte, len(apkSigBlockMagic))
+	_, err = apk.ReadAt(magic, cdOffset-int64(len(magic)))
+	if err != nil && err != io.EOF {
+		return false, fmt.Errorf("failed to read APK Signing Block magic: %w", err)
+	}
+	return bytes.Equal(magic, apkSigBlockMagic), nil
+}
+
+// isAligned returns whether the data of every uncompressed entry of
+// an APK of size bytes starts on a 4 bytes boundary, as zipalign
+// aligns them
+func isAligned(apk io.ReaderAt, size int64) (bool, error) {
+	zipReader, err := zip.NewReader(apk, size)
+	if err != nil {
+		return false, fmt.Errorf("failed to read APK as zip: %w", err)
+	}
+	for _, f := range zipReader.File {
+		if f.Method != zip.Store {
+			continue
+		}
+		offset, err := f.DataOffset()
+		if err != nil {
+			return false, fmt.Errorf("failed to read offset of %q: %w", f.Name, err)
+		}
+		if offset%4 != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// isSigned returns whether an APK of size bytes has v1 signature
+// files or an APK Signing Block
+func isSigned(apk io.ReaderAt, size int64) (bool, error) {
+	names, err := getV1SignerNames(apk, size)
+	if err != nil {
+		return false, err
+	}
+	if len(names) > 0 {
+		return true, nil
+	}
+	return hasAPKSigningBlock(apk, size)
+}
+
+// Options contains options for signing APKs
 type Options struct {
+	// PreserveV1SignerName reuses the basename of the v1 signature
+	// files (META-INF/<name>.SF) of the input APK instead of the
+	// apksigner default when re-signing
+	PreserveV1SignerName bool `json:"preserve_v1_signer_name,omitempty"`
+
+	// ReSignPolicy is how an already signed input is handled, one
+	// of ReSignPolicyStrip (the default) or ReSignPolicyReject
+	ReSignPolicy string `json:"resign_policy,omitempty"`
+
+	// V1Enabled, V2Enabled and V3Enabled enable or disable the v1,
+	// v2 and v3 signature schemes. Nil keeps the default of the
+	// signer: v1 and v2 are enabled, and v3 is enabled in the
+	// v3enabled mode.
+	V1Enabled *bool `json:"v1_enabled,omitempty"`
+	V2Enabled *bool `json:"v2_enabled,omitempty"`
+	V3Enabled *bool `json:"v3_enabled,omitempty"`
+
+	// V4Enabled enables the v4 signature scheme for incremental
+	// installs, whose .idsig signature is returned as a sidecar
+	// file. It requires the v2 or v3 scheme.
+	V4Enabled *bool `json:"v4_enabled,omitempty"`
+
+	// ContentDigest is the content digest algorithm the signatures
+	// must use, ContentDigestSHA256 or ContentDigestSHA512. Empty
+	// keeps the automatic selection of apksigner. Requests that
+	// apksigner would sign with another digest are refused.
+	ContentDigest string `json:"content_digest,omitempty"`
+
+	// Deterministic signs the same input to the same signed APK
+	// byte for byte, e.g. for reproducible builds. Signers with
+	// ECDSA keys refuse it.
+	Deterministic bool `json:"deterministic,omitempty"`
 }
 
 // GetDefaultOptions returns default options of the signer
@@ -211,6 +1285,16 @@ func (s *APK2Signer) GetDefaultOptions() interface{} {
 	return Options{}
 }
 
+// GetOptions takes a input interface and reflects it into a struct of options
+func GetOptions(input interface{}) (options Options, err error) {
+	buf, err := json.Marshal(input)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(buf, &options)
+	return
+}
+
 // GetTestFile returns a valid test APK
 func (s *APK2Signer) GetTestFile() []byte {
 	return testAPK
@@ -0,0 +1,271 @@
+package apk2
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+
+	"go.mozilla.org/pkcs7"
+
+	// register the hashes of the JAR digests
+	_ "crypto/sha1"
+)
+
+// oidPublicKeyECDSA is the id-ecPublicKey OID apksigner sets as the
+// digest encryption algorithm of ECDSA signature blocks
+var oidPublicKeyECDSA = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+
+// jarDigests are the digest attribute prefixes of the manifest and
+// signature files apksigner writes, e.g. SHA-256-Digest and
+// SHA-256-Digest-Manifest
+var jarDigests = []struct {
+	name string
+	hash crypto.Hash
+}{
+	{"SHA-256", crypto.SHA256},
+	{"SHA1", crypto.SHA1},
+}
+
+// isV1SignatureEntry returns whether an APK entry is the manifest or
+// a signature file or block of the v1 scheme, which the manifest does
+// not list
+func isV1SignatureEntry(name string) bool {
+	dir, base := path.Split(name)
+	if dir != "META-INF/" {
+		return false
+	}
+	if base == "MANIFEST.MF" || strings.HasPrefix(base, "SIG-") {
+		return true
+	}
+	switch path.Ext(base) {
+	case ".SF", ".RSA", ".DSA", ".EC":
+		return true
+	}
+	return false
+}
+
+// verifyV1Signature verifies the v1 JAR signatures of a signed APK:
+// the PKCS7 signature of every signature file, the digest of the
+// manifest in the signature files and the digests of the APK entries
+// in the manifest. It returns the DER certificates of the signers, and
+// the versions of the APK Signature Schemes the signature files
+// declare with X-Android-APK-Signed. It returns no certificate when
+// the APK has no signature file.
+func verifyV1Signature(signedAPK []byte) (certs [][]byte, signedSchemes []int, err error) {
+	zipReader, err := zip.NewReader(bytes.NewReader(signedAPK), int64(len(signedAPK)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("apk2: failed to read APK as zip: %w", err)
+	}
+	files := make(map[string][]byte)
+	for _, f := range zipReader.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		if _, ok := files[f.Name]; ok {
+			return nil, nil, fmt.Errorf("apk2: duplicate APK entry %q", f.Name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, nil, fmt.Errorf("apk2: failed to open APK entry %q: %w", f.Name, err)
+		}
+		files[f.Name], err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("apk2: failed to read APK entry %q: %w", f.Name, err)
+		}
+	}
+
+	manifest, hasManifest := files["META-INF/MANIFEST.MF"]
+	seenSchemes := make(map[int]bool)
+	for name, sigfile := range files {
+		dir, base := path.Split(name)
+		if dir != "META-INF/" || path.Ext(base) != ".SF" {
+			continue
+		}
+		if !hasManifest {
+			return nil, nil, fmt.Errorf("apk2: APK has signature file %q but no META-INF/MANIFEST.MF", name)
+		}
+		cert, schemes, err := verifySignatureFile(files, name, sigfile, manifest)
+		if err != nil {
+			return nil, nil, err
+		}
+		certs = append(certs, cert)
+		for _, scheme := range schemes {
+			if !seenSchemes[scheme] {
+				seenSchemes[scheme] = true
+				signedSchemes = append(signedSchemes, scheme)
+			}
+		}
+	}
+	if len(certs) == 0 {
+		return nil, nil, nil
+	}
+
+	_, entries, err := parseManifest(manifest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("apk2: failed to parse manifest: %w", err)
+	}
+	for name, contents := range files {
+		if isV1SignatureEntry(name) {
+			continue
+		}
+		attrs, ok := entries[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("apk2: APK entry %q is not in the manifest", name)
+		}
+		err = checkJARDigests(attrs, "-Digest", contents)
+		if err != nil {
+			return nil, nil, fmt.Errorf("apk2: APK entry %q does not match the manifest: %w", name, err)
+		}
+	}
+	for name := range entries {
+		if _, ok := files[name]; !ok {
+			return nil, nil, fmt.Errorf("apk2: manifest entry %q is not in the APK", name)
+		}
+	}
+	return certs, signedSchemes, nil
+}
+
+// verifySignatureFile verifies the PKCS7 signature block of the
+// signature file at name and that it has the digest of the manifest,
+// and returns the DER certificate of its signer and the APK Signature
+// Scheme versions of its X-Android-APK-Signed attribute
+func verifySignatureFile(files map[string][]byte, name string, sigfile, manifest []byte) (cert []byte, signedSchemes []int, err error) {
+	var block []byte
+	for _, ext := range []string{".RSA", ".EC", ".DSA"} {
+		if b, ok := files[strings.TrimSuffix(name, ".SF")+ext]; ok {
+			block = b
+			break
+		}
+	}
+	if block == nil {
+		return nil, nil, fmt.Errorf("apk2: signature file %q has no signature block", name)
+	}
+	p7, err := pkcs7.Parse(block)
+	if err != nil {
+		return nil, nil, fmt.Errorf("apk2: failed to parse signature block of %q: %w", name, err)
+	}
+	// pkcs7 picks the ECDSA hash from the digest encryption algorithm,
+	// so replace the id-ecPublicKey OID with the one of the digest
+	for i, si := range p7.Signers {
+		if !si.DigestEncryptionAlgorithm.Algorithm.Equal(oidPublicKeyECDSA) {
+			continue
+		}
+		switch {
+		case si.DigestAlgorithm.Algorithm.Equal(pkcs7.OIDDigestAlgorithmSHA1):
+			p7.Signers[i].DigestEncryptionAlgorithm.Algorithm = pkcs7.OIDDigestAlgorithmECDSASHA1
+		case si.DigestAlgorithm.Algorithm.Equal(pkcs7.OIDDigestAlgorithmSHA256):
+			p7.Signers[i].DigestEncryptionAlgorithm.Algorithm = pkcs7.OIDDigestAlgorithmECDSASHA256
+		case si.DigestAlgorithm.Algorithm.Equal(pkcs7.OIDDigestAlgorithmSHA384):
+			p7.Signers[i].DigestEncryptionAlgorithm.Algorithm = pkcs7.OIDDigestAlgorithmECDSASHA384
+		case si.DigestAlgorithm.Algorithm.Equal(pkcs7.OIDDigestAlgorithmSHA512):
+			p7.Signers[i].DigestEncryptionAlgorithm.Algorithm = pkcs7.OIDDigestAlgorithmECDSASHA512
+		}
+	}
+	p7.Content = sigfile
+	err = p7.Verify()
+	if err != nil {
+		return nil, nil, fmt.Errorf("apk2: signature of %q does not verify: %w", name, err)
+	}
+	signerCert := p7.GetOnlySigner()
+	if signerCert == nil {
+		return nil, nil, fmt.Errorf("apk2: signature block of %q must have exactly one signer", name)
+	}
+
+	mainAttrs, _, err := parseManifest(sigfile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("apk2: failed to parse signature file %q: %w", name, err)
+	}
+	err = checkJARDigests(mainAttrs, "-Digest-Manifest", manifest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("apk2: signature file %q does not match the manifest: %w", name, err)
+	}
+	if signed, ok := mainAttrs["X-Android-APK-Signed"]; ok {
+		for _, v := range strings.Split(signed, ",") {
+			scheme, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return nil, nil, fmt.Errorf("apk2: signature file %q has invalid X-Android-APK-Signed %q", name, signed)
+			}
+			// Android only knows of the v2 and v3 schemes to strip
+			if scheme == 2 || scheme == 3 {
+				signedSchemes = append(signedSchemes, scheme)
+			}
+		}
+	}
+	return signerCert.Raw, signedSchemes, nil
+}
+
+// checkJARDigests checks the data matches the SHA-256 and SHA-1
+// digests of the attributes with the suffix, and that there is at
+// least one of them
+func checkJARDigests(attrs map[string]string, suffix string, data []byte) error {
+	found := false
+	for _, digest := range jarDigests {
+		expected, ok := attrs[digest.name+suffix]
+		if !ok {
+			continue
+		}
+		h := digest.hash.New()
+		h.Write(data)
+		if expected != base64.StdEncoding.EncodeToString(h.Sum(nil)) {
+			return fmt.Errorf("%s%s does not match", digest.name, suffix)
+		}
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("no SHA-256%s or SHA1%s attribute", suffix, suffix)
+	}
+	return nil
+}
+
+// parseManifest parses the main attributes and the attributes of the
+// named entries of a JAR manifest or signature file. Its sections are
+// separated by empty lines, and lines starting with a space continue
+// the previous line.
+func parseManifest(manifest []byte) (mainAttrs map[string]string, entries map[string]map[string]string, err error) {
+	entries = make(map[string]map[string]string)
+	sections := strings.Split(strings.ReplaceAll(string(manifest), "\r\n", "\n"), "\n\n")
+	for i, section := range sections {
+		attrs := make(map[string]string)
+		var lines []string
+		for _, line := range strings.Split(section, "\n") {
+			if strings.HasPrefix(line, " ") && len(lines) > 0 {
+				lines[len(lines)-1] += line[1:]
+				continue
+			}
+			if line != "" {
+				lines = append(lines, line)
+			}
+		}
+		for _, line := range lines {
+			parts := strings.SplitN(line, ": ", 2)
+			if len(parts) != 2 {
+				return nil, nil, fmt.Errorf("invalid attribute line %q", line)
+			}
+			attrs[parts[0]] = parts[1]
+		}
+		if i == 0 {
+			mainAttrs = attrs
+			continue
+		}
+		if len(attrs) == 0 {
+			continue
+		}
+		name, ok := attrs["Name"]
+		if !ok {
+			return nil, nil, fmt.Errorf("section %d has no Name attribute", i)
+		}
+		if _, ok := entries[name]; ok {
+			return nil, nil, fmt.Errorf("duplicate entry %q", name)
+		}
+		entries[name] = attrs
+	}
+	return mainAttrs, entries, nil
+}
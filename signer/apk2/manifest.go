@@ -0,0 +1,272 @@
+package apk2
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"unicode/utf16"
+)
+
+const (
+	// androidManifestName is the zip entry of the binary XML
+	// manifest of an APK
+	androidManifestName = "AndroidManifest.xml"
+
+	// minSdkVersionAttrID is the resource ID of the
+	// android:minSdkVersion attribute
+	minSdkVersionAttrID = 0x0101020c
+
+	// resChunkHeaderSize is the size of the header of binary XML
+	// chunks: their type, header size and size
+	resChunkHeaderSize = 8
+
+	// the types of the binary XML chunks the manifest is read from
+	resXMLType         = 0x0003
+	resStringPoolType  = 0x0001
+	resXMLResourceMap  = 0x0180
+	resXMLStartElement = 0x0102
+
+	// resStringPoolUTF8 is the flag of string pools of UTF-8 rather
+	// than UTF-16 strings
+	resStringPoolUTF8 = 1 << 8
+
+	// resXMLAttributeSize is the minimum size of an attribute of a
+	// start element
+	resXMLAttributeSize = 20
+
+	// the types of the attribute values minSdkVersion can have
+	resValueTypeString = 0x03
+	resValueTypeIntDec = 0x10
+	resValueTypeIntHex = 0x11
+)
+
+// getMinSdkVersion returns the android:minSdkVersion of the uses-sdk
+// element of the manifest of an APK of size bytes, and whether it is
+// declared. The codename of a preview SDK is returned as the maximum
+// int32, since it is a preview of a release after all the known ones.
+func getMinSdkVersion(apk io.ReaderAt, size int64) (version int, found bool, err error) {
+	zipReader, err := zip.NewReader(apk, size)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read APK as zip: %w", err)
+	}
+	var manifest []byte
+	for _, f := range zipReader.File {
+		if f.Name != androidManifestName {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to open %s: %w", androidManifestName, err)
+		}
+		manifest, err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to read %s: %w", androidManifestName, err)
+		}
+		break
+	}
+	if manifest == nil {
+		return 0, false, fmt.Errorf("APK has no %s", androidManifestName)
+	}
+	value, found, err := findUsesSdkAttribute(manifest, "minSdkVersion", minSdkVersionAttrID)
+	if err != nil || !found {
+		return 0, false, err
+	}
+	switch value.dataType {
+	case resValueTypeIntDec, resValueTypeIntHex:
+		return int(int32(value.data)), true, nil
+	case resValueTypeString:
+		version, err = strconv.Atoi(value.str)
+		if err != nil {
+			return math.MaxInt32, true, nil
+		}
+		return version, true, nil
+	default:
+		return 0, false, fmt.Errorf("unsupported minSdkVersion value type 0x%x", value.dataType)
+	}
+}
+
+// resValue is the typed value of a binary XML attribute
+type resValue struct {
+	dataType uint8
+	data     uint32
+	str      string
+}
+
+// findUsesSdkAttribute returns the value of the attribute of the
+// uses-sdk element of a binary XML manifest with the resource ID, or
+// the name when the manifest has no resource map
+func findUsesSdkAttribute(manifest []byte, attrName string, attrID uint32) (value resValue, found bool, err error) {
+	if len(manifest) < resChunkHeaderSize || binary.LittleEndian.Uint16(manifest) != resXMLType {
+		return value, false, fmt.Errorf("%s is not a binary XML file", androidManifestName)
+	}
+	var (
+		strs        []string
+		resourceIDs []uint32
+	)
+	offset := int(binary.LittleEndian.Uint16(manifest[2:]))
+	for offset+resChunkHeaderSize <= len(manifest) {
+		chunkType := binary.LittleEndian.Uint16(manifest[offset:])
+		headerSize := int(binary.LittleEndian.Uint16(manifest[offset+2:]))
+		chunkSize := int(binary.LittleEndian.Uint32(manifest[offset+4:]))
+		if chunkSize < resChunkHeaderSize || headerSize > chunkSize || offset+chunkSize > len(manifest) {
+			return value, false, fmt.Errorf("invalid chunk of size %d at offset %d of %s", chunkSize, offset, androidManifestName)
+		}
+		chunk := manifest[offset : offset+chunkSize]
+		offset += chunkSize
+
+		switch chunkType {
+		case resStringPoolType:
+			strs, err = parseStringPool(chunk, headerSize)
+			if err != nil {
+				return value, false, err
+			}
+		case resXMLResourceMap:
+			for i := headerSize; i+4 <= len(chunk); i += 4 {
+				resourceIDs = append(resourceIDs, binary.LittleEndian.Uint32(chunk[i:]))
+			}
+		case resXMLStartElement:
+			// the attrExt of the element follows the node header
+			if len(chunk) < headerSize+20 {
+				return value, false, fmt.Errorf("truncated start element in %s", androidManifestName)
+			}
+			ext := chunk[headerSize:]
+			if lookupString(strs, binary.LittleEndian.Uint32(ext[4:])) != "uses-sdk" {
+				continue
+			}
+			attrStart := int(binary.LittleEndian.Uint16(ext[8:]))
+			attrSize := int(binary.LittleEndian.Uint16(ext[10:]))
+			attrCount := int(binary.LittleEndian.Uint16(ext[12:]))
+			if attrSize < resXMLAttributeSize {
+				return value, false, fmt.Errorf("invalid attribute size %d in %s", attrSize, androidManifestName)
+			}
+			for i := 0; i < attrCount; i++ {
+				start := attrStart + i*attrSize
+				if start+resXMLAttributeSize > len(ext) {
+					return value, false, fmt.Errorf("truncated uses-sdk attributes in %s", androidManifestName)
+				}
+				attr := ext[start:]
+				name := binary.LittleEndian.Uint32(attr[4:])
+				if int(name) < len(resourceIDs) {
+					if resourceIDs[name] != attrID {
+						continue
+					}
+				} else if lookupString(strs, name) != attrName {
+					continue
+				}
+				value.dataType = attr[15]
+				value.data = binary.LittleEndian.Uint32(attr[16:])
+				if value.dataType == resValueTypeString {
+					value.str = lookupString(strs, value.data)
+				}
+				return value, true, nil
+			}
+			return value, false, nil
+		}
+	}
+	return value, false, nil
+}
+
+// lookupString returns the string at an index of the string pool, or
+// an empty string when the index is out of it
+func lookupString(strs []string, index uint32) string {
+	if int64(index) >= int64(len(strs)) {
+		return ""
+	}
+	return strs[index]
+}
+
+// parseStringPool returns the strings of a binary XML string pool
+// chunk
+func parseStringPool(chunk []byte, headerSize int) ([]string, error) {
+	if headerSize < 28 {
+		return nil, fmt.Errorf("invalid string pool header size %d in %s", headerSize, androidManifestName)
+	}
+	count := int(binary.LittleEndian.Uint32(chunk[8:]))
+	flags := binary.LittleEndian.Uint32(chunk[16:])
+	stringsStart := int(binary.LittleEndian.Uint32(chunk[20:]))
+	if count < 0 || headerSize+count*4 > len(chunk) || stringsStart > len(chunk) {
+		return nil, fmt.Errorf("invalid string pool of %d strings in %s", count, androidManifestName)
+	}
+	strs := make([]string, count)
+	for i := range strs {
+		start := stringsStart + int(binary.LittleEndian.Uint32(chunk[headerSize+i*4:]))
+		if start < stringsStart || start >= len(chunk) {
+			return nil, fmt.Errorf("invalid offset of string %d in %s", i, androidManifestName)
+		}
+		var err error
+		if flags&resStringPoolUTF8 != 0 {
+			strs[i], err = decodeUTF8PoolString(chunk[start:])
+		} else {
+			strs[i], err = decodeUTF16PoolString(chunk[start:])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %d in %s: %w", i, androidManifestName, err)
+		}
+	}
+	return strs, nil
+}
+
+// decodeUTF8PoolString decodes a string pool string prefixed with its
+// length in characters and in bytes, which take two bytes when their
+// high bit is set
+func decodeUTF8PoolString(b []byte) (string, error) {
+	pos := 0
+	readLen := func() (int, error) {
+		if pos >= len(b) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		n := int(b[pos])
+		pos++
+		if n&0x80 != 0 {
+			if pos >= len(b) {
+				return 0, io.ErrUnexpectedEOF
+			}
+			n = (n&0x7f)<<8 | int(b[pos])
+			pos++
+		}
+		return n, nil
+	}
+	// skip the length in characters
+	if _, err := readLen(); err != nil {
+		return "", err
+	}
+	n, err := readLen()
+	if err != nil {
+		return "", err
+	}
+	if pos+n > len(b) {
+		return "", io.ErrUnexpectedEOF
+	}
+	return string(b[pos : pos+n]), nil
+}
+
+// decodeUTF16PoolString decodes a string pool string prefixed with its
+// length in UTF-16 code units, which takes two units when its high bit
+// is set
+func decodeUTF16PoolString(b []byte) (string, error) {
+	if len(b) < 2 {
+		return "", io.ErrUnexpectedEOF
+	}
+	n := int(binary.LittleEndian.Uint16(b))
+	pos := 2
+	if n&0x8000 != 0 {
+		if len(b) < 4 {
+			return "", io.ErrUnexpectedEOF
+		}
+		n = (n&0x7fff)<<16 | int(binary.LittleEndian.Uint16(b[2:]))
+		pos = 4
+	}
+	if pos+n*2 > len(b) {
+		return "", io.ErrUnexpectedEOF
+	}
+	units := make([]uint16, n)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(b[pos+i*2:])
+	}
+	return string(utf16.Decode(units)), nil
+}
@@ -0,0 +1,483 @@
+package apk2
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	// register the hashes of the signature algorithms
+	_ "crypto/sha512"
+)
+
+const (
+	// apkSigSchemeV2BlockID and apkSigSchemeV3BlockID are the IDs
+	// of the v2 and v3 signature scheme blocks in the APK Signing
+	// Block
+	apkSigSchemeV2BlockID = 0x7109871a
+	apkSigSchemeV3BlockID = 0xf05368c0
+
+	// apkSigChunkSize is the size of the chunks the contents of an
+	// APK are split into to compute its digest
+	apkSigChunkSize = 1 << 20
+)
+
+// apkSigAlgorithm is a signature algorithm of the v2 and v3 signature
+// schemes
+type apkSigAlgorithm struct {
+	hash  crypto.Hash
+	pss   bool
+	ecdsa bool
+}
+
+// apkSigAlgorithms are the signature algorithms the verifier supports
+// by ID. The verity algorithms digest the APK differently, and the
+// signatures using them are ignored.
+var apkSigAlgorithms = map[uint32]apkSigAlgorithm{
+	0x0101: {hash: crypto.SHA256, pss: true},   // RSASSA-PSS with SHA2-256
+	0x0102: {hash: crypto.SHA512, pss: true},   // RSASSA-PSS with SHA2-512
+	0x0103: {hash: crypto.SHA256},              // RSASSA-PKCS1-v1_5 with SHA2-256
+	0x0104: {hash: crypto.SHA512},              // RSASSA-PKCS1-v1_5 with SHA2-512
+	0x0201: {hash: crypto.SHA256, ecdsa: true}, // ECDSA with SHA2-256
+	0x0202: {hash: crypto.SHA512, ecdsa: true}, // ECDSA with SHA2-512
+}
+
+// VerifySigningBlock verifies the v2 and v3 signatures in the APK
+// Signing Block of a signed APK. It errors when the APK has neither,
+// or when a signer has no signature with a supported algorithm, so
+// unlike the v1 PKCS7 verification it covers ECDSA keys.
+//
+// The signatures are verified with the public keys and certificates
+// they carry, callers must check those are the expected ones.
+func VerifySigningBlock(signedAPK []byte) error {
+	_, err := verifySigningBlock(signedAPK)
+	return err
+}
+
+// Verify verifies the signatures of a signed APK were made with the
+// expected certificate: its v1 JAR signature when it has one, and the
+// v2 and v3 signatures in its APK Signing Block when it has one. It
+// errors when the APK has no signature, when a signature does not
+// verify or was made with another certificate, or when the v1
+// signature declares a v2 or v3 signature the APK does not have,
+// which Android rejects as stripped.
+func Verify(signedAPK []byte, expectedCert *x509.Certificate) error {
+	return VerifyWithRotationCert(signedAPK, expectedCert, nil)
+}
+
+// VerifyWithRotationCert is Verify for the APKs of signers with a
+// rotation key, whose v3 signature can also be made with the rotation
+// certificate. It is Verify when the rotation certificate is nil.
+func VerifyWithRotationCert(signedAPK []byte, expectedCert, rotationCert *x509.Certificate) error {
+	if expectedCert == nil {
+		return fmt.Errorf("apk2: missing expected certificate")
+	}
+	certs, err := verifyAPK(signedAPK)
+	if err != nil {
+		return err
+	}
+	var rotationFingerprint string
+	if rotationCert != nil {
+		rotationFingerprint = certFingerprint(rotationCert.Raw)
+	}
+	return checkCertFingerprints(certs, certFingerprint(expectedCert.Raw), rotationFingerprint)
+}
+
+// certFingerprint returns the hex encoded SHA-256 fingerprint of a DER
+// certificate
+func certFingerprint(cert []byte) string {
+	sum := sha256.Sum256(cert)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkCertFingerprints returns an error when the certificates of the
+// signatures of an APK by scheme version do not have the expected
+// fingerprint, or the rotation fingerprint for the v3 scheme when it
+// is not empty
+func checkCertFingerprints(certs map[int][][]byte, expected, rotation string) error {
+	for scheme, schemeCerts := range certs {
+		for _, cert := range schemeCerts {
+			fingerprint := certFingerprint(cert)
+			if fingerprint == expected {
+				continue
+			}
+			if scheme == 3 && rotation != "" && fingerprint == rotation {
+				continue
+			}
+			return fmt.Errorf("apk2: signed APK has certificate %s in its v%d signature, expected %s", fingerprint, scheme, expected)
+		}
+	}
+	return nil
+}
+
+// verifyAPK verifies the v1, v2 and v3 signatures of a signed APK like
+// Verify, and returns the DER certificates of their signers by
+// signature scheme version, 1 for the v1 JAR signature
+func verifyAPK(signedAPK []byte) (certs map[int][][]byte, err error) {
+	v1Certs, v1SignedSchemes, err := verifyV1Signature(signedAPK)
+	if err != nil {
+		return nil, err
+	}
+	certs, err = verifySigningBlock(signedAPK)
+	switch {
+	case err == nil:
+	case errors.Is(err, errNoAPKSigningBlock) && len(v1Certs) > 0:
+		// the APK is only signed with the v1 scheme
+		certs = make(map[int][][]byte)
+	default:
+		return nil, err
+	}
+	for _, scheme := range v1SignedSchemes {
+		if _, ok := certs[scheme]; !ok {
+			return nil, fmt.Errorf("apk2: v1 signature declares an APK Signature Scheme v%d signature the APK does not have", scheme)
+		}
+	}
+	if len(v1Certs) > 0 {
+		certs[1] = v1Certs
+	}
+	return certs, nil
+}
+
+// errNoAPKSigningBlock is returned when an APK has no APK Signing
+// Block, e.g. because it is only signed with the v1 scheme
+var errNoAPKSigningBlock = errors.New("no APK Signing Block found before the central directory")
+
+// verifySigningBlock verifies the v2 and v3 signatures of a signed APK
+// like VerifySigningBlock, and returns the DER certificates of their
+// signers by the version of the signature scheme it verified
+func verifySigningBlock(signedAPK []byte) (certs map[int][][]byte, err error) {
+	apk := bytes.NewReader(signedAPK)
+	cdOffset, eocdOffset, found, err := findCentralDirectory(apk, int64(len(signedAPK)))
+	if err != nil {
+		return nil, fmt.Errorf("apk2: %w", err)
+	}
+	if !found {
+		return nil, fmt.Errorf("apk2: failed to find the central directory of the APK")
+	}
+	blockOffset, pairs, err := parseAPKSigningBlock(signedAPK, cdOffset)
+	if err != nil {
+		return nil, fmt.Errorf("apk2: %w", err)
+	}
+	digester := &apkDigester{
+		sections: [][]byte{
+			signedAPK[:blockOffset],
+			signedAPK[cdOffset:eocdOffset],
+			// the digest of the end of central directory record
+			// uses the offset of the APK Signing Block as the
+			// offset of the central directory
+			append([]byte(nil), signedAPK[eocdOffset:]...),
+		},
+		digests: make(map[crypto.Hash][]byte),
+	}
+	binary.LittleEndian.PutUint32(digester.sections[2][16:20], uint32(blockOffset))
+
+	certs = make(map[int][][]byte)
+	for _, scheme := range []struct {
+		version int
+		id      uint32
+	}{
+		{2, apkSigSchemeV2BlockID},
+		{3, apkSigSchemeV3BlockID},
+	} {
+		block, ok := pairs[scheme.id]
+		if !ok {
+			continue
+		}
+		schemeCerts, err := verifySchemeBlock(block, scheme.id == apkSigSchemeV3BlockID, digester)
+		if err != nil {
+			return nil, fmt.Errorf("apk2: failed to verify v%d signature scheme block: %w", scheme.version, err)
+		}
+		certs[scheme.version] = schemeCerts
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("apk2: no v2 or v3 signature scheme block found in APK Signing Block")
+	}
+	return certs, nil
+}
+
+// findCentralDirectory returns the offsets of the central directory
+// and end of central directory record of a zip of size bytes, and
+// whether it found them
+func findCentralDirectory(apk io.ReaderAt, size int64) (cdOffset, eocdOffset int64, found bool, err error) {
+	// the end of central directory record is 22 bytes followed by a
+	// comment of up to 65535 bytes
+	searchStart := size - 22 - 65535
+	if searchStart < 0 {
+		searchStart = 0
+	}
+	tail := make([]byte, size-searchStart)
+	_, err = apk.ReadAt(tail, searchStart)
+	if err != nil && err != io.EOF {
+		return 0, 0, false, fmt.Errorf("failed to read end of central directory: %w", err)
+	}
+	eocd := bytes.LastIndex(tail, []byte("PK\x05\x06"))
+	if eocd < 0 || eocd+22 > len(tail) {
+		return 0, 0, false, nil
+	}
+	eocdOffset = searchStart + int64(eocd)
+	cdOffset = int64(binary.LittleEndian.Uint32(tail[eocd+16 : eocd+20]))
+	if cdOffset > eocdOffset {
+		return 0, 0, false, nil
+	}
+	return cdOffset, eocdOffset, true, nil
+}
+
+// parseAPKSigningBlock returns the offset of the APK Signing Block
+// ending at the central directory offset, and its values by ID
+func parseAPKSigningBlock(apk []byte, cdOffset int64) (blockOffset int64, pairs map[uint32][]byte, err error) {
+	// the block ends with its size and magic, and starts with its
+	// size which does not count the starting size field
+	if cdOffset < 24 || !bytes.Equal(apk[cdOffset-16:cdOffset], apkSigBlockMagic) {
+		return 0, nil, errNoAPKSigningBlock
+	}
+	blockSize := binary.LittleEndian.Uint64(apk[cdOffset-24 : cdOffset-16])
+	if blockSize < 24 || blockSize > uint64(cdOffset-8) {
+		return 0, nil, fmt.Errorf("invalid APK Signing Block size %d", blockSize)
+	}
+	blockOffset = cdOffset - int64(blockSize) - 8
+	if binary.LittleEndian.Uint64(apk[blockOffset:blockOffset+8]) != blockSize {
+		return 0, nil, fmt.Errorf("APK Signing Block header and footer sizes differ")
+	}
+	pairs = make(map[uint32][]byte)
+	buf := apk[blockOffset+8 : cdOffset-24]
+	for len(buf) > 0 {
+		if len(buf) < 8 {
+			return 0, nil, fmt.Errorf("truncated APK Signing Block pair")
+		}
+		pairLen := binary.LittleEndian.Uint64(buf[:8])
+		if pairLen < 4 || pairLen > uint64(len(buf)-8) {
+			return 0, nil, fmt.Errorf("invalid APK Signing Block pair length %d", pairLen)
+		}
+		pair := buf[8 : 8+pairLen]
+		pairs[binary.LittleEndian.Uint32(pair[:4])] = pair[4:]
+		buf = buf[8+pairLen:]
+	}
+	return blockOffset, pairs, nil
+}
+
+// apkDigester computes and caches the digests of the contents of an
+// APK the signatures cover
+type apkDigester struct {
+	sections [][]byte
+	digests  map[crypto.Hash][]byte
+}
+
+// digest returns the digest of the contents of the APK, which is the
+// hash of the hashes of its 1MB chunks
+func (d *apkDigester) digest(hash crypto.Hash) []byte {
+	if digest, ok := d.digests[hash]; ok {
+		return digest
+	}
+	var (
+		chunkDigests []byte
+		numChunks    uint32
+		prefix       [5]byte
+	)
+	for _, section := range d.sections {
+		for start := 0; start < len(section); start += apkSigChunkSize {
+			end := start + apkSigChunkSize
+			if end > len(section) {
+				end = len(section)
+			}
+			prefix[0] = 0xa5
+			binary.LittleEndian.PutUint32(prefix[1:], uint32(end-start))
+			h := hash.New()
+			h.Write(prefix[:])
+			h.Write(section[start:end])
+			chunkDigests = h.Sum(chunkDigests)
+			numChunks++
+		}
+	}
+	prefix[0] = 0x5a
+	binary.LittleEndian.PutUint32(prefix[1:], numChunks)
+	h := hash.New()
+	h.Write(prefix[:])
+	h.Write(chunkDigests)
+	d.digests[hash] = h.Sum(nil)
+	return d.digests[hash]
+}
+
+// verifySchemeBlock verifies every signer of a v2 or v3 signature
+// scheme block and returns their DER certificates
+func verifySchemeBlock(block []byte, v3 bool, digester *apkDigester) (certs [][]byte, err error) {
+	signers, _, err := readLengthPrefixed(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signers: %w", err)
+	}
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no signers found")
+	}
+	for i := 0; len(signers) > 0; i++ {
+		var signerBlock, cert []byte
+		signerBlock, signers, err = readLengthPrefixed(signers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signer %d: %w", i, err)
+		}
+		cert, err = verifySigner(signerBlock, v3, digester)
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify signer %d: %w", i, err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// verifySigner verifies the signatures of a signer over its signed
+// data, and the digests of the signed data over the APK contents, and
+// returns its DER certificate
+func verifySigner(signerBlock []byte, v3 bool, digester *apkDigester) (rawCert []byte, err error) {
+	signedData, rest, err := readLengthPrefixed(signerBlock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signed data: %w", err)
+	}
+	var sdkVersions []byte
+	if v3 {
+		if len(rest) < 8 {
+			return nil, fmt.Errorf("failed to read min and max sdk versions")
+		}
+		sdkVersions, rest = rest[:8], rest[8:]
+	}
+	signatures, rest, err := readLengthPrefixed(rest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signatures: %w", err)
+	}
+	rawPublicKey, _, err := readLengthPrefixed(rest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(rawPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+
+	var (
+		signatureAlgs []uint32
+		verifiedAlgs  []uint32
+	)
+	for len(signatures) > 0 {
+		var record, sig []byte
+		record, signatures, err = readLengthPrefixed(signatures)
+		if err != nil || len(record) < 4 {
+			return nil, fmt.Errorf("failed to read signature record")
+		}
+		algID := binary.LittleEndian.Uint32(record[:4])
+		signatureAlgs = append(signatureAlgs, algID)
+		alg, ok := apkSigAlgorithms[algID]
+		if !ok {
+			continue
+		}
+		sig, _, err = readLengthPrefixed(record[4:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signature with algorithm 0x%04x: %w", algID, err)
+		}
+		err = verifySignedData(publicKey, alg, signedData, sig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify signature with algorithm 0x%04x: %w", algID, err)
+		}
+		verifiedAlgs = append(verifiedAlgs, algID)
+	}
+	if len(verifiedAlgs) == 0 {
+		return nil, fmt.Errorf("no signature with a supported algorithm found in %x", signatureAlgs)
+	}
+
+	digests, rest, err := readLengthPrefixed(signedData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read digests: %w", err)
+	}
+	certificates, rest, err := readLengthPrefixed(rest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificates: %w", err)
+	}
+	if v3 && (len(rest) < 8 || !bytes.Equal(rest[:8], sdkVersions)) {
+		return nil, fmt.Errorf("signed data sdk versions do not match the signer sdk versions")
+	}
+
+	// the signed data has the digests of the signature algorithms
+	// of the signer in the same order
+	var digestAlgs []uint32
+	digestsByAlg := make(map[uint32][]byte)
+	for len(digests) > 0 {
+		var record, digest []byte
+		record, digests, err = readLengthPrefixed(digests)
+		if err != nil || len(record) < 4 {
+			return nil, fmt.Errorf("failed to read digest record")
+		}
+		algID := binary.LittleEndian.Uint32(record[:4])
+		digest, _, err = readLengthPrefixed(record[4:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read digest with algorithm 0x%04x: %w", algID, err)
+		}
+		digestAlgs = append(digestAlgs, algID)
+		digestsByAlg[algID] = digest
+	}
+	if fmt.Sprint(digestAlgs) != fmt.Sprint(signatureAlgs) {
+		return nil, fmt.Errorf("digest algorithms %x do not match signature algorithms %x", digestAlgs, signatureAlgs)
+	}
+	for _, algID := range verifiedAlgs {
+		if !bytes.Equal(digestsByAlg[algID], digester.digest(apkSigAlgorithms[algID].hash)) {
+			return nil, fmt.Errorf("APK digest with algorithm 0x%04x does not match signed digest", algID)
+		}
+	}
+
+	rawCert, _, err = readLengthPrefixed(certificates)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(rawCert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	if !bytes.Equal(cert.RawSubjectPublicKeyInfo, rawPublicKey) {
+		return nil, fmt.Errorf("public key does not match the public key of the certificate")
+	}
+	return rawCert, nil
+}
+
+// verifySignedData verifies a signature over the signed data of a
+// signer with an algorithm
+func verifySignedData(publicKey interface{}, alg apkSigAlgorithm, signedData, sig []byte) error {
+	h := alg.hash.New()
+	h.Write(signedData)
+	hashed := h.Sum(nil)
+	switch pubKey := publicKey.(type) {
+	case *rsa.PublicKey:
+		if alg.ecdsa {
+			return fmt.Errorf("ecdsa signature algorithm used with an rsa public key")
+		}
+		if alg.pss {
+			return rsa.VerifyPSS(pubKey, alg.hash, hashed, sig, &rsa.PSSOptions{SaltLength: alg.hash.Size()})
+		}
+		return rsa.VerifyPKCS1v15(pubKey, alg.hash, hashed, sig)
+	case *ecdsa.PublicKey:
+		if !alg.ecdsa {
+			return fmt.Errorf("rsa signature algorithm used with an ecdsa public key")
+		}
+		if !ecdsa.VerifyASN1(pubKey, hashed, sig) {
+			return fmt.Errorf("ecdsa signature verification failed")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+}
+
+// readLengthPrefixed reads a value prefixed with its uint32 little
+// endian length from the start of a buffer, and returns it and the
+// rest of the buffer
+func readLengthPrefixed(buf []byte) (value, rest []byte, err error) {
+	if len(buf) < 4 {
+		return nil, nil, fmt.Errorf("truncated length prefix")
+	}
+	length := binary.LittleEndian.Uint32(buf[:4])
+	if uint64(length) > uint64(len(buf)-4) {
+		return nil, nil, fmt.Errorf("length %d exceeds remaining %d bytes", length, len(buf)-4)
+	}
+	return buf[4 : 4+length], buf[4+length:], nil
+}
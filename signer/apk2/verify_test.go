@@ -0,0 +1,435 @@
+package apk2
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mozilla.org/pkcs7"
+)
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func lengthPrefixed(values ...[]byte) []byte {
+	var buf []byte
+	for _, value := range values {
+		buf = appendUint32(buf, uint32(len(value)))
+		buf = append(buf, value...)
+	}
+	return buf
+}
+
+func makeTestCert(t *testing.T, key crypto.Signer) []byte {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "apk2 verify test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// signWithSigningBlock inserts an APK Signing Block with a v2 or v3
+// signature scheme block of one signer before the central directory
+// of a zip
+func signWithSigningBlock(t *testing.T, zipBytes []byte, key crypto.Signer, cert []byte, algID uint32, v3 bool) []byte {
+	cdOffset, eocdOffset, found, err := findCentralDirectory(bytes.NewReader(zipBytes), int64(len(zipBytes)))
+	if err != nil || !found {
+		t.Fatalf("failed to find central directory: %v", err)
+	}
+	// the digest of the end of central directory record uses the
+	// offset of the APK Signing Block, which is the one of the
+	// central directory of the unsigned zip
+	alg := apkSigAlgorithms[algID]
+	if alg.hash == 0 {
+		alg.hash = crypto.SHA256
+	}
+	digester := &apkDigester{
+		sections: [][]byte{zipBytes[:cdOffset], zipBytes[cdOffset:eocdOffset], zipBytes[eocdOffset:]},
+		digests:  make(map[crypto.Hash][]byte),
+	}
+	algBytes := appendUint32(nil, algID)
+	sdkVersions := appendUint32(appendUint32(nil, 24), 0x7fffffff)
+
+	signedData := lengthPrefixed(
+		lengthPrefixed(append(algBytes, lengthPrefixed(digester.digest(alg.hash))...)),
+		lengthPrefixed(cert),
+	)
+	if v3 {
+		signedData = append(signedData, sdkVersions...)
+	}
+	signedData = append(signedData, lengthPrefixed(nil)...)
+
+	h := alg.hash.New()
+	h.Write(signedData)
+	var signerOpts crypto.SignerOpts = alg.hash
+	if alg.pss {
+		signerOpts = &rsa.PSSOptions{SaltLength: alg.hash.Size(), Hash: alg.hash}
+	}
+	sig, err := key.Sign(rand.Reader, h.Sum(nil), signerOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signerBlock := lengthPrefixed(signedData)
+	if v3 {
+		signerBlock = append(signerBlock, sdkVersions...)
+	}
+	signerBlock = append(signerBlock, lengthPrefixed(lengthPrefixed(append(algBytes, lengthPrefixed(sig)...)))...)
+	signerBlock = append(signerBlock, lengthPrefixed(publicKey)...)
+
+	var blockID uint32 = apkSigSchemeV2BlockID
+	if v3 {
+		blockID = apkSigSchemeV3BlockID
+	}
+	value := lengthPrefixed(lengthPrefixed(signerBlock))
+	pair := appendUint64(nil, uint64(len(value)+4))
+	pair = appendUint32(pair, blockID)
+	pair = append(pair, value...)
+	blockSize := uint64(len(pair) + 8 + len(apkSigBlockMagic))
+	block := appendUint64(nil, blockSize)
+	block = append(block, pair...)
+	block = appendUint64(block, blockSize)
+	block = append(block, apkSigBlockMagic...)
+
+	var out []byte
+	out = append(out, zipBytes[:cdOffset]...)
+	out = append(out, block...)
+	out = append(out, zipBytes[cdOffset:]...)
+	binary.LittleEndian.PutUint32(out[eocdOffset+int64(len(block))+16:], uint32(cdOffset)+uint32(len(block)))
+	return out
+}
+
+func TestVerifySigningBlock(t *testing.T) {
+	t.Parallel()
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecCert, rsaCert := makeTestCert(t, ecKey), makeTestCert(t, rsaKey)
+	unsigned := makeTestZip(t, "META-INF/MANIFEST.MF", "classes.dex")
+
+	tests := []struct {
+		name  string
+		key   crypto.Signer
+		cert  []byte
+		algID uint32
+		v3    bool
+	}{
+		{name: "v2 ECDSA SHA2-256", key: ecKey, cert: ecCert, algID: 0x0201},
+		{name: "v3 ECDSA SHA2-512", key: ecKey, cert: ecCert, algID: 0x0202, v3: true},
+		{name: "v2 RSA PKCS1 SHA2-256", key: rsaKey, cert: rsaCert, algID: 0x0103},
+		{name: "v3 RSA PSS SHA2-256", key: rsaKey, cert: rsaCert, algID: 0x0101, v3: true},
+	}
+	for _, tt := range tests {
+		signed := signWithSigningBlock(t, unsigned, tt.key, tt.cert, tt.algID, tt.v3)
+		err := VerifySigningBlock(signed)
+		if err != nil {
+			t.Fatalf("%s: failed to verify signing block: %v", tt.name, err)
+		}
+		if ok, _ := isSigned(bytes.NewReader(signed), int64(len(signed))); !ok {
+			t.Fatalf("%s: expected signed APK to be detected as signed", tt.name)
+		}
+	}
+}
+
+func TestVerifyFile(t *testing.T) {
+	t.Parallel()
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecCert, otherCert := makeTestCert(t, ecKey), makeTestCert(t, otherKey)
+	unsigned := makeTestZip(t, "META-INF/MANIFEST.MF", "classes.dex")
+	fingerprint := sha256.Sum256(ecCert)
+	s := &APK2Signer{certFingerprint: hex.EncodeToString(fingerprint[:])}
+
+	signed := signWithSigningBlock(t, unsigned, ecKey, ecCert, 0x0201, false)
+	err = s.VerifyFile(unsigned, signed)
+	if err != nil {
+		t.Fatalf("failed to verify file signed with the signer certificate: %v", err)
+	}
+	signed = signWithSigningBlock(t, unsigned, otherKey, otherCert, 0x0201, true)
+	err = s.VerifyFile(unsigned, signed)
+	if err == nil {
+		t.Fatal("expected verification of a file signed with another certificate to fail but it succeeded")
+	}
+	err = s.VerifyFile(unsigned, unsigned)
+	if err == nil {
+		t.Fatal("expected verification of an unsigned file to fail but it succeeded")
+	}
+}
+
+func TestVerifyFileRotation(t *testing.T) {
+	t.Parallel()
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotationKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecCert, rotationCert := makeTestCert(t, ecKey), makeTestCert(t, rotationKey)
+	unsigned := makeTestZip(t, "META-INF/MANIFEST.MF", "classes.dex")
+	fingerprint, rotationFingerprint := sha256.Sum256(ecCert), sha256.Sum256(rotationCert)
+	s := &APK2Signer{
+		certFingerprint:         hex.EncodeToString(fingerprint[:]),
+		rotationCertFingerprint: hex.EncodeToString(rotationFingerprint[:]),
+	}
+
+	// apksigner signs the v3 signature with the rotation certificate
+	signed := signWithSigningBlock(t, unsigned, rotationKey, rotationCert, 0x0201, true)
+	err = s.VerifyFile(unsigned, signed)
+	if err != nil {
+		t.Fatalf("failed to verify v3 signature made with the rotation certificate: %v", err)
+	}
+	signed = signWithSigningBlock(t, unsigned, ecKey, ecCert, 0x0201, true)
+	err = s.VerifyFile(unsigned, signed)
+	if err != nil {
+		t.Fatalf("failed to verify v3 signature made with the signer certificate: %v", err)
+	}
+	signed = signWithSigningBlock(t, unsigned, ecKey, ecCert, 0x0201, false)
+	err = s.VerifyFile(unsigned, signed)
+	if err != nil {
+		t.Fatalf("failed to verify v2 signature made with the signer certificate: %v", err)
+	}
+
+	// but only the v3 signature
+	signed = signWithSigningBlock(t, unsigned, rotationKey, rotationCert, 0x0201, false)
+	err = s.VerifyFile(unsigned, signed)
+	if err == nil || !strings.Contains(err.Error(), "in its v2 signature") {
+		t.Fatalf("expected verification of a v2 signature made with the rotation certificate to fail but got: %v", err)
+	}
+
+	parsedECCert, err := x509.ParseCertificate(ecCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedRotationCert, err := x509.ParseCertificate(rotationCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed = signWithSigningBlock(t, unsigned, rotationKey, rotationCert, 0x0201, true)
+	err = VerifyWithRotationCert(signed, parsedECCert, parsedRotationCert)
+	if err != nil {
+		t.Fatalf("failed to verify v3 signature made with the rotation certificate: %v", err)
+	}
+	err = Verify(signed, parsedECCert)
+	if err == nil {
+		t.Fatal("expected verification of a v3 signature made with the rotation certificate without it to fail but it succeeded")
+	}
+}
+
+func TestVerifySigningBlockErrs(t *testing.T) {
+	t.Parallel()
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecCert := makeTestCert(t, ecKey)
+	unsigned := makeTestZip(t, "META-INF/MANIFEST.MF", "classes.dex")
+	signed := signWithSigningBlock(t, unsigned, ecKey, ecCert, 0x0201, false)
+
+	tamperedEntry := append([]byte(nil), signed...)
+	tamperedEntry[len("PK\x03\x04")+26] ^= 0xff
+	otherCert := signWithSigningBlock(t, unsigned, ecKey, makeTestCert(t, otherKey), 0x0201, false)
+	tests := []struct {
+		name       string
+		input      []byte
+		wantErrStr string
+	}{
+		{name: "not a zip", input: []byte("foo"), wantErrStr: "failed to find the central directory"},
+		{name: "unsigned", input: unsigned, wantErrStr: "no APK Signing Block found"},
+		{name: "tampered entry", input: tamperedEntry, wantErrStr: "does not match signed digest"},
+		{name: "certificate of another key", input: otherCert, wantErrStr: "does not match the public key of the certificate"},
+		{name: "unsupported algorithm", input: signWithSigningBlock(t, unsigned, ecKey, ecCert, 0x0301, false), wantErrStr: "no signature with a supported algorithm"},
+		{name: "ecdsa algorithm with rsa key", input: signWithSigningBlock(t, unsigned, rsaKey, makeTestCert(t, rsaKey), 0x0201, false), wantErrStr: "ecdsa signature algorithm used with an rsa public key"},
+	}
+	for _, tt := range tests {
+		err := VerifySigningBlock(tt.input)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErrStr) {
+			t.Fatalf("%s: expected error containing %q but got %v", tt.name, tt.wantErrStr, err)
+		}
+	}
+}
+
+// signWithV1 makes a zip with a v1 JAR signature of one signer over a
+// classes.dex entry, whose signature file declares the apkSigned
+// schemes. When tamper is set, classes.dex does not match the
+// manifest.
+func signWithV1(t *testing.T, key crypto.Signer, cert []byte, apkSigned string, tamper bool) []byte {
+	dex := []byte("dex\n035\x00")
+	dexDigest := sha256.Sum256(dex)
+	manifest := []byte("Manifest-Version: 1.0\r\nCreated-By: 1.0 (Android)\r\n\r\n" +
+		"Name: classes.dex\r\nSHA-256-Digest: " + base64.StdEncoding.EncodeToString(dexDigest[:]) + "\r\n\r\n")
+	manifestDigest := sha256.Sum256(manifest)
+	sigfile := "Signature-Version: 1.0\r\nCreated-By: 1.0 (Android)\r\n" +
+		"SHA-256-Digest-Manifest: " + base64.StdEncoding.EncodeToString(manifestDigest[:]) + "\r\n"
+	if apkSigned != "" {
+		sigfile += "X-Android-APK-Signed: " + apkSigned + "\r\n"
+	}
+	sigfile += "\r\n"
+
+	x509Cert, err := x509.ParseCertificate(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, err := pkcs7.NewSignedData([]byte(sigfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	err = sd.AddSigner(x509Cert, key, pkcs7.SignerInfoConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockName := "META-INF/CERT.RSA"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		// apksigner identifies ECDSA signatures with id-ecPublicKey
+		sd.GetSignedData().SignerInfos[0].DigestEncryptionAlgorithm.Algorithm = oidPublicKeyECDSA
+		blockName = "META-INF/CERT.EC"
+	}
+	sd.Detach()
+	block, err := sd.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tamper {
+		dex = []byte("dex\n036\x00")
+	}
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, entry := range []struct {
+		name     string
+		contents []byte
+	}{
+		{"META-INF/MANIFEST.MF", manifest},
+		{"META-INF/CERT.SF", []byte(sigfile)},
+		{blockName, block},
+		{"classes.dex", dex},
+	} {
+		f, err := w.Create(entry.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(entry.contents)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecCert, rsaCert := makeTestCert(t, ecKey), makeTestCert(t, rsaKey)
+	parsedECCert, err := x509.ParseCertificate(ecCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedRSACert, err := x509.ParseCertificate(rsaCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned := makeTestZip(t, "META-INF/MANIFEST.MF", "classes.dex")
+
+	tests := []struct {
+		name       string
+		input      []byte
+		cert       *x509.Certificate
+		wantErrStr string
+	}{
+		{name: "v1 RSA", input: signWithV1(t, rsaKey, rsaCert, "", false), cert: parsedRSACert},
+		{name: "v1 ECDSA", input: signWithV1(t, ecKey, ecCert, "", false), cert: parsedECCert},
+		{name: "v1 and v2", input: signWithSigningBlock(t, signWithV1(t, ecKey, ecCert, "2", false), ecKey, ecCert, 0x0201, false), cert: parsedECCert},
+		{name: "v1 and v3", input: signWithSigningBlock(t, signWithV1(t, rsaKey, rsaCert, "3", false), rsaKey, rsaCert, 0x0103, true), cert: parsedRSACert},
+		{name: "v2", input: signWithSigningBlock(t, unsigned, ecKey, ecCert, 0x0201, false), cert: parsedECCert},
+		{name: "missing certificate", input: signWithV1(t, ecKey, ecCert, "", false), wantErrStr: "missing expected certificate"},
+		{name: "unsigned", input: unsigned, cert: parsedECCert, wantErrStr: "no APK Signing Block found"},
+		{name: "v1 with another certificate", input: signWithV1(t, rsaKey, rsaCert, "", false), cert: parsedECCert, wantErrStr: "signed APK has certificate"},
+		{name: "v2 with another certificate", input: signWithSigningBlock(t, signWithV1(t, ecKey, ecCert, "2", false), otherKey, makeTestCert(t, otherKey), 0x0201, false), cert: parsedECCert, wantErrStr: "signed APK has certificate"},
+		{name: "v1 tampered entry", input: signWithV1(t, ecKey, ecCert, "", true), cert: parsedECCert, wantErrStr: `APK entry "classes.dex" does not match the manifest`},
+		{name: "v1 signature of another key", input: signWithV1(t, ecKey, makeTestCert(t, otherKey), "", false), cert: parsedECCert, wantErrStr: "does not verify"},
+		{name: "stripped v2", input: signWithV1(t, ecKey, ecCert, "2", false), cert: parsedECCert, wantErrStr: "declares an APK Signature Scheme v2 signature the APK does not have"},
+		{name: "stripped v3", input: signWithSigningBlock(t, signWithV1(t, ecKey, ecCert, "2, 3", false), ecKey, ecCert, 0x0201, false), cert: parsedECCert, wantErrStr: "declares an APK Signature Scheme v3 signature the APK does not have"},
+	}
+	for _, tt := range tests {
+		err := Verify(tt.input, tt.cert)
+		if tt.wantErrStr == "" {
+			if err != nil {
+				t.Fatalf("%s: failed to verify APK: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErrStr) {
+			t.Fatalf("%s: expected error containing %q but got %v", tt.name, tt.wantErrStr, err)
+		}
+	}
+}
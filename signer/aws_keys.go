@@ -0,0 +1,227 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+)
+
+const (
+	// awsSecretsManagerKeyPrefix prefixes the name or ARN of an AWS
+	// Secrets Manager secret holding the PEM private key of a signer
+	awsSecretsManagerKeyPrefix = "awssm://"
+
+	// awsKMSKeyPrefix prefixes the ID, ARN or alias of an asymmetric
+	// AWS KMS signing key of a signer
+	awsKMSKeyPrefix = "awskms://"
+)
+
+// newSecretsManagerClient and newKMSClient return the AWS clients
+// private key references are resolved with. They use the default
+// credentials and region of the AWS SDK, and are replaced in tests.
+var (
+	newSecretsManagerClient = func() (secretsmanageriface.SecretsManagerAPI, error) {
+		sess, err := session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		return secretsmanager.New(sess), nil
+	}
+	newKMSClient = func() (kmsiface.KMSAPI, error) {
+		sess, err := session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		return kms.New(sess), nil
+	}
+)
+
+// PrivateKeyHasAWSPrefix returns whether the private key of the
+// signer configuration is a reference to an AWS Secrets Manager secret
+// or KMS key rather than a PEM key or HSM label
+func (cfg *Configuration) PrivateKeyHasAWSPrefix() bool {
+	privateKey := removePrivateKeyNewlines(cfg.PrivateKey)
+	return strings.HasPrefix(privateKey, awsSecretsManagerKeyPrefix) || strings.HasPrefix(privateKey, awsKMSKeyPrefix)
+}
+
+// getAWSPrivateKey resolves the AWS reference of the private key of
+// the signer configuration
+func (cfg *Configuration) getAWSPrivateKey() (crypto.PrivateKey, error) {
+	privateKey := strings.TrimSpace(cfg.PrivateKey)
+	if strings.HasPrefix(privateKey, awsKMSKeyPrefix) {
+		keyID := strings.TrimPrefix(privateKey, awsKMSKeyPrefix)
+		if keyID == "" {
+			return nil, fmt.Errorf("signer: missing key ID in AWS KMS private key reference %q", privateKey)
+		}
+		key, err := newAWSKMSPrivateKey(keyID)
+		if err != nil {
+			return nil, fmt.Errorf("signer: failed to load private key from AWS KMS key %q: %w", keyID, err)
+		}
+		return key, nil
+	}
+	secretID := strings.TrimPrefix(privateKey, awsSecretsManagerKeyPrefix)
+	if secretID == "" {
+		return nil, fmt.Errorf("signer: missing secret name in AWS Secrets Manager private key reference %q", privateKey)
+	}
+	keyPEM, err := getAWSSecretsManagerSecret(secretID)
+	if err != nil {
+		return nil, fmt.Errorf("signer: failed to fetch private key from AWS Secrets Manager secret %q: %w", secretID, err)
+	}
+	passphrase, err := cfg.getPrivateKeyPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParseEncryptedPrivateKey(keyPEM, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("signer: failed to parse private key from AWS Secrets Manager secret %q: %w", secretID, err)
+	}
+	return key, nil
+}
+
+// getAWSSecretsManagerSecret returns the string or binary value of
+// the current version of a secret
+func getAWSSecretsManagerSecret(secretID string) ([]byte, error) {
+	client, err := newSecretsManagerClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %w", err)
+	}
+	out, err := client.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out.SecretString != nil {
+		return []byte(*out.SecretString), nil
+	}
+	if len(out.SecretBinary) > 0 {
+		return out.SecretBinary, nil
+	}
+	return nil, fmt.Errorf("secret has no value")
+}
+
+// awsKMSPrivateKey is a crypto.Signer for an asymmetric AWS KMS
+// signing key. Its key material never leaves KMS, and digests are
+// signed by calling the KMS Sign API.
+type awsKMSPrivateKey struct {
+	client kmsiface.KMSAPI
+	keyID  string
+	pub    crypto.PublicKey
+}
+
+// newAWSKMSPrivateKey fetches the public key of a KMS key and checks
+// it is an RSA or ECDSA signing key
+func newAWSKMSPrivateKey(keyID string) (*awsKMSPrivateKey, error) {
+	client, err := newKMSClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %w", err)
+	}
+	out, err := client.GetPublicKey(&kms.GetPublicKeyInput{
+		KeyId: aws.String(keyID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if aws.StringValue(out.KeyUsage) != kms.KeyUsageTypeSignVerify {
+		return nil, fmt.Errorf("key usage is %q and not %q", aws.StringValue(out.KeyUsage), kms.KeyUsageTypeSignVerify)
+	}
+	pub, err := x509.ParsePKIXPublicKey(out.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	switch pub.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return &awsKMSPrivateKey{client: client, keyID: keyID, pub: pub}, nil
+}
+
+// Public returns the public key of the KMS key
+func (k *awsKMSPrivateKey) Public() crypto.PublicKey {
+	return k.pub
+}
+
+// Sign signs a digest with the KMS key. RSA keys make PKCS1v15
+// signatures, or PSS signatures with a salt of the length of the hash
+// when opts are *rsa.PSSOptions. ECDSA signatures are ASN.1 encoded,
+// like those of ecdsa.PrivateKey.
+func (k *awsKMSPrivateKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	algorithm, err := k.signingAlgorithm(opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(digest) != opts.HashFunc().Size() {
+		return nil, fmt.Errorf("signer: digest of %d bytes does not match the %d bytes of %s", len(digest), opts.HashFunc().Size(), opts.HashFunc())
+	}
+	out, err := k.client.Sign(&kms.SignInput{
+		KeyId:            aws.String(k.keyID),
+		Message:          digest,
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		SigningAlgorithm: aws.String(algorithm),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("signer: failed to sign with AWS KMS key %q: %w", k.keyID, err)
+	}
+	return out.Signature, nil
+}
+
+// signingAlgorithm returns the KMS signing algorithm of the key type
+// and the hash and padding of opts
+func (k *awsKMSPrivateKey) signingAlgorithm(opts crypto.SignerOpts) (string, error) {
+	var hashIndex int
+	switch opts.HashFunc() {
+	case crypto.SHA256:
+		hashIndex = 0
+	case crypto.SHA384:
+		hashIndex = 1
+	case crypto.SHA512:
+		hashIndex = 2
+	default:
+		return "", fmt.Errorf("signer: AWS KMS keys do not support hash %s", opts.HashFunc())
+	}
+	switch k.pub.(type) {
+	case *ecdsa.PublicKey:
+		return []string{
+			kms.SigningAlgorithmSpecEcdsaSha256,
+			kms.SigningAlgorithmSpecEcdsaSha384,
+			kms.SigningAlgorithmSpecEcdsaSha512,
+		}[hashIndex], nil
+	case *rsa.PublicKey:
+		if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+			if pssOpts.SaltLength != rsa.PSSSaltLengthEqualsHash && pssOpts.SaltLength != opts.HashFunc().Size() {
+				return "", fmt.Errorf("signer: AWS KMS keys only support PSS salts of the length of the hash")
+			}
+			return []string{
+				kms.SigningAlgorithmSpecRsassaPssSha256,
+				kms.SigningAlgorithmSpecRsassaPssSha384,
+				kms.SigningAlgorithmSpecRsassaPssSha512,
+			}[hashIndex], nil
+		}
+		return []string{
+			kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256,
+			kms.SigningAlgorithmSpecRsassaPkcs1V15Sha384,
+			kms.SigningAlgorithmSpecRsassaPkcs1V15Sha512,
+		}[hashIndex], nil
+	}
+	return "", fmt.Errorf("signer: unsupported AWS KMS public key type %T", k.pub)
+}
+
+// IsAWSKMSKey returns whether a private key returned by GetPrivateKey
+// is an AWS KMS key, which signs via the KMS API and whose key
+// material cannot be marshalled
+func IsAWSKMSKey(priv crypto.PrivateKey) bool {
+	_, ok := priv.(*awsKMSPrivateKey)
+	return ok
+}
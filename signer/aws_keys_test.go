@@ -0,0 +1,245 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+)
+
+type fakeSecretsManager struct {
+	secretsmanageriface.SecretsManagerAPI
+	secrets map[string]*secretsmanager.GetSecretValueOutput
+}
+
+func (f *fakeSecretsManager) GetSecretValue(in *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	out, ok := f.secrets[aws.StringValue(in.SecretId)]
+	if !ok {
+		return nil, errors.New("ResourceNotFoundException: Secrets Manager can't find the specified secret")
+	}
+	return out, nil
+}
+
+// fakeKMS signs with local keys, as KMS does with the signing
+// algorithm of the requests
+type fakeKMS struct {
+	kmsiface.KMSAPI
+	keys     map[string]crypto.Signer
+	keyUsage string
+}
+
+func (f *fakeKMS) GetPublicKey(in *kms.GetPublicKeyInput) (*kms.GetPublicKeyOutput, error) {
+	key, ok := f.keys[aws.StringValue(in.KeyId)]
+	if !ok {
+		return nil, errors.New("NotFoundException: key does not exist")
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &kms.GetPublicKeyOutput{
+		KeyId:     in.KeyId,
+		KeyUsage:  aws.String(f.keyUsage),
+		PublicKey: der,
+	}, nil
+}
+
+func (f *fakeKMS) Sign(in *kms.SignInput) (*kms.SignOutput, error) {
+	key := f.keys[aws.StringValue(in.KeyId)]
+	var opts crypto.SignerOpts = crypto.SHA256
+	switch aws.StringValue(in.SigningAlgorithm) {
+	case kms.SigningAlgorithmSpecEcdsaSha256, kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256:
+	case kms.SigningAlgorithmSpecRsassaPssSha256:
+		opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	default:
+		return nil, errors.New("ValidationException: unsupported signing algorithm")
+	}
+	sig, err := key.Sign(rand.Reader, in.Message, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.SignOutput{Signature: sig}, nil
+}
+
+func withFakeAWSClients(t *testing.T, sm secretsmanageriface.SecretsManagerAPI, k kmsiface.KMSAPI) {
+	origSM, origKMS := newSecretsManagerClient, newKMSClient
+	newSecretsManagerClient = func() (secretsmanageriface.SecretsManagerAPI, error) { return sm, nil }
+	newKMSClient = func() (kmsiface.KMSAPI, error) { return k, nil }
+	t.Cleanup(func() {
+		newSecretsManagerClient, newKMSClient = origSM, origKMS
+	})
+}
+
+func TestGetPrivateKeyFromAWSSecretsManager(t *testing.T) {
+	withFakeAWSClients(t, &fakeSecretsManager{
+		secrets: map[string]*secretsmanager.GetSecretValueOutput{
+			"autograph/rsa":       {SecretString: aws.String(rsaPrivateKey)},
+			"autograph/encrypted": {SecretBinary: []byte(rsaEncryptedPrivateKey)},
+			"autograph/empty":     {},
+		},
+	}, nil)
+	plainKey, err := ParsePrivateKey([]byte(rsaPrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcfg := Configuration{PrivateKey: "awssm://autograph/rsa"}
+	key, err := tcfg.GetPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.(*rsa.PrivateKey).Equal(plainKey) {
+		t.Fatal("expected the private key of the secret")
+	}
+	if _, _, _, err = tcfg.GetKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	tcfg = Configuration{
+		PrivateKey:           "\nawssm://autograph/encrypted",
+		PrivateKeyPassphrase: "correct horse battery staple",
+	}
+	key, err = tcfg.GetPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.(*rsa.PrivateKey).Equal(plainKey) {
+		t.Fatal("expected the decrypted private key of the secret")
+	}
+
+	for _, testcase := range []struct {
+		privateKey string
+		err        string
+	}{
+		{"awssm://", "signer: missing secret name in AWS Secrets Manager private key reference"},
+		{"awssm://autograph/missing", `signer: failed to fetch private key from AWS Secrets Manager secret "autograph/missing": ResourceNotFoundException`},
+		{"awssm://autograph/empty", `signer: failed to fetch private key from AWS Secrets Manager secret "autograph/empty": secret has no value`},
+		{"awssm://autograph/encrypted", `signer: failed to parse private key from AWS Secrets Manager secret "autograph/encrypted": signer: private key is encrypted but no passphrase is configured`},
+	} {
+		tcfg = Configuration{PrivateKey: testcase.privateKey}
+		key, err = tcfg.GetPrivateKey()
+		if err == nil || !strings.HasPrefix(err.Error(), testcase.err) {
+			t.Fatalf("expected %q to fail with %q but got %v", testcase.privateKey, testcase.err, err)
+		}
+		if key != nil {
+			t.Fatalf("expected no key for %q but got %T", testcase.privateKey, key)
+		}
+	}
+}
+
+func TestGetPrivateKeyFromAWSKMS(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := ParsePrivateKey([]byte(rsaPrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeKMS{
+		keys: map[string]crypto.Signer{
+			"alias/autograph-ecdsa": ecKey,
+			"alias/autograph-rsa":   rsaKey.(*rsa.PrivateKey),
+		},
+		keyUsage: kms.KeyUsageTypeSignVerify,
+	}
+	withFakeAWSClients(t, nil, fake)
+	digest := sha256.Sum256([]byte("foobar"))
+
+	tcfg := Configuration{PrivateKey: "awskms://alias/autograph-ecdsa"}
+	priv, pub, publicKey, err := tcfg.GetKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsAWSKMSKey(priv) || IsHSMKey(priv) {
+		t.Fatalf("expected an AWS KMS key but got %T", priv)
+	}
+	if !pub.(*ecdsa.PublicKey).Equal(&ecKey.PublicKey) {
+		t.Fatal("expected the public key of the KMS key")
+	}
+	if publicKey == "" {
+		t.Fatal("expected a marshalled public key")
+	}
+	sig, err := priv.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(&ecKey.PublicKey, digest[:], sig) {
+		t.Fatal("failed to verify ECDSA signature of the KMS key")
+	}
+	_, _, err = tcfg.GetPKCS8PrivateKey()
+	if !errors.Is(err, ErrNonExportableKey) {
+		t.Fatalf("expected exporting a KMS key to fail with ErrNonExportableKey but got %v", err)
+	}
+
+	tcfg = Configuration{PrivateKey: "awskms://alias/autograph-rsa"}
+	priv, err = tcfg.GetPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err = priv.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rsa.VerifyPKCS1v15(&rsaKey.(*rsa.PrivateKey).PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+		t.Fatal(err)
+	}
+	pssOpts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	sig, err = priv.(crypto.Signer).Sign(rand.Reader, digest[:], pssOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rsa.VerifyPSS(&rsaKey.(*rsa.PrivateKey).PublicKey, crypto.SHA256, digest[:], sig, pssOpts); err != nil {
+		t.Fatal(err)
+	}
+	_, err = priv.(crypto.Signer).Sign(rand.Reader, digest[:], &rsa.PSSOptions{SaltLength: 20, Hash: crypto.SHA256})
+	if err == nil {
+		t.Fatal("expected signing with a PSS salt length other than the hash length to fail")
+	}
+	_, err = priv.(crypto.Signer).Sign(rand.Reader, digest[:20], crypto.SHA256)
+	if err == nil {
+		t.Fatal("expected signing a digest of the wrong length to fail")
+	}
+
+	tcfg = Configuration{PrivateKey: "awskms://alias/missing"}
+	_, err = tcfg.GetPrivateKey()
+	if err == nil || !strings.HasPrefix(err.Error(), `signer: failed to load private key from AWS KMS key "alias/missing": NotFoundException`) {
+		t.Fatalf("expected a missing KMS key to fail but got %v", err)
+	}
+
+	fake.keyUsage = kms.KeyUsageTypeEncryptDecrypt
+	tcfg = Configuration{PrivateKey: "awskms://alias/autograph-rsa"}
+	_, err = tcfg.GetPrivateKey()
+	if err == nil || !strings.Contains(err.Error(), `key usage is "ENCRYPT_DECRYPT" and not "SIGN_VERIFY"`) {
+		t.Fatalf("expected an encryption KMS key to fail but got %v", err)
+	}
+}
+
+func TestPrivateKeyHasAWSPrefix(t *testing.T) {
+	for _, testcase := range []struct {
+		privateKey string
+		expected   bool
+	}{
+		{"awssm://autograph/key", true},
+		{"\nawskms://alias/key", true},
+		{rsaPrivateKey, false},
+		{"hsm-key-label", false},
+	} {
+		tcfg := Configuration{PrivateKey: testcase.privateKey}
+		if tcfg.PrivateKeyHasAWSPrefix() != testcase.expected {
+			t.Fatalf("expected PrivateKeyHasAWSPrefix of %q to be %t", testcase.privateKey, testcase.expected)
+		}
+	}
+}
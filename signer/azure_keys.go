@@ -0,0 +1,269 @@
+package signer
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/v7.0/keyvault"
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/v7.0/keyvault/keyvaultapi"
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+)
+
+// azureKeyVaultKeyPrefix prefixes the vault, name and optional version
+// of an Azure Key Vault RSA or EC key of a signer, e.g.
+// azurekv://myvault/mykey or azurekv://myvault/mykey/<version>
+const azureKeyVaultKeyPrefix = "azurekv://"
+
+// newAzureKeyVaultClient returns the Azure Key Vault client and the
+// DNS suffix of vault names key references are resolved with. It
+// authenticates with the client credentials, certificate, username
+// and password or managed identity of the AZURE_* environment
+// variables, and is replaced in tests.
+var newAzureKeyVaultClient = func() (client keyvaultapi.BaseClientAPI, dnsSuffix string, err error) {
+	settings, err := auth.GetSettingsFromEnvironment()
+	if err != nil {
+		return nil, "", err
+	}
+	settings.Values[auth.Resource] = strings.TrimSuffix(settings.Environment.KeyVaultEndpoint, "/")
+	authorizer, err := settings.GetAuthorizer()
+	if err != nil {
+		return nil, "", err
+	}
+	kvClient := keyvault.New()
+	kvClient.Authorizer = authorizer
+	return kvClient, settings.Environment.KeyVaultDNSSuffix, nil
+}
+
+// PrivateKeyHasAzurePrefix returns whether the private key of the
+// signer configuration is a reference to an Azure Key Vault key
+// rather than a PEM key or HSM label
+func (cfg *Configuration) PrivateKeyHasAzurePrefix() bool {
+	return strings.HasPrefix(removePrivateKeyNewlines(cfg.PrivateKey), azureKeyVaultKeyPrefix)
+}
+
+// getAzurePrivateKey resolves the Azure Key Vault reference of the
+// private key of the signer configuration
+func (cfg *Configuration) getAzurePrivateKey() (crypto.PrivateKey, error) {
+	privateKey := strings.TrimSpace(cfg.PrivateKey)
+	parts := strings.Split(strings.TrimPrefix(privateKey, azureKeyVaultKeyPrefix), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("signer: Azure Key Vault private key reference %q is not of the form azurekv://<vault>/<key>[/<version>]", privateKey)
+	}
+	var version string
+	if len(parts) == 3 {
+		version = parts[2]
+	}
+	key, err := newAzureKeyVaultPrivateKey(parts[0], parts[1], version)
+	if err != nil {
+		return nil, fmt.Errorf("signer: failed to load private key from Azure Key Vault key %q: %w", strings.Join(parts, "/"), err)
+	}
+	return key, nil
+}
+
+// azureKeyVaultPrivateKey is a crypto.Signer for an Azure Key Vault
+// RSA or EC key. Its key material never leaves the vault, and digests
+// are signed by calling the Key Vault sign operation.
+type azureKeyVaultPrivateKey struct {
+	client       keyvaultapi.BaseClientAPI
+	vaultBaseURL string
+	name         string
+	version      string
+	pub          crypto.PublicKey
+}
+
+// newAzureKeyVaultPrivateKey fetches the public key of a Key Vault
+// key, and checks it is an RSA or EC key permitted to sign. Vaults
+// without a dot are names in the DNS suffix of the Azure environment,
+// e.g. vault.azure.net, and others are hostnames.
+func newAzureKeyVaultPrivateKey(vault, name, version string) (*azureKeyVaultPrivateKey, error) {
+	client, dnsSuffix, err := newAzureKeyVaultClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Azure Key Vault client: %w", err)
+	}
+	if !strings.Contains(vault, ".") {
+		vault += "." + dnsSuffix
+	}
+	k := &azureKeyVaultPrivateKey{
+		client:       client,
+		vaultBaseURL: "https://" + vault,
+		name:         name,
+		version:      version,
+	}
+	bundle, err := client.GetKey(context.Background(), k.vaultBaseURL, name, version)
+	if err != nil {
+		return nil, err
+	}
+	if bundle.Key == nil {
+		return nil, fmt.Errorf("key has no JSON web key")
+	}
+	if bundle.Key.KeyOps != nil {
+		canSign := false
+		for _, op := range *bundle.Key.KeyOps {
+			if op == string(keyvault.Sign) {
+				canSign = true
+			}
+		}
+		if !canSign {
+			return nil, fmt.Errorf("key operations %q do not include %q", *bundle.Key.KeyOps, keyvault.Sign)
+		}
+	}
+	k.pub, err = parseAzureJSONWebKey(bundle.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	return k, nil
+}
+
+// parseAzureJSONWebKey returns the RSA or ECDSA public key of a Key
+// Vault JSON web key
+func parseAzureJSONWebKey(jwk *keyvault.JSONWebKey) (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case keyvault.RSA, keyvault.RSAHSM:
+		n, err := decodeAzureBigInt(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA modulus: %w", err)
+		}
+		e, err := decodeAzureBigInt(jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA exponent: %w", err)
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("RSA exponent is too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case keyvault.EC, keyvault.ECHSM:
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case keyvault.P256:
+			curve = elliptic.P256()
+		case keyvault.P384:
+			curve = elliptic.P384()
+		case keyvault.P521:
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported elliptic curve %q", jwk.Crv)
+		}
+		x, err := decodeAzureBigInt(jwk.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC X coordinate: %w", err)
+		}
+		y, err := decodeAzureBigInt(jwk.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC Y coordinate: %w", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("EC point is not on curve %q", jwk.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+// decodeAzureBigInt decodes a big-endian integer in the URL-encoded
+// base64 of Key Vault, which may be padded or not
+func decodeAzureBigInt(value *string) (*big.Int, error) {
+	if value == nil {
+		return nil, fmt.Errorf("missing value")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(*value, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// Public returns the public key of the Key Vault key
+func (k *azureKeyVaultPrivateKey) Public() crypto.PublicKey {
+	return k.pub
+}
+
+// Sign signs a digest with the Key Vault key. RSA keys make PKCS1v15
+// signatures, or PSS signatures with a salt of the length of the hash
+// when opts are *rsa.PSSOptions. ECDSA signatures are ASN.1 encoded,
+// like those of ecdsa.PrivateKey, and must use the hash of the curve
+// of the key.
+func (k *azureKeyVaultPrivateKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	algorithm, err := k.signingAlgorithm(opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(digest) != opts.HashFunc().Size() {
+		return nil, fmt.Errorf("signer: digest of %d bytes does not match the %d bytes of %s", len(digest), opts.HashFunc().Size(), opts.HashFunc())
+	}
+	value := base64.RawURLEncoding.EncodeToString(digest)
+	out, err := k.client.Sign(context.Background(), k.vaultBaseURL, k.name, k.version, keyvault.KeySignParameters{
+		Algorithm: algorithm,
+		Value:     &value,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("signer: failed to sign with Azure Key Vault key %q: %w", k.name, err)
+	}
+	if out.Result == nil {
+		return nil, fmt.Errorf("signer: Azure Key Vault key %q returned no signature", k.name)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(*out.Result, "="))
+	if err != nil {
+		return nil, fmt.Errorf("signer: failed to decode signature of Azure Key Vault key %q: %w", k.name, err)
+	}
+	if _, ok := k.pub.(*ecdsa.PublicKey); ok {
+		// Key Vault returns the concatenated r and s of ECDSA signatures
+		if len(sig) == 0 || len(sig)%2 != 0 {
+			return nil, fmt.Errorf("signer: invalid ECDSA signature length %d from Azure Key Vault key %q", len(sig), k.name)
+		}
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			R: new(big.Int).SetBytes(sig[:len(sig)/2]),
+			S: new(big.Int).SetBytes(sig[len(sig)/2:]),
+		})
+	}
+	return sig, nil
+}
+
+// signingAlgorithm returns the Key Vault signature algorithm of the
+// key type and the hash and padding of opts
+func (k *azureKeyVaultPrivateKey) signingAlgorithm(opts crypto.SignerOpts) (keyvault.JSONWebKeySignatureAlgorithm, error) {
+	var hashIndex int
+	switch opts.HashFunc() {
+	case crypto.SHA256:
+		hashIndex = 0
+	case crypto.SHA384:
+		hashIndex = 1
+	case crypto.SHA512:
+		hashIndex = 2
+	default:
+		return "", fmt.Errorf("signer: Azure Key Vault keys do not support hash %s", opts.HashFunc())
+	}
+	switch pub := k.pub.(type) {
+	case *ecdsa.PublicKey:
+		curveIndex := map[string]int{"P-256": 0, "P-384": 1, "P-521": 2}[pub.Curve.Params().Name]
+		if curveIndex != hashIndex {
+			return "", fmt.Errorf("signer: Azure Key Vault %s keys do not support hash %s", pub.Curve.Params().Name, opts.HashFunc())
+		}
+		return []keyvault.JSONWebKeySignatureAlgorithm{keyvault.ES256, keyvault.ES384, keyvault.ES512}[hashIndex], nil
+	case *rsa.PublicKey:
+		if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+			if pssOpts.SaltLength != rsa.PSSSaltLengthEqualsHash && pssOpts.SaltLength != opts.HashFunc().Size() {
+				return "", fmt.Errorf("signer: Azure Key Vault keys only support PSS salts of the length of the hash")
+			}
+			return []keyvault.JSONWebKeySignatureAlgorithm{keyvault.PS256, keyvault.PS384, keyvault.PS512}[hashIndex], nil
+		}
+		return []keyvault.JSONWebKeySignatureAlgorithm{keyvault.RS256, keyvault.RS384, keyvault.RS512}[hashIndex], nil
+	}
+	return "", fmt.Errorf("signer: unsupported Azure Key Vault public key type %T", k.pub)
+}
+
+// IsAzureKeyVaultKey returns whether a private key returned by
+// GetPrivateKey is an Azure Key Vault key, which signs via the Key
+// Vault API and whose key material cannot be marshalled
+func IsAzureKeyVaultKey(priv crypto.PrivateKey) bool {
+	_, ok := priv.(*azureKeyVaultPrivateKey)
+	return ok
+}
@@ -0,0 +1,218 @@
+package signer
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/v7.0/keyvault"
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/v7.0/keyvault/keyvaultapi"
+)
+
+// fakeKeyVault signs with local keys, as Key Vault does with the
+// algorithm of the requests
+type fakeKeyVault struct {
+	keyvaultapi.BaseClientAPI
+	vaultBaseURL string
+	keys         map[string]crypto.Signer
+	keyOps       []string
+}
+
+func encodeAzureBigInt(i *big.Int) *string {
+	s := base64.RawURLEncoding.EncodeToString(i.Bytes())
+	return &s
+}
+
+func (f *fakeKeyVault) GetKey(ctx context.Context, vaultBaseURL string, keyName string, keyVersion string) (keyvault.KeyBundle, error) {
+	key, ok := f.keys[keyName]
+	if !ok || vaultBaseURL != f.vaultBaseURL {
+		return keyvault.KeyBundle{}, errors.New("KeyNotFound: key does not exist")
+	}
+	jwk := &keyvault.JSONWebKey{KeyOps: &f.keyOps}
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = keyvault.RSAHSM
+		jwk.N = encodeAzureBigInt(pub.N)
+		jwk.E = encodeAzureBigInt(big.NewInt(int64(pub.E)))
+	case *ecdsa.PublicKey:
+		jwk.Kty = keyvault.EC
+		jwk.Crv = keyvault.JSONWebKeyCurveName(pub.Curve.Params().Name)
+		jwk.X = encodeAzureBigInt(pub.X)
+		jwk.Y = encodeAzureBigInt(pub.Y)
+	}
+	return keyvault.KeyBundle{Key: jwk}, nil
+}
+
+func (f *fakeKeyVault) Sign(ctx context.Context, vaultBaseURL string, keyName string, keyVersion string, parameters keyvault.KeySignParameters) (keyvault.KeyOperationResult, error) {
+	key := f.keys[keyName]
+	digest, err := base64.RawURLEncoding.DecodeString(*parameters.Value)
+	if err != nil {
+		return keyvault.KeyOperationResult{}, err
+	}
+	var sig []byte
+	switch parameters.Algorithm {
+	case keyvault.ES256:
+		r, s, err := ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest)
+		if err != nil {
+			return keyvault.KeyOperationResult{}, err
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case keyvault.RS256:
+		sig, err = key.Sign(rand.Reader, digest, crypto.SHA256)
+	case keyvault.PS256:
+		sig, err = key.Sign(rand.Reader, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256})
+	default:
+		return keyvault.KeyOperationResult{}, errors.New("BadParameter: unsupported algorithm")
+	}
+	if err != nil {
+		return keyvault.KeyOperationResult{}, err
+	}
+	result := base64.RawURLEncoding.EncodeToString(sig)
+	return keyvault.KeyOperationResult{Result: &result}, nil
+}
+
+func withFakeAzureKeyVault(t *testing.T, f *fakeKeyVault) {
+	orig := newAzureKeyVaultClient
+	newAzureKeyVaultClient = func() (keyvaultapi.BaseClientAPI, string, error) { return f, "vault.azure.net", nil }
+	t.Cleanup(func() {
+		newAzureKeyVaultClient = orig
+	})
+}
+
+func TestGetPrivateKeyFromAzureKeyVault(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := ParsePrivateKey([]byte(rsaPrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeKeyVault{
+		vaultBaseURL: "https://autograph.vault.azure.net",
+		keys: map[string]crypto.Signer{
+			"autograph-ecdsa": ecKey,
+			"autograph-rsa":   rsaKey.(*rsa.PrivateKey),
+		},
+		keyOps: []string{"sign", "verify"},
+	}
+	withFakeAzureKeyVault(t, fake)
+	digest := sha256.Sum256([]byte("foobar"))
+
+	tcfg := Configuration{PrivateKey: "azurekv://autograph/autograph-ecdsa"}
+	priv, pub, publicKey, err := tcfg.GetKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsAzureKeyVaultKey(priv) || IsAWSKMSKey(priv) || IsHSMKey(priv) {
+		t.Fatalf("expected an Azure Key Vault key but got %T", priv)
+	}
+	if !pub.(*ecdsa.PublicKey).Equal(&ecKey.PublicKey) {
+		t.Fatal("expected the public key of the Key Vault key")
+	}
+	if publicKey == "" {
+		t.Fatal("expected a marshalled public key")
+	}
+	sig, err := priv.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(&ecKey.PublicKey, digest[:], sig) {
+		t.Fatal("failed to verify ASN.1 ECDSA signature of the Key Vault key")
+	}
+	_, err = priv.(crypto.Signer).Sign(rand.Reader, make([]byte, 48), crypto.SHA384)
+	if err == nil || !strings.Contains(err.Error(), "P-256 keys do not support hash SHA-384") {
+		t.Fatalf("expected signing a SHA384 digest with a P-256 key to fail but got %v", err)
+	}
+	_, _, err = tcfg.GetPKCS8PrivateKey()
+	if !errors.Is(err, ErrNonExportableKey) {
+		t.Fatalf("expected exporting a Key Vault key to fail with ErrNonExportableKey but got %v", err)
+	}
+	if err = tcfg.CheckHSMConnection(); err == nil {
+		t.Fatal("expected checking the HSM connection of a Key Vault key to fail")
+	}
+
+	// vaults with a dot are hostnames, and keys may have a version
+	tcfg = Configuration{PrivateKey: "\nazurekv://autograph.vault.azure.net/autograph-rsa/0123456789abcdef"}
+	priv, err = tcfg.GetPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if priv.(*azureKeyVaultPrivateKey).version != "0123456789abcdef" {
+		t.Fatalf("expected the key version of the reference but got %q", priv.(*azureKeyVaultPrivateKey).version)
+	}
+	sig, err = priv.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rsa.VerifyPKCS1v15(&rsaKey.(*rsa.PrivateKey).PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+		t.Fatal(err)
+	}
+	pssOpts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	sig, err = priv.(crypto.Signer).Sign(rand.Reader, digest[:], pssOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rsa.VerifyPSS(&rsaKey.(*rsa.PrivateKey).PublicKey, crypto.SHA256, digest[:], sig, pssOpts); err != nil {
+		t.Fatal(err)
+	}
+	_, err = priv.(crypto.Signer).Sign(rand.Reader, digest[:], &rsa.PSSOptions{SaltLength: 20, Hash: crypto.SHA256})
+	if err == nil {
+		t.Fatal("expected signing with a PSS salt length other than the hash length to fail")
+	}
+	_, err = priv.(crypto.Signer).Sign(rand.Reader, digest[:20], crypto.SHA256)
+	if err == nil {
+		t.Fatal("expected signing a digest of the wrong length to fail")
+	}
+
+	for _, testcase := range []struct {
+		privateKey string
+		err        string
+	}{
+		{"azurekv://", "signer: Azure Key Vault private key reference \"azurekv://\" is not of the form"},
+		{"azurekv://autograph", "is not of the form azurekv://<vault>/<key>[/<version>]"},
+		{"azurekv://autograph/key/version/extra", "is not of the form azurekv://<vault>/<key>[/<version>]"},
+		{"azurekv://autograph/missing", `signer: failed to load private key from Azure Key Vault key "autograph/missing": KeyNotFound`},
+		{"azurekv://othervault/autograph-rsa", `signer: failed to load private key from Azure Key Vault key "othervault/autograph-rsa": KeyNotFound`},
+	} {
+		tcfg = Configuration{PrivateKey: testcase.privateKey}
+		_, err = tcfg.GetPrivateKey()
+		if err == nil || !strings.Contains(err.Error(), testcase.err) {
+			t.Fatalf("expected %q to fail with %q but got %v", testcase.privateKey, testcase.err, err)
+		}
+	}
+
+	fake.keyOps = []string{"encrypt", "decrypt"}
+	tcfg = Configuration{PrivateKey: "azurekv://autograph/autograph-rsa"}
+	_, err = tcfg.GetPrivateKey()
+	if err == nil || !strings.Contains(err.Error(), `do not include "sign"`) {
+		t.Fatalf("expected an encryption Key Vault key to fail but got %v", err)
+	}
+}
+
+func TestPrivateKeyHasAzurePrefix(t *testing.T) {
+	for _, testcase := range []struct {
+		privateKey string
+		expected   bool
+	}{
+		{"azurekv://vault/key", true},
+		{"\nazurekv://vault/key/version", true},
+		{"awskms://alias/key", false},
+		{rsaPrivateKey, false},
+		{"hsm-key-label", false},
+	} {
+		tcfg := Configuration{PrivateKey: testcase.privateKey}
+		if tcfg.PrivateKeyHasAzurePrefix() != testcase.expected {
+			t.Fatalf("expected PrivateKeyHasAzurePrefix of %q to be %t", testcase.privateKey, testcase.expected)
+		}
+	}
+}
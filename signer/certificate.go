@@ -0,0 +1,78 @@
+package signer
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"github.com/mozilla-services/autograph/formats"
+)
+
+// ParseCertificateInfo parses a PEM encoded certificate and returns
+// its fields and fingerprints
+func ParseCertificateInfo(certPEM string) (*formats.CertificateInfo, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	sha1Fingerprint := sha1.Sum(cert.Raw)
+	sha256Fingerprint := sha256.Sum256(cert.Raw)
+	info := &formats.CertificateInfo{
+		Subject:           cert.Subject.String(),
+		Issuer:            cert.Issuer.String(),
+		SerialNumber:      cert.SerialNumber.String(),
+		NotBefore:         cert.NotBefore,
+		NotAfter:          cert.NotAfter,
+		SHA1Fingerprint:   hex.EncodeToString(sha1Fingerprint[:]),
+		SHA256Fingerprint: hex.EncodeToString(sha256Fingerprint[:]),
+	}
+	info.SubjectAltNames = append(info.SubjectAltNames, cert.DNSNames...)
+	info.SubjectAltNames = append(info.SubjectAltNames, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		info.SubjectAltNames = append(info.SubjectAltNames, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		info.SubjectAltNames = append(info.SubjectAltNames, uri.String())
+	}
+	return info, nil
+}
+
+// DefaultCertExpiryWarningDays is the number of days before the
+// expiration of a signer certificate it is warned about, when the
+// signer configuration does not set CertExpiryWarningDays
+const DefaultCertExpiryWarningDays = 30
+
+// CertExpiryWarningPeriod returns how long before the expiration of
+// the certificate of the signer it is warned about
+func (cfg *Configuration) CertExpiryWarningPeriod() time.Duration {
+	days := cfg.CertExpiryWarningDays
+	if days == 0 {
+		days = DefaultCertExpiryWarningDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// CheckCertificateValidity returns an error when a signer certificate
+// is not valid at now, so signers fail to initialize instead of
+// producing signatures downstreams reject, and logs a warning when it
+// expires within the warning period of the signer
+func CheckCertificateValidity(conf Configuration, info *formats.CertificateInfo, now time.Time) error {
+	if now.Before(info.NotBefore) {
+		return fmt.Errorf("certificate %q is not valid before %s", info.Subject, info.NotBefore)
+	}
+	if now.After(info.NotAfter) {
+		return fmt.Errorf("certificate %q expired at %s", info.Subject, info.NotAfter)
+	}
+	if info.NotAfter.Sub(now) < conf.CertExpiryWarningPeriod() {
+		Log(conf, "init").Warnf("certificate %q expires at %s", info.Subject, info.NotAfter)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package signer
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/autograph/formats"
+)
+
+func TestCheckCertificateValidity(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	info := &formats.CertificateInfo{
+		Subject:   "CN=testsigner",
+		NotBefore: now.Add(-24 * time.Hour),
+		NotAfter:  now.Add(365 * 24 * time.Hour),
+	}
+	conf := Configuration{ID: "testsigner", Type: "apk2"}
+
+	err := CheckCertificateValidity(conf, info, now)
+	if err != nil {
+		t.Fatalf("expected a valid certificate to pass but got %v", err)
+	}
+	// certificates expiring within the warning period only warn
+	err = CheckCertificateValidity(conf, info, info.NotAfter.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("expected a certificate expiring soon to pass but got %v", err)
+	}
+	err = CheckCertificateValidity(conf, info, info.NotAfter.Add(time.Hour))
+	if err == nil || !strings.Contains(err.Error(), `certificate "CN=testsigner" expired at`) {
+		t.Fatalf("expected an expired certificate to fail but got %v", err)
+	}
+	err = CheckCertificateValidity(conf, info, info.NotBefore.Add(-time.Hour))
+	if err == nil || !strings.Contains(err.Error(), `certificate "CN=testsigner" is not valid before`) {
+		t.Fatalf("expected a certificate not yet valid to fail but got %v", err)
+	}
+}
+
+func TestCertExpiryWarningPeriod(t *testing.T) {
+	conf := Configuration{}
+	if conf.CertExpiryWarningPeriod() != DefaultCertExpiryWarningDays*24*time.Hour {
+		t.Fatalf("expected the default warning period but got %s", conf.CertExpiryWarningPeriod())
+	}
+	conf.CertExpiryWarningDays = 7
+	if conf.CertExpiryWarningPeriod() != 7*24*time.Hour {
+		t.Fatalf("expected a 7 days warning period but got %s", conf.CertExpiryWarningPeriod())
+	}
+}
@@ -109,6 +109,29 @@ func (s *ContentSigner) SignData(input []byte, options interface{}) (signer.Sign
 	return sig, err
 }
 
+// VerifyData verifies a content signature of the data with the public
+// key of the signer
+func (s *ContentSigner) VerifyData(data []byte, sig signer.Signature) error {
+	csig, ok := sig.(*verifier.ContentSignature)
+	if !ok {
+		return fmt.Errorf("contentsignature: cannot verify signature of type %T", sig)
+	}
+	if !csig.VerifyData(data, s.pub.(*ecdsa.PublicKey)) {
+		return fmt.Errorf("contentsignature: failed to verify signature")
+	}
+	return nil
+}
+
+// SignedDataHash returns the hex encoded templated hash SignData would
+// sign for the input
+func (s *ContentSigner) SignedDataHash(input []byte, options interface{}) (string, error) {
+	if len(input) < 10 {
+		return "", fmt.Errorf("contentsignature: refusing to hash input data shorter than 10 bytes")
+	}
+	_, hash := makeTemplatedHash(input, s.Mode)
+	return fmt.Sprintf("%x", hash), nil
+}
+
 // hash returns the templated sha384 of the input data. The template adds
 // the string "Content-Signature:\x00" before the input data prior to
 // calculating the sha384.
@@ -135,10 +158,11 @@ func makeTemplatedHash(data []byte, curvename string) (alg string, out []byte) {
 }
 
 // SignHash takes an input hash and returns a signature. It assumes the input data
-// has already been hashed with something like sha384
+// has already been templated and hashed with the hash of the signer mode, e.g.
+// sha384 for p384ecdsa, and refuses hashes of another length
 func (s *ContentSigner) SignHash(input []byte, options interface{}) (signer.Signature, error) {
-	if len(input) != 32 && len(input) != 48 && len(input) != 64 {
-		return nil, fmt.Errorf("contentsignature: refusing to sign input hash. length %d, expected 32, 48 or 64", len(input))
+	if len(input) != getHashLen(s.Mode) {
+		return nil, fmt.Errorf("contentsignature: refusing to sign input hash: %w %d, expected %d for mode %s", signer.ErrInvalidHashLength, len(input), getHashLen(s.Mode), s.Mode)
 	}
 	var (
 		err  error
@@ -166,6 +190,18 @@ func (s *ContentSigner) SignHash(input []byte, options interface{}) (signer.Sign
 	return csig, nil
 }
 
+// getHashLen returns the length of the hashes signed in the mode, which
+// makeTemplatedHash computes with sha256, sha384 or sha512
+func getHashLen(mode string) int {
+	switch mode {
+	case P384ECDSA:
+		return sha512.Size384
+	case P521ECDSA:
+		return sha512.Size
+	}
+	return sha256.Size
+}
+
 // getSignatureLen returns the size of an ECDSA signature issued by the signer,
 // or -1 if the mode is unknown
 //
@@ -11,6 +11,7 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"strings"
 	"testing"
 
@@ -105,6 +106,19 @@ func TestSign(t *testing.T) {
 	}
 }
 
+func TestTestSigner(t *testing.T) {
+	for i, testcase := range PASSINGTESTCASES {
+		s, err := New(testcase.cfg)
+		if err != nil {
+			t.Fatalf("testcase %d signer initialization failed with: %v", i, err)
+		}
+		err = signer.TestSigner(s)
+		if err != nil {
+			t.Fatalf("testcase %d signer test failed: %v", i, err)
+		}
+	}
+}
+
 var PASSINGTESTCASES = []struct {
 	cfg signer.Configuration
 }{
@@ -201,3 +215,52 @@ func TestNoShortData(t *testing.T) {
 		t.Fatalf("expected to fail with input data too short but failed with: %v", err)
 	}
 }
+
+func TestSignHashLength(t *testing.T) {
+	for i, testcase := range PASSINGTESTCASES {
+		s, err := New(testcase.cfg)
+		if err != nil {
+			t.Fatalf("testcase %d signer initialization failed with: %v", i, err)
+		}
+		_, hash := makeTemplatedHash([]byte("foobarbaz1234abcd"), s.Mode)
+		_, err = s.SignHash(hash, nil)
+		if err != nil {
+			t.Fatalf("testcase %d failed to sign hash: %v", i, err)
+		}
+		for _, length := range []int{20, 32, 48, 64} {
+			if length == len(hash) {
+				continue
+			}
+			_, err = s.SignHash(make([]byte, length), nil)
+			if err == nil {
+				t.Fatalf("testcase %d expected to fail signing hash of length %d in mode %s but succeeded", i, length, s.Mode)
+			}
+		}
+	}
+}
+
+func TestSignedDataHash(t *testing.T) {
+	for i, testcase := range PASSINGTESTCASES {
+		s, err := New(testcase.cfg)
+		if err != nil {
+			t.Fatalf("testcase %d signer initialization failed with: %v", i, err)
+		}
+		input := []byte("foobarbaz1234abcd")
+		hash, err := s.SignedDataHash(input, nil)
+		if err != nil {
+			t.Fatalf("testcase %d failed to hash data: %v", i, err)
+		}
+		_, expected := makeTemplatedHash(input, s.Mode)
+		if hash != fmt.Sprintf("%x", expected) {
+			t.Fatalf("testcase %d expected signed data hash %x but got %s", i, expected, hash)
+		}
+	}
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	_, err = s.SignedDataHash([]byte("a"), nil)
+	if err == nil {
+		t.Fatal("expected to fail with input data too short but succeeded")
+	}
+}
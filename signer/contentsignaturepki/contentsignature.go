@@ -7,17 +7,18 @@ import (
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/asn1"
+	"encoding/json"
 	"fmt"
 	"hash"
 	"io"
 	"math/big"
+	"text/template"
 	"time"
 
 	"github.com/mozilla-services/autograph/database"
 	"github.com/mozilla-services/autograph/signer"
 	verifier "github.com/mozilla-services/autograph/verifier/contentsignature"
 
-	log "github.com/sirupsen/logrus"
 	"go.mozilla.org/mozlogrus"
 )
 
@@ -42,6 +43,12 @@ const (
 	// P384ECDSABYTESIZE defines the bytes length of a P384ECDSA signature
 	P384ECDSABYTESIZE = 96
 
+	// P521ECDSA defines an ecdsa content signature on the P-521 curve
+	P521ECDSA = "p521ecdsa"
+
+	// P521ECDSABYTESIZE defines the bytes length of a P521ECDSA signature
+	P521ECDSABYTESIZE = 132
+
 	// SignaturePrefix is a string preprended to data prior to signing
 	SignaturePrefix = "Content-Signature:\x00"
 
@@ -61,8 +68,18 @@ type ContentSigner struct {
 	validity                    time.Duration
 	clockSkewTolerance          time.Duration
 	chainUploadLocation         string
+	chainNameTemplate           string
+	parsedChainNameTemplate     *template.Template
+	s3UploadOptions             S3UploadOptions
 	caCert                      string
 	db                          *database.Handler
+	x5uFetchTimeout             time.Duration
+	x5uMaxChainSize             int64
+	x5uConnectTimeout           time.Duration
+
+	// chain holds the PEM certificates of the chain at the x5u of
+	// the signer, end-entity first, retrieved by ValidateChain
+	chain []string
 }
 
 // ecdsaAsn1Signature is a private struct to unmarshal asn1 signatures produced by crypto.Signer
@@ -72,6 +89,105 @@ type ecdsaAsn1Signature struct {
 
 // New initializes a ContentSigner using a signer configuration
 func New(conf signer.Configuration) (s *ContentSigner, err error) {
+	s, err = newContentSigner(conf)
+	if err != nil {
+		return nil, err
+	}
+	err = s.initEE(conf)
+	if err != nil {
+		return nil, fmt.Errorf("contentsignaturepki %q: failed to initialize end-entity: %w", s.ID, err)
+	}
+	return
+}
+
+// NewDryRun initializes a ContentSigner using a signer configuration
+// like New, but with a new end-entity key and chain kept in memory:
+// nothing is generated in the HSM, uploaded or stored in the
+// database. It lets a signer configuration be tested before it is
+// deployed, the signer must not serve signatures since its x5u does
+// not point to its chain.
+func NewDryRun(conf signer.Configuration) (s *ContentSigner, err error) {
+	s, err = newContentSigner(conf)
+	if err != nil {
+		return nil, err
+	}
+	s.db = nil
+	issuerPub, ok := s.issuerPub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("contentsignaturepki %q: invalid issuer public key type %T, must be ecdsa", s.ID, s.issuerPub)
+	}
+	s.eeLabel = s.ID + "-dryrun"
+	eePriv, err := ecdsa.GenerateKey(issuerPub.Curve, rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("contentsignaturepki %q: failed to generate end entity: %w", s.ID, err)
+	}
+	s.eePriv, s.eePub = eePriv, eePriv.Public()
+	chain, _, err := s.makeChain()
+	if err != nil {
+		return nil, fmt.Errorf("contentsignaturepki %q: failed to make chain: %w", s.ID, err)
+	}
+	certs, err := verifier.ParseChain([]byte(chain))
+	if err != nil {
+		return nil, fmt.Errorf("contentsignaturepki %q: failed to parse chain: %w", s.ID, err)
+	}
+	err = verifier.VerifyChain(sha2Fingerprint(certs[len(certs)-1]), certs, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("contentsignaturepki %q: failed to verify chain: %w", s.ID, err)
+	}
+	err = s.setChain(certs)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// RotateChain initializes a ContentSigner using a signer
+// configuration like New, but always with a new end-entity key and
+// certificate. Its chain is uploaded and verified at its x5u before
+// the signer is returned, so a running autograph can replace its
+// signer e.g. after the issuer certificate was renewed.
+func RotateChain(conf signer.Configuration) (s *ContentSigner, err error) {
+	s, err = newContentSigner(conf)
+	if err != nil {
+		return nil, err
+	}
+	var tx *database.Transaction
+	if s.db != nil {
+		tx, err = s.db.BeginEndEntityOperations()
+		if err != nil {
+			return nil, fmt.Errorf("contentsignaturepki %q: failed to begin db operations: %w", s.ID, err)
+		}
+		// release the end-entity lock and discard the new
+		// end-entity when the rotation fails
+		defer func() {
+			if err != nil {
+				tx.Rollback()
+			}
+		}()
+	}
+	err = s.makeEE(conf, tx)
+	if err != nil {
+		return nil, err
+	}
+	// the new end-entity only becomes current in the database once
+	// its chain verifies at its x5u
+	err = s.ValidateChain()
+	if err != nil {
+		return nil, err
+	}
+	if tx != nil {
+		err = tx.End()
+		if err != nil {
+			return nil, fmt.Errorf("contentsignaturepki %q: failed to commit end-entity operations in database: %w", s.ID, err)
+		}
+	}
+	signer.Log(s.Configuration, "rotate").Infof("contentsignaturepki: rotated chain to end-entity %q with x5u %q", s.eeLabel, s.X5U)
+	return s, nil
+}
+
+// newContentSigner initializes a ContentSigner and its issuer from a
+// signer configuration, without an end-entity
+func newContentSigner(conf signer.Configuration) (s *ContentSigner, err error) {
 	s = new(ContentSigner)
 	s.ID = conf.ID
 	s.Type = conf.Type
@@ -81,8 +197,12 @@ func New(conf signer.Configuration) (s *ContentSigner, err error) {
 	s.validity = conf.Validity
 	s.clockSkewTolerance = conf.ClockSkewTolerance
 	s.chainUploadLocation = conf.ChainUploadLocation
+	s.s3UploadOptions = S3UploadOptionsFromConfig(conf)
 	s.caCert = conf.CaCert
 	s.db = conf.DB
+	s.x5uFetchTimeout = conf.X5UFetchTimeout
+	s.x5uConnectTimeout = conf.X5UConnectTimeout
+	s.x5uMaxChainSize = conf.X5UMaxChainSize
 
 	if conf.Type != Type {
 		return nil, fmt.Errorf("contentsignaturepki %q: invalid type %q, must be %q", s.ID, conf.Type, Type)
@@ -104,9 +224,32 @@ func New(conf signer.Configuration) (s *ContentSigner, err error) {
 	}
 	// if validity is undef, default to 30 days
 	if s.validity == 0 {
-		log.Printf("contentsignaturepki %q: no validity configured, defaulting to 30 days", s.ID)
+		signer.Log(s.Configuration, "init").Info("contentsignaturepki: no validity configured, defaulting to 30 days")
 		s.validity = 720 * time.Hour
 	}
+	if s.x5uFetchTimeout == 0 {
+		s.x5uFetchTimeout = DefaultX5UFetchTimeout
+	}
+	if s.x5uConnectTimeout == 0 {
+		s.x5uConnectTimeout = DefaultX5UConnectTimeout
+	}
+	if s.x5uMaxChainSize < 0 {
+		return nil, fmt.Errorf("contentsignaturepki %q: x5u max chain size must not be negative, got %d", s.ID, s.x5uMaxChainSize)
+	}
+	if s.x5uMaxChainSize == 0 {
+		s.x5uMaxChainSize = DefaultX5UMaxChainSize
+	}
+	err = s.s3UploadOptions.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("contentsignaturepki %q: %w", s.ID, err)
+	}
+	s.chainNameTemplate = conf.ChainNameTemplate
+	if s.chainNameTemplate != "" {
+		s.parsedChainNameTemplate, err = parseChainNameTemplate(conf.ChainNameTemplate, s.ID)
+		if err != nil {
+			return nil, fmt.Errorf("contentsignaturepki %q: invalid chain name template: %w", s.ID, err)
+		}
+	}
 
 	switch s.issuerPub.(type) {
 	case *ecdsa.PublicKey:
@@ -115,9 +258,15 @@ func New(conf signer.Configuration) (s *ContentSigner, err error) {
 	}
 	s.Mode = s.getModeFromCurve()
 
-	err = s.initEE(conf)
+	// end-entities issued by an expired issuer do not chain
+	s.CertExpiryWarningDays = conf.CertExpiryWarningDays
+	issuerInfo, err := signer.ParseCertificateInfo(s.IssuerCert)
 	if err != nil {
-		return nil, fmt.Errorf("contentsignaturepki %q: failed to initialize end-entity: %w", s.ID, err)
+		return nil, fmt.Errorf("contentsignaturepki %q: failed to parse issuer certificate: %w", s.ID, err)
+	}
+	err = signer.CheckCertificateValidity(s.Configuration, issuerInfo, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("contentsignaturepki %q: invalid issuer certificate: %w", s.ID, err)
 	}
 	return
 }
@@ -129,10 +278,10 @@ func (s *ContentSigner) initEE(conf signer.Configuration) error {
 	err := s.findAndSetEE(conf)
 	switch err {
 	case nil:
-		log.Printf("contentsignaturepki %q: reusing existing EE %q", s.ID, s.eeLabel)
+		signer.Log(s.Configuration, "init").Infof("contentsignaturepki: reusing existing EE %q", s.eeLabel)
 	case database.ErrNoSuitableEEFound:
 		// No suitable end-entity found, making a new chain
-		log.Printf("contentsignaturepki %q: making new end-entity", s.ID)
+		signer.Log(s.Configuration, "init").Info("contentsignaturepki: making new end-entity")
 		var tx *database.Transaction
 		if s.db != nil {
 			tx, err = s.db.BeginEndEntityOperations()
@@ -154,25 +303,9 @@ func (s *ContentSigner) initEE(conf signer.Configuration) error {
 			// some other error popped up, exit
 			return err
 		}
-		// create a label and generate the key
-		s.eeLabel = fmt.Sprintf("%s-%s", s.ID, time.Now().UTC().Format("20060102150405"))
-		s.eePriv, s.eePub, err = conf.MakeKey(s.issuerPub, s.eeLabel)
-		if err != nil {
-			return fmt.Errorf("contentsignaturepki %q: failed to generate end entity: %w", s.ID, err)
-		}
-		// make the certificate and upload the chain
-		err = s.makeAndUploadChain()
+		err = s.makeEE(conf, tx)
 		if err != nil {
-			return fmt.Errorf("contentsignaturepki %q: failed to make chain and x5u: %w", s.ID, err)
-		}
-		if tx != nil {
-			// insert it in database
-			hsmHandle := signer.GetPrivKeyHandle(s.eePriv)
-			err = tx.InsertEE(s.X5U, s.eeLabel, s.ID, hsmHandle)
-			if err != nil {
-				return fmt.Errorf("contentsignaturepki %q: failed to insert EE into database: %w", s.ID, err)
-			}
-			log.Printf("contentsignaturepki %q: generated private key labeled %q with hsm handle %d and x5u %q", s.ID, s.eeLabel, hsmHandle, s.X5U)
+			return err
 		}
 	releaseLock:
 		if tx != nil {
@@ -185,9 +318,31 @@ func (s *ContentSigner) initEE(conf signer.Configuration) error {
 	default:
 		return fmt.Errorf("contentsignaturepki %q: failed to find suitable end-entity: %w", s.ID, err)
 	}
-	_, _, err = GetX5U(buildHTTPClient(), s.X5U)
+	return s.ValidateChain()
+}
+
+// makeEE generates a new end-entity key, issues its certificate and
+// uploads its chain, and inserts it in the database when tx is not nil
+func (s *ContentSigner) makeEE(conf signer.Configuration, tx *database.Transaction) (err error) {
+	// create a label and generate the key
+	s.eeLabel = fmt.Sprintf("%s-%s", s.ID, time.Now().UTC().Format("20060102150405"))
+	s.eePriv, s.eePub, err = conf.MakeKey(s.issuerPub, s.eeLabel)
+	if err != nil {
+		return fmt.Errorf("contentsignaturepki %q: failed to generate end entity: %w", s.ID, err)
+	}
+	// make the certificate and upload the chain
+	err = s.makeAndUploadChain()
 	if err != nil {
-		return fmt.Errorf("contentsignaturepki %q: failed to verify x5u: %w", s.ID, err)
+		return fmt.Errorf("contentsignaturepki %q: failed to make chain and x5u: %w", s.ID, err)
+	}
+	if tx != nil {
+		// insert it in database
+		hsmHandle := signer.GetPrivKeyHandle(s.eePriv)
+		err = tx.InsertEE(s.X5U, s.eeLabel, s.ID, hsmHandle)
+		if err != nil {
+			return fmt.Errorf("contentsignaturepki %q: failed to insert EE into database: %w", s.ID, err)
+		}
+		signer.Log(s.Configuration, "init").Infof("contentsignaturepki: generated private key labeled %q with hsm handle %d and x5u %q", s.eeLabel, hsmHandle, s.X5U)
 	}
 	return nil
 }
@@ -195,18 +350,33 @@ func (s *ContentSigner) initEE(conf signer.Configuration) error {
 // Config returns the configuration of the current signer
 func (s *ContentSigner) Config() signer.Configuration {
 	return signer.Configuration{
-		ID:                  s.ID,
-		Type:                s.Type,
-		Mode:                s.Mode,
-		PrivateKey:          s.PrivateKey,
-		PublicKey:           s.PublicKey,
-		IssuerPrivKey:       s.IssuerPrivKey,
-		IssuerCert:          s.IssuerCert,
-		X5U:                 s.X5U,
-		Validity:            s.validity,
-		ClockSkewTolerance:  s.clockSkewTolerance,
-		ChainUploadLocation: s.chainUploadLocation,
-		CaCert:              s.caCert,
+		ID:                      s.ID,
+		Type:                    s.Type,
+		Mode:                    s.Mode,
+		PrivateKey:              s.PrivateKey,
+		PublicKey:               s.PublicKey,
+		IssuerPrivKey:           s.IssuerPrivKey,
+		IssuerCert:              s.IssuerCert,
+		X5U:                     s.X5U,
+		Validity:                s.validity,
+		ClockSkewTolerance:      s.clockSkewTolerance,
+		ChainUploadLocation:     s.chainUploadLocation,
+		S3ACL:                   s.s3UploadOptions.ACL,
+		S3SSE:                   s.s3UploadOptions.SSE,
+		S3KMSKeyID:              s.s3UploadOptions.KMSKeyID,
+		S3Region:                s.s3UploadOptions.Region,
+		S3Endpoint:              s.s3UploadOptions.Endpoint,
+		S3ForcePathStyle:        s.s3UploadOptions.ForcePathStyle,
+		S3InsecureSkipVerify:    s.s3UploadOptions.InsecureSkipVerify,
+		S3UploadMaxAttempts:     s.s3UploadOptions.MaxAttempts,
+		ChainContentType:        s.s3UploadOptions.ContentType,
+		ChainContentDisposition: s.s3UploadOptions.ContentDisposition,
+		ChainNameTemplate:       s.chainNameTemplate,
+		CaCert:                  s.caCert,
+		CertExpiryWarningDays:   s.CertExpiryWarningDays,
+		X5UFetchTimeout:         s.x5uFetchTimeout,
+		X5UConnectTimeout:       s.x5uConnectTimeout,
+		X5UMaxChainSize:         s.x5uMaxChainSize,
 	}
 }
 
@@ -222,6 +392,34 @@ func (s *ContentSigner) SignData(input []byte, options interface{}) (signer.Sign
 	return sig, err
 }
 
+// VerifyData verifies a content signature of the data with the public
+// key of the end-entity of the signer. It does not fetch the chain at
+// the x5u of the signer.
+func (s *ContentSigner) VerifyData(data []byte, sig signer.Signature) error {
+	csig, ok := sig.(*verifier.ContentSignature)
+	if !ok {
+		return fmt.Errorf("contentsignaturepki %q: cannot verify signature of type %T", s.ID, sig)
+	}
+	pubKey, ok := s.eePub.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("contentsignaturepki %q: invalid end-entity public key type %T, must be ecdsa", s.ID, s.eePub)
+	}
+	if !csig.VerifyData(data, pubKey) {
+		return fmt.Errorf("contentsignaturepki %q: failed to verify signature", s.ID)
+	}
+	return nil
+}
+
+// SignedDataHash returns the hex encoded templated hash SignData would
+// sign for the input
+func (s *ContentSigner) SignedDataHash(input []byte, options interface{}) (string, error) {
+	if len(input) < 10 {
+		return "", fmt.Errorf("contentsignaturepki %q: refusing to hash input data shorter than 10 bytes", s.ID)
+	}
+	_, hash := MakeTemplatedHash(input, s.Mode)
+	return fmt.Sprintf("%x", hash), nil
+}
+
 // MakeTemplatedHash returns the templated sha384 of the input data. The template adds
 // the string "Content-Signature:\x00" before the input data prior to
 // calculating the sha384.
@@ -236,6 +434,9 @@ func MakeTemplatedHash(data []byte, curvename string) (alg string, out []byte) {
 	case P384ECDSA:
 		md = sha512.New384()
 		alg = "sha384"
+	case P521ECDSA:
+		md = sha512.New()
+		alg = "sha512"
 	default:
 		md = sha256.New()
 		alg = "sha256"
@@ -245,10 +446,11 @@ func MakeTemplatedHash(data []byte, curvename string) (alg string, out []byte) {
 }
 
 // SignHash takes an input hash and returns a signature. It assumes the input data
-// has already been hashed with something like sha384
+// has already been templated and hashed with the hash of the signer mode, e.g.
+// sha384 for p384ecdsa, and refuses hashes of another length
 func (s *ContentSigner) SignHash(input []byte, options interface{}) (signer.Signature, error) {
-	if len(input) != 32 && len(input) != 48 && len(input) != 64 {
-		return nil, fmt.Errorf("contentsignaturepki %q: refusing to sign input hash. length %d, expected 32, 48 or 64", s.ID, len(input))
+	if len(input) != getHashLen(s.Mode) {
+		return nil, fmt.Errorf("contentsignaturepki %q: refusing to sign input hash: %w %d, expected %d for mode %s", s.ID, signer.ErrInvalidHashLength, len(input), getHashLen(s.Mode), s.Mode)
 	}
 	var (
 		err  error
@@ -276,6 +478,18 @@ func (s *ContentSigner) SignHash(input []byte, options interface{}) (signer.Sign
 	return csig, nil
 }
 
+// getHashLen returns the length of the hashes signed in the mode, which
+// MakeTemplatedHash computes with sha256, sha384 or sha512
+func getHashLen(mode string) int {
+	switch mode {
+	case P384ECDSA:
+		return sha512.Size384
+	case P521ECDSA:
+		return sha512.Size
+	}
+	return sha256.Size
+}
+
 // getSignatureLen returns the size of an ECDSA signature issued by the signer,
 // or -1 if the mode is unknown
 //
@@ -288,6 +502,8 @@ func getSignatureLen(mode string) int {
 		return P256ECDSABYTESIZE
 	case P384ECDSA:
 		return P384ECDSABYTESIZE
+	case P521ECDSA:
+		return P521ECDSABYTESIZE
 	}
 	return -1
 }
@@ -299,12 +515,45 @@ func (s *ContentSigner) getModeFromCurve() string {
 		return P256ECDSA
 	case "P-384":
 		return P384ECDSA
+	case "P-521":
+		return P521ECDSA
 	default:
 		return ""
 	}
 }
 
-// GetDefaultOptions returns nil because this signer has no option
+// Options contains options for signing content signatures
+type Options struct {
+	// IncludeChain requests the PEM chain of the signer inline in
+	// the signature response, in addition to its x5u
+	IncludeChain bool `json:"include_chain"`
+}
+
+// GetDefaultOptions returns nil because the options of this signer
+// default to their zero values
 func (s *ContentSigner) GetDefaultOptions() interface{} {
 	return nil
 }
+
+// GetOptions takes a input interface and reflects it into a struct of options
+func GetOptions(input interface{}) (options Options, err error) {
+	buf, err := json.Marshal(input)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(buf, &options)
+	return
+}
+
+// IncludedChain returns the PEM certificates of the chain at the x5u
+// of the signer, end-entity first, when the options set IncludeChain
+func (s *ContentSigner) IncludedChain(options interface{}) ([]string, error) {
+	opts, err := GetOptions(options)
+	if err != nil {
+		return nil, fmt.Errorf("contentsignaturepki %q: failed to parse options: %w", s.ID, err)
+	}
+	if !opts.IncludeChain {
+		return nil, nil
+	}
+	return s.chain, nil
+}
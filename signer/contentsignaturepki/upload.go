@@ -1,32 +1,197 @@
 package contentsignaturepki
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
+	"cloud.google.com/go/storage"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/mozilla-services/autograph/signer"
 	csigverifier "github.com/mozilla-services/autograph/verifier/contentsignature"
+	log "github.com/sirupsen/logrus"
 )
 
+// DefaultS3ACL is the canned ACL of the objects uploaded to s3://
+// locations when S3UploadOptions do not set one
+const DefaultS3ACL = s3.ObjectCannedACLPublicRead
+
+const (
+	// DefaultChainContentType and DefaultChainContentDisposition are
+	// the Content-Type and Content-Disposition of the chains uploaded
+	// to s3:// and gs:// locations when S3UploadOptions do not set them
+	DefaultChainContentType        = "binary/octet-stream"
+	DefaultChainContentDisposition = "attachment"
+
+	// DefaultS3UploadAttempts is the number of times a chain upload to
+	// an s3:// location is tried when S3UploadOptions do not set one
+	DefaultS3UploadAttempts = 3
+)
+
+// s3UploadRetryBackoff is the wait before the first retry of an
+// upload to an s3:// location, it doubles before each following retry
+// and is jittered by up to half its value
+var s3UploadRetryBackoff = time.Second
+
+// S3UploadOptions are the canned ACL and server-side encryption of the
+// objects uploaded to s3:// locations, and the S3 API they are uploaded
+// to. The zero value uploads public-read objects without server-side
+// encryption to the S3 API of the AWS environment.
+//
+// ContentType and ContentDisposition are the headers the objects
+// uploaded to s3:// and gs:// locations are served with, they default
+// to binary/octet-stream and attachment.
+//
+// MaxAttempts is the number of times an upload to an s3:// location is
+// tried before its last error is returned, it defaults to
+// DefaultS3UploadAttempts.
+type S3UploadOptions struct {
+	ACL      string
+	SSE      string
+	KMSKeyID string
+
+	MaxAttempts int
+
+	ContentType        string
+	ContentDisposition string
+
+	Region             string
+	Endpoint           string
+	ForcePathStyle     bool
+	InsecureSkipVerify bool
+}
+
+// S3UploadOptionsFromConfig returns the S3UploadOptions of a signer
+// configuration, with the content type and disposition of its chains
+func S3UploadOptionsFromConfig(conf signer.Configuration) S3UploadOptions {
+	return S3UploadOptions{
+		ACL:      conf.S3ACL,
+		SSE:      conf.S3SSE,
+		KMSKeyID: conf.S3KMSKeyID,
+
+		MaxAttempts: conf.S3UploadMaxAttempts,
+
+		ContentType:        conf.ChainContentType,
+		ContentDisposition: conf.ChainContentDisposition,
+
+		Region:             conf.S3Region,
+		Endpoint:           conf.S3Endpoint,
+		ForcePathStyle:     conf.S3ForcePathStyle,
+		InsecureSkipVerify: conf.S3InsecureSkipVerify,
+	}
+}
+
+// Validate returns an error when the ACL or server-side encryption
+// is not supported by S3, a KMS key is set without aws:kms
+// encryption, or the content type or disposition do not parse
+func (o S3UploadOptions) Validate() error {
+	if o.ACL != "" && !containsString(s3.ObjectCannedACL_Values(), o.ACL) {
+		return fmt.Errorf("invalid s3 acl %q, must be one of %q", o.ACL, s3.ObjectCannedACL_Values())
+	}
+	if o.SSE != "" && !containsString(s3.ServerSideEncryption_Values(), o.SSE) {
+		return fmt.Errorf("invalid s3 server-side encryption %q, must be one of %q", o.SSE, s3.ServerSideEncryption_Values())
+	}
+	if o.KMSKeyID != "" && o.SSE != s3.ServerSideEncryptionAwsKms {
+		return fmt.Errorf("s3 kms key id requires %q server-side encryption", s3.ServerSideEncryptionAwsKms)
+	}
+	if o.Endpoint != "" {
+		endpoint, err := url.Parse(o.Endpoint)
+		if err != nil {
+			return fmt.Errorf("failed to parse s3 endpoint: %w", err)
+		}
+		if (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			return fmt.Errorf("invalid s3 endpoint %q, must be an http or https URL", o.Endpoint)
+		}
+	}
+	if o.InsecureSkipVerify && o.Endpoint == "" {
+		return fmt.Errorf("s3 insecure skip verify requires a custom s3 endpoint")
+	}
+	if o.MaxAttempts < 0 {
+		return fmt.Errorf("invalid s3 upload max attempts %d, must not be negative", o.MaxAttempts)
+	}
+	if o.ContentType != "" {
+		mediaType, _, err := mime.ParseMediaType(o.ContentType)
+		if err != nil || !strings.Contains(mediaType, "/") {
+			return fmt.Errorf("invalid chain content type %q, must be a MIME type e.g. %q", o.ContentType, "application/x-pem-file")
+		}
+	}
+	if o.ContentDisposition != "" {
+		disposition, _, err := mime.ParseMediaType(o.ContentDisposition)
+		if err != nil || (disposition != "inline" && disposition != "attachment") {
+			return fmt.Errorf("invalid chain content disposition %q, must be inline or attachment with optional parameters", o.ContentDisposition)
+		}
+	}
+	return nil
+}
+
+// contentType returns the content type of uploaded objects
+func (o S3UploadOptions) contentType() string {
+	if o.ContentType == "" {
+		return DefaultChainContentType
+	}
+	return o.ContentType
+}
+
+// contentDisposition returns the content disposition of uploaded objects
+func (o S3UploadOptions) contentDisposition() string {
+	if o.ContentDisposition == "" {
+		return DefaultChainContentDisposition
+	}
+	return o.ContentDisposition
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 // upload takes a string and a filename and puts it at the upload location
 // defined in the signer, then returns its URL
 func (s *ContentSigner) upload(data, name string) error {
-	parsedURL, err := url.Parse(s.chainUploadLocation)
+	return UploadWithOptions([]byte(data), name, s.chainUploadLocation, s.s3UploadOptions)
+}
+
+// Upload puts data under a filename at an s3://, gs:// or file://
+// upload location, with the default S3UploadOptions
+func Upload(data []byte, name, location string) error {
+	return UploadWithOptions(data, name, location, S3UploadOptions{})
+}
+
+// UploadWithOptions is Upload but uploads to s3:// locations with the
+// ACL and server-side encryption of the options, and to s3:// and gs://
+// locations with their content type and disposition
+func UploadWithOptions(data []byte, name, location string, opts S3UploadOptions) error {
+	parsedURL, err := url.Parse(location)
 	if err != nil {
-		return fmt.Errorf("failed to parse chain upload location: %w", err)
+		return fmt.Errorf("failed to parse upload location: %w", err)
 	}
 	switch parsedURL.Scheme {
 	case "s3":
-		return uploadToS3(data, name, parsedURL)
+		return uploadToS3(data, name, parsedURL, opts)
+	case "gs":
+		return uploadToGCS(data, name, parsedURL, opts)
 	case "file":
 		return writeLocalFile(data, name, parsedURL)
 	default:
@@ -34,27 +199,131 @@ func (s *ContentSigner) upload(data, name string) error {
 	}
 }
 
-func uploadToS3(data, name string, target *url.URL) error {
-	sess := session.Must(session.NewSession())
+// uploadToS3 puts data under a filename in an s3:// bucket, and retries
+// failed uploads with a jittered exponential backoff up to the max
+// attempts of the options, on top of the retries of the AWS SDK, so S3
+// throttling during a chain rotation does not fail the signer init
+func uploadToS3(data []byte, name string, target *url.URL, opts S3UploadOptions) (err error) {
+	sess, err := session.NewSession(s3Config(opts))
+	if err != nil {
+		return fmt.Errorf("failed to create s3 session: %w", err)
+	}
 	uploader := s3manager.NewUploader(sess)
-	_, err := uploader.Upload(&s3manager.UploadInput{
+	maxAttempts := opts.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = DefaultS3UploadAttempts
+	}
+	backoff := s3UploadRetryBackoff
+	for attempt := 1; ; attempt++ {
+		_, err = uploader.Upload(s3UploadInput(data, name, target, opts))
+		if err == nil {
+			return nil
+		}
+		if attempt >= maxAttempts {
+			if maxAttempts > 1 {
+				return fmt.Errorf("%w (after %d attempts)", err, attempt)
+			}
+			return err
+		}
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		log.Warnf("contentsignaturepki: attempt %d of %d to upload %s to %s failed, retrying in %s: %v", attempt, maxAttempts, name, target, wait, err)
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
+
+// s3Config returns the config of the session to the S3 API of the
+// options, which leaves the region and endpoint of the environment
+// unset
+func s3Config(opts S3UploadOptions) *aws.Config {
+	config := aws.NewConfig()
+	if opts.Region != "" {
+		config = config.WithRegion(opts.Region)
+	}
+	if opts.Endpoint != "" {
+		config = config.WithEndpoint(opts.Endpoint)
+	}
+	if opts.ForcePathStyle {
+		config = config.WithS3ForcePathStyle(true)
+	}
+	if opts.InsecureSkipVerify {
+		config = config.WithHTTPClient(&http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		})
+	}
+	return config
+}
+
+// s3UploadInput returns the input of the upload of data under a
+// filename to an s3:// location
+func s3UploadInput(data []byte, name string, target *url.URL, opts S3UploadOptions) *s3manager.UploadInput {
+	acl := opts.ACL
+	if acl == "" {
+		acl = DefaultS3ACL
+	}
+	input := &s3manager.UploadInput{
 		Bucket:             aws.String(target.Host),
 		Key:                aws.String(target.Path + name),
-		ACL:                aws.String("public-read"),
-		Body:               strings.NewReader(data),
-		ContentType:        aws.String("binary/octet-stream"),
-		ContentDisposition: aws.String("attachment"),
-	})
-	return err
+		ACL:                aws.String(acl),
+		Body:               bytes.NewReader(data),
+		ContentType:        aws.String(opts.contentType()),
+		ContentDisposition: aws.String(opts.contentDisposition()),
+	}
+	if opts.SSE != "" {
+		input.ServerSideEncryption = aws.String(opts.SSE)
+	}
+	if opts.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(opts.KMSKeyID)
+	}
+	return input
+}
+
+// uploadToGCS puts data under a filename in a gs:// bucket with the
+// application default credentials of the environment
+func uploadToGCS(data []byte, name string, target *url.URL, opts S3UploadOptions) error {
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create gcs client: %w", err)
+	}
+	defer client.Close()
+	return writeGCSObject(ctx, client, data, name, target, opts)
 }
 
-func writeLocalFile(data, name string, target *url.URL) error {
-	// upload dir may not exist yet
-	_, err := os.Stat(target.Path)
+// writeGCSObject writes data under a filename in a gs:// bucket as a
+// public-read object with the content type and disposition of the
+// options, like the objects uploaded to s3:// locations
+func writeGCSObject(ctx context.Context, client *storage.Client, data []byte, name string, target *url.URL, opts S3UploadOptions) error {
+	// unlike s3 keys, gcs object names do not start with a slash
+	objectName := strings.TrimPrefix(target.Path+name, "/")
+	w := client.Bucket(target.Host).Object(objectName).NewWriter(ctx)
+	w.PredefinedACL = "publicRead"
+	w.ContentType = opts.contentType()
+	w.ContentDisposition = opts.contentDisposition()
+	_, err := w.Write(data)
+	if err != nil {
+		w.Close()
+		return fmt.Errorf("failed to write gcs object: %w", err)
+	}
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("failed to upload gcs object: %w", err)
+	}
+	return nil
+}
+
+func writeLocalFile(data []byte, name string, target *url.URL) error {
+	// upload dir, or the subdirectory of a templated chain name, may
+	// not exist yet
+	path := target.Path + name
+	_, err := os.Stat(filepath.Dir(path))
 	if err != nil {
 		if strings.Contains(err.Error(), "no such file or directory") {
 			// create the target directory
-			err = os.MkdirAll(target.Path, 0755)
+			err = os.MkdirAll(filepath.Dir(path), 0755)
 			if err != nil {
 				return fmt.Errorf("failed to make directory: %w", err)
 			}
@@ -62,58 +331,275 @@ func writeLocalFile(data, name string, target *url.URL) error {
 			return err
 		}
 	}
-	// write the file into the target dir
-	return ioutil.WriteFile(target.Path+name, []byte(data), 0755)
+	// write the file to a temp file in the target dir and rename it
+	// into place, so concurrent readers of a chain being replaced
+	// read either the old or the new chain and never a partial one
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(data)
+	if err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	err = tmpFile.Chmod(0644)
+	if err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to set mode of temp file: %w", err)
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+	err = os.Rename(tmpFile.Name(), path)
+	if err != nil {
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+	return nil
+}
+
+const (
+	// DefaultX5UFetchTimeout is the overall timeout for fetching an
+	// X5U when the signer does not configure one
+	DefaultX5UFetchTimeout = 30 * time.Second
+
+	// DefaultX5UConnectTimeout is the timeout for connecting to an
+	// X5U origin when the signer does not configure one
+	DefaultX5UConnectTimeout = 10 * time.Second
+
+	// DefaultX5UMaxChainSize is the maximum size in bytes of an X5U
+	// chain body when the signer does not configure one. A chain of
+	// three PEM encoded certificates is a few KB.
+	DefaultX5UMaxChainSize = 64 * 1024
+
+	// DefaultX5UClientTimeout is the overall timeout of requests
+	// GetX5U makes with a client that does not set one
+	DefaultX5UClientTimeout = 10 * time.Second
+
+	// X5UFetchAttempts is the number of times GetX5U tries to
+	// retrieve an x5u that fails with a connection error or a 5xx
+	// status
+	X5UFetchAttempts = 3
+)
+
+// x5uRetryBackoff is the wait before the first retry of an x5u
+// retrieval, it doubles before each following retry
+var x5uRetryBackoff = 100 * time.Millisecond
+
+// X5UFetchError is returned by GetX5U when the x5u could not be
+// retrieved, which lets callers tell network failures from chains
+// that fail to parse or verify
+type X5UFetchError struct {
+	// X5U is the location of the chain
+	X5U string
+
+	// Attempts is the number of times the chain was requested
+	Attempts int
+
+	// Err is the error of the last attempt
+	Err error
+
+	// transient is true when the error is worth retrying
+	transient bool
 }
 
-// buildHTTPClient returns the default HTTP.Client for fetching X5Us
-func buildHTTPClient() *http.Client {
-	return &http.Client{}
+func (e *X5UFetchError) Error() string {
+	if e.Attempts > 1 {
+		return fmt.Sprintf("%s (after %d attempts)", e.Err, e.Attempts)
+	}
+	return e.Err.Error()
+}
+
+func (e *X5UFetchError) Unwrap() error {
+	return e.Err
+}
+
+// buildHTTPClient returns the HTTP.Client for fetching X5Us with the
+// provided connect and overall timeouts
+func buildHTTPClient(connectTimeout, timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: connectTimeout,
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:       http.ProxyFromEnvironment,
+			DialContext: dialer.DialContext,
+		},
+	}
 }
 
 // GetX5U retrieves a chain file of certs from upload location, parses
 // and verifies it, then returns a byte slice of the response body and
-// a slice of parsed certificates.
+// a slice of parsed certificates. It reads at most
+// DefaultX5UMaxChainSize bytes of chain.
+//
+// Requests of a client without a timeout time out after
+// DefaultX5UClientTimeout. Connection errors and 5xx statuses are
+// retried up to X5UFetchAttempts times, and failures to retrieve the
+// chain are returned as an *X5UFetchError.
 func GetX5U(client *http.Client, x5u string) (body []byte, certs []*x509.Certificate, err error) {
+	return GetX5UWithMaxSize(client, x5u, DefaultX5UMaxChainSize)
+}
+
+// GetX5UPinned is GetX5U but also returns an error when the
+// SubjectPublicKeyInfo SHA-256 of the root of the chain is not the hex
+// encoded expectedRootHash, so a chain to an internally consistent but
+// unexpected root is rejected
+func GetX5UPinned(client *http.Client, x5u, expectedRootHash string) (body []byte, certs []*x509.Certificate, err error) {
+	body, certs, err = GetX5U(client, x5u)
+	if err != nil {
+		return
+	}
+	err = VerifyRootSPKIHash(certs, expectedRootHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+// VerifyRootSPKIHash returns an error when the SubjectPublicKeyInfo
+// SHA-256 of the last certificate of a chain is not the hex encoded
+// expectedRootHash, which may be colon separated
+func VerifyRootSPKIHash(certs []*x509.Certificate, expectedRootHash string) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("cannot verify root SPKI hash of empty chain")
+	}
+	expected := strings.ToUpper(strings.ReplaceAll(expectedRootHash, ":", ""))
+	if expected == "" {
+		return fmt.Errorf("missing expected root SPKI hash")
+	}
+	rootHash := SPKIFingerprint(certs[len(certs)-1])
+	if rootHash != expected {
+		return fmt.Errorf("root SPKI hash %s does not match expected hash %s", rootHash, expected)
+	}
+	return nil
+}
+
+// GetX5UWithMaxSize is GetX5U but returns an error, without reading
+// the rest of the body, when the chain is larger than maxSize bytes
+func GetX5UWithMaxSize(client *http.Client, x5u string, maxSize int64) (body []byte, certs []*x509.Certificate, err error) {
+	return GetX5UWithClock(client, x5u, maxSize, time.Now)
+}
+
+// GetX5UWithClock is GetX5UWithMaxSize but verifies the chain at the
+// time returned by now instead of the current time, which lets tests
+// retrieve chains that are expired or not valid yet
+func GetX5UWithClock(client *http.Client, x5u string, maxSize int64, now func() time.Time) (body []byte, certs []*x509.Certificate, err error) {
 	parsedURL, err := url.Parse(x5u)
 	if err != nil {
 		err = fmt.Errorf("failed to parse chain upload location: %w", err)
 		return
 	}
+	if client.Timeout == 0 {
+		// use a copy to leave the client of the caller untouched
+		c := *client
+		c.Timeout = DefaultX5UClientTimeout
+		client = &c
+	}
 	if parsedURL.Scheme == "file" {
 		t := &http.Transport{}
 		t.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
 		client.Transport = t
 	}
+	body, err = fetchX5UWithRetries(client, x5u, maxSize)
+	if err != nil {
+		return
+	}
+	certs, err = csigverifier.ParseChain(body)
+	if err != nil {
+		err = fmt.Errorf("failed to parse x5u : %w", err)
+		return
+	}
+	rootHash := sha2Fingerprint(certs[len(certs)-1])
+	err = csigverifier.VerifyChain(rootHash, certs, now())
+	if err != nil {
+		err = fmt.Errorf("failed to verify certificate chain: %w", err)
+		return
+	}
+	return
+}
+
+// fetchX5UWithRetries retrieves the body of an x5u, and retries with
+// an exponential backoff up to X5UFetchAttempts times while the
+// retrieval fails with a transient error
+func fetchX5UWithRetries(client *http.Client, x5u string, maxSize int64) (body []byte, err error) {
+	backoff := x5uRetryBackoff
+	for attempt := 1; ; attempt++ {
+		body, err = fetchX5U(client, x5u, maxSize)
+		var fetchErr *X5UFetchError
+		if !errors.As(err, &fetchErr) {
+			return
+		}
+		fetchErr.Attempts = attempt
+		if !fetchErr.transient || attempt >= X5UFetchAttempts {
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// fetchX5U retrieves the body of an x5u once. Network failures are
+// returned as X5UFetchErrors, transient when the connection failed
+// without timing out or the origin returned a 5xx status.
+func fetchX5U(client *http.Client, x5u string, maxSize int64) (body []byte, err error) {
 	resp, err := client.Get(x5u)
 	if err != nil {
-		err = fmt.Errorf("failed to retrieve x5u: %w", err)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			err = &X5UFetchError{X5U: x5u, Err: fmt.Errorf("failed to retrieve x5u from %s: timed out (client timeout %s): %w", x5u, client.Timeout, err)}
+			return
+		}
+		err = &X5UFetchError{X5U: x5u, Err: fmt.Errorf("failed to retrieve x5u: %w", err), transient: true}
 		return
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("failed to retrieve x5u from %s: %s", x5u, resp.Status)
+		err = &X5UFetchError{
+			X5U:       x5u,
+			Err:       fmt.Errorf("failed to retrieve x5u from %s: %s", x5u, resp.Status),
+			transient: resp.StatusCode >= 500,
+		}
 		return
 	}
-	body, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		err = fmt.Errorf("failed to parse x5u body: %w", err)
+	if resp.ContentLength > maxSize {
+		err = fmt.Errorf("x5u from %s is %d bytes, larger than the maximum chain size of %d bytes", x5u, resp.ContentLength, maxSize)
 		return
 	}
-	certs, err = csigverifier.ParseChain(body)
+	// read one byte past the limit to tell a chain of exactly
+	// maxSize bytes from a larger one
+	body, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
 	if err != nil {
-		err = fmt.Errorf("failed to parse x5u : %w", err)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			err = &X5UFetchError{X5U: x5u, Err: fmt.Errorf("timed out reading x5u body from %s (client timeout %s): %w", x5u, client.Timeout, err)}
+			return
+		}
+		err = &X5UFetchError{X5U: x5u, Err: fmt.Errorf("failed to parse x5u body: %w", err)}
 		return
 	}
-	rootHash := sha2Fingerprint(certs[2])
-	err = csigverifier.VerifyChain(rootHash, certs, time.Now())
-	if err != nil {
-		err = fmt.Errorf("failed to verify certificate chain: %w", err)
+	if int64(len(body)) > maxSize {
+		err = fmt.Errorf("x5u from %s is larger than the maximum chain size of %d bytes", x5u, maxSize)
 		return
 	}
 	return
 }
 
+// getX5U retrieves and verifies a chain with the x5u timeouts and
+// max chain size of the signer
+func (s *ContentSigner) getX5U(x5u string) (body []byte, certs []*x509.Certificate, err error) {
+	return GetX5UWithMaxSize(buildHTTPClient(s.x5uConnectTimeout, s.x5uFetchTimeout), x5u, s.x5uMaxChainSize)
+}
+
 func sha2Fingerprint(cert *x509.Certificate) string {
 	return strings.ToUpper(fmt.Sprintf("%x", sha256.Sum256(cert.Raw)))
 }
+
+// SPKIFingerprint returns the uppercase hex encoded SHA-256 of the
+// DER SubjectPublicKeyInfo of a certificate
+func SPKIFingerprint(cert *x509.Certificate) string {
+	return strings.ToUpper(fmt.Sprintf("%x", sha256.Sum256(cert.RawSubjectPublicKeyInfo)))
+}
@@ -0,0 +1,508 @@
+package contentsignaturepki
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"google.golang.org/api/option"
+)
+
+func TestGetX5UTimesOut(t *testing.T) {
+	t.Parallel()
+
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer ts.Close()
+	// unblock the handler before closing the server
+	defer close(done)
+
+	client := buildHTTPClient(DefaultX5UConnectTimeout, 50*time.Millisecond)
+	_, _, err := GetX5U(client, ts.URL)
+	if err == nil {
+		t.Fatal("expected GetX5U to time out but it succeeded")
+	}
+	if !strings.HasPrefix(err.Error(), "failed to retrieve x5u from "+ts.URL+": timed out (client timeout 50ms)") {
+		t.Fatalf("expected a timeout error but got: %v", err)
+	}
+}
+
+func TestGetX5URetries(t *testing.T) {
+	t.Parallel()
+
+	var TESTCASES = []struct {
+		desc         string
+		statuses     []int
+		wantAttempts int
+		wantFetchErr bool
+	}{
+		{"5xx statuses until the last attempt", []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusInternalServerError}, X5UFetchAttempts, true},
+		{"a 5xx status then a 404", []int{http.StatusServiceUnavailable, http.StatusNotFound}, 2, true},
+		{"a 404", []int{http.StatusNotFound}, 1, true},
+		// the body is fetched and fails to parse instead
+		{"a 5xx status then a 200", []int{http.StatusServiceUnavailable, http.StatusOK}, 2, false},
+	}
+	for _, testcase := range TESTCASES {
+		var hits int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hit := atomic.AddInt32(&hits, 1)
+			w.WriteHeader(testcase.statuses[hit-1])
+			w.Write([]byte("not a chain"))
+		}))
+		_, _, err := GetX5U(&http.Client{}, ts.URL)
+		ts.Close()
+		if err == nil {
+			t.Fatalf("%s: expected GetX5U to fail but it succeeded", testcase.desc)
+		}
+		if got := int(atomic.LoadInt32(&hits)); got != testcase.wantAttempts {
+			t.Fatalf("%s: expected %d requests to the x5u but got %d", testcase.desc, testcase.wantAttempts, got)
+		}
+		var fetchErr *X5UFetchError
+		if errors.As(err, &fetchErr) != testcase.wantFetchErr {
+			t.Fatalf("%s: expected an X5UFetchError %t but got: %v", testcase.desc, testcase.wantFetchErr, err)
+		}
+		if testcase.wantFetchErr && fetchErr.Attempts != testcase.wantAttempts {
+			t.Fatalf("%s: expected the error to report %d attempts but got %d", testcase.desc, testcase.wantAttempts, fetchErr.Attempts)
+		}
+	}
+
+	// connection errors are retried too
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+	_, _, err := GetX5U(&http.Client{}, ts.URL)
+	var fetchErr *X5UFetchError
+	if !errors.As(err, &fetchErr) || fetchErr.Attempts != X5UFetchAttempts {
+		t.Fatalf("expected an X5UFetchError after %d attempts to a closed server but got: %v", X5UFetchAttempts, err)
+	}
+}
+
+func TestGetX5ULeavesClientTimeout(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+	client := &http.Client{}
+	GetX5U(client, ts.URL)
+	if client.Timeout != 0 {
+		t.Fatalf("expected GetX5U to leave the timeout of the client unset but got %s", client.Timeout)
+	}
+}
+
+func TestGetX5UMaxSize(t *testing.T) {
+	t.Parallel()
+
+	chunked := func(w http.ResponseWriter, r *http.Request) {
+		// flushing before the end of the body omits its Content-Length
+		for i := 0; i < 4; i++ {
+			w.Write([]byte(strings.Repeat("A", 256)))
+			w.(http.Flusher).Flush()
+		}
+	}
+	withLength := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("A", 1024)))
+	}
+	for i, handler := range []http.HandlerFunc{chunked, withLength} {
+		ts := httptest.NewServer(handler)
+		_, _, err := GetX5UWithMaxSize(&http.Client{}, ts.URL, 512)
+		ts.Close()
+		if err == nil {
+			t.Fatalf("testcase %d expected GetX5UWithMaxSize to fail on a chain over the max size but it succeeded", i)
+		}
+		if !strings.Contains(err.Error(), "larger than the maximum chain size of 512 bytes") {
+			t.Fatalf("testcase %d expected a max chain size error but got: %v", i, err)
+		}
+
+		// a body at the max size is read and fails to parse instead
+		ts = httptest.NewServer(handler)
+		_, _, err = GetX5UWithMaxSize(&http.Client{}, ts.URL, 1024)
+		ts.Close()
+		if err == nil || !strings.HasPrefix(err.Error(), "failed to parse x5u") {
+			t.Fatalf("testcase %d expected a parsing error for a chain at the max size but got: %v", i, err)
+		}
+	}
+}
+
+func TestNewX5UMaxChainSize(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	if s.x5uMaxChainSize != DefaultX5UMaxChainSize {
+		t.Fatalf("expected default x5u max chain size %d but got %d", DefaultX5UMaxChainSize, s.x5uMaxChainSize)
+	}
+
+	conf := PASSINGTESTCASES[0].cfg
+	conf.X5UMaxChainSize = 16
+	_, err = New(conf)
+	if err == nil || !strings.Contains(err.Error(), "maximum chain size of 16 bytes") {
+		t.Fatalf("expected signer with a chain larger than its x5u max chain size to fail with a max chain size error but got: %v", err)
+	}
+
+	conf.X5UMaxChainSize = -1
+	_, err = New(conf)
+	if err == nil {
+		t.Fatalf("expected signer with a negative x5u max chain size to fail but it succeeded")
+	}
+}
+
+func TestNewDefaultsX5UTimeouts(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	if s.x5uFetchTimeout != DefaultX5UFetchTimeout {
+		t.Fatalf("expected default x5u fetch timeout %s but got %s", DefaultX5UFetchTimeout, s.x5uFetchTimeout)
+	}
+	if s.x5uConnectTimeout != DefaultX5UConnectTimeout {
+		t.Fatalf("expected default x5u connect timeout %s but got %s", DefaultX5UConnectTimeout, s.x5uConnectTimeout)
+	}
+}
+
+func TestGetX5UWithClock(t *testing.T) {
+	t.Parallel()
+
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("failed to initialize signer: %v", err)
+	}
+	client := buildHTTPClient(s.x5uConnectTimeout, s.x5uFetchTimeout)
+	now := time.Now()
+	var TESTCASES = []struct {
+		desc  string
+		now   time.Time
+		valid bool
+	}{
+		{"now", now, true},
+		{"after the end-entity expires", now.Add(s.validity + s.clockSkewTolerance + time.Hour), false},
+		{"before the end-entity is valid", now.Add(-s.clockSkewTolerance - time.Hour), false},
+	}
+	for _, testcase := range TESTCASES {
+		_, _, err = GetX5UWithClock(client, s.X5U, DefaultX5UMaxChainSize, func() time.Time { return testcase.now })
+		if testcase.valid && err != nil {
+			t.Fatalf("expected chain verification %s to succeed but got: %v", testcase.desc, err)
+		}
+		if !testcase.valid && err == nil {
+			t.Fatalf("expected chain verification %s to fail but it succeeded", testcase.desc)
+		}
+	}
+}
+
+func TestS3UploadInput(t *testing.T) {
+	t.Parallel()
+
+	target, err := url.Parse("s3://bucket/chains/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := s3UploadInput([]byte("chain"), "signer.pem", target, S3UploadOptions{})
+	if aws.StringValue(input.ACL) != "public-read" || input.ServerSideEncryption != nil || input.SSEKMSKeyId != nil {
+		t.Fatalf("expected default upload input to be public-read without encryption but got %+v", input)
+	}
+	if aws.StringValue(input.Bucket) != "bucket" || aws.StringValue(input.Key) != "/chains/signer.pem" {
+		t.Fatalf("unexpected upload bucket %q and key %q", aws.StringValue(input.Bucket), aws.StringValue(input.Key))
+	}
+	if aws.StringValue(input.ContentType) != "binary/octet-stream" || aws.StringValue(input.ContentDisposition) != "attachment" {
+		t.Fatalf("expected default upload input to be a binary attachment but got %+v", input)
+	}
+
+	input = s3UploadInput([]byte("chain"), "signer.pem", target, S3UploadOptions{
+		ACL:      "bucket-owner-full-control",
+		SSE:      "aws:kms",
+		KMSKeyID: "alias/autograph",
+
+		ContentType:        "application/x-pem-file",
+		ContentDisposition: `inline; filename="signer.pem"`,
+	})
+	if aws.StringValue(input.ACL) != "bucket-owner-full-control" ||
+		aws.StringValue(input.ServerSideEncryption) != "aws:kms" ||
+		aws.StringValue(input.SSEKMSKeyId) != "alias/autograph" {
+		t.Fatalf("expected upload input with the options acl and encryption but got %+v", input)
+	}
+	if aws.StringValue(input.ContentType) != "application/x-pem-file" || aws.StringValue(input.ContentDisposition) != `inline; filename="signer.pem"` {
+		t.Fatalf("expected upload input with the options content type and disposition but got %+v", input)
+	}
+}
+
+func TestNewS3UploadOptions(t *testing.T) {
+	conf := PASSINGTESTCASES[0].cfg
+	conf.S3ACL = "bucket-owner-full-control"
+	conf.S3SSE = "aws:kms"
+	conf.S3KMSKeyID = "alias/autograph"
+	conf.ChainContentType = "application/x-pem-file"
+	conf.ChainContentDisposition = "inline"
+	s, err := New(conf)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	if s.Config().S3ACL != conf.S3ACL || s.Config().S3SSE != conf.S3SSE || s.Config().S3KMSKeyID != conf.S3KMSKeyID ||
+		s.Config().ChainContentType != conf.ChainContentType || s.Config().ChainContentDisposition != conf.ChainContentDisposition {
+		t.Fatalf("expected signer config to have the s3 upload options but got %+v", s.Config())
+	}
+
+	var TESTCASES = []struct {
+		acl, sse, kmsKeyID string
+		endpoint           string
+		insecureSkipVerify bool
+		contentType        string
+		contentDisposition string
+		maxAttempts        int
+	}{
+		{acl: "world-writable"},
+		{sse: "rot13"},
+		{sse: "AES256", kmsKeyID: "alias/autograph"},
+		{kmsKeyID: "alias/autograph"},
+		{endpoint: "minio:9000"},
+		{insecureSkipVerify: true},
+		{maxAttempts: -1},
+		{contentType: "pem"},
+		{contentType: "text/plain; charset"},
+		{contentDisposition: "download"},
+		{contentDisposition: "inline; filename"},
+	}
+	for _, testcase := range TESTCASES {
+		conf := PASSINGTESTCASES[0].cfg
+		conf.S3ACL = testcase.acl
+		conf.S3SSE = testcase.sse
+		conf.S3KMSKeyID = testcase.kmsKeyID
+		conf.S3Endpoint = testcase.endpoint
+		conf.S3InsecureSkipVerify = testcase.insecureSkipVerify
+		conf.ChainContentType = testcase.contentType
+		conf.ChainContentDisposition = testcase.contentDisposition
+		conf.S3UploadMaxAttempts = testcase.maxAttempts
+		_, err = New(conf)
+		if err == nil {
+			t.Fatalf("expected signer with s3 upload options %+v to fail but it succeeded", testcase)
+		}
+	}
+}
+
+// TestUploadToS3Endpoint does not run in parallel since it sets AWS
+// credentials in the environment
+func TestUploadToS3Endpoint(t *testing.T) {
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"} {
+		old, ok := os.LookupEnv(name)
+		os.Setenv(name, "test")
+		defer func(name, old string, ok bool) {
+			if ok {
+				os.Setenv(name, old)
+			} else {
+				os.Unsetenv(name)
+			}
+		}(name, old, ok)
+	}
+
+	// a MinIO-like endpoint with a self-signed certificate that
+	// addresses buckets in the path
+	var method, path, acl string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path, acl = r.Method, r.URL.Path, r.Header.Get("X-Amz-Acl")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	opts := S3UploadOptions{
+		ACL:            "bucket-owner-full-control",
+		MaxAttempts:    1,
+		Region:         "us-gov-west-1",
+		Endpoint:       ts.URL,
+		ForcePathStyle: true,
+	}
+	err := UploadWithOptions([]byte("chain"), "signer.pem", "s3://bucket/chains/", opts)
+	if err == nil {
+		t.Fatalf("expected upload to an endpoint with a self-signed certificate to fail without insecure skip verify")
+	}
+
+	opts.InsecureSkipVerify = true
+	err = UploadWithOptions([]byte("chain"), "signer.pem", "s3://bucket/chains/", opts)
+	if err != nil {
+		t.Fatalf("failed to upload to s3 endpoint: %v", err)
+	}
+	if method != http.MethodPut || path != "/bucket/chains/signer.pem" || acl != "bucket-owner-full-control" {
+		t.Fatalf("expected a PUT of /bucket/chains/signer.pem with the options acl but got %s %s with acl %q", method, path, acl)
+	}
+}
+
+// TestUploadToS3Retries does not run in parallel since it sets AWS
+// credentials in the environment and the upload retry backoff
+func TestUploadToS3Retries(t *testing.T) {
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"} {
+		old, ok := os.LookupEnv(name)
+		os.Setenv(name, "test")
+		defer func(name, old string, ok bool) {
+			if ok {
+				os.Setenv(name, old)
+			} else {
+				os.Unsetenv(name)
+			}
+		}(name, old, ok)
+	}
+	defer func(backoff time.Duration) { s3UploadRetryBackoff = backoff }(s3UploadRetryBackoff)
+	s3UploadRetryBackoff = time.Millisecond
+
+	// an endpoint that rejects the first uploads with an error the
+	// AWS SDK does not retry
+	var puts, failures int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		puts++
+		if puts <= failures {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	var TESTCASES = []struct {
+		maxAttempts, failures int
+		expectedPuts          int
+		expectErr             bool
+	}{
+		{maxAttempts: 0, failures: 2, expectedPuts: 3},
+		{maxAttempts: 0, failures: 3, expectedPuts: 3, expectErr: true},
+		{maxAttempts: 1, failures: 1, expectedPuts: 1, expectErr: true},
+		{maxAttempts: 5, failures: 4, expectedPuts: 5},
+	}
+	for i, testcase := range TESTCASES {
+		puts, failures = 0, testcase.failures
+		opts := S3UploadOptions{
+			MaxAttempts:    testcase.maxAttempts,
+			Region:         "us-east-1",
+			Endpoint:       ts.URL,
+			ForcePathStyle: true,
+		}
+		err := UploadWithOptions([]byte("chain"), "signer.pem", "s3://bucket/chains/", opts)
+		if testcase.expectErr != (err != nil) {
+			t.Fatalf("testcase %d expected error %t but got %v", i, testcase.expectErr, err)
+		}
+		if puts != testcase.expectedPuts {
+			t.Fatalf("testcase %d expected %d uploads but got %d", i, testcase.expectedPuts, puts)
+		}
+	}
+}
+
+func TestWriteGCSObject(t *testing.T) {
+	t.Parallel()
+
+	var method, path, name, acl, body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		name, acl = r.URL.Query().Get("name"), r.URL.Query().Get("predefinedAcl")
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"bucket": "bucket", "name": "chains/signer.pem"}`))
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx, option.WithEndpoint(ts.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("failed to create gcs client: %v", err)
+	}
+	defer client.Close()
+	target, _ := url.Parse("gs://bucket/chains/")
+	err = writeGCSObject(ctx, client, []byte("chain"), "signer.pem", target, S3UploadOptions{})
+	if err != nil {
+		t.Fatalf("failed to write gcs object: %v", err)
+	}
+	if method != http.MethodPost || path != "/upload/storage/v1/b/bucket/o" || name != "chains/signer.pem" || acl != "publicRead" {
+		t.Fatalf("expected an upload of chains/signer.pem to bucket with the publicRead acl but got %s %s of %q with acl %q", method, path, name, acl)
+	}
+	if !strings.Contains(body, `"contentDisposition":"attachment"`) || !strings.Contains(body, "chain") {
+		t.Fatalf("expected the upload to carry the chain as an attachment but got body: %s", body)
+	}
+}
+
+func TestWriteLocalFile(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "autograph_chains_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target, _ := url.Parse("file://" + dir + "/chains/")
+
+	for _, chain := range []string{"first chain", "second chain"} {
+		err = writeLocalFile([]byte(chain), "signer.pem", target)
+		if err != nil {
+			t.Fatalf("failed to write local file: %v", err)
+		}
+		data, err := ioutil.ReadFile(dir + "/chains/signer.pem")
+		if err != nil {
+			t.Fatalf("failed to read local file: %v", err)
+		}
+		if string(data) != chain {
+			t.Fatalf("expected local file to contain %q but got %q", chain, data)
+		}
+	}
+	fi, err := os.Stat(dir + "/chains/signer.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0644 {
+		t.Fatalf("expected local file mode 0644 but got %s", fi.Mode().Perm())
+	}
+	// the temp files are renamed into place
+	entries, err := ioutil.ReadDir(dir + "/chains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only the chain in the target dir but got %d files", len(entries))
+	}
+}
+
+func TestGetX5UPinned(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	client := buildHTTPClient(s.x5uConnectTimeout, s.x5uFetchTimeout)
+	_, certs, err := GetX5U(client, s.X5U)
+	if err != nil {
+		t.Fatalf("failed to get X5U %q: %v", s.X5U, err)
+	}
+	rootHash := SPKIFingerprint(certs[len(certs)-1])
+
+	_, pinnedCerts, err := GetX5UPinned(client, s.X5U, rootHash)
+	if err != nil {
+		t.Fatalf("failed to get X5U pinned to its root: %v", err)
+	}
+	if len(pinnedCerts) != len(certs) {
+		t.Fatalf("expected %d pinned certs but got %d", len(certs), len(pinnedCerts))
+	}
+	// the pin is hex, with or without colons and in any case
+	colonHash := strings.ToLower(rootHash[:2])
+	for i := 2; i < len(rootHash); i += 2 {
+		colonHash += ":" + strings.ToLower(rootHash[i:i+2])
+	}
+	_, _, err = GetX5UPinned(client, s.X5U, colonHash)
+	if err != nil {
+		t.Fatalf("failed to get X5U pinned to its colon separated root hash: %v", err)
+	}
+
+	_, _, err = GetX5UPinned(client, s.X5U, SPKIFingerprint(certs[0]))
+	if err == nil || !strings.Contains(err.Error(), "does not match expected hash") {
+		t.Fatalf("expected root SPKI hash mismatch error but got %v", err)
+	}
+	_, _, err = GetX5UPinned(client, s.X5U, "")
+	if err == nil {
+		t.Fatal("expected error getting X5U with an empty pin")
+	}
+}
@@ -7,10 +7,13 @@ import (
 	"encoding/pem"
 	"fmt"
 	"math/big"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/mozilla-services/autograph/database"
 	"github.com/mozilla-services/autograph/signer"
+	csigverifier "github.com/mozilla-services/autograph/verifier/contentsignature"
 )
 
 // findAndSetEE searches the database for an end-entity key that is currently
@@ -52,7 +55,7 @@ func (s *ContentSigner) makeAndUploadChain() (err error) {
 		return fmt.Errorf("failed to upload chain: %w", err)
 	}
 	newX5U := s.X5U + chainName
-	_, _, err = GetX5U(buildHTTPClient(), newX5U)
+	_, _, err = s.getX5U(newX5U)
 	if err != nil {
 		return fmt.Errorf("failed to download new chain: %w", err)
 	}
@@ -60,6 +63,40 @@ func (s *ContentSigner) makeAndUploadChain() (err error) {
 	return
 }
 
+// ValidateChain retrieves the chain at the x5u of the signer, verifies
+// it with GetX5U and checks that its end-entity certificate is the one
+// of the signing key. It runs when the signer is initialized, so a
+// chain that cannot be retrieved or verified fails at startup instead
+// of on the first signing request.
+func (s *ContentSigner) ValidateChain() error {
+	_, certs, err := s.getX5U(s.X5U)
+	if err != nil {
+		return fmt.Errorf("contentsignaturepki %q: failed to verify x5u: %w", s.ID, err)
+	}
+	return s.setChain(certs)
+}
+
+// setChain checks that the end-entity certificate of a verified chain
+// is the one of the signing key and sets it as the chain of the signer
+func (s *ContentSigner) setChain(certs []*x509.Certificate) error {
+	eePub, err := x509.MarshalPKIXPublicKey(s.eePub)
+	if err != nil {
+		return fmt.Errorf("contentsignaturepki %q: failed to marshal end-entity public key: %w", s.ID, err)
+	}
+	chainPub, err := x509.MarshalPKIXPublicKey(certs[0].PublicKey)
+	if err != nil {
+		return fmt.Errorf("contentsignaturepki %q: failed to marshal public key of x5u end-entity: %w", s.ID, err)
+	}
+	if !bytes.Equal(eePub, chainPub) {
+		return fmt.Errorf("contentsignaturepki %q: end-entity of x5u %q does not match the signing key", s.ID, s.X5U)
+	}
+	s.chain = make([]string, len(certs))
+	for i, cert := range certs {
+		s.chain[i] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	}
+	return nil
+}
+
 // makeChain issues an end-entity certificate using the ca private key and the first
 // cert of the chain (which is supposed to match the ca private key).  it
 // returns the entire chain of certificate, its name (based on the ee cn &
@@ -142,7 +179,115 @@ func (s *ContentSigner) makeChain() (chain string, name string, err error) {
 	}
 
 	// return a chain with the EE cert first then the issuers
-	chain = certPem.String() + s.IssuerCert + s.caCert
-	name = fmt.Sprintf("%s-%s.chain", cert.Subject.CommonName, cert.NotAfter.Format("2006-01-02-15-04-05"))
+	chain, err = assembleChain(certPem.String(), s.IssuerCert, s.caCert)
+	if err != nil {
+		err = fmt.Errorf("failed to assemble chain: %w", err)
+		return
+	}
+	name, err = s.chainName(cert)
+	if err != nil {
+		err = fmt.Errorf("failed to name chain: %w", err)
+		return
+	}
 	return
 }
+
+// parseChainNameTemplate parses a chain name template, and checks it
+// executes to a valid name with the fields of a sample end-entity of
+// the signer, so an invalid template fails at startup instead of when
+// the next chain is made
+func parseChainNameTemplate(text, signerID string) (*template.Template, error) {
+	tpl, err := template.New("chain_name_template").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	_, err = executeChainNameTemplate(tpl, signerID, big.NewInt(time.Now().UnixNano()), time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	return tpl, nil
+}
+
+// executeChainNameTemplate returns the chain name of the template for
+// an end-entity. The serial is in decimal, and notAfter is a
+// time.Time the template can format.
+func executeChainNameTemplate(tpl *template.Template, signerID string, serial *big.Int, notAfter time.Time) (string, error) {
+	var name strings.Builder
+	err := tpl.Execute(&name, map[string]interface{}{
+		"serial":   serial.String(),
+		"signerID": signerID,
+		"notAfter": notAfter,
+	})
+	if err != nil {
+		return "", err
+	}
+	if name.Len() == 0 {
+		return "", fmt.Errorf("chain name is empty")
+	}
+	if strings.HasPrefix(name.String(), "/") || strings.HasSuffix(name.String(), "/") {
+		return "", fmt.Errorf("chain name %q must not start or end with a slash", name.String())
+	}
+	for _, elem := range strings.Split(name.String(), "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return "", fmt.Errorf("chain name %q must not have empty, . or .. path elements", name.String())
+		}
+	}
+	return name.String(), nil
+}
+
+// chainName returns the name the chain of an end-entity certificate
+// is uploaded under, from the chain name template of the signer or
+// <common name>-<expiration>.chain by default
+func (s *ContentSigner) chainName(cert *x509.Certificate) (string, error) {
+	if s.parsedChainNameTemplate == nil {
+		return fmt.Sprintf("%s-%s.chain", cert.Subject.CommonName, cert.NotAfter.Format("2006-01-02-15-04-05")), nil
+	}
+	return executeChainNameTemplate(s.parsedChainNameTemplate, s.ID, cert.SerialNumber, cert.NotAfter)
+}
+
+// assembleChain concatenates the PEM encoded end-entity, intermediate
+// and root certificates in the leaf-intermediate-root order GetX5U
+// expects, and checks the order of the assembled chain so a misordered
+// chain is caught before it is uploaded
+func assembleChain(ee, intermediate, root string) (string, error) {
+	var chain strings.Builder
+	for _, cert := range []string{ee, intermediate, root} {
+		chain.WriteString(strings.TrimSpace(cert))
+		chain.WriteString("\n")
+	}
+	err := verifyChainOrder([]byte(chain.String()))
+	if err != nil {
+		return "", err
+	}
+	return chain.String(), nil
+}
+
+// verifyChainOrder checks that a PEM encoded chain contains an
+// end-entity certificate issued by the following intermediate, which
+// is issued by the following self-signed root
+func verifyChainOrder(chain []byte) error {
+	certs, err := csigverifier.ParseChain(chain)
+	if err != nil {
+		return fmt.Errorf("failed to parse chain: %w", err)
+	}
+	ee, intermediate, root := certs[0], certs[1], certs[2]
+	if ee.IsCA {
+		return fmt.Errorf("chain is not leaf first: first certificate %q is a CA", ee.Subject.CommonName)
+	}
+	err = ee.CheckSignatureFrom(intermediate)
+	if err != nil {
+		return fmt.Errorf("chain is not in leaf-intermediate-root order: end-entity %q is not issued by intermediate %q: %w",
+			ee.Subject.CommonName, intermediate.Subject.CommonName, err)
+	}
+	err = intermediate.CheckSignatureFrom(root)
+	if err != nil {
+		return fmt.Errorf("chain is not in leaf-intermediate-root order: intermediate %q is not issued by root %q: %w",
+			intermediate.Subject.CommonName, root.Subject.CommonName, err)
+	}
+	err = root.CheckSignatureFrom(root)
+	if err != nil {
+		return fmt.Errorf("chain is not in leaf-intermediate-root order: root %q is not self-signed: %w",
+			root.Subject.CommonName, err)
+	}
+	return nil
+}
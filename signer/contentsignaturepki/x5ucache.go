@@ -0,0 +1,101 @@
+package contentsignaturepki
+
+import (
+	"crypto/x509"
+	"net/http"
+	"sync"
+	"time"
+
+	csigverifier "github.com/mozilla-services/autograph/verifier/contentsignature"
+)
+
+// DefaultX5UCacheTTL is how long an X5UCache returns a chain before
+// retrieving it again when it is created without a TTL
+const DefaultX5UCacheTTL = 15 * time.Minute
+
+// X5UCache caches the chains retrieved with GetX5UWithMaxSize by x5u,
+// so verifying many signatures with the same x5u does not fetch and
+// parse its chain every time. A nil X5UCache retrieves every chain.
+type X5UCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]cachedX5U
+}
+
+// cachedX5U is a chain retrieved from an x5u
+type cachedX5U struct {
+	body      []byte
+	certs     []*x509.Certificate
+	fetchedAt time.Time
+}
+
+// NewX5UCache returns an empty cache keeping chains for ttl, or
+// DefaultX5UCacheTTL when ttl is zero
+func NewX5UCache(ttl time.Duration) *X5UCache {
+	return NewX5UCacheWithClock(ttl, time.Now)
+}
+
+// NewX5UCacheWithClock is NewX5UCache but expires and verifies the
+// cached chains at the times returned by now
+func NewX5UCacheWithClock(ttl time.Duration, now func() time.Time) *X5UCache {
+	if ttl == 0 {
+		ttl = DefaultX5UCacheTTL
+	}
+	return &X5UCache{
+		ttl:     ttl,
+		now:     now,
+		entries: make(map[string]cachedX5U),
+	}
+}
+
+// Get returns the chain at an x5u from the cache, or retrieves it
+// with GetX5UWithClock when it is missing or older than the TTL of the
+// cache. Cached chains are verified again at the current time and
+// evicted when they no longer verify, and failed retrievals are not
+// cached.
+func (c *X5UCache) Get(client *http.Client, x5u string, maxSize int64) (body []byte, certs []*x509.Certificate, err error) {
+	if c == nil {
+		return GetX5UWithMaxSize(client, x5u, maxSize)
+	}
+	c.mu.Lock()
+	cached, ok := c.entries[x5u]
+	c.mu.Unlock()
+	if ok && c.now().Sub(cached.fetchedAt) < c.ttl {
+		err = csigverifier.VerifyChain(sha2Fingerprint(cached.certs[len(cached.certs)-1]), cached.certs, c.now())
+		if err == nil {
+			return cached.body, cached.certs, nil
+		}
+	}
+
+	body, certs, err = GetX5UWithClock(client, x5u, maxSize, c.now)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		delete(c.entries, x5u)
+		return nil, nil, err
+	}
+	c.entries[x5u] = cachedX5U{body: body, certs: certs, fetchedAt: c.now()}
+	return body, certs, nil
+}
+
+// Clear removes every chain from the cache
+func (c *X5UCache) Clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]cachedX5U)
+}
+
+// Len returns the number of chains in the cache
+func (c *X5UCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
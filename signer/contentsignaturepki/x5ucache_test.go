@@ -0,0 +1,87 @@
+package contentsignaturepki
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestX5UCache(t *testing.T) {
+	t.Parallel()
+
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("failed to initialize signer: %v", err)
+	}
+	client := buildHTTPClient(s.x5uConnectTimeout, s.x5uFetchTimeout)
+	chain, _, err := GetX5U(client, s.X5U)
+	if err != nil {
+		t.Fatalf("failed to get signer chain: %v", err)
+	}
+	var (
+		fetches int32
+		failing int32
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(chain)
+	}))
+	defer ts.Close()
+
+	now := time.Now()
+	cache := NewX5UCache(time.Minute)
+	cache.now = func() time.Time { return now }
+	assertGet := func(desc string, wantFetches int32, wantErr bool) {
+		t.Helper()
+		body, certs, err := cache.Get(client, ts.URL, DefaultX5UMaxChainSize)
+		if wantErr && err == nil {
+			t.Fatalf("%s: expected getting the x5u to fail but it succeeded", desc)
+		}
+		if !wantErr && (err != nil || string(body) != string(chain) || len(certs) != 3) {
+			t.Fatalf("%s: expected the signer chain but got %d certs and error %v", desc, len(certs), err)
+		}
+		if got := atomic.LoadInt32(&fetches); got != wantFetches {
+			t.Fatalf("%s: expected %d fetches of the x5u but got %d", desc, wantFetches, got)
+		}
+	}
+
+	assertGet("first get", 1, false)
+	assertGet("cached get", 1, false)
+
+	now = now.Add(2 * time.Minute)
+	assertGet("get after the ttl", 2, false)
+
+	cache.Clear()
+	assertGet("get after clearing the cache", 3, false)
+
+	// a cached chain that no longer verifies within the ttl is
+	// fetched again
+	valid := now
+	now = now.Add(s.validity + s.clockSkewTolerance + time.Hour)
+	entry := cache.entries[ts.URL]
+	entry.fetchedAt = now
+	cache.entries[ts.URL] = entry
+	assertGet("get of an expired cached chain", 4, true)
+	if _, ok := cache.entries[ts.URL]; ok {
+		t.Fatalf("expected the chain that failed to verify to be evicted")
+	}
+
+	// failed retrievals are not cached
+	now = valid
+	atomic.StoreInt32(&failing, 1)
+	assertGet("failing get", 5, true)
+	atomic.StoreInt32(&failing, 0)
+	assertGet("get after a failure", 6, false)
+
+	var nilCache *X5UCache
+	_, _, err = nilCache.Get(client, ts.URL, DefaultX5UMaxChainSize)
+	if err != nil || atomic.LoadInt32(&fetches) != 7 {
+		t.Fatalf("expected a nil cache to fetch the x5u but got %d fetches and error %v", atomic.LoadInt32(&fetches), err)
+	}
+}
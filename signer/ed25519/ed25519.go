@@ -0,0 +1,148 @@
+package ed25519 // import "github.com/mozilla-services/autograph/signer/ed25519"
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/mozilla-services/autograph/formats"
+	"github.com/mozilla-services/autograph/signer"
+)
+
+const (
+	// Type of this signer is "ed25519"
+	Type = "ed25519"
+)
+
+// Ed25519Signer holds the configuration of the signer
+type Ed25519Signer struct {
+	signer.Configuration
+
+	// key is the Ed25519 private key to sign data
+	key ed25519.PrivateKey
+}
+
+// Options are the options of the signer, it has none
+type Options struct {
+}
+
+// New initializes an ed25519 signer using a configuration
+func New(conf signer.Configuration) (s *Ed25519Signer, err error) {
+	s = new(Ed25519Signer)
+
+	if conf.Type != Type {
+		return nil, fmt.Errorf("ed25519: invalid type %q, must be %q", conf.Type, Type)
+	}
+	s.Type = conf.Type
+
+	if conf.ID == "" {
+		return nil, fmt.Errorf("ed25519: missing signer ID in signer configuration")
+	}
+	s.ID = conf.ID
+
+	if conf.PrivateKey == "" {
+		return nil, fmt.Errorf("ed25519: missing private key for signer %q", s.ID)
+	}
+	s.PrivateKey = conf.PrivateKey
+
+	priv, _, publicKey, err := conf.GetKeys()
+	if err != nil {
+		return nil, fmt.Errorf("ed25519: error fetching key for signer %q: %w", s.ID, err)
+	}
+	key, ok := priv.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("ed25519: unsupported private key type %T for signer %q, use PKCS8 Ed25519 keys", priv, s.ID)
+	}
+	s.key = key
+	s.PublicKey = publicKey
+	return s, nil
+}
+
+// Config returns the configuration of the current signer
+func (s *Ed25519Signer) Config() signer.Configuration {
+	return signer.Configuration{
+		ID:         s.ID,
+		Type:       s.Type,
+		PrivateKey: s.PrivateKey,
+		PublicKey:  s.PublicKey,
+	}
+}
+
+// SignData returns a detached Ed25519 signature of the data. Ed25519
+// signs the data itself rather than a hash of it, so the signer does
+// not implement SignHash.
+func (s *Ed25519Signer) SignData(data []byte, options interface{}) (signer.Signature, error) {
+	sig := new(Signature)
+	sig.Data = ed25519.Sign(s.key, data)
+	return sig, nil
+}
+
+// Signature is an ed25519 signature
+type Signature struct {
+	Data []byte
+}
+
+// Marshal returns the base64 representation of a signature
+func (sig *Signature) Marshal() (string, error) {
+	return base64.StdEncoding.EncodeToString(sig.Data), nil
+}
+
+// Unmarshal decodes a base64 signature string into a Signature
+func Unmarshal(sigstr string) (signer.Signature, error) {
+	sigBytes, err := base64.StdEncoding.DecodeString(sigstr)
+	if err != nil {
+		return nil, err
+	}
+	if len(sigBytes) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("ed25519: invalid signature length %d, must be %d", len(sigBytes), ed25519.SignatureSize)
+	}
+	return &Signature{Data: sigBytes}, nil
+}
+
+// GetDefaultOptions returns default options of the signer
+func (s *Ed25519Signer) GetDefaultOptions() interface{} {
+	return Options{}
+}
+
+// VerifyData verifies a signature of the data with the public key of
+// the signer
+func (s *Ed25519Signer) VerifyData(data []byte, sig signer.Signature) error {
+	edSig, ok := sig.(*Signature)
+	if !ok {
+		return fmt.Errorf("ed25519: cannot verify signature of type %T", sig)
+	}
+	if !ed25519.Verify(s.key.Public().(ed25519.PublicKey), data, edSig.Data) {
+		return fmt.Errorf("ed25519: failed to verify signature")
+	}
+	return nil
+}
+
+// VerifyEd25519SignatureResponse is a helper that takes an input and
+// autograph signature response and verifies its signature with the
+// public key of the response
+func VerifyEd25519SignatureResponse(input []byte, sr formats.SignatureResponse) error {
+	if sr.Type != Type {
+		return fmt.Errorf("ed25519: signature response of type %q cannot be verified by %q", sr.Type, Type)
+	}
+	sig, err := Unmarshal(sr.Signature)
+	if err != nil {
+		return fmt.Errorf("ed25519: failed to unmarshal signature: %w", err)
+	}
+	keyBytes, err := base64.StdEncoding.DecodeString(sr.PublicKey)
+	if err != nil {
+		return fmt.Errorf("ed25519: failed to decode public key: %w", err)
+	}
+	keyInterface, err := x509.ParsePKIXPublicKey(keyBytes)
+	if err != nil {
+		return fmt.Errorf("ed25519: failed to parse pkix public key: %w", err)
+	}
+	pubKey, ok := keyInterface.(ed25519.PublicKey)
+	if !ok {
+		return fmt.Errorf("ed25519: invalid public key type %T, must be ed25519", keyInterface)
+	}
+	if !ed25519.Verify(pubKey, input, sig.(*Signature).Data) {
+		return fmt.Errorf("ed25519: failed to verify signature")
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package signer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrExternalSignersBusy is wrapped by the errors of signers that
+// gave up waiting for a free external signer slot
+var ErrExternalSignersBusy = errors.New("signer: too many concurrent external signers")
+
+var (
+	// externalSignersMu protects externalSigners
+	externalSignersMu sync.RWMutex
+
+	// externalSigners holds a token for each running signing tool
+	// process of the signers that shell out e.g. to apksigner or
+	// gpg, it is nil when their number is not limited
+	externalSigners chan struct{}
+)
+
+// SetMaxConcurrentExternalSigners limits the number of signing tool
+// processes the signers that shell out run at the same time across
+// all signers, 0 removes the limit
+func SetMaxConcurrentExternalSigners(max int) error {
+	if max < 0 {
+		return fmt.Errorf("signer: invalid max concurrent external signers %d, must be 0 or more", max)
+	}
+	externalSignersMu.Lock()
+	defer externalSignersMu.Unlock()
+	if max == 0 {
+		externalSigners = nil
+		return nil
+	}
+	externalSigners = make(chan struct{}, max)
+	return nil
+}
+
+// AcquireExternalSigner waits for a free external signer slot before
+// a signer runs a signing tool process and returns the func releasing
+// it. It returns an error wrapping ErrExternalSignersBusy when the
+// context is done first.
+func AcquireExternalSigner(ctx context.Context) (release func(), err error) {
+	externalSignersMu.RLock()
+	slots := externalSigners
+	externalSignersMu.RUnlock()
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w: %v", ErrExternalSignersBusy, ctx.Err())
+	}
+}
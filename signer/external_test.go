@@ -0,0 +1,59 @@
+package signer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAcquireExternalSigner(t *testing.T) {
+	defer SetMaxConcurrentExternalSigners(0)
+
+	// unlimited by default
+	release, err := AcquireExternalSigner(context.Background())
+	if err != nil {
+		t.Fatalf("failed to acquire unlimited external signer: %v", err)
+	}
+	release()
+
+	err = SetMaxConcurrentExternalSigners(1)
+	if err != nil {
+		t.Fatalf("failed to set max concurrent external signers: %v", err)
+	}
+	release, err = AcquireExternalSigner(context.Background())
+	if err != nil {
+		t.Fatalf("failed to acquire free external signer: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = AcquireExternalSigner(ctx)
+	if !errors.Is(err, ErrExternalSignersBusy) {
+		t.Fatalf("expected error %v acquiring saturated external signers but got %v", ErrExternalSignersBusy, err)
+	}
+
+	// a queued request gets the slot once it is released
+	acquired := make(chan error)
+	go func() {
+		release, err := AcquireExternalSigner(context.Background())
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+	release()
+	select {
+	case err = <-acquired:
+		if err != nil {
+			t.Fatalf("failed to acquire released external signer: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued request did not acquire the released external signer")
+	}
+
+	err = SetMaxConcurrentExternalSigners(-1)
+	if err == nil {
+		t.Fatal("expected error setting negative max concurrent external signers")
+	}
+}
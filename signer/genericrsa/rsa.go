@@ -3,15 +3,17 @@ package genericrsa
 import (
 	"crypto"
 	"crypto/rsa"
-	"crypto/sha1"
-	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"hash"
 	"io"
 
+	// register the hash functions of the signer configurations
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
 	"github.com/mozilla-services/autograph/formats"
 
 	"github.com/mozilla-services/autograph/signer"
@@ -41,8 +43,14 @@ type RSASigner struct {
 	// in pkcs15 mode
 	sigOpts crypto.SignerOpts
 
-	// hashSize is the byte size of the configured hash checksum
+	// hashID is the configured hash function and hashSize the
+	// byte size of its checksum
+	hashID   crypto.Hash
 	hashSize int
+
+	// allowedSigOpts are the signer options of the configured hash
+	// and of the allowed hashes signing requests can choose
+	allowedSigOpts map[crypto.Hash]crypto.SignerOpts
 }
 
 const (
@@ -68,6 +76,41 @@ func (opts *Options) HashFunc() crypto.Hash {
 
 }
 
+// SignOptions contains the options of signing requests
+type SignOptions struct {
+	// Hash, if not empty, is the hash algorithm e.g. "sha384" to
+	// sign with instead of the hash of the signer. It must be one of
+	// the allowed hashes of the signer configuration.
+	Hash string `json:"hash,omitempty"`
+}
+
+// GetSignOptions takes a input interface and reflects it into a struct
+// of sign options
+func GetSignOptions(input interface{}) (options SignOptions, err error) {
+	buf, err := json.Marshal(input)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(buf, &options)
+	return
+}
+
+// parseHash returns the hash function of a hash name of the signer
+// configuration or sign options
+func parseHash(name string) (crypto.Hash, error) {
+	switch name {
+	case "sha1":
+		return crypto.SHA1, nil
+	case "sha256":
+		return crypto.SHA256, nil
+	case "sha384":
+		return crypto.SHA384, nil
+	case "sha512":
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported hash %q, must be 'sha1', 'sha256', 'sha384' or 'sha512'", name)
+}
+
 // New initializes a rsa signer using a configuration
 func New(conf signer.Configuration) (s *RSASigner, err error) {
 	s = new(RSASigner)
@@ -104,42 +147,105 @@ func New(conf signer.Configuration) (s *RSASigner, err error) {
 	if err != nil {
 		return nil, fmt.Errorf("genericrsa: error fetching key for signer %q: %w", s.ID, err)
 	}
-	_, ok := s.pubKey.(*rsa.PublicKey)
+	rsaPubKey, ok := s.pubKey.(*rsa.PublicKey)
 	if !ok {
 		return nil, fmt.Errorf("genericrsa: unsupported public key type %T for signer %q, use RSA keys", s.pubKey, s.ID)
 	}
 
 	s.Hash = conf.Hash
-	var hashID crypto.Hash
-	switch s.Hash {
-	case "sha1":
-		hashID = crypto.SHA1
-		s.hashSize = sha1.Size
-	case "sha256":
-		hashID = crypto.SHA256
-		s.hashSize = sha256.Size
-	default:
-		return nil, fmt.Errorf("genericrsa: unsupported hash %q for signer %q, must be 'sha1' or 'sha256'", s.Hash, s.ID)
+	if s.Hash == "" {
+		s.Hash = "sha256"
 	}
+	s.hashID, err = parseHash(s.Hash)
+	if err != nil {
+		return nil, fmt.Errorf("genericrsa: invalid hash for signer %q: %w", s.ID, err)
+	}
+	s.hashSize = s.hashID.Size()
 
-	s.SaltLength = conf.SaltLength
-	switch s.Mode {
-	case ModePSS:
-		s.sigOpts = &rsa.PSSOptions{
-			SaltLength: s.SaltLength,
-			Hash:       hashID,
-		}
-	case ModePKCS15:
-		if s.SaltLength != 0 {
-			return nil, fmt.Errorf("genericrsa: signer %q uses mode %q and sets salt length to %d, which is only valid in 'pss' mode", s.ID, s.Mode, s.SaltLength)
+	// the signer signs with its hash unless the sign options choose
+	// one of the allowed hashes
+	hashIDs := []crypto.Hash{s.hashID}
+	for _, allowedHash := range conf.AllowedHashes {
+		hashID, err := parseHash(allowedHash)
+		if err != nil {
+			return nil, fmt.Errorf("genericrsa: invalid allowed hash for signer %q: %w", s.ID, err)
 		}
-		s.sigOpts = &Options{
-			Hash: hashID,
+		hashIDs = append(hashIDs, hashID)
+	}
+	s.AllowedHashes = conf.AllowedHashes
+
+	s.SaltLength = conf.SaltLength
+	s.allowedSigOpts = make(map[crypto.Hash]crypto.SignerOpts)
+	for _, hashID := range hashIDs {
+		switch s.Mode {
+		case ModePSS:
+			// the salt length is either one of the rsa.PSSSaltLength
+			// constants or a number of bytes that fits in the key
+			// with the hash
+			maxSaltLength := (rsaPubKey.N.BitLen()-1+7)/8 - hashID.Size() - 2
+			if s.SaltLength < rsa.PSSSaltLengthEqualsHash || s.SaltLength > maxSaltLength {
+				return nil, fmt.Errorf("genericrsa: invalid salt length %d for signer %q with hash %s, must be between %d and %d", s.SaltLength, s.ID, hashID, rsa.PSSSaltLengthEqualsHash, maxSaltLength)
+			}
+			s.allowedSigOpts[hashID] = &rsa.PSSOptions{
+				SaltLength: s.SaltLength,
+				Hash:       hashID,
+			}
+		case ModePKCS15:
+			if s.SaltLength != 0 {
+				return nil, fmt.Errorf("genericrsa: signer %q uses mode %q and sets salt length to %d, which is only valid in 'pss' mode", s.ID, s.Mode, s.SaltLength)
+			}
+			s.allowedSigOpts[hashID] = &Options{
+				Hash: hashID,
+			}
 		}
 	}
+	s.sigOpts = s.allowedSigOpts[s.hashID]
 	return s, nil
 }
 
+// signerOpts returns the signer options of the hash of the sign
+// options, or of the hash of the signer when they do not set one
+func (s *RSASigner) signerOpts(options interface{}) (crypto.SignerOpts, error) {
+	opt, err := GetSignOptions(options)
+	if err != nil {
+		return nil, fmt.Errorf("genericrsa: failed to get options: %w", err)
+	}
+	if opt.Hash == "" {
+		return s.sigOpts, nil
+	}
+	hashID, err := parseHash(opt.Hash)
+	if err != nil {
+		return nil, fmt.Errorf("genericrsa: invalid hash option: %w", err)
+	}
+	sigOpts, ok := s.allowedSigOpts[hashID]
+	if !ok {
+		return nil, fmt.Errorf("genericrsa: hash %q is not allowed for signer %q, set it in the allowed hashes of its configuration", opt.Hash, s.ID)
+	}
+	return sigOpts, nil
+}
+
+// ResponseSignerOpts returns the signer options of the hash of the
+// signer options of a signature response, when the hash is the hash of
+// the signer or one of its allowed hashes. The other options, such as
+// the PSS salt length, are those of the signer rather than the
+// response.
+func (s *RSASigner) ResponseSignerOpts(responseOpts interface{}) (crypto.SignerOpts, error) {
+	marshalledOpt, err := json.Marshal(responseOpts)
+	if err != nil {
+		return nil, err
+	}
+	var opt Options
+	err = json.Unmarshal(marshalledOpt, &opt)
+	if err != nil {
+		return nil, fmt.Errorf("genericrsa: failed to parse signer options: %w", err)
+	}
+	sigOpts, ok := s.allowedSigOpts[opt.Hash]
+	if !ok {
+		return nil, fmt.Errorf("genericrsa: hash %d of signer options is not allowed for signer %q", opt.Hash, s.ID)
+	}
+	return sigOpts, nil
+}
+
 // Config returns the configuration of the current signer
 func (s *RSASigner) Config() signer.Configuration {
 	return signer.Configuration{
@@ -152,36 +258,56 @@ func (s *RSASigner) Config() signer.Configuration {
 	}
 }
 
-// SignData takes data, hashes it and returns a signed base64 encoded hash
+// SignData takes data, hashes it with the hash of the options or the
+// signer and returns a signed base64 encoded hash
 func (s *RSASigner) SignData(data []byte, options interface{}) (signer.Signature, error) {
-	var h hash.Hash
-	switch s.Hash {
-	case "sha1":
-		h = sha1.New()
-	case "sha256":
-		h = sha256.New()
+	sigOpts, err := s.signerOpts(options)
+	if err != nil {
+		return nil, err
 	}
+	h := sigOpts.HashFunc().New()
 	h.Write(data)
-	return s.SignHash(h.Sum(nil), options)
+	return s.signHash(h.Sum(nil), sigOpts)
 }
 
-// SignHash takes an input hash and returns a signed base64 encoded hash
+// SignHash takes an input hash of the hash of the options or the
+// signer and returns a signed base64 encoded hash
 func (s *RSASigner) SignHash(digest []byte, options interface{}) (signer.Signature, error) {
-	if len(digest) != s.hashSize {
-		return nil, fmt.Errorf("genericrsa: refusing to sign input hash. Got length %d, expected %d", len(digest), s.hashSize)
+	sigOpts, err := s.signerOpts(options)
+	if err != nil {
+		return nil, err
+	}
+	return s.signHash(digest, sigOpts)
+}
+
+func (s *RSASigner) signHash(digest []byte, sigOpts crypto.SignerOpts) (signer.Signature, error) {
+	hashSize := sigOpts.HashFunc().Size()
+	if len(digest) != hashSize {
+		return nil, fmt.Errorf("genericrsa: refusing to sign input hash: %w %d, expected %d", signer.ErrInvalidHashLength, len(digest), hashSize)
 	}
-	sigBytes, err := s.key.(crypto.Signer).Sign(s.rng, digest, s.sigOpts)
+	sigBytes, err := s.key.(crypto.Signer).Sign(s.rng, digest, sigOpts)
 	if err != nil {
 		return nil, fmt.Errorf("genericrsa: error signing hash: %w", err)
 	}
 	sig := new(Signature)
 	sig.Data = sigBytes
+	sig.signerOpts = sigOpts
 	return sig, nil
 }
 
 // Signature is a rsa signature
 type Signature struct {
 	Data []byte
+
+	// signerOpts are the signer options of the signature, nil for
+	// unmarshalled signatures
+	signerOpts crypto.SignerOpts
+}
+
+// SignerOpts returns the signer options the signature was made with,
+// so responses carry the hash chosen by the sign options
+func (sig *Signature) SignerOpts() crypto.SignerOpts {
+	return sig.signerOpts
 }
 
 // Marshal returns the base64 representation of a signature
@@ -202,11 +328,27 @@ func Unmarshal(sigstr string) (signer.Signature, error) {
 
 // GetDefaultOptions returns default options of the signer
 func (s *RSASigner) GetDefaultOptions() interface{} {
-	return Options{}
+	return SignOptions{}
 }
 
-// VerifySignature verifies a rsa signature for the given SHA1
-// digest for the given RSA public and signature bytes
+// VerifyData verifies a signature of the data with the public key and
+// the signer options of the signature, or of the signer for
+// unmarshalled signatures
+func (s *RSASigner) VerifyData(data []byte, sig signer.Signature) error {
+	rsaSig, ok := sig.(*Signature)
+	if !ok {
+		return fmt.Errorf("genericrsa: cannot verify signature of type %T", sig)
+	}
+	sigOpts := s.sigOpts
+	if rsaSig.signerOpts != nil {
+		sigOpts = rsaSig.signerOpts
+	}
+	return VerifySignature(data, rsaSig.Data, s.pubKey.(*rsa.PublicKey), sigOpts, s.Mode)
+}
+
+// VerifySignature verifies a rsa signature of the input hashed with
+// the hash of the signer options for the given RSA public and
+// signature bytes
 func VerifySignature(input, sigBytes []byte, pubKey *rsa.PublicKey, sigopt interface{}, mode string) (err error) {
 	switch mode {
 	case ModePSS:
@@ -222,6 +364,9 @@ func VerifySignature(input, sigBytes []byte, pubKey *rsa.PublicKey, sigopt inter
 		if err != nil {
 			return err
 		}
+		if !opt.Hash.Available() {
+			return fmt.Errorf("genericrsa: unsupported hash %d in signer options", opt.Hash)
+		}
 		h := opt.Hash.New()
 		h.Write(input)
 		hashed := h.Sum(nil)
@@ -238,6 +383,9 @@ func VerifySignature(input, sigBytes []byte, pubKey *rsa.PublicKey, sigopt inter
 		if err != nil {
 			return err
 		}
+		if !opt.Hash.Available() {
+			return fmt.Errorf("genericrsa: unsupported hash %d in signer options", opt.Hash)
+		}
 		h := opt.Hash.New()
 		h.Write(input)
 		hashed := h.Sum(nil)
@@ -248,7 +396,8 @@ func VerifySignature(input, sigBytes []byte, pubKey *rsa.PublicKey, sigopt inter
 }
 
 // VerifyGenericRsaSignatureResponse is a helper that takes
-// an input and autograph signature response and verify its signature.
+// an input and autograph signature response and verify its signature
+// with the hash of the signer options of the response.
 func VerifyGenericRsaSignatureResponse(input []byte, sr formats.SignatureResponse) error {
 	if sr.Type != Type {
 		return fmt.Errorf("genericrsa: signature response of type %q cannot be verified by %q", sr.Type, Type)
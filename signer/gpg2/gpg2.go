@@ -2,6 +2,9 @@ package gpg2
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,9 +15,12 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/mozilla-services/autograph/formats"
 	"github.com/mozilla-services/autograph/signer"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
 )
 
 const (
@@ -32,6 +38,18 @@ const (
 	// ModeDebsign represents a signer that signs files with debsign
 	ModeDebsign = "debsign"
 
+	// SignatureFormatArmoredDetached is the format of ASCII armored
+	// detached signatures, the default
+	SignatureFormatArmoredDetached = "armored_detached"
+
+	// SignatureFormatBinaryDetached is the format of binary detached
+	// signatures, they are base64 encoded in signature responses
+	SignatureFormatBinaryDetached = "binary_detached"
+
+	// SignatureFormatClearsign is the format of ASCII armored
+	// cleartext signatures holding the signed data
+	SignatureFormatClearsign = "clearsign"
+
 	keyRingFilename = "autograph_gpg2_keyring.gpg"
 	secRingFilename = "autograph_gpg2_secring.gpg"
 	gpgConfFilename = "gpg.conf"
@@ -57,6 +75,10 @@ no-tty
 passphrase-fd 0
 pinentry-mode loopback
 yes`
+
+	// maxGNUPGHomePoolSize is the maximum number of GNUPGHOMEs a
+	// signer can create
+	maxGNUPGHomePoolSize = 64
 )
 
 var monitoringInputData = []byte(`AUTOGRAPH MONITORING`)
@@ -65,6 +87,9 @@ var isAlphanumeric = regexp.MustCompile(`^[a-zA-Z0-9]+$`).MatchString
 // gpg2 fails when multiple signers are called at in parallel so we serialize
 // invoking this signer through a global mutex. For more info on this particular
 // piece of gpg sadness, see https://answers.launchpad.net/duplicity/+question/296122
+//
+// Signers configured with a GNUPGHOME pool don't take this mutex
+// since each gpg invocation gets a home of its own.
 var serializeSigning sync.Mutex
 
 // GPG2Signer holds the configuration of the signer
@@ -79,10 +104,22 @@ type GPG2Signer struct {
 	// gpg secret key
 	passphrase string
 
-	// tmpDir is the signer's temporary working directory. It
+	// tmpDir is the signer's first temporary working directory. It
 	// holds the gpg sec and keyrings
 	tmpDir string
 
+	// tmpDirs are all the signer's temporary working directories,
+	// one per GNUPGHOME in the pool
+	tmpDirs []string
+
+	// homes holds the GNUPGHOMEs that are not in use by a gpg
+	// invocation
+	homes chan string
+
+	// serialize is true when the signer has no GNUPGHOME pool and
+	// must take the global serializeSigning mutex
+	serialize bool
+
 	// Mode is which signing command to use gpg2 or debsign
 	Mode string
 }
@@ -133,20 +170,63 @@ func New(conf signer.Configuration) (s *GPG2Signer, err error) {
 
 	s.passphrase = conf.Passphrase
 
-	s.tmpDir, err = createKeyRing(s)
+	poolSize := conf.GNUPGHomePoolSize
+	if poolSize < 0 || poolSize > maxGNUPGHomePoolSize {
+		return nil, fmt.Errorf("gpg2: GNUPGHOME pool size %d must be between 0 and %d", poolSize, maxGNUPGHomePoolSize)
+	}
+	s.GNUPGHomePoolSize = poolSize
+	if poolSize == 0 {
+		s.serialize = true
+		poolSize = 1
+	}
+	s.homes = make(chan string, poolSize)
+	for i := 0; i < poolSize; i++ {
+		dir, err := createGNUPGHome(s)
+		if err != nil {
+			s.AtExit()
+			return nil, err
+		}
+		s.tmpDirs = append(s.tmpDirs, dir)
+		s.homes <- dir
+	}
+	s.tmpDir = s.tmpDirs[0]
+	return
+}
+
+// createGNUPGHome creates a GNUPGHOME with the signer keys imported
+// in its keyring, and the gpg config debsign needs in debsign mode
+func createGNUPGHome(s *GPG2Signer) (dir string, err error) {
+	dir, err = createKeyRing(s)
 	if err != nil {
-		return nil, fmt.Errorf("gpg2: error creating keyring: %w", err)
+		return "", fmt.Errorf("gpg2: error creating keyring: %w", err)
 	}
 
 	// debsign lets us to specify a gpg program name (gpg or
 	// gpg2), but not args. We use a config file to sent them.
 	if s.Mode == ModeDebsign {
 		// write gpg.conf after importing keys, so gpg doesn't try to read stdin for key imports
-		if err = writeGPGConf(s.tmpDir); err != nil {
-			return nil, fmt.Errorf("error writing gpg conf: %w", err)
+		if err = writeGPGConf(dir); err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("error writing gpg conf: %w", err)
+		}
+	}
+	return dir, nil
+}
+
+// acquireGNUPGHome blocks until a GNUPGHOME of the pool is free and
+// returns it with a func to release it once gpg is done with it
+func (s *GPG2Signer) acquireGNUPGHome() (dir string, release func()) {
+	if s.serialize {
+		// take a mutex to prevent multiple invocations of gpg in parallel
+		serializeSigning.Lock()
+	}
+	dir = <-s.homes
+	return dir, func() {
+		s.homes <- dir
+		if s.serialize {
+			serializeSigning.Unlock()
 		}
 	}
-	return
 }
 
 // createKeyRing creates a temporary gpg sec and keyrings, loads the
@@ -265,12 +345,16 @@ func writeGPGConf(gpgHomeDir string) error {
 	return nil
 }
 
-// AtExit removes the temp dir containing the signer key and sec rings
+// AtExit removes the temp dirs containing the signer key and sec rings
 // when the app is shut down gracefully
-func (s *GPG2Signer) AtExit() error {
-	err := os.RemoveAll(s.tmpDir)
-	if err == nil {
-		log.Infof("gpg2: cleaned up %s in exit handler", s.tmpDir)
+func (s *GPG2Signer) AtExit() (err error) {
+	for _, dir := range s.tmpDirs {
+		rmErr := os.RemoveAll(dir)
+		if rmErr != nil {
+			err = rmErr
+			continue
+		}
+		signer.Log(s.Configuration, "exit").Infof("gpg2: cleaned up %s in exit handler", dir)
 	}
 	return err
 }
@@ -283,6 +367,8 @@ func (s *GPG2Signer) Config() signer.Configuration {
 		PrivateKey: s.PrivateKey,
 		PublicKey:  s.PublicKey,
 		Mode:       s.Mode,
+
+		GNUPGHomePoolSize: s.GNUPGHomePoolSize,
 	}
 }
 
@@ -291,11 +377,29 @@ func (s *GPG2Signer) SignData(data []byte, options interface{}) (signer.Signatur
 	if s.Mode != ModeGPG2 && !bytes.Equal(data, monitoringInputData) {
 		return nil, fmt.Errorf("gpg2: can only sign monitor data in %s mode", ModeGPG2)
 	}
-	keyRingPath := filepath.Join(s.tmpDir, keyRingFilename)
-	secRingPath := filepath.Join(s.tmpDir, secRingFilename)
+	opt, err := GetOptions(options)
+	if err != nil {
+		return nil, fmt.Errorf("gpg2: failed to get options: %w", err)
+	}
+	format, err := opt.signatureFormat()
+	if err != nil {
+		return nil, err
+	}
+	gnupgHome, release := s.acquireGNUPGHome()
+	defer release()
+	// gpg2 signing takes no context, so it waits for a free
+	// external signer slot until one is released
+	releaseSlot, err := signer.AcquireExternalSigner(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("gpg2: failed to start signing: %w", err)
+	}
+	defer releaseSlot()
+
+	keyRingPath := filepath.Join(gnupgHome, keyRingFilename)
+	secRingPath := filepath.Join(gnupgHome, secRingFilename)
 
 	// write the input to a temp file
-	tmpContentFile, err := ioutil.TempFile(s.tmpDir, fmt.Sprintf("gpg2_%s_input", s.ID))
+	tmpContentFile, err := ioutil.TempFile(gnupgHome, fmt.Sprintf("gpg2_%s_input", s.ID))
 	if err != nil {
 		return nil, fmt.Errorf("gpg2: failed to create tempfile for input to sign: %w", err)
 	}
@@ -309,18 +413,18 @@ func (s *GPG2Signer) SignData(data []byte, options interface{}) (signer.Signatur
 		return nil, fmt.Errorf("gpg2: failed to write tempfile for input to sign: %w", err)
 	}
 
-	// take a mutex to prevent multiple invocations of gpg in parallel
-	serializeSigning.Lock()
-	defer serializeSigning.Unlock()
-
-	gpgDetachSign := exec.Command("gpg",
+	args := []string{
 		// Shortcut for --options /dev/null. This option is detected before an attempt to open an option file. Using this option will also prevent the creation of a ~/.gnupg homedir.
 		"--no-options",
-		"--homedir", s.tmpDir,
+		"--homedir", gnupgHome,
 		"--no-default-keyring",
 		"--keyring", keyRingPath,
 		"--secret-keyring", secRingPath,
-		"--armor",
+	}
+	if format != SignatureFormatBinaryDetached {
+		args = append(args, "--armor")
+	}
+	args = append(args,
 		"--no-tty",
 		"--batch",
 		"--yes",
@@ -328,10 +432,15 @@ func (s *GPG2Signer) SignData(data []byte, options interface{}) (signer.Signatur
 		"--output", "-",
 		"--pinentry-mode", "loopback",
 		"--passphrase-fd", "0",
-		"--detach-sign", tmpContentFile.Name(),
 	)
-	gpgDetachSign.Dir = s.tmpDir
-	stdin, err := gpgDetachSign.StdinPipe()
+	if format == SignatureFormatClearsign {
+		args = append(args, "--clearsign", tmpContentFile.Name())
+	} else {
+		args = append(args, "--detach-sign", tmpContentFile.Name())
+	}
+	gpgSign := exec.Command("gpg", args...)
+	gpgSign.Dir = gnupgHome
+	stdin, err := gpgSign.StdinPipe()
 	if err != nil {
 		return nil, fmt.Errorf("gpg2: failed to create stdin pipe for sign cmd: %w", err)
 	}
@@ -341,28 +450,69 @@ func (s *GPG2Signer) SignData(data []byte, options interface{}) (signer.Signatur
 	if err = stdin.Close(); err != nil {
 		return nil, fmt.Errorf("gpg2: failed to close to stdin pipe for sign cmd: %w", err)
 	}
-	out, err := gpgDetachSign.CombinedOutput()
+	// the signature is read from stdout alone, so the warnings gpg
+	// prints on stderr do not end up in binary signatures
+	var stdout, stderr bytes.Buffer
+	gpgSign.Stdout = &stdout
+	gpgSign.Stderr = &stderr
+	err = gpgSign.Run()
 	if err != nil {
-		return nil, fmt.Errorf("gpg2: failed to sign input %s\n%s", err, out)
+		return nil, fmt.Errorf("gpg2: failed to sign input %s\n%s", err, signer.LogOutput(stderr.Bytes(), s.passphrase))
 	}
-	log.Debugf("signed as:\n%s\n", string(out))
+	signer.Log(s.Configuration, "sign").Debugf("gpg2: signed as %s:\n%s", format, signer.LogOutput(stderr.Bytes(), s.passphrase))
 
 	sig := new(Signature)
-	sig.Data = out
+	sig.Data = stdout.Bytes()
+	sig.SignatureFormat = format
 	return sig, nil
 }
 
+// VerifyData verifies a signature of the data in any of the signature
+// formats with the public key of the signer
+func (s *GPG2Signer) VerifyData(data []byte, sig signer.Signature) error {
+	pgpSig, ok := sig.(*Signature)
+	if !ok {
+		return fmt.Errorf("gpg2: cannot verify signature of type %T", sig)
+	}
+	sigstr, err := pgpSig.Marshal()
+	if err != nil {
+		return err
+	}
+	return VerifyGPG2SignatureResponse(data, formats.SignatureResponse{
+		Type:            s.Type,
+		PublicKey:       s.PublicKey,
+		Signature:       sigstr,
+		SignatureFormat: pgpSig.Format(),
+	})
+}
+
 // Signature is a PGP signature
 type Signature struct {
 	Data []byte
+
+	// SignatureFormat is the format of Data, an armored detached
+	// signature when empty
+	SignatureFormat string
 }
 
 // Marshal doesn't do much for this signer. sig.Data already contains
-// an armored signature, so we simply convert it to a string and return it
+// an armored signature, so we simply convert it to a string and return
+// it. Binary signatures are base64 encoded.
 func (sig *Signature) Marshal() (string, error) {
+	if sig.SignatureFormat == SignatureFormatBinaryDetached {
+		return base64.StdEncoding.EncodeToString(sig.Data), nil
+	}
 	return string(sig.Data), nil
 }
 
+// Format returns the format of the signature
+func (sig *Signature) Format() string {
+	if sig.SignatureFormat == "" {
+		return SignatureFormatArmoredDetached
+	}
+	return sig.SignatureFormat
+}
+
 // Unmarshal also does very little. It simply converts the armored signature
 // from a string to an []byte, but doesn't attempt to parse it, and returns it
 // as a Signature
@@ -372,8 +522,75 @@ func Unmarshal(sigstr string) (signer.Signature, error) {
 	return sig, nil
 }
 
-// Options are not implemented for this signer
+// VerifyGPG2SignatureResponse is a helper that takes an input and
+// autograph signature response and verifies its signature with the
+// armored public key of the response. The signature is an armored
+// detached signature unless the signature format of the response is
+// binary_detached or clearsign, in which case the signed text must be
+// the input.
+func VerifyGPG2SignatureResponse(input []byte, sr formats.SignatureResponse) error {
+	if sr.Type != Type {
+		return fmt.Errorf("gpg2: signature response of type %q cannot be verified by %q", sr.Type, Type)
+	}
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(sr.PublicKey))
+	if err != nil {
+		return fmt.Errorf("gpg2: failed to read public key into a keyring: %w", err)
+	}
+	switch sr.SignatureFormat {
+	case "", SignatureFormatArmoredDetached:
+		_, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(input), strings.NewReader(sr.Signature))
+	case SignatureFormatBinaryDetached:
+		var sig []byte
+		sig, err = base64.StdEncoding.DecodeString(sr.Signature)
+		if err != nil {
+			return fmt.Errorf("gpg2: failed to base64 decode binary signature: %w", err)
+		}
+		_, err = openpgp.CheckDetachedSignature(keyring, bytes.NewReader(input), bytes.NewReader(sig))
+	case SignatureFormatClearsign:
+		block, _ := clearsign.Decode([]byte(sr.Signature))
+		if block == nil {
+			return fmt.Errorf("gpg2: failed to decode cleartext signature")
+		}
+		// the cleartext ends without the trailing newline of the
+		// input, and with CRLF line endings when canonicalized
+		if !bytes.Equal(bytes.TrimRight(block.Plaintext, "\n"), bytes.TrimRight(input, "\n")) {
+			return fmt.Errorf("gpg2: cleartext signature does not hold the input")
+		}
+		_, err = openpgp.CheckDetachedSignature(keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body)
+	default:
+		return fmt.Errorf("gpg2: invalid signature format %q", sr.SignatureFormat)
+	}
+	if err != nil {
+		return fmt.Errorf("gpg2: failed to verify signature: %w", err)
+	}
+	return nil
+}
+
+// Options are the signing options of gpg2 signers in the gpg2 mode
 type Options struct {
+	// Armor sets whether the signature is ASCII armored, it
+	// defaults to true. Binary signatures are base64 encoded in
+	// signature responses.
+	Armor *bool `json:"armor,omitempty"`
+
+	// Clearsign returns an ASCII armored cleartext signature holding
+	// the signed data instead of a detached signature
+	Clearsign bool `json:"clearsign,omitempty"`
+}
+
+// signatureFormat returns the signature format of the options
+func (o Options) signatureFormat() (string, error) {
+	armor := o.Armor == nil || *o.Armor
+	switch {
+	case o.Clearsign && !armor:
+		return "", fmt.Errorf("gpg2: cleartext signatures are always armored, the armor option cannot be false with clearsign")
+	case o.Clearsign:
+		return SignatureFormatClearsign, nil
+	case armor:
+		return SignatureFormatArmoredDetached, nil
+	default:
+		return SignatureFormatBinaryDetached, nil
+	}
 }
 
 // GetDefaultOptions returns default options of the signer
@@ -381,6 +598,16 @@ func (s *GPG2Signer) GetDefaultOptions() interface{} {
 	return Options{}
 }
 
+// GetOptions takes a input interface and reflects it into a struct of options
+func GetOptions(input interface{}) (options Options, err error) {
+	buf, err := json.Marshal(input)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(buf, &options)
+	return
+}
+
 // SignFiles uses debsign to gpg2 clearsign multiple named
 // *.buildinfo, *.dsc, or *.changes files
 func (s *GPG2Signer) SignFiles(inputs []signer.NamedUnsignedFile, options interface{}) (signedFiles []signer.NamedSignedFile, err error) {
@@ -416,9 +643,15 @@ func (s *GPG2Signer) SignFiles(inputs []signer.NamedUnsignedFile, options interf
 		inputFilePaths = append(inputFilePaths, inputFilePath)
 	}
 
-	// take a mutex to prevent multiple invocations of gpg in parallel
-	serializeSigning.Lock()
-	defer serializeSigning.Unlock()
+	gnupgHome, release := s.acquireGNUPGHome()
+	defer release()
+	// gpg2 signing takes no context, so it waits for a free
+	// external signer slot until one is released
+	releaseSlot, err := signer.AcquireExternalSigner(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("gpg2: failed to start signing: %w", err)
+	}
+	defer releaseSlot()
 
 	args := append([]string{
 		// "Do not read any configuration files. This can only be used as the first option given on the command-line."
@@ -431,7 +664,7 @@ func (s *GPG2Signer) SignFiles(inputs []signer.NamedUnsignedFile, options interf
 	}, inputFilePaths...)
 	debsignCmd := exec.Command("debsign", args...)
 	debsignCmd.Env = append(os.Environ(),
-		fmt.Sprintf("GNUPGHOME=%s", s.tmpDir),
+		fmt.Sprintf("GNUPGHOME=%s", gnupgHome),
 	)
 	stdin, err := debsignCmd.StdinPipe()
 	if err != nil {
@@ -450,7 +683,7 @@ func (s *GPG2Signer) SignFiles(inputs []signer.NamedUnsignedFile, options interf
 	}
 	out, err := debsignCmd.CombinedOutput()
 	if err != nil {
-		return nil, fmt.Errorf("gpg2: failed to debsign inputs %s\n%s", err, out)
+		return nil, fmt.Errorf("gpg2: failed to debsign inputs %s\n%s", err, signer.LogOutput(out, s.passphrase))
 	}
 
 	// read the signed tempfiles
@@ -464,6 +697,6 @@ func (s *GPG2Signer) SignFiles(inputs []signer.NamedUnsignedFile, options interf
 			Bytes: signedFileBytes,
 		})
 	}
-	log.Debugf("debsign output:\n%s\n", string(out))
+	signer.Log(s.Configuration, "sign").Debugf("gpg2: debsign output:\n%s", signer.LogOutput(out, s.passphrase))
 	return signedFiles, nil
 }
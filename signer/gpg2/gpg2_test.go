@@ -9,8 +9,10 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 
+	"github.com/mozilla-services/autograph/formats"
 	"github.com/mozilla-services/autograph/signer"
 )
 
@@ -212,6 +214,77 @@ func TestNewSigner(t *testing.T) {
 		invalidConf.KeyID = "!?;\\"
 		assertNewSignerWithConfErrs(t, invalidConf)
 	})
+
+	t.Run("negative GNUPGHOME pool size", func(t *testing.T) {
+		t.Parallel()
+
+		invalidConf := pgpsubkeyGPG2SignerConf
+		invalidConf.GNUPGHomePoolSize = -1
+		assertNewSignerWithConfErrs(t, invalidConf)
+	})
+
+	t.Run("too large GNUPGHOME pool size", func(t *testing.T) {
+		t.Parallel()
+
+		invalidConf := pgpsubkeyGPG2SignerConf
+		invalidConf.GNUPGHomePoolSize = maxGNUPGHomePoolSize + 1
+		assertNewSignerWithConfErrs(t, invalidConf)
+	})
+}
+
+func TestGNUPGHomePool(t *testing.T) {
+	t.Parallel()
+
+	conf := pgpsubkeyGPG2SignerConf
+	conf.GNUPGHomePoolSize = 3
+	s := assertNewSignerWithConfOK(t, conf)
+	if s.serialize {
+		t.Fatal("signer with a GNUPGHOME pool serializes signing")
+	}
+	if len(s.tmpDirs) != conf.GNUPGHomePoolSize {
+		t.Fatalf("expected %d GNUPGHOMEs but got %d", conf.GNUPGHomePoolSize, len(s.tmpDirs))
+	}
+	seen := make(map[string]bool)
+	for _, dir := range s.tmpDirs {
+		if seen[dir] {
+			t.Fatalf("GNUPGHOME %s is in the pool twice", dir)
+		}
+		seen[dir] = true
+		if _, err := os.Stat(filepath.Join(dir, keyRingFilename)); err != nil {
+			t.Fatalf("GNUPGHOME %s is missing a keyring: %v", dir, err)
+		}
+	}
+
+	// sign more inputs than there are homes in parallel
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*conf.GNUPGHomePoolSize)
+	for i := 0; i < 2*conf.GNUPGHomePoolSize; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := s.SignData([]byte(fmt.Sprintf("input %d", i)), s.GetDefaultOptions())
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("failed to sign data concurrently: %v", err)
+		}
+	}
+	if len(s.homes) != conf.GNUPGHomePoolSize {
+		t.Fatalf("expected %d free GNUPGHOMEs after signing but got %d", conf.GNUPGHomePoolSize, len(s.homes))
+	}
+
+	if err := s.AtExit(); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range s.tmpDirs {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Fatalf("AtExit failed to clean temp dir %s", dir)
+		}
+	}
 }
 
 func TestSignerAtExit(t *testing.T) {
@@ -321,6 +394,24 @@ func TestSignData(t *testing.T) {
 				}
 			})
 
+			t.Run("VerifyGPG2SignatureResponse", func(t *testing.T) {
+				t.Parallel()
+
+				sr := formats.SignatureResponse{
+					Type:      s.Type,
+					PublicKey: s.PublicKey,
+					Signature: sigstr,
+				}
+				err := VerifyGPG2SignatureResponse(input, sr)
+				if err != nil {
+					t.Fatalf("failed to verify signature response: %v", err)
+				}
+				err = VerifyGPG2SignatureResponse([]byte("some other input"), sr)
+				if err == nil {
+					t.Fatalf("expected signature response verification on another input to fail but it succeeded")
+				}
+			})
+
 			t.Run("VerifyWithGnuPG", func(t *testing.T) {
 				t.Parallel()
 
@@ -388,6 +479,77 @@ func TestSignData(t *testing.T) {
 	}
 }
 
+func TestSignDataFormats(t *testing.T) {
+	armor, noArmor := true, false
+	input := []byte("foobarbaz1234abcd\n")
+	testcases := []struct {
+		name           string
+		options        Options
+		expectedFormat string
+		expectedErr    string
+	}{
+		{"default", Options{}, SignatureFormatArmoredDetached, ""},
+		{"armored", Options{Armor: &armor}, SignatureFormatArmoredDetached, ""},
+		{"binary", Options{Armor: &noArmor}, SignatureFormatBinaryDetached, ""},
+		{"clearsign", Options{Clearsign: true}, SignatureFormatClearsign, ""},
+		{"binary clearsign", Options{Armor: &noArmor, Clearsign: true}, "", "gpg2: cleartext signatures are always armored"},
+	}
+	s := assertNewSignerWithConfOK(t, validSignerConfigs[0])
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			sig, err := s.SignData(input, testcase.options)
+			if testcase.expectedErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), testcase.expectedErr) {
+					t.Fatalf("expected error %q but got %v", testcase.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to sign data: %v", err)
+			}
+			format := sig.(signer.FormattedSignature).Format()
+			if format != testcase.expectedFormat {
+				t.Fatalf("expected signature format %q but got %q", testcase.expectedFormat, format)
+			}
+			sigstr, err := sig.Marshal()
+			if err != nil {
+				t.Fatalf("failed to marshal signature: %v", err)
+			}
+			sr := formats.SignatureResponse{
+				Type:            s.Type,
+				PublicKey:       s.PublicKey,
+				Signature:       sigstr,
+				SignatureFormat: format,
+			}
+			err = VerifyGPG2SignatureResponse(input, sr)
+			if err != nil {
+				t.Fatalf("failed to verify signature response: %v", err)
+			}
+			err = VerifyGPG2SignatureResponse([]byte("some other input\n"), sr)
+			if err == nil {
+				t.Fatalf("expected signature response verification on another input to fail but it succeeded")
+			}
+			err = s.VerifyData(input, sig)
+			if err != nil {
+				t.Fatalf("failed to verify signature: %v", err)
+			}
+		})
+	}
+}
+
+func TestTestSigner(t *testing.T) {
+	t.Parallel()
+
+	for _, conf := range validSignerConfigs {
+		s := assertNewSignerWithConfOK(t, conf)
+		err := signer.TestSigner(s)
+		if err != nil {
+			t.Fatalf("signer %s test failed: %v", conf.ID, err)
+		}
+	}
+}
+
 func TestGPG2Signer_SignFiles(t *testing.T) {
 	type fields struct {
 		Configuration signer.Configuration
@@ -0,0 +1,62 @@
+package signer
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"go.mozilla.org/mozlogrus"
+)
+
+const (
+	// LogFormatJSON logs entries as mozlog JSON, it is the default
+	LogFormatJSON = "json"
+
+	// LogFormatText logs entries as logrus text
+	LogFormatText = "text"
+
+	// maxLoggedOutputLen is the number of bytes of the output of a
+	// signing tool LogOutput keeps
+	maxLoggedOutputLen = 1024
+)
+
+// SetLogFormat sets the format of the entries autograph and its
+// signers log to LogFormatJSON, the default when format is empty, or
+// LogFormatText
+func SetLogFormat(format string) error {
+	switch format {
+	case "", LogFormatJSON:
+		mozlogrus.Enable("autograph")
+	case LogFormatText:
+		log.SetFormatter(&log.TextFormatter{})
+	default:
+		return fmt.Errorf("signer: invalid log format %q, must be empty, %q or %q", format, LogFormatJSON, LogFormatText)
+	}
+	return nil
+}
+
+// Log returns a log entry with the signer_id, signer_type and
+// operation fields of an operation of a signer e.g. "init" or "sign"
+func Log(conf Configuration, operation string) *log.Entry {
+	return log.WithFields(log.Fields{
+		"signer_id":   conf.ID,
+		"signer_type": conf.Type,
+		"operation":   operation,
+	})
+}
+
+// LogOutput returns the output of a signing tool to log, with every
+// occurrence of the non-empty secrets e.g. the paths of key files
+// redacted, and truncated to its first 1024 bytes
+func LogOutput(out []byte, secrets ...string) string {
+	logged := string(out)
+	for _, secret := range secrets {
+		if secret != "" {
+			logged = strings.ReplaceAll(logged, secret, "[redacted]")
+		}
+	}
+	if len(logged) > maxLoggedOutputLen {
+		logged = fmt.Sprintf("%s... (%d bytes truncated)", logged[:maxLoggedOutputLen], len(logged)-maxLoggedOutputLen)
+	}
+	return logged
+}
@@ -0,0 +1,57 @@
+package signer
+
+import (
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestSetLogFormat(t *testing.T) {
+	defer SetLogFormat(LogFormatJSON)
+
+	err := SetLogFormat(LogFormatText)
+	if err != nil {
+		t.Fatalf("failed to set text log format: %v", err)
+	}
+	if _, ok := log.StandardLogger().Formatter.(*log.TextFormatter); !ok {
+		t.Fatalf("expected a text formatter but got %T", log.StandardLogger().Formatter)
+	}
+	err = SetLogFormat("")
+	if err != nil {
+		t.Fatalf("failed to set default log format: %v", err)
+	}
+	if _, ok := log.StandardLogger().Formatter.(*log.TextFormatter); ok {
+		t.Fatal("expected the default log format not to be text")
+	}
+	err = SetLogFormat("xml")
+	if err == nil {
+		t.Fatal("expected setting an invalid log format to fail but it succeeded")
+	}
+}
+
+func TestLog(t *testing.T) {
+	entry := Log(Configuration{ID: "testsigner", Type: "apk2"}, "sign")
+	expected := log.Fields{"signer_id": "testsigner", "signer_type": "apk2", "operation": "sign"}
+	for k, v := range expected {
+		if entry.Data[k] != v {
+			t.Fatalf("expected log field %q to be %q but got %q", k, v, entry.Data[k])
+		}
+	}
+}
+
+func TestLogOutput(t *testing.T) {
+	out := []byte("signing with /tmp/apk2_sign_123/key.pk8 and password hunter2")
+	logged := LogOutput(out, "/tmp/apk2_sign_123", "", "hunter2")
+	if logged != "signing with [redacted]/key.pk8 and password [redacted]" {
+		t.Fatalf("unexpected redacted output %q", logged)
+	}
+
+	logged = LogOutput([]byte(strings.Repeat("a", 2000)))
+	if !strings.HasPrefix(logged, strings.Repeat("a", maxLoggedOutputLen)+"...") {
+		t.Fatalf("expected output to be truncated to %d bytes but got %q", maxLoggedOutputLen, logged)
+	}
+	if !strings.HasSuffix(logged, "(976 bytes truncated)") {
+		t.Fatalf("expected truncated output to say how many bytes were truncated but got %q", logged)
+	}
+}
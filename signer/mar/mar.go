@@ -5,11 +5,13 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rsa"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 
+	"github.com/mozilla-services/autograph/formats"
 	"github.com/mozilla-services/autograph/signer"
 
 	margo "go.mozilla.org/mar"
@@ -55,22 +57,32 @@ func New(conf signer.Configuration) (s *MARSigner, err error) {
 	}
 
 	// select the default signature algorithm depending on the public key type
-	switch pubKey := s.publicKey.(type) {
+	s.defaultSigAlg, err = SigAlgForPublicKey(s.publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// SigAlgForPublicKey returns the MAR signature algorithm of a public
+// key: RSA PKCS1 with SHA384 for RSA keys, and ECDSA with the hash of
+// the curve for P-256 and P-384 keys
+func SigAlgForPublicKey(pub crypto.PublicKey) (uint32, error) {
+	switch pubKey := pub.(type) {
 	case *rsa.PublicKey:
-		s.defaultSigAlg = margo.SigAlgRsaPkcs1Sha384
+		return margo.SigAlgRsaPkcs1Sha384, nil
 	case *ecdsa.PublicKey:
 		switch pubKey.Params().Name {
 		case elliptic.P256().Params().Name:
-			s.defaultSigAlg = margo.SigAlgEcdsaP256Sha256
+			return margo.SigAlgEcdsaP256Sha256, nil
 		case elliptic.P384().Params().Name:
-			s.defaultSigAlg = margo.SigAlgEcdsaP384Sha384
+			return margo.SigAlgEcdsaP384Sha384, nil
 		default:
-			return nil, fmt.Errorf("mar: elliptic curve %q is not supported", pubKey.Params().Name)
+			return 0, fmt.Errorf("mar: elliptic curve %q is not supported", pubKey.Params().Name)
 		}
 	default:
-		return nil, fmt.Errorf("mar: unsupported public key type %T", s.signingKey)
+		return 0, fmt.Errorf("mar: unsupported public key type %T", pub)
 	}
-	return
 }
 
 // Config returns the configuration of the current signer
@@ -143,6 +155,14 @@ func (s *MARSigner) SignHash(hashed []byte, options interface{}) (signer.Signatu
 	if opt.SigAlg == 0 {
 		opt.SigAlg = s.defaultSigAlg
 	}
+	// hash nothing to get the hash function of the algorithm
+	_, hashAlg, err := margo.Hash(nil, opt.SigAlg)
+	if err != nil {
+		return nil, fmt.Errorf("mar: failed to sign: %w", err)
+	}
+	if len(hashed) != hashAlg.Size() {
+		return nil, fmt.Errorf("mar: refusing to sign input hash: %w %d, expected %d for signature algorithm %d", signer.ErrInvalidHashLength, len(hashed), hashAlg.Size(), opt.SigAlg)
+	}
 	sig := new(Signature)
 	sig.Data, err = margo.Sign(s.signingKey, s.rand, hashed, opt.SigAlg)
 	if err != nil {
@@ -151,6 +171,60 @@ func (s *MARSigner) SignHash(hashed []byte, options interface{}) (signer.Signatu
 	return sig, nil
 }
 
+// VerifyData verifies a signature of MAR data marshalled for signature
+// with the public key of the signer and its default signature algorithm
+func (s *MARSigner) VerifyData(data []byte, sig signer.Signature) error {
+	marSig, ok := sig.(*Signature)
+	if !ok {
+		return fmt.Errorf("mar: cannot verify signature of type %T", sig)
+	}
+	err := margo.VerifySignature(data, marSig.Data, s.defaultSigAlg, s.publicKey)
+	if err != nil {
+		return fmt.Errorf("mar: failed to verify signature: %w", err)
+	}
+	return nil
+}
+
+// VerifyMARSignatureResponse is a helper that takes an input and
+// autograph signature response and verifies its signature with the
+// public key of the response, using the signature algorithm of the key
+func VerifyMARSignatureResponse(input []byte, sr formats.SignatureResponse) error {
+	if sr.Type != Type {
+		return fmt.Errorf("mar: signature response of type %q cannot be verified by %q", sr.Type, Type)
+	}
+	sig, err := base64.StdEncoding.DecodeString(sr.Signature)
+	if err != nil {
+		return fmt.Errorf("mar: failed to decode signature: %w", err)
+	}
+	keyBytes, err := base64.StdEncoding.DecodeString(sr.PublicKey)
+	if err != nil {
+		return fmt.Errorf("mar: failed to decode public key: %w", err)
+	}
+	pubKey, err := x509.ParsePKIXPublicKey(keyBytes)
+	if err != nil {
+		return fmt.Errorf("mar: failed to parse pkix public key: %w", err)
+	}
+	sigAlg, err := SigAlgForPublicKey(pubKey)
+	if err != nil {
+		return err
+	}
+	// monitor responses of option variants sign with their algorithm
+	if sr.Options != nil {
+		opt, err := GetOptions(sr.Options)
+		if err != nil {
+			return fmt.Errorf("mar: failed to parse options of signature response: %w", err)
+		}
+		if opt.SigAlg != 0 {
+			sigAlg = opt.SigAlg
+		}
+	}
+	err = margo.VerifySignature(input, sig, sigAlg, pubKey)
+	if err != nil {
+		return fmt.Errorf("mar: failed to verify signature: %w", err)
+	}
+	return nil
+}
+
 // Signature is a MAR signature
 type Signature struct {
 	Data []byte
@@ -1,13 +1,17 @@
 package mar
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/base64"
+	"io"
+	"strings"
 	"testing"
 
+	"github.com/mozilla-services/autograph/formats"
 	"github.com/mozilla-services/autograph/signer"
 	margo "go.mozilla.org/mar"
 )
@@ -46,6 +50,82 @@ func TestSignFile(t *testing.T) {
 	}
 }
 
+func TestSignFileStream(t *testing.T) {
+	for i, marsignerconf := range marsignerconfs {
+		s, err := New(marsignerconf)
+		if err != nil {
+			t.Fatalf("failed to initialize signer %d: %v", i, err)
+		}
+		var output bytes.Buffer
+		err = s.SignFileStream(bytes.NewReader(miniMarB), &output, nil)
+		if err != nil {
+			t.Fatalf("signer %d failed to sign file stream: %v", i, err)
+		}
+		// inputs without random access are spooled
+		var spooledOutput bytes.Buffer
+		err = s.SignFileStream(struct{ io.Reader }{bytes.NewReader(miniMarB)}, &spooledOutput, nil)
+		if err != nil {
+			t.Fatalf("signer %d failed to sign spooled file stream: %v", i, err)
+		}
+		if spooledOutput.Len() != output.Len() {
+			t.Fatalf("signer %d spooled file is %d bytes but streamed file is %d", i, spooledOutput.Len(), output.Len())
+		}
+		var parsedMar margo.File
+		err = margo.Unmarshal(output.Bytes(), &parsedMar)
+		if err != nil {
+			t.Fatalf("signer %d failed to parse streamed file: %v", i, err)
+		}
+		err = parsedMar.VerifySignature(s.publicKey)
+		if err != nil {
+			t.Fatalf("signer %d failed to verify streamed signature: %v", i, err)
+		}
+		// rsa pkcs1.5 signatures are deterministic, so the streamed
+		// file must be identical to the buffered one
+		if s.defaultSigAlg == margo.SigAlgRsaPkcs1Sha384 {
+			signedMAR, err := s.SignFile(miniMarB, nil)
+			if err != nil {
+				t.Fatalf("signer %d failed to sign file: %v", i, err)
+			}
+			if !bytes.Equal(signedMAR, output.Bytes()) {
+				t.Fatalf("signer %d streamed file does not match signed file", i)
+			}
+		}
+	}
+}
+
+func TestSignFileStreamErrs(t *testing.T) {
+	s, err := New(marsignerconfs[0])
+	if err != nil {
+		t.Fatalf("failed to initialize signer: %v", err)
+	}
+	badMarID := append([]byte("MAR2"), miniMarB[4:]...)
+	badFileSize := append([]byte{}, miniMarB...)
+	badFileSize[15]++
+	var testcases = []struct {
+		input  []byte
+		size   int64
+		errStr string
+	}{
+		{miniMarB[:20], 20, "the total file is below the minimum allowed"},
+		{badMarID, int64(len(badMarID)), "mar ID must be MAR1"},
+		{badFileSize, int64(len(badFileSize)), "the total file size does not match offset + index size"},
+		{miniMarB[:len(miniMarB)/2], int64(len(miniMarB)), "failed to parse input file"},
+	}
+	for i, testcase := range testcases {
+		var output bytes.Buffer
+		err = s.SignFileStream(io.NewSectionReader(bytes.NewReader(testcase.input), 0, testcase.size), &output, nil)
+		if err == nil {
+			t.Fatalf("testcase %d expected to fail but succeeded", i)
+		}
+		if !strings.Contains(err.Error(), testcase.errStr) {
+			t.Fatalf("testcase %d expected error %q but got %v", i, testcase.errStr, err)
+		}
+		if output.Len() != 0 {
+			t.Fatalf("testcase %d wrote %d bytes to output on failure", i, output.Len())
+		}
+	}
+}
+
 func TestSignData(t *testing.T) {
 	for i, marsignerconf := range marsignerconfs {
 		s, err := New(marsignerconf)
@@ -72,6 +152,19 @@ func TestSignData(t *testing.T) {
 	}
 }
 
+func TestTestSigner(t *testing.T) {
+	for i, marsignerconf := range marsignerconfs {
+		s, err := New(marsignerconf)
+		if err != nil {
+			t.Fatalf("failed to initialize signer %d: %v", i, err)
+		}
+		err = signer.TestSigner(s)
+		if err != nil {
+			t.Fatalf("signer %d %q test failed: %v", i, s.ID, err)
+		}
+	}
+}
+
 func TestSignHash(t *testing.T) {
 	for i, marsignerconf := range marsignerconfs {
 		s, err := New(marsignerconf)
@@ -99,6 +192,10 @@ func TestSignHash(t *testing.T) {
 		if err != nil {
 			t.Fatalf("failed to verify signature: %v", err)
 		}
+		_, err = s.SignHash(digest[1:], Options{SigAlg: s.defaultSigAlg})
+		if err == nil || !strings.HasPrefix(err.Error(), "mar: refusing to sign input hash") {
+			t.Fatalf("expected to fail signing a hash of the wrong length but got: %v", err)
+		}
 	}
 }
 
@@ -117,6 +214,55 @@ func TestSignDataWithBadSigAlg(t *testing.T) {
 	}
 }
 
+func TestVerifyMARSignatureResponse(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	for i, marsignerconf := range marsignerconfs {
+		s, err := New(marsignerconf)
+		if err != nil {
+			t.Fatalf("failed to initialize signer %d: %v", i, err)
+		}
+		sig, err := s.SignData(input, s.GetDefaultOptions())
+		if err != nil {
+			t.Fatalf("signer %d %q failed to sign data: %v", i, s.ID, err)
+		}
+		sigstr, err := sig.Marshal()
+		if err != nil {
+			t.Fatalf("signer %d %q failed to marshal signature: %v", i, s.ID, err)
+		}
+		sr := formats.SignatureResponse{
+			Type:      s.Type,
+			PublicKey: s.PublicKey,
+			Signature: sigstr,
+		}
+		err = VerifyMARSignatureResponse(input, sr)
+		if err != nil {
+			t.Fatalf("signer %d %q signature response does not verify: %v", i, s.ID, err)
+		}
+		err = VerifyMARSignatureResponse([]byte("some other input"), sr)
+		if err == nil {
+			t.Fatalf("signer %d %q signature response verified on another input", i, s.ID)
+		}
+		if s.defaultSigAlg != margo.SigAlgRsaPkcs1Sha384 {
+			continue
+		}
+		// the monitor sets the options of the responses of option variants
+		sig, err = s.SignData(input, Options{SigAlg: margo.SigAlgRsaPkcs1Sha1})
+		if err != nil {
+			t.Fatalf("signer %d %q failed to sign data with SHA1: %v", i, s.ID, err)
+		}
+		sr.Signature, _ = sig.Marshal()
+		err = VerifyMARSignatureResponse(input, sr)
+		if err == nil {
+			t.Fatalf("signer %d %q SHA1 signature response verified with the default algorithm", i, s.ID)
+		}
+		sr.Options = map[string]interface{}{"sigalg": margo.SigAlgRsaPkcs1Sha1}
+		err = VerifyMARSignatureResponse(input, sr)
+		if err != nil {
+			t.Fatalf("signer %d %q SHA1 signature response with options does not verify: %v", i, s.ID, err)
+		}
+	}
+}
+
 func TestUnsupportedP521Curve(t *testing.T) {
 	_, err := New(signer.Configuration{
 		ID:   "p521marsigner",
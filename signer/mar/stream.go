@@ -0,0 +1,363 @@
+package mar
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/mozilla-services/autograph/signer"
+	margo "go.mozilla.org/mar"
+)
+
+// limits enforced when parsing MAR files for streaming, they match the
+// limits of the go.mozilla.org/mar parser used by SignFile
+const (
+	limitMinFileSize           = margo.MarIDLen + margo.OffsetToIndexLen + margo.FileSizeLen + margo.IndexHeaderLen + margo.IndexEntryHeaderLen
+	limitMaxFileSize           = 524288000
+	limitFileNameLength        = 1024
+	limitMaxSignatureSize      = 2048
+	limitMaxAdditionalDataSize = 10485760
+
+	// limitMaxIndexSize bounds the memory used to hold the index,
+	// which is the only part of a MAR that scales with the number
+	// of files and is held in memory for streaming
+	limitMaxIndexSize = 10485760
+)
+
+// streamLayout holds the parts of a MAR file that are kept in memory
+// when streaming, everything but the signatures and content
+type streamLayout struct {
+	additionalSections []margo.AdditionalSection
+	index              []margo.IndexEntry
+}
+
+// sectionReader reads consecutive sections of a MAR file
+type sectionReader struct {
+	input  io.ReaderAt
+	size   int64
+	cursor int64
+}
+
+// read returns the next n bytes of the input and advances the cursor
+func (r *sectionReader) read(n int64) ([]byte, error) {
+	if n < 0 || r.cursor+n > r.size {
+		return nil, fmt.Errorf("refusing to read more bytes than present in input")
+	}
+	buf := make([]byte, n)
+	_, err := r.input.ReadAt(buf, r.cursor)
+	if err != nil {
+		return nil, err
+	}
+	r.cursor += n
+	return buf, nil
+}
+
+// readUint32 returns the next big endian uint32 of the input
+func (r *sectionReader) readUint32() (uint32, error) {
+	buf, err := r.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf), nil
+}
+
+// parseStreamLayout parses the headers, additional sections and
+// index of a MAR file of the given size, with the same checks as
+// go.mozilla.org/mar Unmarshal, without reading the content
+func parseStreamLayout(input io.ReaderAt, size int64) (*streamLayout, error) {
+	switch {
+	case size < limitMinFileSize:
+		return nil, fmt.Errorf("the total file is below the minimum allowed of %d bytes", limitMinFileSize)
+	case size > limitMaxFileSize:
+		return nil, fmt.Errorf("the total file exceeds the maximum allowed of 500MB")
+	}
+	r := &sectionReader{input: input, size: size}
+	marid, err := r.read(margo.MarIDLen)
+	if err != nil {
+		return nil, fmt.Errorf("mar id parsing failed: %w", err)
+	}
+	if string(marid) != "MAR1" {
+		return nil, fmt.Errorf("mar ID must be MAR1")
+	}
+	offsetToIndex, err := r.readUint32()
+	if err != nil {
+		return nil, fmt.Errorf("offset parsing failed: %w", err)
+	}
+
+	// parse the index
+	if int64(offsetToIndex) > size || size-int64(offsetToIndex) > limitMaxIndexSize {
+		return nil, fmt.Errorf("the index exceeds the maximum allowed of %d bytes", limitMaxIndexSize)
+	}
+	r.cursor = int64(offsetToIndex)
+	indexSize, err := r.readUint32()
+	if err != nil {
+		return nil, fmt.Errorf("index header parsing failed: %w", err)
+	}
+	if indexSize < margo.IndexEntryHeaderLen {
+		return nil, fmt.Errorf("the index is smaller than the minimum allowed length of 12 bytes")
+	}
+	rawIndex, err := r.read(size - r.cursor)
+	if err != nil {
+		return nil, fmt.Errorf("index parsing failed: %w", err)
+	}
+	layout := new(streamLayout)
+	fileNames := make(map[string]bool)
+	for len(rawIndex) > 0 {
+		if len(rawIndex) < margo.IndexEntryHeaderLen {
+			return nil, fmt.Errorf("index entry parsing failed: refusing to read more bytes than present in input")
+		}
+		var idxEntry margo.IndexEntry
+		idxEntry.OffsetToContent = binary.BigEndian.Uint32(rawIndex[0:4])
+		idxEntry.Size = binary.BigEndian.Uint32(rawIndex[4:8])
+		idxEntry.Flags = binary.BigEndian.Uint32(rawIndex[8:12])
+		rawIndex = rawIndex[margo.IndexEntryHeaderLen:]
+		if uint64(idxEntry.OffsetToContent)+uint64(idxEntry.Size) > uint64(size) {
+			return nil, fmt.Errorf("malformed content offset and size overrun the end of the file")
+		}
+		endNamePos := bytes.IndexByte(rawIndex, 0)
+		if endNamePos < 0 {
+			return nil, fmt.Errorf("malformed index is missing null terminator in file name")
+		}
+		if endNamePos > limitFileNameLength {
+			return nil, fmt.Errorf("index file name exceeds the maximum length of 1024 characters")
+		}
+		idxEntry.FileName = string(rawIndex[:endNamePos])
+		rawIndex = rawIndex[endNamePos+1:]
+		if fileNames[idxEntry.FileName] {
+			return nil, fmt.Errorf("file named %q already exists in the archive, duplicates are not permitted", idxEntry.FileName)
+		}
+		fileNames[idxEntry.FileName] = true
+		layout.index = append(layout.index, idxEntry)
+	}
+	if len(layout.index) < 1 {
+		return nil, fmt.Errorf("the index is smaller than the minimum allowed length of 12 bytes")
+	}
+	// old MARs have their content right after the header and no
+	// signatures or additional sections
+	if layout.index[0].OffsetToContent == margo.MarIDLen+margo.OffsetToIndexLen {
+		return layout, nil
+	}
+
+	// parse the total file size, signatures and additional sections
+	r.cursor = margo.MarIDLen + margo.OffsetToIndexLen
+	rawFileSize, err := r.read(margo.FileSizeLen)
+	if err != nil {
+		return nil, fmt.Errorf("total file size header parsing failed: %w", err)
+	}
+	if binary.BigEndian.Uint64(rawFileSize) != uint64(offsetToIndex)+uint64(indexSize)+margo.IndexHeaderLen {
+		return nil, fmt.Errorf("the total file size does not match offset + index size")
+	}
+	numSignatures, err := r.readUint32()
+	if err != nil {
+		return nil, fmt.Errorf("signatures header parsing failed: %w", err)
+	}
+	for i := uint32(0); i < numSignatures; i++ {
+		algorithmID, err := r.readUint32()
+		if err != nil {
+			return nil, fmt.Errorf("signature entry header parsing failed: %w", err)
+		}
+		sigSize, err := r.readUint32()
+		if err != nil {
+			return nil, fmt.Errorf("signature entry header parsing failed: %w", err)
+		}
+		if sigSize > limitMaxSignatureSize {
+			return nil, fmt.Errorf("signature exceeds maximum allowed of 2048 bytes")
+		}
+		switch algorithmID {
+		case margo.SigAlgRsaPkcs1Sha1, margo.SigAlgRsaPkcs1Sha384, margo.SigAlgEcdsaP256Sha256, margo.SigAlgEcdsaP384Sha384:
+		default:
+			return nil, fmt.Errorf("signature algorithm is unknown")
+		}
+		// existing signatures are dropped, skip their data
+		if r.cursor+int64(sigSize) > size {
+			return nil, fmt.Errorf("signature data parsing failed: refusing to read more bytes than present in input")
+		}
+		r.cursor += int64(sigSize)
+	}
+	numAdditionalSections, err := r.readUint32()
+	if err != nil {
+		return nil, fmt.Errorf("additional section header parsing failed: %w", err)
+	}
+	for i := uint32(0); i < numAdditionalSections; i++ {
+		var as margo.AdditionalSection
+		as.BlockSize, err = r.readUint32()
+		if err != nil {
+			return nil, fmt.Errorf("additional section entry header parsing failed: %w", err)
+		}
+		as.BlockID, err = r.readUint32()
+		if err != nil {
+			return nil, fmt.Errorf("additional section entry header parsing failed: %w", err)
+		}
+		if as.BlockSize > limitMaxAdditionalDataSize {
+			return nil, fmt.Errorf("additional data exceeds maximum allowed of 10MB")
+		}
+		if as.BlockSize < margo.AdditionalSectionsEntryHeaderLen {
+			return nil, fmt.Errorf("additional section block size %d is smaller than its header", as.BlockSize)
+		}
+		as.Data, err = r.read(int64(as.BlockSize - margo.AdditionalSectionsEntryHeaderLen))
+		if err != nil {
+			return nil, fmt.Errorf("additional section data parsing failed: %w", err)
+		}
+		layout.additionalSections = append(layout.additionalSections, as)
+	}
+	return layout, nil
+}
+
+// marshal returns the header and index of the signed MAR file with a
+// single signature of sigSize bytes, and the offsets to the content
+// of each index entry in the input. When sigData is nil, the header
+// is marshalled for signature and excludes the signature data.
+func (l *streamLayout) marshal(sigAlg, sigSize uint32, sigData []byte) (header, index []byte, err error) {
+	offsetToContent := uint64(margo.MarIDLen + margo.OffsetToIndexLen + margo.FileSizeLen + margo.SignaturesHeaderLen)
+	offsetToContent += uint64(margo.SignatureEntryHeaderLen + sigSize)
+	offsetToContent += margo.AdditionalSectionsHeaderLen
+	for _, as := range l.additionalSections {
+		offsetToContent += uint64(margo.AdditionalSectionsEntryHeaderLen + len(as.Data))
+	}
+
+	idxBuf := new(bytes.Buffer)
+	for _, idx := range l.index {
+		binary.Write(idxBuf, binary.BigEndian, uint32(offsetToContent))
+		binary.Write(idxBuf, binary.BigEndian, idx.Size)
+		binary.Write(idxBuf, binary.BigEndian, idx.Flags)
+		idxBuf.WriteString(idx.FileName)
+		idxBuf.WriteByte(0)
+		offsetToContent += uint64(idx.Size)
+	}
+	offsetToIndex := offsetToContent
+	fileSize := offsetToIndex + margo.IndexHeaderLen + uint64(idxBuf.Len())
+	if offsetToIndex < limitMinFileSize-margo.IndexHeaderLen {
+		return nil, nil, fmt.Errorf("offset to index is too small to be valid")
+	}
+	if fileSize > limitMaxFileSize {
+		return nil, nil, fmt.Errorf("the signed file exceeds the maximum allowed of 500MB")
+	}
+
+	headerBuf := new(bytes.Buffer)
+	headerBuf.WriteString("MAR1")
+	binary.Write(headerBuf, binary.BigEndian, uint32(offsetToIndex))
+	binary.Write(headerBuf, binary.BigEndian, fileSize)
+	binary.Write(headerBuf, binary.BigEndian, uint32(1))
+	binary.Write(headerBuf, binary.BigEndian, sigAlg)
+	binary.Write(headerBuf, binary.BigEndian, sigSize)
+	headerBuf.Write(sigData)
+	binary.Write(headerBuf, binary.BigEndian, uint32(len(l.additionalSections)))
+	for _, as := range l.additionalSections {
+		binary.Write(headerBuf, binary.BigEndian, uint32(margo.AdditionalSectionsEntryHeaderLen+len(as.Data)))
+		binary.Write(headerBuf, binary.BigEndian, as.BlockID)
+		headerBuf.Write(as.Data)
+	}
+
+	index = make([]byte, margo.IndexHeaderLen, margo.IndexHeaderLen+idxBuf.Len())
+	binary.BigEndian.PutUint32(index, uint32(idxBuf.Len()))
+	index = append(index, idxBuf.Bytes()...)
+	return headerBuf.Bytes(), index, nil
+}
+
+// writeTo writes the signed MAR file, header, content from the input
+// and index, to output
+func (l *streamLayout) writeTo(output io.Writer, input io.ReaderAt, header, index []byte) error {
+	_, err := output.Write(header)
+	if err != nil {
+		return err
+	}
+	for _, idx := range l.index {
+		_, err = io.Copy(output, io.NewSectionReader(input, int64(idx.OffsetToContent), int64(idx.Size)))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = output.Write(index)
+	return err
+}
+
+// newHash returns the hash used by a MAR signature algorithm
+func newHash(sigAlg uint32) (hash.Hash, error) {
+	switch sigAlg {
+	case margo.SigAlgRsaPkcs1Sha1:
+		return sha1.New(), nil
+	case margo.SigAlgEcdsaP256Sha256:
+		return sha256.New(), nil
+	case margo.SigAlgRsaPkcs1Sha384, margo.SigAlgEcdsaP384Sha384:
+		return sha512.New384(), nil
+	default:
+		return nil, fmt.Errorf("unsupported signature algorithm %d", sigAlg)
+	}
+}
+
+// signatureSize returns the size of the MAR signature made by the
+// signer key
+func (s *MARSigner) signatureSize() (uint32, error) {
+	switch pubKey := s.publicKey.(type) {
+	case *rsa.PublicKey:
+		return uint32(pubKey.Size()), nil
+	case *ecdsa.PublicKey:
+		return uint32(2 * ((pubKey.Params().BitSize + 7) / 8)), nil
+	default:
+		return 0, fmt.Errorf("unsupported public key type %T", s.publicKey)
+	}
+}
+
+// SignFileStream reads a MAR file from input, and writes the signed
+// MAR file to output. Only the headers and index of the file are held
+// in memory, the content is read twice: once to hash it and once to
+// copy it to output. Inputs without random access, unlike
+// *bytes.Reader or *io.SectionReader, are spooled to a temp file
+// first. The signed file is the same SignFile returns for the same
+// input.
+func (s *MARSigner) SignFileStream(input io.Reader, output io.Writer, options interface{}) error {
+	spooled, size, cleanup, err := signer.SpoolFileStream(input, limitMaxFileSize)
+	if err != nil {
+		return fmt.Errorf("mar: failed to read input file: %w", err)
+	}
+	defer cleanup()
+	return s.signReaderAt(spooled, size, output)
+}
+
+// signReaderAt signs a MAR file of size bytes read from input like
+// SignFileStream
+func (s *MARSigner) signReaderAt(input io.ReaderAt, size int64, output io.Writer) error {
+	layout, err := parseStreamLayout(input, size)
+	if err != nil {
+		return fmt.Errorf("mar: failed to parse input file: %w", err)
+	}
+	sigSize, err := s.signatureSize()
+	if err != nil {
+		return fmt.Errorf("mar: failed to prepare signature: %w", err)
+	}
+	header, index, err := layout.marshal(s.defaultSigAlg, sigSize, nil)
+	if err != nil {
+		return fmt.Errorf("mar: failed to marshal file for signature: %w", err)
+	}
+	h, err := newHash(s.defaultSigAlg)
+	if err != nil {
+		return fmt.Errorf("mar: failed to hash input: %w", err)
+	}
+	err = layout.writeTo(h, input, header, index)
+	if err != nil {
+		return fmt.Errorf("mar: failed to hash input: %w", err)
+	}
+	sigData, err := margo.Sign(s.signingKey, s.rand, h.Sum(nil), s.defaultSigAlg)
+	if err != nil {
+		return fmt.Errorf("mar: failed to sign: %w", err)
+	}
+	if uint32(len(sigData)) != sigSize {
+		return fmt.Errorf("mar: signature is %d bytes but %d were expected", len(sigData), sigSize)
+	}
+	header, index, err = layout.marshal(s.defaultSigAlg, sigSize, sigData)
+	if err != nil {
+		return fmt.Errorf("mar: failed to marshal signed file: %w", err)
+	}
+	err = layout.writeTo(output, input, header, index)
+	if err != nil {
+		return fmt.Errorf("mar: failed to write signed file: %w", err)
+	}
+	return nil
+}
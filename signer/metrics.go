@@ -0,0 +1,66 @@
+package signer
+
+import (
+	"sync"
+	"time"
+)
+
+// MetricsCollector observes the signing operations of signers, e.g.
+// to record latency histograms by signer ID and type
+type MetricsCollector interface {
+	// ObserveSign is called after a signing operation of a signer
+	// with its duration and its error or nil when it succeeded
+	ObserveSign(signerID, signerType string, d time.Duration, err error)
+}
+
+// noopMetricsCollector is the default MetricsCollector, it discards
+// the observations
+type noopMetricsCollector struct{}
+
+func (noopMetricsCollector) ObserveSign(signerID, signerType string, d time.Duration, err error) {}
+
+var (
+	// metricsCollectorMu protects metricsCollector
+	metricsCollectorMu sync.RWMutex
+	metricsCollector   MetricsCollector = noopMetricsCollector{}
+)
+
+// SetMetricsCollector sets the collector signing operations are
+// reported to, a nil collector restores the no-op default
+func SetMetricsCollector(collector MetricsCollector) {
+	if collector == nil {
+		collector = noopMetricsCollector{}
+	}
+	metricsCollectorMu.Lock()
+	defer metricsCollectorMu.Unlock()
+	metricsCollector = collector
+}
+
+// ObserveSign reports a signing operation of a signer that started at
+// start and returned err to the metrics collector
+func ObserveSign(conf Configuration, start time.Time, err error) {
+	metricsCollectorMu.RLock()
+	collector := metricsCollector
+	metricsCollectorMu.RUnlock()
+	collector.ObserveSign(conf.ID, conf.Type, time.Since(start), err)
+}
+
+// MonitorMetricsCollector is the optional interface of collectors
+// that also observe the checks of the signers by the monitor
+type MonitorMetricsCollector interface {
+	// ObserveMonitorCheck is called after the monitor checked a
+	// signer with its duration and its error or nil when it passed
+	ObserveMonitorCheck(signerID, signerType string, d time.Duration, err error)
+}
+
+// ObserveMonitorCheck reports a monitor check of a signer that started
+// at start and returned err to the metrics collector, when it observes
+// monitor checks
+func ObserveMonitorCheck(conf Configuration, start time.Time, err error) {
+	metricsCollectorMu.RLock()
+	collector := metricsCollector
+	metricsCollectorMu.RUnlock()
+	if monitorCollector, ok := collector.(MonitorMetricsCollector); ok {
+		monitorCollector.ObserveMonitorCheck(conf.ID, conf.Type, time.Since(start), err)
+	}
+}
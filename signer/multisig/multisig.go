@@ -0,0 +1,280 @@
+package multisig // import "github.com/mozilla-services/autograph/signer/multisig"
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/mozilla-services/autograph/formats"
+	"github.com/mozilla-services/autograph/signer"
+	"github.com/mozilla-services/autograph/signer/contentsignature"
+	"github.com/mozilla-services/autograph/signer/genericrsa"
+	verifier "github.com/mozilla-services/autograph/verifier/contentsignature"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Type of this signer is "multisig", a signer that signs data
+	// with each of its member signers and returns their signatures
+	// together with a threshold
+	Type = "multisig"
+)
+
+// memberTypes are the types of signers that can be members of a
+// multisig signer, Verify must be able to verify their signatures
+var memberTypes = map[string]bool{
+	contentsignature.Type: true,
+	genericrsa.Type:       true,
+}
+
+// MultiSigner holds the configuration of the signer
+type MultiSigner struct {
+	signer.Configuration
+
+	// members are the initialized member signers in the order
+	// of their configuration, they all implement signer.DataSigner
+	members []signer.Signer
+}
+
+// New initializes a multisig signer using a configuration. newMember
+// initializes each of the configured member signers.
+func New(conf signer.Configuration, newMember func(signer.Configuration) (signer.Signer, error)) (s *MultiSigner, err error) {
+	s = new(MultiSigner)
+
+	if conf.Type != Type {
+		return nil, fmt.Errorf("multisig: invalid type %q, must be %q", conf.Type, Type)
+	}
+	s.Type = conf.Type
+
+	if conf.ID == "" {
+		return nil, fmt.Errorf("multisig: missing signer ID in signer configuration")
+	}
+	s.ID = conf.ID
+
+	if len(conf.Members) < 2 {
+		return nil, fmt.Errorf("multisig %q: must have at least 2 members, got %d", s.ID, len(conf.Members))
+	}
+	if conf.Threshold < 1 || conf.Threshold > len(conf.Members) {
+		return nil, fmt.Errorf("multisig %q: threshold must be between 1 and the number of members %d, got %d",
+			s.ID, len(conf.Members), conf.Threshold)
+	}
+	s.Threshold = conf.Threshold
+
+	memberIDs := make(map[string]bool)
+	publicKeys := make(map[string]bool)
+	for i, memberConf := range conf.Members {
+		if !memberTypes[memberConf.Type] {
+			return nil, fmt.Errorf("multisig %q: member %d has unsupported type %q", s.ID, i, memberConf.Type)
+		}
+		if memberIDs[memberConf.ID] {
+			return nil, fmt.Errorf("multisig %q: duplicate member ID %q", s.ID, memberConf.ID)
+		}
+		memberIDs[memberConf.ID] = true
+
+		member, err := newMember(memberConf)
+		if err != nil {
+			return nil, fmt.Errorf("multisig %q: failed to initialize member %q: %w", s.ID, memberConf.ID, err)
+		}
+		if _, ok := member.(signer.DataSigner); !ok {
+			return nil, fmt.Errorf("multisig %q: member %q does not implement data signing", s.ID, memberConf.ID)
+		}
+		// dual control requires the members to sign with distinct keys
+		publicKey := member.Config().PublicKey
+		if publicKey == "" {
+			return nil, fmt.Errorf("multisig %q: member %q has no public key", s.ID, memberConf.ID)
+		}
+		if publicKeys[publicKey] {
+			return nil, fmt.Errorf("multisig %q: member %q has the same public key as another member", s.ID, memberConf.ID)
+		}
+		publicKeys[publicKey] = true
+		s.members = append(s.members, member)
+	}
+	return
+}
+
+// Config returns the configuration of the current signer
+func (s *MultiSigner) Config() signer.Configuration {
+	conf := signer.Configuration{
+		ID:        s.ID,
+		Type:      s.Type,
+		Threshold: s.Threshold,
+	}
+	for _, member := range s.members {
+		conf.Members = append(conf.Members, member.Config())
+	}
+	return conf
+}
+
+// SignData signs the data with each member and returns their
+// signatures. Members that fail to sign are left out of the
+// signature, it errors when fewer members than the threshold sign.
+func (s *MultiSigner) SignData(data []byte, options interface{}) (signer.Signature, error) {
+	sig := &Signature{Threshold: s.Threshold}
+	for _, member := range s.members {
+		memberConf := member.Config()
+		memberSig, err := member.(signer.DataSigner).SignData(data, options)
+		if err != nil {
+			signer.Log(s.Configuration, "sign").Errorf("multisig: member %q failed to sign: %v", memberConf.ID, err)
+			continue
+		}
+		marshalled, err := memberSig.Marshal()
+		if err != nil {
+			signer.Log(s.Configuration, "sign").Errorf("multisig: failed to marshal signature of member %q: %v", memberConf.ID, err)
+			continue
+		}
+		signerOpts := memberConf.SignerOpts
+		if optsSig, ok := memberSig.(signer.SignerOptsSignature); ok {
+			signerOpts = optsSig.SignerOpts()
+		}
+		sig.Signatures = append(sig.Signatures, MemberSignature{
+			SignerID:   memberConf.ID,
+			Type:       memberConf.Type,
+			Mode:       memberConf.Mode,
+			PublicKey:  memberConf.PublicKey,
+			SignerOpts: signerOpts,
+			Signature:  marshalled,
+		})
+	}
+	if len(sig.Signatures) < s.Threshold {
+		return nil, fmt.Errorf("multisig %q: %d of %d members signed, below the threshold of %d",
+			s.ID, len(sig.Signatures), len(s.members), s.Threshold)
+	}
+	return sig, nil
+}
+
+// VerifyData checks that at least the threshold of member signatures
+// verify the data with the public keys of the members
+func (s *MultiSigner) VerifyData(data []byte, sig signer.Signature) error {
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		return fmt.Errorf("multisig %q: failed to marshal signature: %w", s.ID, err)
+	}
+	var trustedKeys []string
+	for _, member := range s.members {
+		trustedKeys = append(trustedKeys, member.Config().PublicKey)
+	}
+	return Verify(data, sigstr, s.Threshold, trustedKeys)
+}
+
+// GetDefaultOptions returns default options of the signer
+func (s *MultiSigner) GetDefaultOptions() interface{} {
+	return nil
+}
+
+// MemberSignature is the signature of a member signer
+type MemberSignature struct {
+	SignerID   string      `json:"signer_id"`
+	Type       string      `json:"type"`
+	Mode       string      `json:"mode"`
+	PublicKey  string      `json:"public_key"`
+	SignerOpts interface{} `json:"signer_opts,omitempty"`
+	Signature  string      `json:"signature"`
+}
+
+// Signature contains the member signatures of a multisig signature
+// and the number of them required to verify it
+type Signature struct {
+	Threshold  int               `json:"threshold"`
+	Signatures []MemberSignature `json:"signatures"`
+}
+
+// Marshal returns the base64 representation of the JSON encoded
+// signature
+func (sig *Signature) Marshal() (string, error) {
+	buf, err := json.Marshal(sig)
+	if err != nil {
+		return "", fmt.Errorf("multisig: failed to marshal signature: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+// Unmarshal decodes a base64 multisig signature string into a
+// Signature
+func Unmarshal(sigstr string) (*Signature, error) {
+	buf, err := base64.StdEncoding.DecodeString(sigstr)
+	if err != nil {
+		return nil, fmt.Errorf("multisig: failed to base64 decode signature: %w", err)
+	}
+	sig := new(Signature)
+	err = json.Unmarshal(buf, sig)
+	if err != nil {
+		return nil, fmt.Errorf("multisig: failed to unmarshal signature: %w", err)
+	}
+	return sig, nil
+}
+
+// Verify checks that at least threshold member signatures from
+// distinct trusted public keys verify the input. trustedKeys are the
+// base64 DER encoded public keys of the members, as returned in the
+// public_key field of their signature responses. The threshold of the
+// signature itself is informative, verifiers pick their own.
+func Verify(input []byte, sigstr string, threshold int, trustedKeys []string) error {
+	if threshold < 1 {
+		return fmt.Errorf("multisig: threshold must be at least 1, got %d", threshold)
+	}
+	sig, err := Unmarshal(sigstr)
+	if err != nil {
+		return err
+	}
+	trusted := make(map[string]bool)
+	for _, key := range trustedKeys {
+		trusted[key] = true
+	}
+	verifiedKeys := make(map[string]bool)
+	for _, memberSig := range sig.Signatures {
+		if !trusted[memberSig.PublicKey] || verifiedKeys[memberSig.PublicKey] {
+			continue
+		}
+		err = VerifyMember(input, memberSig)
+		if err != nil {
+			log.Debugf("multisig: signature of member %q does not verify: %v", memberSig.SignerID, err)
+			continue
+		}
+		verifiedKeys[memberSig.PublicKey] = true
+	}
+	if len(verifiedKeys) < threshold {
+		return fmt.Errorf("multisig: %d member signatures from trusted keys verify, below the threshold of %d",
+			len(verifiedKeys), threshold)
+	}
+	return nil
+}
+
+// VerifyMember verifies the signature of a member signer on the input
+func VerifyMember(input []byte, memberSig MemberSignature) error {
+	switch memberSig.Type {
+	case contentsignature.Type:
+		keyBytes, err := base64.StdEncoding.DecodeString(memberSig.PublicKey)
+		if err != nil {
+			return fmt.Errorf("multisig: failed to decode public key: %w", err)
+		}
+		keyInterface, err := x509.ParsePKIXPublicKey(keyBytes)
+		if err != nil {
+			return fmt.Errorf("multisig: failed to parse pkix public key: %w", err)
+		}
+		pubKey, ok := keyInterface.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("multisig: invalid public key type %T for content signature, must be ecdsa", keyInterface)
+		}
+		sig, err := verifier.Unmarshal(memberSig.Signature)
+		if err != nil {
+			return fmt.Errorf("multisig: failed to unmarshal content signature: %w", err)
+		}
+		if !sig.VerifyData(input, pubKey) {
+			return fmt.Errorf("multisig: content signature verification failed")
+		}
+		return nil
+	case genericrsa.Type:
+		return genericrsa.VerifyGenericRsaSignatureResponse(input, formats.SignatureResponse{
+			Type:       memberSig.Type,
+			Mode:       memberSig.Mode,
+			PublicKey:  memberSig.PublicKey,
+			SignerOpts: memberSig.SignerOpts,
+			Signature:  memberSig.Signature,
+		})
+	default:
+		return fmt.Errorf("multisig: cannot verify signature of member type %q", memberSig.Type)
+	}
+}
@@ -0,0 +1,237 @@
+package multisig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"testing"
+
+	"github.com/mozilla-services/autograph/signer"
+	"github.com/mozilla-services/autograph/signer/contentsignature"
+	"github.com/mozilla-services/autograph/signer/genericrsa"
+)
+
+var input = []byte("foobarbaz1234abcd")
+
+func mustECDSAKeyPEM() string {
+	priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	der, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		panic(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
+
+func mustRSAKeyPEM() string {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}))
+}
+
+var (
+	ecdsaKey1 = mustECDSAKeyPEM()
+	ecdsaKey2 = mustECDSAKeyPEM()
+	rsaKey    = mustRSAKeyPEM()
+)
+
+func testMembers() []signer.Configuration {
+	return []signer.Configuration{
+		{ID: "member1", Type: contentsignature.Type, PrivateKey: ecdsaKey1},
+		{ID: "member2", Type: contentsignature.Type, PrivateKey: ecdsaKey2},
+		{ID: "member3", Type: genericrsa.Type, Mode: genericrsa.ModePSS, Hash: "sha256", PrivateKey: rsaKey, PublicKey: "unused"},
+	}
+}
+
+// newTestMember initializes the member signers of the tests
+func newTestMember(conf signer.Configuration) (signer.Signer, error) {
+	switch conf.Type {
+	case contentsignature.Type:
+		return contentsignature.New(conf)
+	case genericrsa.Type:
+		return genericrsa.New(conf)
+	}
+	return nil, fmt.Errorf("unknown member type %q", conf.Type)
+}
+
+// failingMember is a member signer that fails to sign
+type failingMember struct {
+	signer.Configuration
+}
+
+func (m *failingMember) Config() signer.Configuration {
+	return m.Configuration
+}
+
+func (m *failingMember) SignData(data []byte, options interface{}) (signer.Signature, error) {
+	return nil, fmt.Errorf("hsm unavailable")
+}
+
+func (m *failingMember) GetDefaultOptions() interface{} {
+	return nil
+}
+
+func TestSignAndVerify(t *testing.T) {
+	s, err := New(signer.Configuration{ID: "testmultisig", Type: Type, Threshold: 2, Members: testMembers()}, newTestMember)
+	if err != nil {
+		t.Fatalf("failed to initialize signer: %v", err)
+	}
+	conf := s.Config()
+	if conf.Threshold != 2 || len(conf.Members) != 3 {
+		t.Fatalf("unexpected signer config threshold %d and %d members", conf.Threshold, len(conf.Members))
+	}
+	var trustedKeys []string
+	for _, member := range conf.Members {
+		trustedKeys = append(trustedKeys, member.PublicKey)
+	}
+
+	sig, err := s.SignData(input, s.GetDefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	parsed, err := Unmarshal(sigstr)
+	if err != nil {
+		t.Fatalf("failed to unmarshal signature: %v", err)
+	}
+	if parsed.Threshold != 2 || len(parsed.Signatures) != 3 {
+		t.Fatalf("expected signature with threshold 2 and 3 members but got threshold %d and %d members",
+			parsed.Threshold, len(parsed.Signatures))
+	}
+	for i, memberSig := range parsed.Signatures {
+		err = VerifyMember(input, memberSig)
+		if err != nil {
+			t.Fatalf("failed to verify signature of member %d: %v", i, err)
+		}
+	}
+
+	err = Verify(input, sigstr, 3, trustedKeys)
+	if err != nil {
+		t.Fatalf("failed to verify signature: %v", err)
+	}
+
+	var TESTCASES = []struct {
+		desc        string
+		input       []byte
+		threshold   int
+		trustedKeys []string
+	}{
+		{"threshold above the number of members", input, 4, trustedKeys},
+		{"not enough trusted keys", input, 2, trustedKeys[:1]},
+		{"no trusted keys", input, 1, nil},
+		{"other input", []byte("some other input"), 1, trustedKeys},
+		{"invalid threshold", input, 0, trustedKeys},
+	}
+	for _, testcase := range TESTCASES {
+		err = Verify(testcase.input, sigstr, testcase.threshold, testcase.trustedKeys)
+		if err == nil {
+			t.Fatalf("expected verification with %s to fail but it succeeded", testcase.desc)
+		}
+	}
+}
+
+func TestTestSigner(t *testing.T) {
+	s, err := New(signer.Configuration{ID: "testmultisig", Type: Type, Threshold: 2, Members: testMembers()}, newTestMember)
+	if err != nil {
+		t.Fatalf("failed to initialize signer: %v", err)
+	}
+	err = signer.TestSigner(s)
+	if err != nil {
+		t.Fatalf("signer test failed: %v", err)
+	}
+}
+
+func TestVerifyCountsDistinctKeys(t *testing.T) {
+	s, err := New(signer.Configuration{ID: "testmultisig", Type: Type, Threshold: 2, Members: testMembers()}, newTestMember)
+	if err != nil {
+		t.Fatalf("failed to initialize signer: %v", err)
+	}
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	// repeat the signature of the first member
+	memberSig := sig.(*Signature).Signatures[0]
+	repeated := &Signature{Threshold: 2, Signatures: []MemberSignature{memberSig, memberSig}}
+	sigstr, err := repeated.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Verify(input, sigstr, 2, []string{memberSig.PublicKey})
+	if err == nil {
+		t.Fatalf("expected signatures from the same key to count once but verification succeeded")
+	}
+}
+
+func TestSignBelowThreshold(t *testing.T) {
+	newMember := func(conf signer.Configuration) (signer.Signer, error) {
+		if conf.ID == "member3" {
+			conf.PublicKey = "failing"
+			return &failingMember{conf}, nil
+		}
+		return newTestMember(conf)
+	}
+	s, err := New(signer.Configuration{ID: "testmultisig", Type: Type, Threshold: 2, Members: testMembers()}, newMember)
+	if err != nil {
+		t.Fatalf("failed to initialize signer: %v", err)
+	}
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("expected signing with 2 of 3 members to succeed but got: %v", err)
+	}
+	if len(sig.(*Signature).Signatures) != 2 {
+		t.Fatalf("expected 2 member signatures but got %d", len(sig.(*Signature).Signatures))
+	}
+
+	s, err = New(signer.Configuration{ID: "testmultisig", Type: Type, Threshold: 3, Members: testMembers()}, newMember)
+	if err != nil {
+		t.Fatalf("failed to initialize signer: %v", err)
+	}
+	_, err = s.SignData(input, nil)
+	if err == nil {
+		t.Fatalf("expected signing with 2 members below the threshold of 3 to fail but it succeeded")
+	}
+}
+
+func TestNewErrs(t *testing.T) {
+	duplicateID := testMembers()
+	duplicateID[1].ID = duplicateID[0].ID
+	duplicateKey := testMembers()
+	duplicateKey[1].PrivateKey = duplicateKey[0].PrivateKey
+	unsupportedType := testMembers()
+	unsupportedType[0].Type = Type
+	invalidMember := testMembers()
+	invalidMember[0].PrivateKey = ""
+
+	var TESTCASES = []struct {
+		desc string
+		conf signer.Configuration
+	}{
+		{"invalid type", signer.Configuration{ID: "testmultisig", Type: "foo", Threshold: 2, Members: testMembers()}},
+		{"missing ID", signer.Configuration{Type: Type, Threshold: 2, Members: testMembers()}},
+		{"single member", signer.Configuration{ID: "testmultisig", Type: Type, Threshold: 1, Members: testMembers()[:1]}},
+		{"zero threshold", signer.Configuration{ID: "testmultisig", Type: Type, Members: testMembers()}},
+		{"threshold above members", signer.Configuration{ID: "testmultisig", Type: Type, Threshold: 4, Members: testMembers()}},
+		{"duplicate member ID", signer.Configuration{ID: "testmultisig", Type: Type, Threshold: 2, Members: duplicateID}},
+		{"duplicate member key", signer.Configuration{ID: "testmultisig", Type: Type, Threshold: 2, Members: duplicateKey}},
+		{"unsupported member type", signer.Configuration{ID: "testmultisig", Type: Type, Threshold: 2, Members: unsupportedType}},
+		{"invalid member", signer.Configuration{ID: "testmultisig", Type: Type, Threshold: 2, Members: invalidMember}},
+	}
+	for _, testcase := range TESTCASES {
+		_, err := New(testcase.conf, newTestMember)
+		if err == nil {
+			t.Fatalf("expected signer with %s to fail but it succeeded", testcase.desc)
+		}
+	}
+}
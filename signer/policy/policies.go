@@ -0,0 +1,158 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/autograph/signer"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// LogType is a policy that logs each signing operation
+	LogType = "log"
+
+	// RequireOptionType is a policy that refuses signing operations
+	// without a non-empty value for a signing request option, e.g.
+	// an audit identifier
+	RequireOptionType = "requireoption"
+
+	// RateLimitType is a policy that refuses signing operations
+	// above a rate
+	RateLimitType = "ratelimit"
+)
+
+// logPolicy logs signing operations once they return
+type logPolicy struct {
+	level log.Level
+}
+
+func newLogPolicy(conf signer.PolicyConfiguration) (*logPolicy, error) {
+	p := &logPolicy{level: log.InfoLevel}
+	if conf.Level != "" {
+		var err error
+		p.level, err = log.ParseLevel(conf.Level)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log policy level: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// Before does nothing, operations are logged once they return
+func (p *logPolicy) Before(op *Operation) error {
+	return nil
+}
+
+// After logs the signing operation and its error if any
+func (p *logPolicy) After(op *Operation, err error) {
+	entry := log.WithFields(log.Fields{
+		"signer_id":  op.SignerID,
+		"method":     op.Method,
+		"options":    op.Options,
+		"input_size": op.InputSize,
+		"t":          int32(time.Since(op.Start) / time.Millisecond),
+	})
+	if err != nil {
+		entry.WithField("error", err.Error()).Log(p.level, "policy: signing operation failed")
+		return
+	}
+	entry.Log(p.level, "policy: signing operation succeeded")
+}
+
+// requireOptionPolicy refuses signing operations without a value for
+// a signing request option
+type requireOptionPolicy struct {
+	option string
+}
+
+func newRequireOptionPolicy(conf signer.PolicyConfiguration) (*requireOptionPolicy, error) {
+	if conf.Option == "" {
+		return nil, fmt.Errorf("missing option name for requireoption policy")
+	}
+	return &requireOptionPolicy{option: conf.Option}, nil
+}
+
+// Before returns an error when the required option is missing, null
+// or an empty string
+func (p *requireOptionPolicy) Before(op *Operation) error {
+	// options are decoded from the JSON request, round trip them
+	// to read them as a map regardless of their go type
+	buf, err := json.Marshal(op.Options)
+	if err != nil {
+		return fmt.Errorf("%w: failed to read options: %v", ErrDenied, err)
+	}
+	var options map[string]interface{}
+	err = json.Unmarshal(buf, &options)
+	if err != nil {
+		return fmt.Errorf("%w: options are not an object", ErrDenied)
+	}
+	value, ok := options[p.option]
+	if !ok || value == nil || value == "" {
+		return fmt.Errorf("%w: missing required option %q", ErrDenied, p.option)
+	}
+	return nil
+}
+
+// After does nothing
+func (p *requireOptionPolicy) After(op *Operation, err error) {}
+
+// rateLimitPolicy refuses signing operations above a rate with a
+// token bucket
+type rateLimitPolicy struct {
+	sync.Mutex
+
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	// now returns the current time, it is time.Now outside of tests
+	now func() time.Time
+}
+
+func newRateLimitPolicy(conf signer.PolicyConfiguration) (*rateLimitPolicy, error) {
+	if conf.Rate <= 0 {
+		return nil, fmt.Errorf("ratelimit policy rate must be positive, got %g", conf.Rate)
+	}
+	burst := conf.Burst
+	if burst < 0 {
+		return nil, fmt.Errorf("ratelimit policy burst must not be negative, got %d", burst)
+	}
+	if burst == 0 {
+		burst = 1
+	}
+	p := &rateLimitPolicy{
+		rate:   conf.Rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		now:    time.Now,
+	}
+	p.last = p.now()
+	return p, nil
+}
+
+// Before takes a token from the bucket or returns an error when it is
+// empty
+func (p *rateLimitPolicy) Before(op *Operation) error {
+	p.Lock()
+	defer p.Unlock()
+
+	now := p.now()
+	p.tokens += now.Sub(p.last).Seconds() * p.rate
+	if p.tokens > p.burst {
+		p.tokens = p.burst
+	}
+	p.last = now
+	if p.tokens < 1 {
+		return fmt.Errorf("%w: signer %q allows %g operations per second", ErrRateLimited, op.SignerID, p.rate)
+	}
+	p.tokens--
+	return nil
+}
+
+// After does nothing
+func (p *rateLimitPolicy) After(op *Operation, err error) {}
@@ -0,0 +1,296 @@
+package policy // import "github.com/mozilla-services/autograph/signer/policy"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/mozilla-services/autograph/signer"
+)
+
+var (
+	// ErrDenied is wrapped by the errors of policies that refuse a
+	// signing operation
+	ErrDenied = errors.New("policy: signing operation denied")
+
+	// ErrRateLimited is wrapped by the errors of policies that
+	// refuse a signing operation because of its rate
+	ErrRateLimited = errors.New("policy: signing rate limit exceeded")
+)
+
+// Operation describes a signing operation of a wrapped signer
+type Operation struct {
+	// SignerID is the ID of the wrapped signer
+	SignerID string
+
+	// Method is the name of the signing method called e.g. "SignData"
+	Method string
+
+	// Options are the signing request options
+	Options interface{}
+
+	// InputSize is the size in bytes of the input to sign, -1 when
+	// a file stream of unknown size is signed
+	InputSize int
+
+	// Start is when the operation started
+	Start time.Time
+}
+
+// Policy is a decorator applied to the signing operations of a
+// wrapped signer
+type Policy interface {
+	// Before is called before the signing operation, the operation
+	// is refused when it returns an error
+	Before(op *Operation) error
+
+	// After is called with the error of the signing operation once
+	// it returns
+	After(op *Operation, err error)
+}
+
+// New returns the policy of a configuration
+func New(conf signer.PolicyConfiguration) (Policy, error) {
+	switch conf.Type {
+	case LogType:
+		return newLogPolicy(conf)
+	case RequireOptionType:
+		return newRequireOptionPolicy(conf)
+	case RateLimitType:
+		return newRateLimitPolicy(conf)
+	default:
+		return nil, fmt.Errorf("policy: unknown policy type %q", conf.Type)
+	}
+}
+
+// Configured returns the policies of a signer configuration: a
+// ratelimit policy first when it sets MaxSignaturesPerSecond, so
+// refused operations do not reach the other policies, followed by its
+// configured policies
+func Configured(conf signer.Configuration) ([]signer.PolicyConfiguration, error) {
+	if conf.MaxSignaturesPerSecond < 0 {
+		return nil, fmt.Errorf("policy: max signatures per second of signer %q must not be negative, got %g", conf.ID, conf.MaxSignaturesPerSecond)
+	}
+	if conf.MaxSignaturesPerSecond == 0 {
+		return conf.Policies, nil
+	}
+	// allow the signatures of a whole second at once
+	rateLimit := signer.PolicyConfiguration{
+		Type:  RateLimitType,
+		Rate:  conf.MaxSignaturesPerSecond,
+		Burst: int(math.Ceil(conf.MaxSignaturesPerSecond)),
+	}
+	return append([]signer.PolicyConfiguration{rateLimit}, conf.Policies...), nil
+}
+
+// Signer wraps a signer and applies policies to its signing
+// operations
+type Signer struct {
+	base     signer.Signer
+	policies []Policy
+}
+
+// Wrap returns the signer wrapped with the configured policies, or the
+// signer itself when no policy is configured
+func Wrap(base signer.Signer, confs []signer.PolicyConfiguration) (signer.Signer, error) {
+	if len(confs) == 0 {
+		return base, nil
+	}
+	s := &Signer{base: base}
+	for i, conf := range confs {
+		p, err := New(conf)
+		if err != nil {
+			return nil, fmt.Errorf("policy: failed to initialize policy %d of signer %q: %w", i, base.Config().ID, err)
+		}
+		s.policies = append(s.policies, p)
+	}
+	return s, nil
+}
+
+// Unwrap returns the wrapped signer
+func (s *Signer) Unwrap() signer.Signer {
+	return s.base
+}
+
+// Config returns the configuration of the wrapped signer
+func (s *Signer) Config() signer.Configuration {
+	return s.base.Config()
+}
+
+// apply runs the policies around a signing operation. The After hooks
+// run in reverse order of the Before hooks and only for the policies
+// whose Before hook ran.
+func (s *Signer) apply(method string, options interface{}, inputSize int, sign func() error) (err error) {
+	op := &Operation{
+		SignerID:  s.base.Config().ID,
+		Method:    method,
+		Options:   options,
+		InputSize: inputSize,
+		Start:     time.Now(),
+	}
+	var applied int
+	defer func() {
+		for i := applied - 1; i >= 0; i-- {
+			s.policies[i].After(op, err)
+		}
+	}()
+	for _, p := range s.policies {
+		applied++
+		err = p.Before(op)
+		if err != nil {
+			return err
+		}
+	}
+	return sign()
+}
+
+// notImplemented returns the error of a signing method the wrapped
+// signer does not implement
+func (s *Signer) notImplemented(method string) error {
+	return fmt.Errorf("policy: signer %q does not implement %s", s.base.Config().ID, method)
+}
+
+// SignHash applies the policies and signs a hash with the wrapped signer
+func (s *Signer) SignHash(hashed []byte, options interface{}) (sig signer.Signature, err error) {
+	hashSigner, ok := s.base.(signer.HashSigner)
+	if !ok {
+		return nil, s.notImplemented("SignHash")
+	}
+	err = s.apply("SignHash", options, len(hashed), func() (err error) {
+		sig, err = hashSigner.SignHash(hashed, options)
+		return err
+	})
+	return
+}
+
+// SignData applies the policies and signs data with the wrapped signer
+func (s *Signer) SignData(data []byte, options interface{}) (sig signer.Signature, err error) {
+	dataSigner, ok := s.base.(signer.DataSigner)
+	if !ok {
+		return nil, s.notImplemented("SignData")
+	}
+	err = s.apply("SignData", options, len(data), func() (err error) {
+		sig, err = dataSigner.SignData(data, options)
+		return err
+	})
+	return
+}
+
+// SignFile applies the policies and signs a file with the wrapped signer
+func (s *Signer) SignFile(file []byte, options interface{}) (signed signer.SignedFile, err error) {
+	fileSigner, ok := s.base.(signer.FileSigner)
+	if !ok {
+		return nil, s.notImplemented("SignFile")
+	}
+	err = s.apply("SignFile", options, len(file), func() (err error) {
+		signed, err = fileSigner.SignFile(file, options)
+		return err
+	})
+	return
+}
+
+// SignFileContext applies the policies and signs a file with the
+// wrapped signer until the context is done
+func (s *Signer) SignFileContext(ctx context.Context, file []byte, options interface{}) (signed signer.SignedFile, err error) {
+	contextSigner, ok := s.base.(signer.ContextFileSigner)
+	if !ok {
+		return nil, s.notImplemented("SignFileContext")
+	}
+	err = s.apply("SignFileContext", options, len(file), func() (err error) {
+		signed, err = contextSigner.SignFileContext(ctx, file, options)
+		return err
+	})
+	return
+}
+
+// SignFileWithSidecar applies the policies and signs a file with the
+// wrapped signer, returning its sidecar file
+func (s *Signer) SignFileWithSidecar(ctx context.Context, file []byte, options interface{}) (signed signer.SignedFile, sidecar []byte, err error) {
+	sidecarSigner, ok := s.base.(signer.SidecarFileSigner)
+	if !ok {
+		return nil, nil, s.notImplemented("SignFileWithSidecar")
+	}
+	err = s.apply("SignFileWithSidecar", options, len(file), func() (err error) {
+		signed, sidecar, err = sidecarSigner.SignFileWithSidecar(ctx, file, options)
+		return err
+	})
+	return
+}
+
+// SignFiles applies the policies and signs files with the wrapped signer
+func (s *Signer) SignFiles(files []signer.NamedUnsignedFile, options interface{}) (signed []signer.NamedSignedFile, err error) {
+	multiFileSigner, ok := s.base.(signer.MultipleFileSigner)
+	if !ok {
+		return nil, s.notImplemented("SignFiles")
+	}
+	var inputSize int
+	for _, file := range files {
+		inputSize += len(file.Bytes)
+	}
+	err = s.apply("SignFiles", options, inputSize, func() (err error) {
+		signed, err = multiFileSigner.SignFiles(files, options)
+		return err
+	})
+	return
+}
+
+// SignFileStream applies the policies and signs a file stream with the
+// wrapped signer
+func (s *Signer) SignFileStream(input io.Reader, output io.Writer, options interface{}) error {
+	streamSigner, ok := s.base.(signer.FileStreamSigner)
+	if !ok {
+		return s.notImplemented("SignFileStream")
+	}
+	return s.apply("SignFileStream", options, int(signer.StreamInputSize(input)), func() error {
+		return streamSigner.SignFileStream(input, output, options)
+	})
+}
+
+// SignedDataHash applies the policies and returns the hash of the
+// data the wrapped signer would sign
+func (s *Signer) SignedDataHash(data []byte, options interface{}) (hash string, err error) {
+	dataHasher, ok := s.base.(signer.SignedDataHasher)
+	if !ok {
+		return "", s.notImplemented("SignedDataHash")
+	}
+	err = s.apply("SignedDataHash", options, len(data), func() (err error) {
+		hash, err = dataHasher.SignedDataHash(data, options)
+		return err
+	})
+	return
+}
+
+// SignedFileHash applies the policies and returns the hash of the
+// manifest the wrapped signer would sign
+func (s *Signer) SignedFileHash(file []byte, options interface{}) (hash string, err error) {
+	fileHasher, ok := s.base.(signer.SignedFileHasher)
+	if !ok {
+		return "", s.notImplemented("SignedFileHash")
+	}
+	err = s.apply("SignedFileHash", options, len(file), func() (err error) {
+		hash, err = fileHasher.SignedFileHash(file, options)
+		return err
+	})
+	return
+}
+
+// GetDefaultOptions returns the default options of the wrapped signer
+func (s *Signer) GetDefaultOptions() interface{} {
+	optionsGetter, ok := s.base.(interface{ GetDefaultOptions() interface{} })
+	if !ok {
+		return nil
+	}
+	return optionsGetter.GetDefaultOptions()
+}
+
+// AtExit cleans up the wrapped signer when it is a StatefulSigner
+func (s *Signer) AtExit() error {
+	statefulSigner, ok := s.base.(signer.StatefulSigner)
+	if !ok {
+		return nil
+	}
+	return statefulSigner.AtExit()
+}
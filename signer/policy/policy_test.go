@@ -0,0 +1,290 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/autograph/signer"
+)
+
+// testSignature is the signature of the testDataSigner
+type testSignature []byte
+
+func (sig testSignature) Marshal() (string, error) {
+	return string(sig), nil
+}
+
+// testDataSigner is a signer that only implements data signing
+type testDataSigner struct {
+	calls int
+}
+
+func (s *testDataSigner) Config() signer.Configuration {
+	return signer.Configuration{ID: "testsigner", Type: "test"}
+}
+
+func (s *testDataSigner) SignData(data []byte, options interface{}) (signer.Signature, error) {
+	s.calls++
+	return testSignature(data), nil
+}
+
+func (s *testDataSigner) GetDefaultOptions() interface{} {
+	return map[string]interface{}{"default": true}
+}
+
+// testSidecarSigner is a signer that signs files with a sidecar, or
+// until their context is done
+type testSidecarSigner struct {
+	testDataSigner
+}
+
+func (s *testSidecarSigner) SignFileWithSidecar(ctx context.Context, file []byte, options interface{}) (signer.SignedFile, []byte, error) {
+	s.calls++
+	return signer.SignedFile(file), []byte("sidecar"), nil
+}
+
+func (s *testSidecarSigner) SignFileContext(ctx context.Context, file []byte, options interface{}) (signer.SignedFile, error) {
+	s.calls++
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("test: signing stopped: %w", ctx.Err())
+	}
+	return signer.SignedFile(file), nil
+}
+
+// recordingPolicy records the calls to its hooks in calls
+type recordingPolicy struct {
+	name      string
+	calls     *[]string
+	beforeErr error
+}
+
+func (p *recordingPolicy) Before(op *Operation) error {
+	*p.calls = append(*p.calls, fmt.Sprintf("%s.Before(%s)", p.name, op.Method))
+	return p.beforeErr
+}
+
+func (p *recordingPolicy) After(op *Operation, err error) {
+	*p.calls = append(*p.calls, fmt.Sprintf("%s.After(%v)", p.name, err))
+}
+
+func TestWrap(t *testing.T) {
+	base := &testDataSigner{}
+
+	s, err := Wrap(base, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != signer.Signer(base) {
+		t.Fatalf("expected signer without policies to not be wrapped")
+	}
+
+	s, err = Wrap(base, []signer.PolicyConfiguration{{Type: LogType}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer.Unwrap(s) != signer.Signer(base) {
+		t.Fatalf("expected wrapped signer to unwrap to its base signer")
+	}
+	if s.Config().ID != "testsigner" {
+		t.Fatalf("expected wrapped signer config of its base signer but got ID %q", s.Config().ID)
+	}
+	sig, err := s.(signer.DataSigner).SignData([]byte("foo"), nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	if sig.(testSignature) == nil || string(sig.(testSignature)) != "foo" {
+		t.Fatalf("unexpected signature %q", sig)
+	}
+	_, err = s.(signer.HashSigner).SignHash([]byte("foo"), nil)
+	if err == nil {
+		t.Fatalf("expected hash signing to fail for a base signer without hash signing")
+	}
+	if s.(signer.DataSigner).GetDefaultOptions().(map[string]interface{})["default"] != true {
+		t.Fatalf("expected default options of the base signer")
+	}
+}
+
+func TestWrapErrs(t *testing.T) {
+	var testcases = []signer.PolicyConfiguration{
+		{Type: "unknown"},
+		{Type: LogType, Level: "loud"},
+		{Type: RequireOptionType},
+		{Type: RateLimitType},
+		{Type: RateLimitType, Rate: -1},
+		{Type: RateLimitType, Rate: 1, Burst: -1},
+	}
+	for i, testcase := range testcases {
+		_, err := Wrap(&testDataSigner{}, []signer.PolicyConfiguration{testcase})
+		if err == nil {
+			t.Fatalf("testcase %d expected policy %+v to fail but it succeeded", i, testcase)
+		}
+	}
+}
+
+func TestPolicyOrder(t *testing.T) {
+	var calls []string
+	errRefused := errors.New("refused")
+	base := &testDataSigner{}
+	s := &Signer{
+		base: base,
+		policies: []Policy{
+			&recordingPolicy{name: "first", calls: &calls},
+			&recordingPolicy{name: "second", calls: &calls, beforeErr: errRefused},
+			&recordingPolicy{name: "third", calls: &calls},
+		},
+	}
+	_, err := s.SignData([]byte("foo"), nil)
+	if !errors.Is(err, errRefused) {
+		t.Fatalf("expected refused error but got %v", err)
+	}
+	if base.calls != 0 {
+		t.Fatalf("expected refused operation to not reach the base signer")
+	}
+	expected := []string{
+		"first.Before(SignData)",
+		"second.Before(SignData)",
+		"second.After(refused)",
+		"first.After(refused)",
+	}
+	if fmt.Sprint(calls) != fmt.Sprint(expected) {
+		t.Fatalf("expected policy calls %q but got %q", expected, calls)
+	}
+}
+
+func TestSignFileWithSidecar(t *testing.T) {
+	var calls []string
+	base := &testSidecarSigner{}
+	s := &Signer{base: base, policies: []Policy{&recordingPolicy{name: "first", calls: &calls}}}
+	signed, sidecar, err := s.SignFileWithSidecar(context.Background(), []byte("foo"), nil)
+	if err != nil {
+		t.Fatalf("failed to sign file with sidecar: %v", err)
+	}
+	if string(signed) != "foo" || string(sidecar) != "sidecar" {
+		t.Fatalf("unexpected signed file %q and sidecar %q", signed, sidecar)
+	}
+	expected := []string{"first.Before(SignFileWithSidecar)", "first.After(<nil>)"}
+	if fmt.Sprint(calls) != fmt.Sprint(expected) {
+		t.Fatalf("expected policy calls %q but got %q", expected, calls)
+	}
+
+	s = &Signer{base: &testDataSigner{}}
+	_, _, err = s.SignFileWithSidecar(context.Background(), []byte("foo"), nil)
+	if err == nil {
+		t.Fatalf("expected signing with a sidecar to fail for a base signer without sidecar signing")
+	}
+}
+
+func TestSignFileContext(t *testing.T) {
+	var calls []string
+	s := &Signer{base: &testSidecarSigner{}, policies: []Policy{&recordingPolicy{name: "first", calls: &calls}}}
+	signed, err := s.SignFileContext(context.Background(), []byte("foo"), nil)
+	if err != nil || string(signed) != "foo" {
+		t.Fatalf("failed to sign file with a context: %q %v", signed, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = s.SignFileContext(ctx, []byte("foo"), nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected signing with a canceled context to return a context error but got %v", err)
+	}
+	expected := []string{
+		"first.Before(SignFileContext)", "first.After(<nil>)",
+		"first.Before(SignFileContext)", "first.After(test: signing stopped: context canceled)",
+	}
+	if fmt.Sprint(calls) != fmt.Sprint(expected) {
+		t.Fatalf("expected policy calls %q but got %q", expected, calls)
+	}
+
+	s = &Signer{base: &testDataSigner{}}
+	_, err = s.SignFileContext(context.Background(), []byte("foo"), nil)
+	if err == nil {
+		t.Fatalf("expected signing with a context to fail for a base signer without context signing")
+	}
+}
+
+func TestRequireOptionPolicy(t *testing.T) {
+	s, err := Wrap(&testDataSigner{}, []signer.PolicyConfiguration{{Type: RequireOptionType, Option: "audit_id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var testcases = []struct {
+		options interface{}
+		denied  bool
+	}{
+		{options: map[string]interface{}{"audit_id": "CHG-1234"}},
+		{options: struct {
+			AuditID string `json:"audit_id"`
+		}{"CHG-1234"}},
+		{options: nil, denied: true},
+		{options: map[string]interface{}{}, denied: true},
+		{options: map[string]interface{}{"audit_id": ""}, denied: true},
+		{options: map[string]interface{}{"audit_id": nil}, denied: true},
+		{options: "audit_id", denied: true},
+	}
+	for i, testcase := range testcases {
+		_, err = s.(signer.DataSigner).SignData([]byte("foo"), testcase.options)
+		if testcase.denied && !errors.Is(err, ErrDenied) {
+			t.Fatalf("testcase %d expected operation to be denied but got %v", i, err)
+		}
+		if !testcase.denied && err != nil {
+			t.Fatalf("testcase %d expected operation to succeed but got %v", i, err)
+		}
+	}
+}
+
+func TestRateLimitPolicy(t *testing.T) {
+	p, err := newRateLimitPolicy(signer.PolicyConfiguration{Type: RateLimitType, Rate: 1, Burst: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	p.now = func() time.Time { return now }
+	p.last = now
+	s := &Signer{base: &testDataSigner{}, policies: []Policy{p}}
+
+	for i := 0; i < 2; i++ {
+		if _, err = s.SignData([]byte("foo"), nil); err != nil {
+			t.Fatalf("expected operation %d within burst to succeed but got %v", i, err)
+		}
+	}
+	if _, err = s.SignData([]byte("foo"), nil); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected operation above burst to be rate limited but got %v", err)
+	}
+	now = now.Add(time.Second)
+	if _, err = s.SignData([]byte("foo"), nil); err != nil {
+		t.Fatalf("expected operation after refill to succeed but got %v", err)
+	}
+	if _, err = s.SignData([]byte("foo"), nil); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected second operation after refill to be rate limited but got %v", err)
+	}
+}
+
+func TestConfigured(t *testing.T) {
+	logPolicy := signer.PolicyConfiguration{Type: LogType}
+
+	policies, err := Configured(signer.Configuration{ID: "testsigner", Policies: []signer.PolicyConfiguration{logPolicy}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 1 || policies[0] != logPolicy {
+		t.Fatalf("expected only the configured policies but got %+v", policies)
+	}
+
+	policies, err = Configured(signer.Configuration{ID: "testsigner", MaxSignaturesPerSecond: 2.5, Policies: []signer.PolicyConfiguration{logPolicy}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := signer.PolicyConfiguration{Type: RateLimitType, Rate: 2.5, Burst: 3}
+	if len(policies) != 2 || policies[0] != expected || policies[1] != logPolicy {
+		t.Fatalf("expected a ratelimit policy before the configured policies but got %+v", policies)
+	}
+
+	_, err = Configured(signer.Configuration{ID: "testsigner", MaxSignaturesPerSecond: -1})
+	if err == nil {
+		t.Fatal("expected a negative max signatures per second to fail but it succeeded")
+	}
+}
@@ -0,0 +1,418 @@
+// Package rfc3161 implements a timestamping authority that issues
+// RFC3161 timestamp tokens over digests
+package rfc3161 // import "github.com/mozilla-services/autograph/signer/rfc3161"
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/mozilla-services/autograph/formats"
+	"github.com/mozilla-services/autograph/signer"
+
+	"go.mozilla.org/pkcs7"
+)
+
+const (
+	// Type of this signer is "rfc3161"
+	Type = "rfc3161"
+)
+
+var (
+	// oidTSTInfo is the id-ct-TSTInfo content type of timestamp tokens
+	oidTSTInfo = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+
+	// oidSigningCertificateV2 is the id-aa-signingCertificateV2 signed
+	// attribute that binds the token to the TSA certificate
+	oidSigningCertificateV2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+
+	// oidExtKeyUsage is the extended key usage certificate extension
+	oidExtKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37}
+)
+
+// RFC3161Signer holds the configuration of the signer
+type RFC3161Signer struct {
+	signer.Configuration
+
+	// signingKey is the private key of the TSA certificate
+	signingKey crypto.PrivateKey
+
+	// cert is the parsed TSA certificate
+	cert *x509.Certificate
+
+	// policy is the TSA policy of the issued tokens
+	policy asn1.ObjectIdentifier
+
+	// rand is the source of the serial numbers of the tokens
+	rand io.Reader
+}
+
+// New initializes an rfc3161 signer using a configuration
+func New(conf signer.Configuration) (s *RFC3161Signer, err error) {
+	s = new(RFC3161Signer)
+
+	if conf.Type != Type {
+		return nil, fmt.Errorf("rfc3161: invalid type %q, must be %q", conf.Type, Type)
+	}
+	s.Type = conf.Type
+
+	if conf.ID == "" {
+		return nil, fmt.Errorf("rfc3161: missing signer ID in signer configuration")
+	}
+	s.ID = conf.ID
+
+	if conf.PrivateKey == "" {
+		return nil, fmt.Errorf("rfc3161: missing private key in signer configuration")
+	}
+	s.PrivateKey = conf.PrivateKey
+
+	if conf.Certificate == "" {
+		return nil, fmt.Errorf("rfc3161: missing TSA certificate in signer configuration")
+	}
+	s.Certificate = conf.Certificate
+
+	if conf.TSAPolicyOID == "" {
+		return nil, fmt.Errorf("rfc3161: missing TSA policy OID in signer configuration")
+	}
+	s.policy, err = parseOID(conf.TSAPolicyOID)
+	if err != nil {
+		return nil, fmt.Errorf("rfc3161: invalid TSA policy OID in signer configuration: %w", err)
+	}
+	s.TSAPolicyOID = conf.TSAPolicyOID
+
+	s.rand = conf.GetRand()
+	var pub crypto.PublicKey
+	s.signingKey, pub, s.PublicKey, err = conf.GetKeys()
+	if err != nil {
+		return nil, fmt.Errorf("rfc3161: failed to get keys: %w", err)
+	}
+
+	block, _ := pem.Decode([]byte(s.Certificate))
+	if block == nil {
+		return nil, fmt.Errorf("rfc3161: failed to decode PEM TSA certificate")
+	}
+	s.cert, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("rfc3161: failed to parse TSA certificate: %w", err)
+	}
+	if !isTimeStampingCert(s.cert) {
+		return nil, fmt.Errorf("rfc3161: TSA certificate %q must have the critical timeStamping extended key usage only", s.cert.Subject)
+	}
+	certPub, err := x509.MarshalPKIXPublicKey(s.cert.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("rfc3161: failed to marshal public key of TSA certificate: %w", err)
+	}
+	if base64.StdEncoding.EncodeToString(certPub) != s.PublicKey {
+		return nil, fmt.Errorf("rfc3161: private key of type %T does not match the TSA certificate", pub)
+	}
+	certInfo, err := signer.ParseCertificateInfo(s.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("rfc3161: failed to parse TSA certificate: %w", err)
+	}
+	s.CertExpiryWarningDays = conf.CertExpiryWarningDays
+	err = signer.CheckCertificateValidity(s.Configuration, certInfo, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("rfc3161: invalid TSA certificate in signer configuration: %w", err)
+	}
+	return
+}
+
+// Config returns the configuration of the current signer
+func (s *RFC3161Signer) Config() signer.Configuration {
+	return signer.Configuration{
+		ID:           s.ID,
+		Type:         s.Type,
+		PrivateKey:   s.PrivateKey,
+		PublicKey:    s.PublicKey,
+		Certificate:  s.Certificate,
+		TSAPolicyOID: s.TSAPolicyOID,
+	}
+}
+
+// SignData returns a timestamp token over the SHA-256 digest of data
+func (s *RFC3161Signer) SignData(data []byte, options interface{}) (signer.Signature, error) {
+	digest := sha256.Sum256(data)
+	return s.SignHash(digest[:], options)
+}
+
+// SignHash returns a timestamp token over a SHA-256, SHA-384 or SHA-512
+// digest, whose algorithm is that of its length
+func (s *RFC3161Signer) SignHash(digest []byte, options interface{}) (signer.Signature, error) {
+	opt, err := GetOptions(options)
+	if err != nil {
+		return nil, fmt.Errorf("rfc3161: failed to get options: %w", err)
+	}
+	hashAlg, err := hashAlgForDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	serial := make([]byte, 16)
+	_, err = io.ReadFull(s.rand, serial)
+	if err != nil {
+		return nil, fmt.Errorf("rfc3161: failed to generate token serial number: %w", err)
+	}
+	info := TSTInfo{
+		Version: 1,
+		Policy:  s.policy,
+		MessageImprint: MessageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: hashAlg},
+			HashedMessage: digest,
+		},
+		SerialNumber: new(big.Int).SetBytes(serial),
+		GenTime:      time.Now().UTC().Truncate(time.Second),
+		Nonce:        opt.Nonce,
+	}
+	content, err := asn1.Marshal(info)
+	if err != nil {
+		return nil, fmt.Errorf("rfc3161: failed to marshal TSTInfo: %w", err)
+	}
+
+	sd, err := pkcs7.NewSignedData(content)
+	if err != nil {
+		return nil, fmt.Errorf("rfc3161: failed to create signed data: %w", err)
+	}
+	// the content type is signed as an attribute, so it must be
+	// set before adding the signer
+	sd.GetSignedData().ContentInfo.ContentType = oidTSTInfo
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	certHash := sha256.Sum256(s.cert.Raw)
+	err = sd.AddSigner(s.cert, s.signingKey, pkcs7.SignerInfoConfig{
+		ExtraSignedAttributes: []pkcs7.Attribute{{
+			Type:  oidSigningCertificateV2,
+			Value: signingCertificateV2{Certs: []essCertIDv2{{CertHash: certHash[:]}}},
+		}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("rfc3161: failed to sign timestamp token: %w", err)
+	}
+	token, err := sd.Finish()
+	if err != nil {
+		return nil, fmt.Errorf("rfc3161: failed to marshal timestamp token: %w", err)
+	}
+	return &Signature{Data: token}, nil
+}
+
+// VerifyData verifies a timestamp token over the SHA-256 digest of
+// data with the TSA certificate of the signer
+func (s *RFC3161Signer) VerifyData(data []byte, sig signer.Signature) error {
+	tsSig, ok := sig.(*Signature)
+	if !ok {
+		return fmt.Errorf("rfc3161: cannot verify signature of type %T", sig)
+	}
+	digest := sha256.Sum256(data)
+	_, err := VerifyTimeStampToken(tsSig.Data, digest[:], s.cert)
+	return err
+}
+
+// Options are the options of the signer
+type Options struct {
+	// Nonce is the optional nonce of the timestamp request, it is
+	// copied in the token so clients can match it to their request
+	Nonce *big.Int `json:"nonce,omitempty"`
+}
+
+// GetDefaultOptions returns default options of the signer
+func (s *RFC3161Signer) GetDefaultOptions() interface{} {
+	return Options{}
+}
+
+// GetOptions takes a input interface and reflects it into a struct of options
+func GetOptions(input interface{}) (options Options, err error) {
+	buf, err := json.Marshal(input)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(buf, &options)
+	return
+}
+
+// Signature is a DER encoded RFC3161 TimeStampToken
+type Signature struct {
+	Data []byte
+}
+
+// Marshal returns the base64 representation of a timestamp token
+func (sig *Signature) Marshal() (string, error) {
+	return base64.StdEncoding.EncodeToString(sig.Data), nil
+}
+
+// Unmarshal decodes a base64 timestamp token into a Signature
+func Unmarshal(sigstr string) (signer.Signature, error) {
+	token, err := base64.StdEncoding.DecodeString(sigstr)
+	if err != nil {
+		return nil, fmt.Errorf("rfc3161: failed to decode timestamp token: %w", err)
+	}
+	return &Signature{Data: token}, nil
+}
+
+// TSTInfo is the signed content of a timestamp token
+type TSTInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint MessageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time `asn1:"generalized"`
+	Nonce          *big.Int  `asn1:"optional"`
+}
+
+// MessageImprint is the digest a timestamp token is issued over
+type MessageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+// signingCertificateV2 is the ESS signing certificate attribute of
+// RFC5035, with the SHA-256 hash of the TSA certificate
+type signingCertificateV2 struct {
+	Certs []essCertIDv2
+}
+
+// essCertIDv2 omits its hash algorithm, which defaults to SHA-256
+type essCertIDv2 struct {
+	CertHash []byte
+}
+
+// encapsulatedContentType is the start of the SignedData of a token
+// up to the type of its content, which pkcs7 does not expose
+type encapsulatedContentType struct {
+	ContentType asn1.ObjectIdentifier
+	Content     struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		EncapContentInfo struct {
+			EContentType asn1.ObjectIdentifier
+			EContent     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+		}
+		Rest []asn1.RawValue `asn1:"optional"`
+	} `asn1:"explicit,tag:0"`
+}
+
+// VerifyTimeStampToken verifies a DER timestamp token was signed by
+// the TSA certificate over digest, and returns its TSTInfo
+func VerifyTimeStampToken(token, digest []byte, tsaCert *x509.Certificate) (*TSTInfo, error) {
+	var ct encapsulatedContentType
+	_, err := asn1.Unmarshal(token, &ct)
+	if err != nil {
+		return nil, fmt.Errorf("rfc3161: failed to parse timestamp token: %w", err)
+	}
+	if !ct.Content.EncapContentInfo.EContentType.Equal(oidTSTInfo) {
+		return nil, fmt.Errorf("rfc3161: invalid timestamp token content type %s, must be %s", ct.Content.EncapContentInfo.EContentType, oidTSTInfo)
+	}
+	p7, err := pkcs7.Parse(token)
+	if err != nil {
+		return nil, fmt.Errorf("rfc3161: failed to parse timestamp token: %w", err)
+	}
+	signerCert := p7.GetOnlySigner()
+	if signerCert == nil {
+		return nil, fmt.Errorf("rfc3161: timestamp token must have exactly one signer")
+	}
+	if !bytes.Equal(signerCert.Raw, tsaCert.Raw) {
+		return nil, fmt.Errorf("rfc3161: timestamp token was signed by %q, not the TSA certificate %q", signerCert.Subject, tsaCert.Subject)
+	}
+	if !isTimeStampingCert(signerCert) {
+		return nil, fmt.Errorf("rfc3161: timestamp token signer %q is not a TSA certificate", signerCert.Subject)
+	}
+	err = p7.Verify()
+	if err != nil {
+		return nil, fmt.Errorf("rfc3161: failed to verify timestamp token: %w", err)
+	}
+	info := new(TSTInfo)
+	_, err = asn1.Unmarshal(p7.Content, info)
+	if err != nil {
+		return nil, fmt.Errorf("rfc3161: failed to parse TSTInfo: %w", err)
+	}
+	hashAlg, err := hashAlgForDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	if !info.MessageImprint.HashAlgorithm.Algorithm.Equal(hashAlg) || !bytes.Equal(info.MessageImprint.HashedMessage, digest) {
+		return nil, fmt.Errorf("rfc3161: timestamp token message imprint does not match the digest")
+	}
+	return info, nil
+}
+
+// VerifyRFC3161SignatureResponse is a helper that takes an input and
+// autograph signature response and verifies its timestamp token over
+// the SHA-256 digest of the input was signed by a TSA certificate
+// with the public key of the response
+func VerifyRFC3161SignatureResponse(input []byte, sr formats.SignatureResponse) error {
+	if sr.Type != Type {
+		return fmt.Errorf("rfc3161: signature response of type %q cannot be verified by %q", sr.Type, Type)
+	}
+	token, err := base64.StdEncoding.DecodeString(sr.Signature)
+	if err != nil {
+		return fmt.Errorf("rfc3161: failed to decode timestamp token: %w", err)
+	}
+	p7, err := pkcs7.Parse(token)
+	if err != nil {
+		return fmt.Errorf("rfc3161: failed to parse timestamp token: %w", err)
+	}
+	tsaCert := p7.GetOnlySigner()
+	if tsaCert == nil {
+		return fmt.Errorf("rfc3161: timestamp token must have exactly one signer")
+	}
+	certPub, err := x509.MarshalPKIXPublicKey(tsaCert.PublicKey)
+	if err != nil {
+		return fmt.Errorf("rfc3161: failed to marshal public key of TSA certificate: %w", err)
+	}
+	if base64.StdEncoding.EncodeToString(certPub) != sr.PublicKey {
+		return fmt.Errorf("rfc3161: TSA certificate %q does not match the public key of the response", tsaCert.Subject)
+	}
+	digest := sha256.Sum256(input)
+	_, err = VerifyTimeStampToken(token, digest[:], tsaCert)
+	return err
+}
+
+// hashAlgForDigest returns the OID of the hash algorithm of a digest
+// from its length
+func hashAlgForDigest(digest []byte) (asn1.ObjectIdentifier, error) {
+	switch len(digest) {
+	case crypto.SHA256.Size():
+		return pkcs7.OIDDigestAlgorithmSHA256, nil
+	case crypto.SHA384.Size():
+		return pkcs7.OIDDigestAlgorithmSHA384, nil
+	case crypto.SHA512.Size():
+		return pkcs7.OIDDigestAlgorithmSHA512, nil
+	default:
+		return nil, fmt.Errorf("rfc3161: refusing to timestamp input hash: %w %d, expected %d, %d or %d", signer.ErrInvalidHashLength, len(digest), crypto.SHA256.Size(), crypto.SHA384.Size(), crypto.SHA512.Size())
+	}
+}
+
+// isTimeStampingCert returns whether the certificate has the critical
+// timeStamping extended key usage only, as RFC3161 requires
+func isTimeStampingCert(cert *x509.Certificate) bool {
+	if len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageTimeStamping || len(cert.UnknownExtKeyUsage) != 0 {
+		return false
+	}
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidExtKeyUsage) {
+			return ext.Critical
+		}
+	}
+	return false
+}
+
+// parseOID parses a dotted OID e.g. 1.2.3.4
+func parseOID(s string) (oid asn1.ObjectIdentifier, err error) {
+	for _, arc := range bytes.Split([]byte(s), []byte(".")) {
+		n, ok := new(big.Int).SetString(string(arc), 10)
+		if !ok || n.Sign() < 0 || !n.IsInt64() || n.Int64() > int64(^uint(0)>>1) {
+			return nil, fmt.Errorf("invalid OID arc %q in %q", arc, s)
+		}
+		oid = append(oid, int(n.Int64()))
+	}
+	if len(oid) < 2 {
+		return nil, fmt.Errorf("OID %q must have at least two arcs", s)
+	}
+	return oid, nil
+}
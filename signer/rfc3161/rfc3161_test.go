@@ -0,0 +1,185 @@
+package rfc3161
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/autograph/formats"
+	"github.com/mozilla-services/autograph/signer"
+)
+
+// newTestTSA returns the PEM private key and certificate of a self
+// signed TSA with the extended key usage extension
+func newTestTSA(t *testing.T, extKeyUsage asn1.ObjectIdentifier, critical bool) (keyPEM, certPEM string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ekuExt, err := asn1.Marshal([]asn1.ObjectIdentifier{extKeyUsage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "autograph test TSA"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtraExtensions: []pkix.Extension{{
+			Id:       asn1.ObjectIdentifier{2, 5, 29, 37},
+			Critical: critical,
+			Value:    ekuExt,
+		}},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+	certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}))
+	return
+}
+
+var oidTimeStamping = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 8}
+
+func newTestConf(t *testing.T) signer.Configuration {
+	keyPEM, certPEM := newTestTSA(t, oidTimeStamping, true)
+	return signer.Configuration{
+		ID:           "testtsa",
+		Type:         Type,
+		PrivateKey:   keyPEM,
+		Certificate:  certPEM,
+		TSAPolicyOID: "1.2.3.4.1",
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	s, err := New(newTestConf(t))
+	if err != nil {
+		t.Fatalf("failed to initialize signer: %v", err)
+	}
+	input := []byte("foobarbaz1234abcd")
+	sig, err := s.SignData(input, s.GetDefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	err = s.VerifyData(input, sig)
+	if err != nil {
+		t.Fatalf("failed to verify timestamp token: %v", err)
+	}
+	err = s.VerifyData([]byte("tampered"), sig)
+	if err == nil || !strings.Contains(err.Error(), "message imprint does not match") {
+		t.Fatalf("expected message imprint mismatch for other data but got %v", err)
+	}
+
+	sigStr, err := sig.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr := formats.SignatureResponse{
+		Type:      Type,
+		SignerID:  s.ID,
+		PublicKey: s.PublicKey,
+		Signature: sigStr,
+	}
+	err = VerifyRFC3161SignatureResponse(input, sr)
+	if err != nil {
+		t.Fatalf("failed to verify signature response: %v", err)
+	}
+
+	// the token must not verify with another TSA certificate
+	other, err := New(newTestConf(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr.PublicKey = other.PublicKey
+	err = VerifyRFC3161SignatureResponse(input, sr)
+	if err == nil || !strings.Contains(err.Error(), "does not match the public key") {
+		t.Fatalf("expected public key mismatch but got %v", err)
+	}
+	digest := sha256.Sum256(input)
+	_, err = VerifyTimeStampToken(sig.(*Signature).Data, digest[:], other.cert)
+	if err == nil || !strings.Contains(err.Error(), "not the TSA certificate") {
+		t.Fatalf("expected TSA certificate mismatch but got %v", err)
+	}
+}
+
+func TestSignHash(t *testing.T) {
+	s, err := New(newTestConf(t))
+	if err != nil {
+		t.Fatalf("failed to initialize signer: %v", err)
+	}
+	digest := sha512.Sum384([]byte("foobarbaz1234abcd"))
+	sig, err := s.SignHash(digest[:], Options{Nonce: big.NewInt(42)})
+	if err != nil {
+		t.Fatalf("failed to sign hash: %v", err)
+	}
+	info, err := VerifyTimeStampToken(sig.(*Signature).Data, digest[:], s.cert)
+	if err != nil {
+		t.Fatalf("failed to verify timestamp token: %v", err)
+	}
+	if !info.MessageImprint.HashAlgorithm.Algorithm.Equal(asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}) {
+		t.Fatalf("expected SHA-384 message imprint but got %s", info.MessageImprint.HashAlgorithm.Algorithm)
+	}
+	if info.Nonce == nil || info.Nonce.Int64() != 42 {
+		t.Fatalf("expected nonce 42 but got %v", info.Nonce)
+	}
+	if !info.Policy.Equal(asn1.ObjectIdentifier{1, 2, 3, 4, 1}) {
+		t.Fatalf("expected policy 1.2.3.4.1 but got %s", info.Policy)
+	}
+	if time.Since(info.GenTime) > time.Minute {
+		t.Fatalf("expected a recent genTime but got %s", info.GenTime)
+	}
+
+	_, err = s.SignHash([]byte("tooshort"), nil)
+	if !errors.Is(err, signer.ErrInvalidHashLength) {
+		t.Fatalf("expected invalid hash length error but got %v", err)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	keyPEM, serverCertPEM := newTestTSA(t, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 1}, true)
+	_, nonCriticalCertPEM := newTestTSA(t, oidTimeStamping, false)
+	_, otherCertPEM := newTestTSA(t, oidTimeStamping, true)
+	testcases := []struct {
+		mutate func(*signer.Configuration)
+		err    string
+	}{
+		{func(c *signer.Configuration) { c.Type = "mar" }, `rfc3161: invalid type "mar", must be "rfc3161"`},
+		{func(c *signer.Configuration) { c.ID = "" }, "rfc3161: missing signer ID in signer configuration"},
+		{func(c *signer.Configuration) { c.Certificate = "" }, "rfc3161: missing TSA certificate in signer configuration"},
+		{func(c *signer.Configuration) { c.TSAPolicyOID = "" }, "rfc3161: missing TSA policy OID in signer configuration"},
+		{func(c *signer.Configuration) { c.TSAPolicyOID = "1.a.3" }, "rfc3161: invalid TSA policy OID in signer configuration"},
+		{func(c *signer.Configuration) {
+			c.PrivateKey, c.Certificate = keyPEM, serverCertPEM
+		}, "must have the critical timeStamping extended key usage only"},
+		{func(c *signer.Configuration) {
+			c.PrivateKey, c.Certificate = keyPEM, nonCriticalCertPEM
+		}, "must have the critical timeStamping extended key usage only"},
+		{func(c *signer.Configuration) { c.Certificate = otherCertPEM }, "does not match the TSA certificate"},
+	}
+	for i, testcase := range testcases {
+		conf := newTestConf(t)
+		testcase.mutate(&conf)
+		_, err := New(conf)
+		if err == nil || !strings.Contains(err.Error(), testcase.err) {
+			t.Fatalf("testcase %d expected error %q but got %v", i, testcase.err, err)
+		}
+	}
+}
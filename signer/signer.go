@@ -7,16 +7,21 @@
 package signer // import "github.com/mozilla-services/autograph/signer"
 
 import (
+	"bytes"
+	"context"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"regexp"
 	"strings"
 	"time"
@@ -83,6 +88,30 @@ type RecommendationConfig struct {
 	ValidityDuration time.Duration `yaml:"duration,omitempty"`
 }
 
+// PolicyConfiguration is a config for a policy decorator wrapping a
+// signer
+type PolicyConfiguration struct {
+	// Type of the policy, one of the types of the signer/policy
+	// package e.g. "log", "requireoption" or "ratelimit"
+	Type string `json:"type"`
+
+	// Option is the name of the signing request option the
+	// requireoption policy requires
+	Option string `json:"option,omitempty"`
+
+	// Rate is the number of signing operations per second the
+	// ratelimit policy allows
+	Rate float64 `json:"rate,omitempty"`
+
+	// Burst is the number of signing operations the ratelimit
+	// policy allows at once
+	Burst int `json:"burst,omitempty"`
+
+	// Level is the logrus level the log policy logs signing
+	// operations at, defaults to "info"
+	Level string `json:"level,omitempty"`
+}
+
 // Configuration defines the parameters of a signer
 type Configuration struct {
 	ID            string            `json:"id"`
@@ -107,6 +136,12 @@ type Configuration struct {
 	// recommendations files for XPI signers
 	RecommendationConfig RecommendationConfig `yaml:"recommendation,omitempty"`
 
+	// COSEAlgorithms for XPI signers are the COSE algorithms
+	// e.g. ES256, ES384 or PS256 of the detached COSE signatures
+	// added to signed files when the request options don't set
+	// cose_algorithms. XPIs are only signed with PKCS7 when empty.
+	COSEAlgorithms []string `json:"cosealgorithms,omitempty"`
+
 	// NoPKCS7SignedAttributes for signing legacy APKs don't sign
 	// attributes and use a legacy PKCS7 digest
 	NoPKCS7SignedAttributes bool `json:"nopkcs7signedattributes,omitempty"`
@@ -119,6 +154,22 @@ type Configuration struct {
 	// gpg secret key for the gpg2 signer type
 	Passphrase string `json:"passphrase,omitempty"`
 
+	// GNUPGHomePoolSize is the number of isolated GNUPGHOMEs the
+	// gpg2 signer type creates at startup to sign concurrently.
+	// When unset, a single GNUPGHOME is used and signing is
+	// serialized with all other gpg2 signers.
+	GNUPGHomePoolSize int `json:"gnupghomepoolsize,omitempty"`
+
+	// PrivateKeyPassphrase is the optional passphrase to decrypt
+	// an encrypted PEM private key
+	PrivateKeyPassphrase string `json:"privatekeypassphrase,omitempty"`
+
+	// PrivateKeyPassphraseEnv is the optional name of an
+	// environment variable holding the passphrase to decrypt an
+	// encrypted PEM private key. It takes precedence over
+	// PrivateKeyPassphrase.
+	PrivateKeyPassphraseEnv string `json:"privatekeypassphraseenv,omitempty"`
+
 	// Validity is the lifetime of a end-entity certificate
 	Validity time.Duration `json:"validity,omitempty"`
 
@@ -133,12 +184,187 @@ type Configuration struct {
 	// uploaded to in order for clients to find it at the x5u location.
 	ChainUploadLocation string `json:"chain_upload_location,omitempty"`
 
+	// S3ACL is the canned ACL of the certificate chains uploaded to
+	// an s3:// chain upload location, it defaults to public-read
+	S3ACL string `json:"s3_acl,omitempty"`
+
+	// S3SSE is the server-side encryption of the certificate chains
+	// uploaded to an s3:// chain upload location, AES256 or aws:kms.
+	// Chains are not encrypted when it is empty.
+	S3SSE string `json:"s3_sse,omitempty"`
+
+	// S3KMSKeyID is the ID of the KMS key aws:kms server-side
+	// encryption uses instead of the default S3 KMS key
+	S3KMSKeyID string `json:"s3_kms_key_id,omitempty"`
+
+	// S3Region and S3Endpoint are the region and endpoint of the S3
+	// API chains are uploaded to, they default to the ones of the AWS
+	// environment e.g. to upload to GovCloud or a MinIO instance
+	S3Region   string `json:"s3_region,omitempty"`
+	S3Endpoint string `json:"s3_endpoint,omitempty"`
+
+	// S3ForcePathStyle addresses buckets in the path of the S3
+	// endpoint rather than its host, as MinIO requires
+	S3ForcePathStyle bool `json:"s3_force_path_style,omitempty"`
+
+	// S3InsecureSkipVerify disables TLS certificate verification of
+	// the S3 endpoint, e.g. a MinIO instance with a self-signed
+	// certificate in tests. It requires S3Endpoint.
+	S3InsecureSkipVerify bool `json:"s3_insecure_skip_verify,omitempty"`
+
+	// S3UploadMaxAttempts is the number of times a chain upload to an
+	// s3:// chain upload location is tried, it defaults to 3
+	S3UploadMaxAttempts int `json:"s3_upload_max_attempts,omitempty"`
+
+	// ChainContentType and ChainContentDisposition are the
+	// Content-Type and Content-Disposition headers of the certificate
+	// chains uploaded to s3:// and gs:// chain upload locations, they
+	// default to binary/octet-stream and attachment
+	ChainContentType        string `json:"chain_content_type,omitempty"`
+	ChainContentDisposition string `json:"chain_content_disposition,omitempty"`
+
+	// ChainNameTemplate is a Go text/template of the name certificate
+	// chains are uploaded under and appended to the x5u, with the
+	// serial, signerID and notAfter fields of their end-entity, e.g.
+	// {{.signerID}}/{{.serial}}.pem. It defaults to the common name and
+	// expiration date of the end-entity.
+	ChainNameTemplate string `json:"chain_name_template,omitempty"`
+
+	// MaxRequestBytes is the max size of the bodies of signing
+	// requests to the signer, which lowers the limit of the data or
+	// file endpoints of the server. Zero does not lower it.
+	MaxRequestBytes int64 `json:"max_request_bytes,omitempty"`
+
 	// CaCert is the certificate of the root of the pki, when used
 	CaCert string `json:"cacert,omitempty"`
 
+	// X5UFetchTimeout is the overall timeout for fetching and reading
+	// the certificate chain at the x5u location
+	X5UFetchTimeout time.Duration `json:"x5u_fetch_timeout,omitempty"`
+
+	// X5UConnectTimeout is the timeout for establishing the
+	// connection to the x5u location
+	X5UConnectTimeout time.Duration `json:"x5u_connect_timeout,omitempty"`
+
+	// X5UMaxChainSize is the maximum size in bytes of the
+	// certificate chain body read from the x5u location
+	X5UMaxChainSize int64 `json:"x5u_max_chain_size,omitempty"`
+
+	// Threshold is the minimum number of member signatures of a
+	// multisig signer
+	Threshold int `json:"threshold,omitempty"`
+
+	// Members are the configurations of the signers whose signatures
+	// a multisig signer collects
+	Members []Configuration `json:"members,omitempty"`
+
+	// Standby are the configurations of the backends a signer
+	// switches to when its own backend fails its health probes,
+	// in order of preference
+	Standby []Configuration `json:"standby,omitempty"`
+
+	// StandbyProbeInterval is the interval between two health
+	// probes of the backends of a signer with standby backends
+	StandbyProbeInterval time.Duration `json:"standbyprobeinterval,omitempty"`
+
+	// CommandLogLevel is the logrus level, e.g. "info", at which
+	// signers that shell out to a signing tool log the redacted
+	// command line they run for audit. Defaults to "debug".
+	CommandLogLevel string `json:"commandloglevel,omitempty"`
+
+	// JavaPath is the java binary signers that shell out to a java
+	// signing tool run it with, it defaults to java on the PATH
+	JavaPath string `json:"javapath,omitempty"`
+
+	// APKSignerPath is the apksigner jar apk2 signers run, it
+	// defaults to /usr/share/java/apksigner.jar
+	APKSignerPath string `json:"apksignerpath,omitempty"`
+
+	// JarsignerPath is the jarsigner binary aab signers run, it
+	// defaults to jarsigner on the PATH
+	JarsignerPath string `json:"jarsignerpath,omitempty"`
+
+	// ZipalignPath is the optional zipalign binary apk2 signers run
+	// to align APKs before signing them
+	ZipalignPath string `json:"zipalignpath,omitempty"`
+
+	// MinSDKVersion is the minimum Android SDK version apk2 signers
+	// pass to apksigner for APKs that do not declare one, it
+	// defaults to 18 for ECDSA keys and 9 otherwise
+	MinSDKVersion string `json:"minsdkversion,omitempty"`
+
+	// KeystorePath is the JKS or PKCS12 keystore apk2 and aab
+	// signers pass to apksigner or jarsigner instead of a PEM private
+	// key, it is set together with KeystorePassword and KeyAlias
+	KeystorePath string `json:"keystorepath,omitempty"`
+
+	// KeystorePassword is the password of the keystore at KeystorePath
+	KeystorePassword string `json:"keystorepassword,omitempty"`
+
+	// KeyAlias is the alias of the signing key in the keystore at
+	// KeystorePath
+	KeyAlias string `json:"keyalias,omitempty"`
+
+	// RotationKey is the optional PEM private key apk2 signers
+	// rotate the signing key to: apksigner signs with it as the
+	// next signer after the key of the signer, so the v3 signature
+	// carries both certificates. It is set together with
+	// RotationCert.
+	RotationKey string `json:"rotationkey,omitempty"`
+
+	// RotationCert is the PEM certificate of RotationKey
+	RotationCert string `json:"rotationcert,omitempty"`
+
+	// RotationLineagePath is the signing certificate lineage file
+	// apk2 signers pass to apksigner with a rotation key, as output
+	// by `apksigner rotate`. It is required with a rotation key.
+	RotationLineagePath string `json:"rotationlineagepath,omitempty"`
+
+	// SourceStampKey is the optional PEM private key apk2 signers
+	// sign the source stamp of APKs with, apksigner adds a source
+	// stamp to the signed APKs when it is set together with
+	// SourceStampCert.
+	SourceStampKey string `json:"sourcestampkey,omitempty"`
+
+	// SourceStampCert is the PEM certificate of SourceStampKey. The
+	// monitor checks that the source stamp of the signed test file
+	// verifies with it.
+	SourceStampCert string `json:"sourcestampcert,omitempty"`
+
+	// SignedFileMinSizeRatio is the optional minimum size of a
+	// signed file relative to the size of its unsigned input,
+	// e.g. 1.0 rejects signed files smaller than their input
+	SignedFileMinSizeRatio float64 `json:"signedfileminsizeratio,omitempty"`
+
+	// SignedFileMaxSizeRatio is the optional maximum size of a
+	// signed file relative to the size of its unsigned input,
+	// e.g. 2.0 rejects signed files more than twice as large as
+	// their input
+	SignedFileMaxSizeRatio float64 `json:"signedfilemaxsizeratio,omitempty"`
+
+	// SignedFileContentType is the optional content type of the
+	// signed files returned raw to /sign/file clients that accept
+	// it, instead of the default content type of the signer type
+	SignedFileContentType string `json:"signedfilecontenttype,omitempty"`
+
+	// SignedFileUploadLocation is the optional s3://, gs:// or file://
+	// location /sign/file requests setting upload_signed_file
+	// upload their signed file to instead of returning it, with
+	// the S3 options of the signer
+	SignedFileUploadLocation string `json:"signedfileuploadlocation,omitempty"`
+
+	// SignedFileDownloadLocation is the public location of the
+	// uploaded signed files, it defaults to SignedFileUploadLocation
+	SignedFileDownloadLocation string `json:"signedfiledownloadlocation,omitempty"`
+
 	// Hash is a hash algorithm like 'sha1' or 'sha256'
 	Hash string `json:"hash,omitempty"`
 
+	// AllowedHashes are the hash algorithms genericrsa signing
+	// requests can choose in their hash option instead of Hash,
+	// e.g. to sign under both 'sha256' and 'sha384'
+	AllowedHashes []string `json:"allowedhashes,omitempty"`
+
 	// SaltLength controls the length of the salt used in a RSA PSS
 	// signature. It can either be a number of bytes, or one of the special
 	// PSSSaltLength constants from the rsa package.
@@ -147,6 +373,27 @@ type Configuration struct {
 	// SignerOpts contains options for signing with a Signer
 	SignerOpts crypto.SignerOpts `json:"signer_opts,omitempty"`
 
+	// Policies are the optional policy decorators that wrap the
+	// signer, they are applied in order to each signing operation
+	Policies []PolicyConfiguration `json:"policies,omitempty"`
+
+	// CertExpiryWarningDays is the number of days before the
+	// expiration of the certificate of the signer from which it is
+	// logged at initialization and flagged by the monitor. It
+	// defaults to DefaultCertExpiryWarningDays.
+	CertExpiryWarningDays int `json:"certexpirywarningdays,omitempty"`
+
+	// MaxSignaturesPerSecond is the optional number of signing
+	// operations per second the signer allows, e.g. to protect its
+	// HSM from a flooding client. Operations above it are refused
+	// before reaching the signer, independently of other signers.
+	MaxSignaturesPerSecond float64 `json:"maxsignaturespersecond,omitempty"`
+
+	// TSAPolicyOID is the dotted OID of the TSA policy, e.g.
+	// 1.3.6.1.4.1.4146.2.3, that rfc3161 signers issue timestamp
+	// tokens under
+	TSAPolicyOID string `json:"tsapolicyoid,omitempty"`
+
 	isHsmAvailable bool
 	hsmCtx         *pkcs11.Ctx
 }
@@ -175,6 +422,10 @@ type HashSigner interface {
 	GetDefaultOptions() interface{}
 }
 
+// ErrInvalidHashLength is wrapped by the errors of hash signers given a
+// hash whose length does not match the hash function of the signer
+var ErrInvalidHashLength = errors.New("invalid input hash length")
+
 // DataSigner is an interface to a signer able to sign raw data
 type DataSigner interface {
 	SignData(data []byte, options interface{}) (Signature, error)
@@ -187,6 +438,63 @@ type FileSigner interface {
 	GetDefaultOptions() interface{}
 }
 
+// ErrInvalidInput is wrapped by the errors of file signers given an
+// input that is not in one of the formats they sign
+var ErrInvalidInput = errors.New("invalid input")
+
+// InputFormat is a format of the inputs of a file signer, identified
+// by the magic bytes files of its content type start with
+type InputFormat struct {
+	ContentType string
+	Magic       []byte
+}
+
+// InputFormatDeclarer is an interface to a file signer that only signs
+// inputs in the formats it declares, and checks inputs with
+// CheckInputFormat before signing them e.g. to fail with a clear error
+// rather than the output of the tool it shells out to
+type InputFormatDeclarer interface {
+	InputFormats() []InputFormat
+}
+
+// CheckInputFormat returns an error wrapping ErrInvalidInput when the
+// header of an input does not start with the magic bytes of any of the
+// input formats. The header is the start of the input, which must be
+// at least as long as the longest magic bytes unless the input is
+// shorter.
+func CheckInputFormat(header []byte, inputFormats []InputFormat) error {
+	if len(inputFormats) == 0 {
+		return nil
+	}
+	contentTypes := make([]string, len(inputFormats))
+	for i, inputFormat := range inputFormats {
+		if bytes.HasPrefix(header, inputFormat.Magic) {
+			return nil
+		}
+		contentTypes[i] = inputFormat.ContentType
+	}
+	if len(header) > 8 {
+		header = header[:8]
+	}
+	return fmt.Errorf("%w: expected a file of type %s but input starts with %x",
+		ErrInvalidInput, strings.Join(contentTypes, " or "), header)
+}
+
+// ContextFileSigner is an interface to a file signer that stops
+// signing and returns an error wrapping the context error when its
+// context is canceled or its deadline expires
+type ContextFileSigner interface {
+	SignFileContext(ctx context.Context, file []byte, options interface{}) (SignedFile, error)
+}
+
+// SidecarFileSigner is an interface to a file signer that can also
+// output a sidecar file next to the signed file, e.g. the v4 signature
+// of an APK. The sidecar is nil when the options do not enable it.
+// Signing stops when the context is done like a ContextFileSigner.
+type SidecarFileSigner interface {
+	SignFileWithSidecar(ctx context.Context, file []byte, options interface{}) (signed SignedFile, sidecar []byte, err error)
+}
+
 // MultipleFileSigner is an interface to a signer that signs multiple
 // files in one signing operation
 type MultipleFileSigner interface {
@@ -194,11 +502,176 @@ type MultipleFileSigner interface {
 	GetDefaultOptions() interface{}
 }
 
+// FileStreamSigner is an interface to a signer able to sign files
+// read from input and written to output without holding the whole
+// file in memory. It is a library API: the signing endpoints read
+// their whole request body and do not use it.
+type FileStreamSigner interface {
+	SignFileStream(input io.Reader, output io.Writer, options interface{}) error
+}
+
+// sizedReaderAt is a reader with random access to its known size
+// bytes, e.g. a *bytes.Reader or an *io.SectionReader
+type sizedReaderAt interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// StreamInputSize returns the size of the input of a FileStreamSigner
+// when it is known without reading it, and -1 otherwise
+func StreamInputSize(input io.Reader) int64 {
+	if sized, ok := input.(sizedReaderAt); ok {
+		return sized.Size()
+	}
+	return -1
+}
+
+// SpoolFileStream returns the input of a FileStreamSigner with random
+// access and its size, for signers that read their input more than
+// once. Inputs with a known size like *bytes.Reader are returned as
+// is, other inputs are copied to a temp file that cleanup removes. It
+// errors when the input is larger than maxSize bytes.
+func SpoolFileStream(input io.Reader, maxSize int64) (spooled io.ReaderAt, size int64, cleanup func(), err error) {
+	if sized, ok := input.(sizedReaderAt); ok {
+		if sized.Size() > maxSize {
+			return nil, 0, nil, fmt.Errorf("signer: input of %d bytes is larger than %d bytes", sized.Size(), maxSize)
+		}
+		return sized, sized.Size(), func() {}, nil
+	}
+	tmpFile, err := os.CreateTemp("", "autograph_stream_")
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("signer: failed to create temp file to spool input: %w", err)
+	}
+	cleanup = func() {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+	}
+	size, err = io.Copy(tmpFile, io.LimitReader(input, maxSize+1))
+	if err != nil {
+		cleanup()
+		return nil, 0, nil, fmt.Errorf("signer: failed to spool input: %w", err)
+	}
+	if size > maxSize {
+		cleanup()
+		return nil, 0, nil, fmt.Errorf("signer: input is larger than %d bytes", maxSize)
+	}
+	return tmpFile, size, cleanup, nil
+}
+
+// Wrapper is an interface to a signer that wraps another signer, e.g.
+// to enforce policies. Wrappers implement all the signing interfaces,
+// the interfaces they support are those of their innermost signer.
+type Wrapper interface {
+	Unwrap() Signer
+}
+
+// Unwrap returns the innermost signer wrapped by s, or s when it does
+// not wrap another signer
+func Unwrap(s Signer) Signer {
+	for {
+		w, ok := s.(Wrapper)
+		if !ok {
+			return s
+		}
+		s = w.Unwrap()
+	}
+}
+
+// SignedDataHasher is an interface to a signer able to return the
+// hex encoded hash of the data it would sign for a /sign/data input
+// without signing it. Comparing hashes across runs checks that the
+// signed data is deterministic even when signatures are randomized.
+type SignedDataHasher interface {
+	SignedDataHash(data []byte, options interface{}) (string, error)
+}
+
+// SignedFileHasher is an interface to a signer able to return the
+// hex encoded hash of the manifest it would sign for a /sign/file
+// input without signing it
+type SignedFileHasher interface {
+	SignedFileHash(file []byte, options interface{}) (string, error)
+}
+
+// ToolVersioner is an interface to a signer that shells out to an
+// external tool and reports the version of that tool, so signatures
+// can be correlated with tool upgrades. An empty version means it
+// could not be determined.
+type ToolVersioner interface {
+	ToolVersion() string
+}
+
+// ToolError is the error of a failed run of the external tool a
+// signer shells out to, it holds the redacted output of the tool so
+// it can be logged in a field of its own
+type ToolError struct {
+	// Msg describes the failed operation e.g. "apk2: failed to sign"
+	Msg string
+
+	// Tool is the name of the tool e.g. "apksigner"
+	Tool string
+
+	// Version is the version of the tool, empty when unknown
+	Version string
+
+	// Output is the combined output of the tool as returned by
+	// LogOutput
+	Output string
+
+	// Err is the error running the tool
+	Err error
+}
+
+func (e *ToolError) Error() string {
+	return fmt.Sprintf("%s\n%s: %v", e.Msg, e.Output, e.Err)
+}
+
+func (e *ToolError) Unwrap() error {
+	return e.Err
+}
+
+// CertFingerprinter is an interface to a signer that embeds a
+// certificate in its signed files and reports the hex encoded SHA-256
+// fingerprint of that certificate, so clients can check the signing
+// identity without parsing the signed files
+type CertFingerprinter interface {
+	CertFingerprint() string
+}
+
+// CertificateInfoer is an interface to a signer with a certificate
+// that parses it once at initialization and returns its fields
+type CertificateInfoer interface {
+	CertificateInfo() *formats.CertificateInfo
+}
+
+// ChainIncluder is an interface to a signer that can return the PEM
+// certificate chain of its signatures inline in signature responses,
+// for clients that cannot fetch the chain at its x5u. It returns the
+// PEM certificates of the chain, end-entity first, when the request
+// options ask for them and nil otherwise.
+type ChainIncluder interface {
+	IncludedChain(options interface{}) ([]string, error)
+}
+
 // Signature is an interface to a digital signature
 type Signature interface {
 	Marshal() (signature string, err error)
 }
 
+// FormattedSignature is an interface to a signature that can be
+// returned in several forms, e.g. armored or binary, and reports the
+// form of its marshaled signature so clients handle it accordingly
+type FormattedSignature interface {
+	Format() string
+}
+
+// SignerOptsSignature is an interface to a signature that may be made
+// with other signer options than the ones of the signer configuration,
+// e.g. with a hash chosen by the request options. They are returned in
+// the signer_opts of its response instead.
+type SignerOptsSignature interface {
+	SignerOpts() crypto.SignerOpts
+}
+
 // SignedFile is an []bytes that contains file data
 type SignedFile []byte
 
@@ -213,8 +686,11 @@ type NamedUnsignedFile namedFile
 // NamedSignedFile is a file with a name that's been signed
 type NamedSignedFile namedFile
 
-// isValidUnsignedFilename
-func isValidUnsignedFilename(filename string) error {
+// CheckUnsignedFilename returns an error when the name of a file to
+// sign is not alphanumeric characters and -_.+~ of at most 256
+// characters, starting and ending with an alphanumeric character and
+// without ..
+func CheckUnsignedFilename(filename string) error {
 	if !regexp.MustCompile(`^[a-zA-Z0-9]`).MatchString(filename) {
 		return fmt.Errorf("unsigned filename must start with an alphanumeric character")
 	}
@@ -236,12 +712,12 @@ func isValidUnsignedFilename(filename string) error {
 // NamedUnsignedFile from a REST format SigningFile. It base64 decodes
 // the REST SigningFile.Content into NamedUnsignedFile.Bytes.
 func NewNamedUnsignedFile(restSigningFile formats.SigningFile) (*NamedUnsignedFile, error) {
-	if err := isValidUnsignedFilename(restSigningFile.Name); err != nil {
+	if err := CheckUnsignedFilename(restSigningFile.Name); err != nil {
 		return nil, fmt.Errorf("invalid named file name: %w", err)
 	}
 	fileBytes, err := base64.StdEncoding.DecodeString(restSigningFile.Content)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to base64 decode content of named file %q: %w", restSigningFile.Name, err)
 	}
 	return &NamedUnsignedFile{
 		Name:  restSigningFile.Name,
@@ -265,6 +741,127 @@ type TestFileGetter interface {
 	GetTestFile() (testfile []byte)
 }
 
+// TestFilePreferrer is an interface to a signer implementing both
+// DataSigner and FileSigner that is checked with its test file rather
+// than the monitoring input when PrefersTestFile returns true, e.g.
+// because its data signatures do not exercise its configuration
+type TestFilePreferrer interface {
+	PrefersTestFile() bool
+}
+
+// UsesTestFile returns whether a signer is checked by the monitor and
+// TestSigner by signing its test file rather than the monitoring input:
+// file signers that do not sign data, and signers that prefer their
+// test file
+func UsesTestFile(s Signer) bool {
+	s = Unwrap(s)
+	if _, ok := s.(FileSigner); !ok {
+		return false
+	}
+	if _, ok := s.(DataSigner); !ok {
+		return true
+	}
+	testFilePreferrer, ok := s.(TestFilePreferrer)
+	return ok && testFilePreferrer.PrefersTestFile()
+}
+
+// DataVerifier is an interface to a data signer able to verify the
+// signatures it returns with its own keys
+type DataVerifier interface {
+	VerifyData(data []byte, sig Signature) error
+}
+
+// FileVerifier is an interface to a file signer able to verify the
+// signed files it returns with its own keys
+type FileVerifier interface {
+	VerifyFile(file []byte, signed SignedFile) error
+}
+
+// TestSignerInput is the data TestSigner signs with data signers. It
+// is the monitoring input, which gpg2 signers in debsign mode accept.
+var TestSignerInput = []byte(`AUTOGRAPH MONITORING`)
+
+// TestSigner checks that a signer produces valid signatures. Data
+// signers sign TestSignerInput and file signers sign their test file
+// with their default options, and the result is verified with the
+// keys of the signer. Signers that prefer their test file are tested
+// as file signers. The policies wrapping the signer are
+// bypassed. TestSigner does not upload or store anything, but
+// initializing the signer may, e.g. contentsignaturepki.New uploads
+// its chain, use contentsignaturepki.NewDryRun to test a configuration
+// before it is deployed.
+func TestSigner(s Signer) error {
+	return TestSignerContext(context.Background(), s)
+}
+
+// TestSignerContext is TestSigner but stops when the context is done.
+// File signers implementing ContextFileSigner are canceled with the
+// context, other signers are only checked before each step.
+func TestSignerContext(ctx context.Context, s Signer) error {
+	s = Unwrap(s)
+	conf := s.Config()
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("signer: test of signer %q stopped: %w", conf.ID, err)
+	}
+	if dataSigner, ok := s.(DataSigner); ok && !UsesTestFile(s) {
+		dataVerifier, ok := s.(DataVerifier)
+		if !ok {
+			return fmt.Errorf("signer: signer %q of type %q does not implement the DataVerifier interface", conf.ID, conf.Type)
+		}
+		sig, err := dataSigner.SignData(TestSignerInput, dataSigner.GetDefaultOptions())
+		if err != nil {
+			return fmt.Errorf("signer: signer %q failed to sign test input: %w", conf.ID, err)
+		}
+		_, err = sig.Marshal()
+		if err != nil {
+			return fmt.Errorf("signer: signer %q failed to marshal signature of test input: %w", conf.ID, err)
+		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("signer: test of signer %q stopped: %w", conf.ID, err)
+		}
+		err = dataVerifier.VerifyData(TestSignerInput, sig)
+		if err != nil {
+			return fmt.Errorf("signer: signature of test input by signer %q does not verify: %w", conf.ID, err)
+		}
+		return nil
+	}
+
+	if fileSigner, ok := s.(FileSigner); ok {
+		testFileGetter, ok := s.(TestFileGetter)
+		if !ok {
+			return fmt.Errorf("signer: signer %q of type %q does not implement the TestFileGetter interface", conf.ID, conf.Type)
+		}
+		fileVerifier, ok := s.(FileVerifier)
+		if !ok {
+			return fmt.Errorf("signer: signer %q of type %q does not implement the FileVerifier interface", conf.ID, conf.Type)
+		}
+		var (
+			testFile = testFileGetter.GetTestFile()
+			signed   SignedFile
+			err      error
+		)
+		if contextSigner, ok := s.(ContextFileSigner); ok {
+			signed, err = contextSigner.SignFileContext(ctx, testFile, fileSigner.GetDefaultOptions())
+		} else {
+			signed, err = fileSigner.SignFile(testFile, fileSigner.GetDefaultOptions())
+		}
+		if err != nil {
+			return fmt.Errorf("signer: signer %q failed to sign test file: %w", conf.ID, err)
+		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("signer: test of signer %q stopped: %w", conf.ID, err)
+		}
+		err = fileVerifier.VerifyFile(testFile, signed)
+		if err != nil {
+			return fmt.Errorf("signer: test file signed by signer %q does not verify: %w", conf.ID, err)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("signer: signer %q does not implement the DataSigner or FileSigner interfaces", conf.ID)
+}
+
 // GetRand returns a cryptographically secure random number from the
 // HSM if available and otherwise rand.Reader
 func (cfg *Configuration) GetRand() io.Reader {
@@ -297,6 +894,10 @@ func (cfg *Configuration) GetKeys() (priv crypto.PrivateKey, pub crypto.PublicKe
 		pub = privateKey.Public()
 		unmarshaledPub = &privateKey.PublicKey
 
+	case ed25519.PrivateKey:
+		pub = privateKey.Public()
+		unmarshaledPub = pub
+
 	case *crypto11.PKCS11PrivateKeyECDSA:
 		pub = privateKey.Public()
 		unmarshaledPub = privateKey.PubKey.(*ecdsa.PublicKey)
@@ -305,6 +906,14 @@ func (cfg *Configuration) GetKeys() (priv crypto.PrivateKey, pub crypto.PublicKe
 		pub = privateKey.Public()
 		unmarshaledPub = privateKey.PubKey.(*rsa.PublicKey)
 
+	case *awsKMSPrivateKey:
+		pub = privateKey.Public()
+		unmarshaledPub = pub
+
+	case *azureKeyVaultPrivateKey:
+		pub = privateKey.Public()
+		unmarshaledPub = pub
+
 	default:
 		err = fmt.Errorf("unsupported private key type %T", priv)
 		return
@@ -330,11 +939,28 @@ func (cfg *Configuration) GetKeys() (priv crypto.PrivateKey, pub crypto.PublicKe
 // caller, who should simply assume that the privatekey implements a
 // crypto.Sign interface
 //
+// A private key of the form `awssm://<secret>` is the PEM key stored in
+// an AWS Secrets Manager secret, and one of the form `awskms://<key>`
+// is an asymmetric AWS KMS key that signs via the KMS API. Both are
+// resolved when the key is loaded. Likewise, one of the form
+// `azurekv://<vault>/<key>` is an Azure Key Vault key that signs via
+// the Key Vault API.
+//
 // Note that we assume the PKCS11 library has been previously initialized
 func (cfg *Configuration) GetPrivateKey() (crypto.PrivateKey, error) {
 	cfg.PrivateKey = removePrivateKeyNewlines(cfg.PrivateKey)
+	if cfg.PrivateKeyHasAWSPrefix() {
+		return cfg.getAWSPrivateKey()
+	}
+	if cfg.PrivateKeyHasAzurePrefix() {
+		return cfg.getAzurePrivateKey()
+	}
 	if cfg.PrivateKeyHasPEMPrefix() {
-		return ParsePrivateKey([]byte(cfg.PrivateKey))
+		passphrase, err := cfg.getPrivateKeyPassphrase()
+		if err != nil {
+			return nil, err
+		}
+		return ParseEncryptedPrivateKey([]byte(cfg.PrivateKey), passphrase)
 	}
 	// otherwise, we assume the privatekey represents a label in the HSM
 	if cfg.isHsmAvailable {
@@ -347,10 +973,75 @@ func (cfg *Configuration) GetPrivateKey() (crypto.PrivateKey, error) {
 	return nil, fmt.Errorf("no suitable key found")
 }
 
+// ErrNonExportableKey is returned by signers that pass their private
+// key to an external tool when the key is in the HSM and cannot be
+// exported
+var ErrNonExportableKey = errors.New("signer: non-exportable HSM key unsupported")
+
+// IsHSMKey returns whether a private key returned by GetPrivateKey is
+// a handle to a key in the HSM, which signs via PKCS11 and whose key
+// material cannot be marshalled
+func IsHSMKey(priv crypto.PrivateKey) bool {
+	switch priv.(type) {
+	case *crypto11.PKCS11PrivateKeyECDSA, *crypto11.PKCS11PrivateKeyRSA:
+		return true
+	}
+	return false
+}
+
+// GetPKCS8PrivateKey returns the private key of a signer
+// configuration and its PKCS8 DER encoding, for signers that pass the
+// key to an external tool in a file. Its error wraps
+// ErrNonExportableKey when the key is in the HSM, AWS KMS or Azure Key
+// Vault.
+func (cfg *Configuration) GetPKCS8PrivateKey() (priv crypto.PrivateKey, pkcs8Key []byte, err error) {
+	priv, err = cfg.GetPrivateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	if IsHSMKey(priv) {
+		return nil, nil, fmt.Errorf("signer: cannot export HSM key %q: %w", cfg.PrivateKey, ErrNonExportableKey)
+	}
+	if IsAWSKMSKey(priv) {
+		return nil, nil, fmt.Errorf("signer: cannot export AWS KMS key %q: %w", cfg.PrivateKey, ErrNonExportableKey)
+	}
+	if IsAzureKeyVaultKey(priv) {
+		return nil, nil, fmt.Errorf("signer: cannot export Azure Key Vault key %q: %w", cfg.PrivateKey, ErrNonExportableKey)
+	}
+	pkcs8Key, err = x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("signer: failed to encode private key to pkcs8: %w", err)
+	}
+	return priv, pkcs8Key, nil
+}
+
+// getPrivateKeyPassphrase returns the passphrase to decrypt the
+// private key from the environment or configuration, or nil when none
+// is configured
+func (cfg *Configuration) getPrivateKeyPassphrase() ([]byte, error) {
+	if cfg.PrivateKeyPassphraseEnv != "" {
+		passphrase, ok := os.LookupEnv(cfg.PrivateKeyPassphraseEnv)
+		if !ok {
+			return nil, fmt.Errorf("signer: environment variable %q for the private key passphrase is not set", cfg.PrivateKeyPassphraseEnv)
+		}
+		return []byte(passphrase), nil
+	}
+	if cfg.PrivateKeyPassphrase != "" {
+		return []byte(cfg.PrivateKeyPassphrase), nil
+	}
+	return nil, nil
+}
+
 // ParsePrivateKey takes a PEM blocks are returns a crypto.PrivateKey
 // It tries to parse as many known key types as possible before failing and
 // returning all the errors it encountered.
 func ParsePrivateKey(keyPEMBlock []byte) (key crypto.PrivateKey, err error) {
+	return ParseEncryptedPrivateKey(keyPEMBlock, nil)
+}
+
+// ParseEncryptedPrivateKey is like ParsePrivateKey but first decrypts
+// PEM blocks encrypted with a Proc-Type header using the passphrase
+func ParseEncryptedPrivateKey(keyPEMBlock, passphrase []byte) (key crypto.PrivateKey, err error) {
 	var (
 		keyDERBlock       *pem.Block
 		skippedBlockTypes []string
@@ -369,24 +1060,38 @@ func ParsePrivateKey(keyPEMBlock []byte) (key crypto.PrivateKey, err error) {
 		}
 		skippedBlockTypes = append(skippedBlockTypes, keyDERBlock.Type)
 	}
+	if keyDERBlock.Type == "ENCRYPTED PRIVATE KEY" {
+		return nil, fmt.Errorf("signer: encrypted PKCS8 private keys are not supported, use a PEM private key with a Proc-Type encryption header")
+	}
+	keyDER := keyDERBlock.Bytes
+	// decrypt keys encrypted with openssl's legacy PEM encryption
+	if x509.IsEncryptedPEMBlock(keyDERBlock) {
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("signer: private key is encrypted but no passphrase is configured")
+		}
+		keyDER, err = x509.DecryptPEMBlock(keyDERBlock, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("signer: failed to decrypt private key: %w", err)
+		}
+	}
 	// Attempt to parse the given private key DER block. OpenSSL 0.9.8 generates
 	// PKCS#1 private keys by default, while OpenSSL 1.0.0 generates PKCS#8 keys.
 	// OpenSSL ecparam generates SEC1 EC private keys for ECDSA. We try all three.
 	// Code taken from the crypto/tls standard library.
-	if key, err = x509.ParsePKCS1PrivateKey(keyDERBlock.Bytes); err == nil {
+	if key, err = x509.ParsePKCS1PrivateKey(keyDER); err == nil {
 		return key, nil
 	}
 	var savedErr []string
 	savedErr = append(savedErr, "pkcs1: "+err.Error())
-	if key, err = x509.ParsePKCS8PrivateKey(keyDERBlock.Bytes); err == nil {
+	if key, err = x509.ParsePKCS8PrivateKey(keyDER); err == nil {
 		switch key := key.(type) {
-		case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
 			return key, nil
 		}
 	}
 	savedErr = append(savedErr, "pkcs8: "+err.Error())
 
-	if key, err = x509.ParseECPrivateKey(keyDERBlock.Bytes); err == nil {
+	if key, err = x509.ParseECPrivateKey(keyDER); err == nil {
 		return key, nil
 	}
 	savedErr = append(savedErr, "ecdsa: "+err.Error())
@@ -409,6 +1114,36 @@ func (cfg *Configuration) PrivateKeyHasPEMPrefix() bool {
 	return strings.HasPrefix(removePrivateKeyNewlines(cfg.PrivateKey), "-----BEGIN")
 }
 
+// ValidateSignedFileSizeBounds returns an error when the signed file
+// size ratios of the configuration are negative or when the minimum
+// ratio is larger than the maximum
+func (cfg *Configuration) ValidateSignedFileSizeBounds() error {
+	if cfg.SignedFileMinSizeRatio < 0 || cfg.SignedFileMaxSizeRatio < 0 {
+		return fmt.Errorf("signer: signed file size ratios must not be negative")
+	}
+	if cfg.SignedFileMaxSizeRatio > 0 && cfg.SignedFileMinSizeRatio > cfg.SignedFileMaxSizeRatio {
+		return fmt.Errorf("signer: signed file minimum size ratio %g is larger than maximum size ratio %g",
+			cfg.SignedFileMinSizeRatio, cfg.SignedFileMaxSizeRatio)
+	}
+	return nil
+}
+
+// CheckSignedFileSize returns an error when the size of a signed
+// file is outside of the bounds the configuration sets relative to
+// the size of its unsigned input. Bounds that are not set are not
+// checked.
+func (cfg *Configuration) CheckSignedFileSize(inputSize, signedSize int) error {
+	if cfg.SignedFileMinSizeRatio > 0 && float64(signedSize) < cfg.SignedFileMinSizeRatio*float64(inputSize) {
+		return fmt.Errorf("signer: signed file of %d bytes is smaller than the minimum of %g times the %d bytes input",
+			signedSize, cfg.SignedFileMinSizeRatio, inputSize)
+	}
+	if cfg.SignedFileMaxSizeRatio > 0 && float64(signedSize) > cfg.SignedFileMaxSizeRatio*float64(inputSize) {
+		return fmt.Errorf("signer: signed file of %d bytes is larger than the maximum of %g times the %d bytes input",
+			signedSize, cfg.SignedFileMaxSizeRatio, inputSize)
+	}
+	return nil
+}
+
 // CheckHSMConnection is the default implementation of
 // CheckHSMConnection (exposed via the signer.Configuration
 // interface).  It tried to fetch the signer private key and errors if
@@ -417,6 +1152,12 @@ func (cfg *Configuration) CheckHSMConnection() error {
 	if cfg.PrivateKeyHasPEMPrefix() {
 		return fmt.Errorf("private key for signer %s has a PEM prefix and is not an HSM key label", cfg.ID)
 	}
+	if cfg.PrivateKeyHasAWSPrefix() {
+		return fmt.Errorf("private key for signer %s is an AWS reference and not an HSM key label", cfg.ID)
+	}
+	if cfg.PrivateKeyHasAzurePrefix() {
+		return fmt.Errorf("private key for signer %s is an Azure Key Vault reference and not an HSM key label", cfg.ID)
+	}
 	if !cfg.isHsmAvailable {
 		return fmt.Errorf("HSM is not available for signer %s", cfg.ID)
 	}
@@ -474,6 +1215,8 @@ func (cfg *Configuration) MakeKey(keyTpl interface{}, keyName string) (priv cryp
 			priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 		case "P-384":
 			priv, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		case "P-521":
+			priv, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
 		default:
 			return nil, nil, fmt.Errorf("unsupported curve %q",
 				keyTpl.(*ecdsa.PublicKey).Params().Name)
@@ -0,0 +1,299 @@
+package standby // import "github.com/mozilla-services/autograph/signer/standby"
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/autograph/signer"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultProbeInterval is the default interval between two
+	// health probes of the backends of a signer
+	DefaultProbeInterval = 10 * time.Second
+)
+
+// probeInput is the data the backends sign to probe their health
+var probeInput = []byte("AUTOGRAPH STANDBY PROBE")
+
+// Signer routes signing operations to the first healthy backend of a
+// primary and its standby backends. The health of the backends is
+// probed periodically, so the selection changes before signing
+// requests fail.
+type Signer struct {
+	id            string
+	probeInterval time.Duration
+
+	// backends are the primary backend followed by the standby
+	// backends in order of preference, they all implement
+	// signer.DataSigner to be probed
+	backends []signer.Signer
+
+	// mu protects healthy and active
+	mu      sync.RWMutex
+	healthy []bool
+	active  int
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// New initializes a signer with its primary and standby backends and
+// starts probing their health. newBackend initializes the backend
+// signer of a configuration.
+func New(conf signer.Configuration, newBackend func(signer.Configuration) (signer.Signer, error)) (s *Signer, err error) {
+	s = new(Signer)
+
+	if conf.ID == "" {
+		return nil, fmt.Errorf("standby: missing signer ID in signer configuration")
+	}
+	s.id = conf.ID
+	if len(conf.Standby) == 0 {
+		return nil, fmt.Errorf("standby %q: must have at least 1 standby backend", s.id)
+	}
+	if conf.StandbyProbeInterval < 0 {
+		return nil, fmt.Errorf("standby %q: probe interval must not be negative, got %s", s.id, conf.StandbyProbeInterval)
+	}
+	s.probeInterval = conf.StandbyProbeInterval
+	if s.probeInterval == 0 {
+		s.probeInterval = DefaultProbeInterval
+	}
+
+	// the primary backend is the signer configuration itself
+	primaryConf := conf
+	primaryConf.Standby = nil
+	primaryConf.StandbyProbeInterval = 0
+	primaryConf.Policies = nil
+	backendConfs := []signer.Configuration{primaryConf}
+	for i, backendConf := range conf.Standby {
+		// standby backends sign as the signer, so responses and
+		// authorizations do not depend on the selected backend
+		if backendConf.ID == "" {
+			backendConf.ID = conf.ID
+		}
+		if backendConf.ID != conf.ID {
+			return nil, fmt.Errorf("standby %q: standby backend %d has ID %q, must be empty or %q", s.id, i, backendConf.ID, conf.ID)
+		}
+		if backendConf.Type == "" {
+			backendConf.Type = conf.Type
+		}
+		if backendConf.Type != conf.Type {
+			return nil, fmt.Errorf("standby %q: standby backend %d has type %q, must be %q", s.id, i, backendConf.Type, conf.Type)
+		}
+		if len(backendConf.Standby) > 0 || len(backendConf.Policies) > 0 {
+			return nil, fmt.Errorf("standby %q: standby backend %d must not have standby backends or policies", s.id, i)
+		}
+		backendConfs = append(backendConfs, backendConf)
+	}
+	for i, backendConf := range backendConfs {
+		backend, err := newBackend(backendConf)
+		if err != nil {
+			return nil, fmt.Errorf("standby %q: failed to initialize backend %d: %w", s.id, i, err)
+		}
+		if _, ok := signer.Unwrap(backend).(signer.DataSigner); !ok {
+			return nil, fmt.Errorf("standby %q: backend %d does not implement data signing to probe its health", s.id, i)
+		}
+		s.backends = append(s.backends, backend)
+	}
+	s.healthy = make([]bool, len(s.backends))
+
+	s.probe()
+	s.stop = make(chan struct{})
+	go s.run()
+	return
+}
+
+// run probes the health of the backends every probe interval until
+// the signer is stopped
+func (s *Signer) run() {
+	ticker := time.NewTicker(s.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.probe()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// probe checks the health of each backend and selects the first
+// healthy one. The selection does not change when no backend is
+// healthy.
+func (s *Signer) probe() {
+	healthy := make([]bool, len(s.backends))
+	for i, backend := range s.backends {
+		err := s.probeBackend(backend)
+		if err != nil {
+			log.Warnf("standby %q: backend %d failed its health probe: %v", s.id, i, err)
+			continue
+		}
+		healthy[i] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.healthy = healthy
+	for i := range healthy {
+		if !healthy[i] {
+			continue
+		}
+		if i != s.active {
+			log.Warnf("standby %q: switching from backend %d to healthy backend %d", s.id, s.active, i)
+			s.active = i
+		}
+		return
+	}
+	log.Errorf("standby %q: no healthy backend, keeping backend %d", s.id, s.active)
+}
+
+// probeBackend signs the probe input with a backend, and errors when
+// signing fails or takes longer than the probe interval
+func (s *Signer) probeBackend(backend signer.Signer) error {
+	result := make(chan error, 1)
+	go func() {
+		_, err := backend.(signer.DataSigner).SignData(probeInput, backend.(signer.DataSigner).GetDefaultOptions())
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(s.probeInterval):
+		return fmt.Errorf("health probe timed out after %s", s.probeInterval)
+	}
+}
+
+// current returns the selected backend
+func (s *Signer) current() signer.Signer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.backends[s.active]
+}
+
+// Unwrap returns the selected backend
+func (s *Signer) Unwrap() signer.Signer {
+	return s.current()
+}
+
+// Config returns the configuration of the selected backend
+func (s *Signer) Config() signer.Configuration {
+	return s.current().Config()
+}
+
+// notImplemented returns the error of a signing method the backends
+// do not implement
+func (s *Signer) notImplemented(method string) error {
+	return fmt.Errorf("standby: signer %q does not implement %s", s.id, method)
+}
+
+// SignHash signs a hash with the selected backend
+func (s *Signer) SignHash(hashed []byte, options interface{}) (signer.Signature, error) {
+	hashSigner, ok := s.current().(signer.HashSigner)
+	if !ok {
+		return nil, s.notImplemented("SignHash")
+	}
+	return hashSigner.SignHash(hashed, options)
+}
+
+// SignData signs data with the selected backend
+func (s *Signer) SignData(data []byte, options interface{}) (signer.Signature, error) {
+	return s.current().(signer.DataSigner).SignData(data, options)
+}
+
+// SignFile signs a file with the selected backend
+func (s *Signer) SignFile(file []byte, options interface{}) (signer.SignedFile, error) {
+	fileSigner, ok := s.current().(signer.FileSigner)
+	if !ok {
+		return nil, s.notImplemented("SignFile")
+	}
+	return fileSigner.SignFile(file, options)
+}
+
+// SignFileContext signs a file with the selected backend until the
+// context is done
+func (s *Signer) SignFileContext(ctx context.Context, file []byte, options interface{}) (signer.SignedFile, error) {
+	contextSigner, ok := s.current().(signer.ContextFileSigner)
+	if !ok {
+		return nil, s.notImplemented("SignFileContext")
+	}
+	return contextSigner.SignFileContext(ctx, file, options)
+}
+
+// SignFileWithSidecar signs a file with the selected backend and
+// returns its sidecar file
+func (s *Signer) SignFileWithSidecar(ctx context.Context, file []byte, options interface{}) (signer.SignedFile, []byte, error) {
+	sidecarSigner, ok := s.current().(signer.SidecarFileSigner)
+	if !ok {
+		return nil, nil, s.notImplemented("SignFileWithSidecar")
+	}
+	return sidecarSigner.SignFileWithSidecar(ctx, file, options)
+}
+
+// SignFiles signs files with the selected backend
+func (s *Signer) SignFiles(files []signer.NamedUnsignedFile, options interface{}) ([]signer.NamedSignedFile, error) {
+	multiFileSigner, ok := s.current().(signer.MultipleFileSigner)
+	if !ok {
+		return nil, s.notImplemented("SignFiles")
+	}
+	return multiFileSigner.SignFiles(files, options)
+}
+
+// SignFileStream signs a file stream with the selected backend
+func (s *Signer) SignFileStream(input io.Reader, output io.Writer, options interface{}) error {
+	streamSigner, ok := s.current().(signer.FileStreamSigner)
+	if !ok {
+		return s.notImplemented("SignFileStream")
+	}
+	return streamSigner.SignFileStream(input, output, options)
+}
+
+// SignedDataHash returns the hash of the data the selected backend
+// would sign
+func (s *Signer) SignedDataHash(data []byte, options interface{}) (string, error) {
+	dataHasher, ok := s.current().(signer.SignedDataHasher)
+	if !ok {
+		return "", s.notImplemented("SignedDataHash")
+	}
+	return dataHasher.SignedDataHash(data, options)
+}
+
+// SignedFileHash returns the hash of the manifest the selected
+// backend would sign
+func (s *Signer) SignedFileHash(file []byte, options interface{}) (string, error) {
+	fileHasher, ok := s.current().(signer.SignedFileHasher)
+	if !ok {
+		return "", s.notImplemented("SignedFileHash")
+	}
+	return fileHasher.SignedFileHash(file, options)
+}
+
+// GetDefaultOptions returns the default options of the selected backend
+func (s *Signer) GetDefaultOptions() interface{} {
+	return s.current().(signer.DataSigner).GetDefaultOptions()
+}
+
+// AtExit stops the health probes and cleans up the backends that are
+// StatefulSigners
+func (s *Signer) AtExit() error {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	var firstErr error
+	for i, backend := range s.backends {
+		statefulSigner, ok := backend.(signer.StatefulSigner)
+		if !ok {
+			continue
+		}
+		err := statefulSigner.AtExit()
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("standby %q: failed to clean up backend %d: %w", s.id, i, err)
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,227 @@
+package standby
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/autograph/signer"
+)
+
+// testBackend is a data signer whose health is set by the tests
+type testBackend struct {
+	signer.Configuration
+
+	mu      sync.Mutex
+	failing bool
+	signed  int
+}
+
+func (b *testBackend) setFailing(failing bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failing = failing
+}
+
+func (b *testBackend) Config() signer.Configuration {
+	return b.Configuration
+}
+
+func (b *testBackend) SignData(data []byte, options interface{}) (signer.Signature, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failing {
+		return nil, fmt.Errorf("hsm unavailable")
+	}
+	b.signed++
+	return nil, nil
+}
+
+func (b *testBackend) GetDefaultOptions() interface{} {
+	return nil
+}
+
+// hashOnlyBackend cannot sign data and cannot be probed
+type hashOnlyBackend struct {
+	signer.Configuration
+}
+
+func (b *hashOnlyBackend) Config() signer.Configuration {
+	return b.Configuration
+}
+
+func (b *hashOnlyBackend) SignHash(hashed []byte, options interface{}) (signer.Signature, error) {
+	return nil, nil
+}
+
+func testConf() signer.Configuration {
+	return signer.Configuration{
+		ID:   "testsigner",
+		Type: "test",
+		// the label of the key identifies the backend in the tests
+		PrivateKey:           "primary",
+		StandbyProbeInterval: time.Hour,
+		Standby: []signer.Configuration{
+			{PrivateKey: "standby1"},
+			{ID: "testsigner", Type: "test", PrivateKey: "standby2"},
+		},
+	}
+}
+
+// newTestSigner returns a standby signer of testConf and its
+// backends by key label, with the backends failing by label
+func newTestSigner(t *testing.T, failing ...string) (*Signer, map[string]*testBackend) {
+	backends := make(map[string]*testBackend)
+	s, err := New(testConf(), func(conf signer.Configuration) (signer.Signer, error) {
+		backend := &testBackend{Configuration: conf}
+		for _, label := range failing {
+			if label == conf.PrivateKey {
+				backend.failing = true
+			}
+		}
+		backends[conf.PrivateKey] = backend
+		return backend, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to initialize signer: %v", err)
+	}
+	return s, backends
+}
+
+func expectActive(t *testing.T, s *Signer, label string) {
+	t.Helper()
+	if s.Config().PrivateKey != label {
+		t.Fatalf("expected backend %q to be selected but got %q", label, s.Config().PrivateKey)
+	}
+	if s.Unwrap().Config().PrivateKey != label {
+		t.Fatalf("expected unwrapped backend %q but got %q", label, s.Unwrap().Config().PrivateKey)
+	}
+}
+
+func TestNewBackendConfs(t *testing.T) {
+	s, backends := newTestSigner(t)
+	defer s.AtExit()
+
+	if len(backends) != 3 {
+		t.Fatalf("expected 3 backends but got %d", len(backends))
+	}
+	for label, backend := range backends {
+		if backend.ID != "testsigner" || backend.Type != "test" {
+			t.Fatalf("expected backend %q to have the ID and type of the signer but got %q %q", label, backend.ID, backend.Type)
+		}
+		if len(backend.Standby) != 0 || backend.StandbyProbeInterval != 0 {
+			t.Fatalf("expected backend %q to have no standby configuration", label)
+		}
+	}
+	if s.probeInterval != time.Hour {
+		t.Fatalf("expected probe interval of 1h but got %s", s.probeInterval)
+	}
+}
+
+func TestHealthBasedSelection(t *testing.T) {
+	s, backends := newTestSigner(t)
+	defer s.AtExit()
+	expectActive(t, s, "primary")
+
+	// planned maintenance of the primary
+	backends["primary"].setFailing(true)
+	s.probe()
+	expectActive(t, s, "standby1")
+	_, err := s.SignData([]byte("foo"), nil)
+	if err != nil {
+		t.Fatalf("failed to sign with the standby backend: %v", err)
+	}
+	// the standby signed the probes at start and after the
+	// maintenance, and the data
+	if backends["standby1"].signed != 3 {
+		t.Fatalf("expected the standby backend to sign 2 probes and the data, got %d signatures", backends["standby1"].signed)
+	}
+
+	backends["standby1"].setFailing(true)
+	s.probe()
+	expectActive(t, s, "standby2")
+
+	// no healthy backend keeps the selection
+	backends["standby2"].setFailing(true)
+	s.probe()
+	expectActive(t, s, "standby2")
+
+	// the primary is preferred once it recovers
+	backends["primary"].setFailing(false)
+	s.probe()
+	expectActive(t, s, "primary")
+}
+
+func TestSelectionAtStart(t *testing.T) {
+	s, _ := newTestSigner(t, "primary")
+	defer s.AtExit()
+	expectActive(t, s, "standby1")
+}
+
+func TestProbesRun(t *testing.T) {
+	conf := testConf()
+	conf.StandbyProbeInterval = 10 * time.Millisecond
+	backends := make(map[string]*testBackend)
+	s, err := New(conf, func(conf signer.Configuration) (signer.Signer, error) {
+		backends[conf.PrivateKey] = &testBackend{Configuration: conf}
+		return backends[conf.PrivateKey], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.AtExit()
+	expectActive(t, s, "primary")
+
+	backends["primary"].setFailing(true)
+	for i := 0; i < 100 && s.Config().PrivateKey == "primary"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	expectActive(t, s, "standby1")
+}
+
+func TestNewErrs(t *testing.T) {
+	noID := testConf()
+	noID.ID = ""
+	noStandby := testConf()
+	noStandby.Standby = nil
+	negativeInterval := testConf()
+	negativeInterval.StandbyProbeInterval = -time.Second
+	otherID := testConf()
+	otherID.Standby[0].ID = "othersigner"
+	otherType := testConf()
+	otherType.Standby[0].Type = "othertype"
+	nested := testConf()
+	nested.Standby[0].Standby = []signer.Configuration{{}}
+	withPolicies := testConf()
+	withPolicies.Standby[0].Policies = []signer.PolicyConfiguration{{Type: "log"}}
+
+	newBackend := func(conf signer.Configuration) (signer.Signer, error) {
+		return &testBackend{Configuration: conf}, nil
+	}
+	var TESTCASES = []struct {
+		desc       string
+		conf       signer.Configuration
+		newBackend func(signer.Configuration) (signer.Signer, error)
+	}{
+		{"missing ID", noID, newBackend},
+		{"no standby backend", noStandby, newBackend},
+		{"negative probe interval", negativeInterval, newBackend},
+		{"standby with another ID", otherID, newBackend},
+		{"standby with another type", otherType, newBackend},
+		{"nested standby", nested, newBackend},
+		{"standby with policies", withPolicies, newBackend},
+		{"failing backend", testConf(), func(conf signer.Configuration) (signer.Signer, error) {
+			return nil, fmt.Errorf("invalid key")
+		}},
+		{"backend without data signing", testConf(), func(conf signer.Configuration) (signer.Signer, error) {
+			return &hashOnlyBackend{conf}, nil
+		}},
+	}
+	for _, testcase := range TESTCASES {
+		_, err := New(testcase.conf, testcase.newBackend)
+		if err == nil {
+			t.Fatalf("expected signer with %s to fail but it succeeded", testcase.desc)
+		}
+	}
+}
@@ -1,9 +1,11 @@
 package xpi // import "github.com/mozilla-services/autograph/signer/xpi"
 
 import (
+	"archive/zip"
 	"bytes"
 	"crypto"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/asn1"
 	"encoding/base64"
@@ -14,6 +16,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/mozilla-services/autograph/formats"
 	"github.com/mozilla-services/autograph/signer"
 
 	log "github.com/sirupsen/logrus"
@@ -70,6 +73,9 @@ type XPISigner struct {
 	issuerPublicKey crypto.PublicKey
 	issuerCert      *x509.Certificate
 
+	// issuerCertInfo are the fields of the issuer certificate
+	issuerCertInfo *formats.CertificateInfo
+
 	// OU is the organizational unit of the end-entity certificate
 	// generated for each operation performed by this signer
 	OU string
@@ -156,6 +162,12 @@ func New(conf signer.Configuration, stats *signer.StatsClient) (s *XPISigner, er
 	if err != nil {
 		return nil, fmt.Errorf("xpi: could not parse X.509 certificate: %w", err)
 	}
+	s.Certificate = conf.Certificate
+	s.CertExpiryWarningDays = conf.CertExpiryWarningDays
+	s.issuerCertInfo, err = signer.ParseCertificateInfo(conf.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("xpi: could not parse X.509 certificate: %w", err)
+	}
 	// some sanity checks for the signer cert
 	if !s.issuerCert.IsCA {
 		return nil, fmt.Errorf("xpi: signer certificate must have CA constraint set to true")
@@ -206,6 +218,13 @@ func New(conf signer.Configuration, stats *signer.StatsClient) (s *XPISigner, er
 	s.recommendationFilePath = conf.RecommendationConfig.FilePath
 	log.Infof("xpi: signer %q is ignoring recommendation file path %q", s.ID, s.recommendationFilePath)
 
+	for _, alg := range conf.COSEAlgorithms {
+		if stringToCOSEAlg(alg) == nil {
+			return nil, fmt.Errorf("xpi: invalid or unsupported COSE algorithm %q in signer configuration", alg)
+		}
+	}
+	s.COSEAlgorithms = conf.COSEAlgorithms
+
 	// If the private key is rsa, launch go routines that
 	// populates the rsa cache with private keys of the same
 	// length
@@ -246,10 +265,16 @@ func (s *XPISigner) Config() signer.Configuration {
 		Mode:        s.Mode,
 		PrivateKey:  s.PrivateKey,
 		Certificate: s.Certificate,
+
+		COSEAlgorithms:        s.COSEAlgorithms,
+		CertExpiryWarningDays: s.CertExpiryWarningDays,
 	}
 }
 
-// SignFile takes an unsigned zipped XPI file and returns a signed XPI file
+// SignFile takes an unsigned zipped XPI file and returns a signed XPI
+// file. It adds detached COSE signatures with the cose_algorithms of
+// the options, or the COSE algorithms of the signer when they are not
+// set.
 func (s *XPISigner) SignFile(input []byte, options interface{}) (signedFile signer.SignedFile, err error) {
 	var (
 		pkcs7Manifest []byte
@@ -268,24 +293,17 @@ func (s *XPISigner) SignFile(input []byte, options interface{}) (signedFile sign
 	if err != nil {
 		return nil, err
 	}
+	if opt.COSEAlgorithms == nil {
+		opt.COSEAlgorithms = s.COSEAlgorithms
+	}
 	coseSigAlgs, err = opt.Algorithms()
 	if err != nil {
 		return nil, fmt.Errorf("xpi: error parsing cose_algorithms options: %w", err)
 	}
 
-	input, err = removeFileFromZIP(input, s.recommendationFilePath)
+	input, err = s.prepareXPI(input, opt, cn)
 	if err != nil {
-		return nil, fmt.Errorf("xpi: error removing recommendation file from XPI: %w", err)
-	}
-	if s.Mode == ModeAddOnWithRecommendation {
-		recFileBytes, err := s.makeRecommendationFile(opt, cn)
-		if err != nil {
-			return nil, fmt.Errorf("xpi: error making recommendation file from options: %w", err)
-		}
-		input, err = appendFileToZIP(input, s.recommendationFilePath, recFileBytes)
-		if err != nil {
-			return nil, fmt.Errorf("xpi: error append recommendation file to XPI: %w", err)
-		}
+		return nil, err
 	}
 
 	manifest, err = makeJARManifest(input)
@@ -346,6 +364,56 @@ func (s *XPISigner) SignFile(input []byte, options interface{}) (signedFile sign
 	return signedFile, nil
 }
 
+// prepareXPI removes any recommendation file from an unsigned XPI and
+// adds a new one for signers in ModeAddOnWithRecommendation
+func (s *XPISigner) prepareXPI(input []byte, opt Options, cn string) ([]byte, error) {
+	input, err := removeFileFromZIP(input, s.recommendationFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("xpi: error removing recommendation file from XPI: %w", err)
+	}
+	if s.Mode == ModeAddOnWithRecommendation {
+		recFileBytes, err := s.makeRecommendationFile(opt, cn)
+		if err != nil {
+			return nil, fmt.Errorf("xpi: error making recommendation file from options: %w", err)
+		}
+		input, err = appendFileToZIP(input, s.recommendationFilePath, recFileBytes)
+		if err != nil {
+			return nil, fmt.Errorf("xpi: error append recommendation file to XPI: %w", err)
+		}
+	}
+	return input, nil
+}
+
+// SignedFileHash returns the hex encoded SHA256 hash of the JAR
+// manifest SignFile would sign for an unsigned XPI. Recommendation
+// files include validity timestamps, so the hash of XPIs signed in
+// ModeAddOnWithRecommendation changes between calls.
+func (s *XPISigner) SignedFileHash(input []byte, options interface{}) (string, error) {
+	opt, err := GetOptions(options)
+	if err != nil {
+		return "", fmt.Errorf("xpi: cannot get options: %w", err)
+	}
+	cn, err := opt.CN(s)
+	if err != nil {
+		return "", err
+	}
+	input, err = s.prepareXPI(input, opt, cn)
+	if err != nil {
+		return "", err
+	}
+	manifest, err := makeJARManifest(input)
+	if err != nil {
+		return "", fmt.Errorf("xpi: cannot make JAR manifest from XPI: %w", err)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(manifest)), nil
+}
+
+// SignedDataHash returns the hex encoded SHA256 hash of the signature
+// file SignData would sign
+func (s *XPISigner) SignedDataHash(sigfile []byte, options interface{}) (string, error) {
+	return fmt.Sprintf("%x", sha256.Sum256(sigfile)), nil
+}
+
 // SignData takes an input signature file and returns a PKCS7 or COSE detached signature
 func (s *XPISigner) SignData(sigfile []byte, options interface{}) (signer.Signature, error) {
 	opt, err := GetOptions(options)
@@ -373,6 +441,105 @@ func (s *XPISigner) SignData(sigfile []byte, options interface{}) (signer.Signat
 	return sig, nil
 }
 
+// VerifyData verifies a PKCS7 detached signature of the data and that
+// its end-entity chains to the issuer of the signer
+func (s *XPISigner) VerifyData(data []byte, sig signer.Signature) error {
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		return fmt.Errorf("xpi: failed to marshal signature: %w", err)
+	}
+	p7sig, err := Unmarshal(sigstr, data)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(s.issuerCert)
+	return p7sig.VerifyWithChainAt(roots, time.Now().UTC())
+}
+
+// CertificateInfo returns the fields of the issuer certificate of the
+// end-entities of the signer parsed at initialization
+func (s *XPISigner) CertificateInfo() *formats.CertificateInfo {
+	return s.issuerCertInfo
+}
+
+// VerifyFile verifies the PKCS7 signature of a signed XPI and its
+// COSE signatures with the COSE algorithms of the signer, and that
+// their end-entities chain to the issuer of the signer
+func (s *XPISigner) VerifyFile(input []byte, signed signer.SignedFile) error {
+	opts, err := SignedFileOptions(signed)
+	if err != nil {
+		return err
+	}
+	if len(opts.COSEAlgorithms) != len(s.COSEAlgorithms) {
+		return fmt.Errorf("xpi: signed file has %d COSE signatures, but signer has %d COSE algorithms", len(opts.COSEAlgorithms), len(s.COSEAlgorithms))
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(s.issuerCert)
+	return VerifySignedFile(signed, roots, opts, time.Now().UTC())
+}
+
+// GetTestFile returns a minimal unsigned WebExtension for monitoring
+func (s *XPISigner) GetTestFile() []byte {
+	return testXPI
+}
+
+// PrefersTestFile returns whether the signer has COSE algorithms, it
+// only adds COSE signatures to signed files so it is checked with its
+// test file
+func (s *XPISigner) PrefersTestFile() bool {
+	return len(s.COSEAlgorithms) > 0
+}
+
+// testXPI is an unsigned WebExtension with only a manifest
+var testXPI = makeTestXPI()
+
+// makeTestXPI returns a zip with the WebExtension manifest of a
+// minimal add-on
+func makeTestXPI() []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	f, err := w.Create(webextManifestPath)
+	if err != nil {
+		panic(err)
+	}
+	f.Write([]byte(`{"manifest_version": 2, "name": "autograph monitoring test extension", "version": "1.0"}`))
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// SignedFileOptions returns the options to verify the COSE signatures
+// of a signed XPI with: the add-on ID in the subject CN of their
+// end-entities and their COSE algorithms. It returns empty options
+// for XPIs only signed with PKCS7.
+func SignedFileOptions(signedFile signer.SignedFile) (opts Options, err error) {
+	contents, err := readXPIContentsToMap(signedFile)
+	if err != nil {
+		return opts, fmt.Errorf("xpi: failed to read signed file: %w", err)
+	}
+	coseMsgBytes, ok := contents[coseSigPath]
+	if !ok {
+		return opts, nil
+	}
+	xpiSig, err := Unmarshal(base64.StdEncoding.EncodeToString(coseMsgBytes), nil)
+	if err != nil {
+		return opts, fmt.Errorf("xpi: error unmarshaling cose.sig: %w", err)
+	}
+	_, eeCerts, algs, err := validateCOSEMessageStructureAndGetCertsAndAlgs(xpiSig.signMessage)
+	if err != nil {
+		return opts, fmt.Errorf("xpi: cose.sig is not a valid COSE SignMessage: %w", err)
+	}
+	for i, eeCert := range eeCerts {
+		if i == 0 {
+			opts.ID = eeCert.Subject.CommonName
+		}
+		opts.COSEAlgorithms = append(opts.COSEAlgorithms, algs[i].Name)
+	}
+	return opts, nil
+}
+
 func (s *XPISigner) signDataWithPKCS7(sigfile []byte, cn string, digest asn1.ObjectIdentifier) ([]byte, error) {
 	eeCert, eeKey, err := s.MakeEndEntity(cn, nil)
 	if err != nil {
@@ -3,6 +3,7 @@ package xpi
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
@@ -164,6 +165,28 @@ func TestSignData(t *testing.T) {
 	}
 }
 
+func TestTestSigner(t *testing.T) {
+	t.Parallel()
+
+	for i, testcase := range validSignerConfigs {
+		s, err := New(testcase, nil)
+		if err != nil {
+			t.Fatalf("testcase %d signer initialization failed with: %v", i, err)
+		}
+		err = signer.TestSigner(s)
+		if s.issuerCert.NotAfter.Before(time.Now()) {
+			// the end-entity does not chain to an expired issuer
+			if err == nil {
+				t.Fatalf("testcase %d signer test passed with an expired issuer", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("testcase %d signer test failed: %v", i, err)
+		}
+	}
+}
+
 func TestSignDataAndVerifyWithOpenSSL(t *testing.T) {
 	t.Parallel()
 
@@ -348,6 +371,36 @@ func TestNoID(t *testing.T) {
 	}
 }
 
+func TestSignedFileHash(t *testing.T) {
+	t.Parallel()
+
+	s, err := New(validSignerConfigs[3], nil)
+	if err != nil {
+		t.Fatalf("failed to initialize signer: %v", err)
+	}
+	opts := Options{ID: "test@example.net"}
+	hash, err := s.SignedFileHash(unsignedBootstrap, opts)
+	if err != nil {
+		t.Fatalf("failed to hash file: %v", err)
+	}
+	expected := fmt.Sprintf("%x", sha256.Sum256(unsignedBootstrapManifest))
+	if hash != expected {
+		t.Fatalf("expected signed file hash %q but got %q", expected, hash)
+	}
+	hash2, err := s.SignedFileHash(unsignedBootstrap, opts)
+	if err != nil {
+		t.Fatalf("failed to hash file a second time: %v", err)
+	}
+	if hash != hash2 {
+		t.Fatalf("expected signed file hash to be deterministic but got %q and %q", hash, hash2)
+	}
+
+	_, err = s.SignedFileHash(unsignedBootstrap, struct{ Foo string }{Foo: "bar"})
+	if err == nil || err.Error() != "xpi: missing common name" {
+		t.Fatalf("expected to fail with missing CN but got error '%v'", err)
+	}
+}
+
 func TestBadCOSEAlgsErrs(t *testing.T) {
 	t.Parallel()
 
@@ -624,6 +677,76 @@ func TestSignFileWithCOSESignatures(t *testing.T) {
 	}
 }
 
+func TestSignFileWithConfiguredCOSEAlgorithms(t *testing.T) {
+	t.Parallel()
+
+	testcase := validSignerConfigs[0]
+	testcase.COSEAlgorithms = []string{"ES384", "PS256"}
+	s, err := New(testcase, nil)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	if len(s.Config().COSEAlgorithms) != 2 {
+		t.Fatalf("expected signer config to have 2 COSE algorithms but got %q", s.Config().COSEAlgorithms)
+	}
+
+	// the test extension is signed with the COSE algorithms of the
+	// signer and verifies
+	err = signer.TestSigner(s)
+	if err != nil {
+		t.Fatalf("signer test failed: %v", err)
+	}
+	signedXPI, err := s.SignFile(s.GetTestFile(), s.GetDefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to sign test file: %v", err)
+	}
+	opts, err := SignedFileOptions(signedXPI)
+	if err != nil {
+		t.Fatalf("failed to get options of signed file: %v", err)
+	}
+	if opts.ID != "ffffffff-ffff-ffff-ffff-ffffffffffff" || strings.Join(opts.COSEAlgorithms, ",") != "ES384,PS256" {
+		t.Fatalf("unexpected options of signed file %+v", opts)
+	}
+	err = s.VerifyFile(s.GetTestFile(), signedXPI)
+	if err != nil {
+		t.Fatalf("failed to verify signed test file: %v", err)
+	}
+
+	// request options override the COSE algorithms of the signer,
+	// and an empty list signs with PKCS7 only
+	signedXPI, err = s.SignFile(s.GetTestFile(), Options{
+		ID:             "test@example.net",
+		COSEAlgorithms: []string{},
+		PKCS7Digest:    "SHA256",
+	})
+	if err != nil {
+		t.Fatalf("failed to sign test file without COSE signatures: %v", err)
+	}
+	opts, err = SignedFileOptions(signedXPI)
+	if err != nil {
+		t.Fatalf("failed to get options of signed file: %v", err)
+	}
+	if len(opts.COSEAlgorithms) != 0 {
+		t.Fatalf("expected no COSE signatures but got %q", opts.COSEAlgorithms)
+	}
+	err = s.VerifyFile(s.GetTestFile(), signedXPI)
+	if err == nil {
+		t.Fatal("expected file signed without the COSE algorithms of the signer not to verify")
+	}
+
+	// data signatures stay PKCS7
+	_, err = s.SignData([]byte("foobarbaz1234abcd"), s.GetDefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+
+	testcase.COSEAlgorithms = []string{"ROT13"}
+	_, err = New(testcase, nil)
+	if err == nil || !strings.Contains(err.Error(), `invalid or unsupported COSE algorithm "ROT13" in signer configuration`) {
+		t.Fatalf("expected signer with unknown COSE algorithm to fail initialization but got %v", err)
+	}
+}
+
 var validSignerConfigs = []signer.Configuration{
 	signer.Configuration{
 		ID:   "rsa addon",
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mozilla-services/autograph/signer"
+	"github.com/mozilla-services/autograph/signer/contentsignaturepki"
+)
+
+// testSignersCommand is the subcommand that tests the signers of a
+// configuration and exits, e.g. 'autograph test-signers -c config.yaml'
+const testSignersCommand = "test-signers"
+
+// testSigners initializes the signers of a configuration and checks
+// that each produces signatures that verify with signer.TestSigner, so
+// a configuration can be checked in CI before it is deployed.
+// contentsignaturepki signers are initialized with NewDryRun, so their
+// chain is neither uploaded nor stored in the database. It returns the
+// IDs of the signers that failed.
+func testSigners(conf configuration) (failed []string) {
+	if conf.HSM.Path != "" {
+		new(autographer).initHSM(conf)
+	}
+	for _, signerConf := range conf.Signers {
+		err := testSigner(signerConf)
+		if err != nil {
+			log.Errorf("signer %q failed its test: %v", signerConf.ID, err)
+			failed = append(failed, signerConf.ID)
+			continue
+		}
+		log.Infof("signer %q passed its test", signerConf.ID)
+	}
+	return failed
+}
+
+// testSigner initializes a signer without side effects and tests it
+func testSigner(signerConf signer.Configuration) error {
+	var (
+		s   signer.Signer
+		err error
+	)
+	if signerConf.Type == contentsignaturepki.Type {
+		s, err = contentsignaturepki.NewDryRun(signerConf)
+	} else {
+		s, err = newSigner(signerConf, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to initialize signer: %w", err)
+	}
+	return signer.TestSigner(s)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mozilla-services/autograph/signer"
+	"github.com/mozilla-services/autograph/signer/contentsignature"
+	"github.com/mozilla-services/autograph/signer/contentsignaturepki"
+)
+
+func TestTestSigners(t *testing.T) {
+	t.Parallel()
+
+	var csConf, pkiConf signer.Configuration
+	for _, signerConf := range conf.Signers {
+		switch signerConf.Type {
+		case contentsignature.Type:
+			csConf = signerConf
+		case contentsignaturepki.Type:
+			pkiConf = signerConf
+		}
+	}
+	invalidConf := csConf
+	invalidConf.ID = "invalidsigner"
+	invalidConf.PrivateKey = "not a key"
+
+	failed := testSigners(configuration{Signers: []signer.Configuration{csConf, pkiConf, invalidConf}})
+	if len(failed) != 1 || failed[0] != invalidConf.ID {
+		t.Fatalf("expected only signer %q to fail its test but got %v", invalidConf.ID, failed)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/mozilla-services/autograph/formats"
 	"github.com/mozilla-services/autograph/signer/apk2"
 	"github.com/mozilla-services/autograph/signer/contentsignature"
+	"github.com/mozilla-services/autograph/signer/ed25519"
 	"github.com/mozilla-services/autograph/signer/genericrsa"
 	"github.com/mozilla-services/autograph/signer/gpg2"
 	"github.com/mozilla-services/autograph/signer/mar"
@@ -383,6 +384,18 @@ examples:
 					if err != nil {
 						log.Fatal(err)
 					}
+				case ed25519.Type:
+					if !noVerify {
+						err = ed25519.VerifyEd25519SignatureResponse(input, response)
+						if err != nil {
+							log.Fatal(err)
+						}
+						sigStatus = true
+					}
+					sigData, err = base64.StdEncoding.DecodeString(response.Signature)
+					if err != nil {
+						log.Fatal(err)
+					}
 				case gpg2.Type:
 					if reqType == requestTypeFiles {
 						// TODO: implement verify pgp clearsigned
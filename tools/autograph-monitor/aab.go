@@ -0,0 +1,18 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/mozilla-services/autograph/signer/aab"
+)
+
+// verifyAABSignature verifies the JAR signature of the signed test
+// bundle of an aab monitoring response
+func verifyAABSignature(signedFile string) error {
+	signedAAB, err := base64.StdEncoding.DecodeString(signedFile)
+	if err != nil {
+		return fmt.Errorf("failed to base64 decode signed AAB: %w", err)
+	}
+	return aab.VerifyJARSignature(signedAAB)
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/mozilla-services/autograph/signer/apk2"
+)
+
+// verifyAPK2Signature verifies the v2 and v3 signatures of the signed
+// test APK of an apk2 monitoring response, which unlike its v1
+// signature can be verified for both RSA and ECDSA keys
+func verifyAPK2Signature(signedFile string) error {
+	signedAPK, err := base64.StdEncoding.DecodeString(signedFile)
+	if err != nil {
+		return fmt.Errorf("failed to base64 decode signed APK: %w", err)
+	}
+	return apk2.VerifySigningBlock(signedAPK)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"log"
 	"net/http"
@@ -52,12 +53,13 @@ const month = 4 * week
 //
 // It fetches the X5U, sends soft notifications, verifies the content
 // signature data and certificate chain trust to the provided root
-// certificate SHA2 hash/fingerprint, and errors for pending
+// certificate SHA2 hash/fingerprint and, when rootSPKIHash is set, to
+// the root key SubjectPublicKeyInfo SHA2 hash, and errors for pending
 // expirations.
 //
 // Chains with leaf/EE CommonNames in ignoredCerts are ignored.
 //
-func verifyContentSignature(x5uClient *http.Client, notifier Notifier, rootHash string, ignoredCerts map[string]bool, response formats.SignatureResponse, input []byte) (err error) {
+func verifyContentSignature(x5uClient *http.Client, notifier Notifier, rootHash, rootSPKIHash string, ignoredCerts map[string]bool, response formats.SignatureResponse, input []byte) (err error) {
 	if response.X5U == "" {
 		return fmt.Errorf("content signature response is missing an X5U to fetch")
 	}
@@ -65,11 +67,18 @@ func verifyContentSignature(x5uClient *http.Client, notifier Notifier, rootHash
 		certChain []byte
 		certs     []*x509.Certificate
 	)
-	// GetX5U verifies chain contains three certs
-	certChain, certs, err = contentsignaturepki.GetX5U(x5uClient, response.X5U)
+	// GetX5U verifies the chain from the EE to the root, its last cert
+	certChain, certs, err = conf.x5uCache.Get(x5uClient, response.X5U, contentsignaturepki.DefaultX5UMaxChainSize)
 	if err != nil {
 		return fmt.Errorf("error fetching content signature signature x5u: %w", err)
 	}
+	// pin the key of the root when one is configured
+	if rootSPKIHash != "" {
+		err = contentsignaturepki.VerifyRootSPKIHash(certs, rootSPKIHash)
+		if err != nil {
+			return fmt.Errorf("error verifying content signature x5u root: %w", err)
+		}
+	}
 	if notifier != nil {
 		notifications := certChainValidityNotifications(certs)
 		// check if we should ignore this cert
@@ -174,3 +183,18 @@ func certChainPendingExpiration(certs []*x509.Certificate) error {
 	}
 	return nil
 }
+
+// mustSPKIFingerprint returns the SubjectPublicKeyInfo SHA2 hash of a
+// PEM root certificate of constants.go, and exits when it does not
+// parse
+func mustSPKIFingerprint(rootPEM string) string {
+	block, _ := pem.Decode([]byte(rootPEM))
+	if block == nil {
+		log.Fatal("failed to decode PEM root certificate")
+	}
+	root, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		log.Fatalf("failed to parse root certificate: %v", err)
+	}
+	return contentsignaturepki.SPKIFingerprint(root)
+}
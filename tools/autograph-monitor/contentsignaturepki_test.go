@@ -20,6 +20,7 @@ import (
 	"time"
 
 	"github.com/mozilla-services/autograph/formats"
+	"github.com/mozilla-services/autograph/signer/contentsignaturepki"
 
 	gomock "github.com/golang/mock/gomock"
 	"github.com/mozilla-services/autograph/tools/autograph-monitor/mock_main"
@@ -205,6 +206,7 @@ func Test_verifyContentSignature(t *testing.T) {
 		x5uClient    *http.Client
 		notifier     Notifier
 		rootHash     string
+		rootSPKIHash string
 		ignoredCerts map[string]bool
 		response     formats.SignatureResponse
 		input        []byte
@@ -234,6 +236,43 @@ func Test_verifyContentSignature(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "valid csig response with pinned root key",
+			args: args{
+				x5uClient:    &http.Client{},
+				notifier:     nil,
+				rootHash:     sha2Fingerprint(testRoot),
+				rootSPKIHash: contentsignaturepki.SPKIFingerprint(testRoot),
+				response: formats.SignatureResponse{
+					Type:      "contentsignature",
+					Mode:      "p384ecdsa",
+					SignerID:  "normankey",
+					Signature: "qGjS1QmB2xANizjJqrGmIPoojzjBrTV5kgi01p1ELnfKwH4E3UDTZRf-9K7PCEwjt0mOzd1bBmRBKcnWZNFAMvAduBwfAPHFGpX-YKBoRSLHuA6QuiosEydnZEs5ykAR",
+					X5U:       testLeafChainTestServer.URL,
+				},
+				input: signerTestData,
+			},
+			wantErr: false,
+		},
+		{
+			name: "csig response with another pinned root key",
+			args: args{
+				x5uClient:    &http.Client{},
+				notifier:     nil,
+				rootHash:     sha2Fingerprint(testRoot),
+				rootSPKIHash: contentsignaturepki.SPKIFingerprint(testInter),
+				response: formats.SignatureResponse{
+					Type:      "contentsignature",
+					Mode:      "p384ecdsa",
+					SignerID:  "normankey",
+					Signature: "qGjS1QmB2xANizjJqrGmIPoojzjBrTV5kgi01p1ELnfKwH4E3UDTZRf-9K7PCEwjt0mOzd1bBmRBKcnWZNFAMvAduBwfAPHFGpX-YKBoRSLHuA6QuiosEydnZEs5ykAR",
+					X5U:       testLeafChainTestServer.URL,
+				},
+				input: signerTestData,
+			},
+			wantErr:   true,
+			errSubStr: "does not match expected hash",
+		},
 		{
 			name: "valid csig response typed nil notifier ok",
 			args: args{
@@ -489,7 +528,7 @@ func Test_verifyContentSignature(t *testing.T) {
 		}
 
 		t.Run(tt.name, func(t *testing.T) {
-			err := verifyContentSignature(tt.args.x5uClient, notifier, tt.args.rootHash, tt.args.ignoredCerts, tt.args.response, tt.args.input)
+			err := verifyContentSignature(tt.args.x5uClient, notifier, tt.args.rootHash, tt.args.rootSPKIHash, tt.args.ignoredCerts, tt.args.response, tt.args.input)
 
 			if (err != nil) != tt.wantErr {
 				t.Errorf("verifyContentSignature() error = %v, wantErr %v", err, tt.wantErr)
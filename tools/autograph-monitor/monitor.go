@@ -1,7 +1,6 @@
 package main
 
 import (
-	"crypto/sha256"
 	"crypto/x509"
 	"encoding/json"
 	"fmt"
@@ -14,15 +13,18 @@ import (
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/mozilla-services/autograph/client"
 	"github.com/mozilla-services/autograph/formats"
+	"github.com/mozilla-services/autograph/signer/aab"
 	"github.com/mozilla-services/autograph/signer/apk2"
 	"github.com/mozilla-services/autograph/signer/contentsignature"
 	"github.com/mozilla-services/autograph/signer/contentsignaturepki"
+	"github.com/mozilla-services/autograph/signer/ed25519"
 	"github.com/mozilla-services/autograph/signer/genericrsa"
 	"github.com/mozilla-services/autograph/signer/gpg2"
 	"github.com/mozilla-services/autograph/signer/mar"
+	"github.com/mozilla-services/autograph/signer/rfc3161"
 	"github.com/mozilla-services/autograph/signer/xpi"
-	"go.mozilla.org/hawk"
 )
 
 type configuration struct {
@@ -42,8 +44,16 @@ type configuration struct {
 	contentSignatureRootHash   string
 	contentSignatureTruststore *x509.CertPool
 
+	// contentSignatureRootSPKIHash pins the key of the root of
+	// ContentSignature chains, it is empty when no key is pinned
+	contentSignatureRootSPKIHash string
+
 	// notifier raises and resolves warnings
 	notifier Notifier
+
+	// x5uCache keeps the content signature chains fetched from x5us
+	// across the runs of a warm lambda
+	x5uCache *contentsignaturepki.X5UCache
 }
 
 const inputdata string = "AUTOGRAPH MONITORING"
@@ -74,6 +84,7 @@ func main() {
 		conf.contentSignatureRootHash = firefoxPkiContentSignatureStageRootHash
 		conf.contentSignatureTruststore = x509.NewCertPool()
 		conf.contentSignatureTruststore.AppendCertsFromPEM([]byte(firefoxPkiContentSignatureStageRoot))
+		conf.contentSignatureRootSPKIHash = mustSPKIFingerprint(firefoxPkiContentSignatureStageRoot)
 		conf.depRootHash = ""
 		conf.depTruststore = nil
 	case "prod":
@@ -82,6 +93,7 @@ func main() {
 		conf.truststore.AppendCertsFromPEM([]byte(firefoxPkiProdRoot))
 		conf.contentSignatureRootHash = firefoxPkiProdRootHash
 		conf.contentSignatureTruststore = conf.truststore
+		conf.contentSignatureRootSPKIHash = mustSPKIFingerprint(firefoxPkiProdRoot)
 		conf.depRootHash = firefoxPkiStageRootHash
 		conf.depTruststore = x509.NewCertPool()
 		conf.depTruststore.AppendCertsFromPEM([]byte(firefoxPkiStageRoot))
@@ -90,6 +102,7 @@ func main() {
 		conf.truststore = nil
 		conf.contentSignatureRootHash = autographDevRootHash
 		conf.contentSignatureTruststore = nil
+		conf.contentSignatureRootSPKIHash = ""
 		conf.depRootHash = ""
 		conf.depTruststore = nil
 	}
@@ -97,8 +110,24 @@ func main() {
 		conf.rootHash = os.Getenv("AUTOGRAPH_ROOT_HASH")
 		conf.contentSignatureRootHash = conf.rootHash
 		log.Printf("Using root hash from env var AUTOGRAPH_ROOT_HASH=%q\n", conf.rootHash)
+		// the key of the root of the environment does not apply
+		// to another root
+		conf.contentSignatureRootSPKIHash = ""
+	}
+	if os.Getenv("AUTOGRAPH_ROOT_SPKI_HASH") != "" {
+		conf.contentSignatureRootSPKIHash = os.Getenv("AUTOGRAPH_ROOT_SPKI_HASH")
+		log.Printf("Using root SPKI hash from env var AUTOGRAPH_ROOT_SPKI_HASH=%q\n", conf.contentSignatureRootSPKIHash)
 	}
 
+	var x5uCacheTTL time.Duration
+	if os.Getenv("AUTOGRAPH_X5U_CACHE_TTL") != "" {
+		var err error
+		x5uCacheTTL, err = time.ParseDuration(os.Getenv("AUTOGRAPH_X5U_CACHE_TTL"))
+		if err != nil {
+			log.Fatalf("failed to parse AUTOGRAPH_X5U_CACHE_TTL: %v", err)
+		}
+	}
+	conf.x5uCache = contentsignaturepki.NewX5UCache(x5uCacheTTL)
 	if os.Getenv("LAMBDA_TASK_ROOT") != "" {
 		// we are inside a lambda environment so run as lambda
 		lambda.Start(Handler)
@@ -139,7 +168,7 @@ func monitor() (err error) {
 	req.Close = true
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", makeAuthHeader(req, "monitor", conf.monitoringKey))
+	req.Header.Set("Authorization", client.AuthHeader(req, "monitor", conf.monitoringKey, nil))
 	cli := &http.Client{}
 	resp, err := cli.Do(req)
 	if err != nil || resp == nil {
@@ -167,32 +196,51 @@ func monitor() (err error) {
 		} else if err != nil {
 			log.Fatal(err)
 		}
+		if response.Skipped {
+			log.Printf("Signer %q is excluded from the monitor checks, skipping", response.SignerID)
+			continue
+		}
+		if response.TimedOut {
+			log.Printf("Signer %q timed out", response.SignerID)
+			failed = true
+			failures = append(failures, fmt.Errorf("signer %q did not complete its check within the monitor timeout", response.SignerID))
+			continue
+		}
 		switch response.Type {
 		case contentsignature.Type:
 			log.Printf("Verifying content signature from signer %q", response.SignerID)
-			err = verifyContentSignature(x5uClient, conf.notifier, conf.contentSignatureRootHash, contentSignatureIgnoredLeafCertCNs, response, []byte(inputdata))
+			err = verifyContentSignature(x5uClient, conf.notifier, conf.contentSignatureRootHash, conf.contentSignatureRootSPKIHash, contentSignatureIgnoredLeafCertCNs, response, []byte(inputdata))
 		case contentsignaturepki.Type:
 			log.Printf("Verifying content signature pki from signer %q", response.SignerID)
-			err = verifyContentSignature(x5uClient, conf.notifier, conf.contentSignatureRootHash, contentSignatureIgnoredLeafCertCNs, response, []byte(inputdata))
+			err = verifyContentSignature(x5uClient, conf.notifier, conf.contentSignatureRootHash, conf.contentSignatureRootSPKIHash, contentSignatureIgnoredLeafCertCNs, response, []byte(inputdata))
 		case xpi.Type:
 			log.Printf("Verifying XPI signature from signer %q", response.SignerID)
-			err = verifyXPISignature(response.Signature)
+			if response.SignedFile != "" {
+				err = verifyXPISignedFile(response.SignedFile)
+			} else {
+				err = verifyXPISignature(response.Signature)
+			}
 		case apk2.Type:
-			// we don't verify apk2 signatures because they can only be obtained on valid
-			// APK files, which is too big to fit in the monitoring logic
-			log.Printf("Skipping verification of APK2 signature from signer %q (we can't verify those)", response.SignerID)
-			continue
+			log.Printf("Verifying APK signature from signer %q", response.SignerID)
+			err = verifyAPK2Signature(response.SignedFile)
+		case aab.Type:
+			log.Printf("Verifying AAB signature from signer %q", response.SignerID)
+			err = verifyAABSignature(response.SignedFile)
 		case mar.Type:
 			log.Printf("Verifying MAR signature from signer %q", response.SignerID)
-			err = verifyMARSignature(response.Signature, response.PublicKey)
+			err = mar.VerifyMARSignatureResponse([]byte(inputdata), response)
 		case genericrsa.Type:
 			log.Printf("Verifying RSA signature from signer %q", response.SignerID)
 			err = genericrsa.VerifyGenericRsaSignatureResponse([]byte(inputdata), response)
+		case ed25519.Type:
+			log.Printf("Verifying Ed25519 signature from signer %q", response.SignerID)
+			err = ed25519.VerifyEd25519SignatureResponse([]byte(inputdata), response)
+		case rfc3161.Type:
+			log.Printf("Verifying RFC3161 timestamp token from signer %q", response.SignerID)
+			err = rfc3161.VerifyRFC3161SignatureResponse([]byte(inputdata), response)
 		case gpg2.Type:
-			// we don't verify pgp signatures because that requires building a keyring
-			// using the public key which is hard to do using the current openpgp package
-			log.Printf("Skipping verification of PGP signature from signer %q (we can't verify those)", response.SignerID)
-			continue
+			log.Printf("Verifying PGP signature from signer %q", response.SignerID)
+			err = gpg2.VerifyGPG2SignatureResponse([]byte(inputdata), response)
 		default:
 			err = fmt.Errorf("unknown signature type %q", response.Type)
 		}
@@ -215,17 +263,3 @@ func monitor() (err error) {
 	log.Println("All signature responses passed, monitoring OK")
 	return
 }
-
-func makeAuthHeader(req *http.Request, user, token string) string {
-	auth := hawk.NewRequestAuth(req,
-		&hawk.Credentials{
-			ID:   user,
-			Key:  token,
-			Hash: sha256.New},
-		0)
-	auth.Ext = fmt.Sprintf("%d", time.Now().Nanosecond())
-	payloadhash := auth.PayloadHash("application/json")
-	payloadhash.Write([]byte(""))
-	auth.SetHash(payloadhash)
-	return auth.RequestHeader()
-}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"encoding/base64"
+	"fmt"
 	"log"
+	"time"
 
 	"github.com/mozilla-services/autograph/signer/xpi"
 )
@@ -18,3 +21,28 @@ func verifyXPISignature(sig string) error {
 	log.Printf("Got error %s verifying XPI signature with rel truststore trying dep truststore", err)
 	return xpiSig.VerifyWithChain(conf.depTruststore)
 }
+
+// verifyXPISignedFile verifies the PKCS7 and COSE signatures of the
+// signed test extension of an xpi monitoring response
+func verifyXPISignedFile(signedFile string) error {
+	signedXPI, err := base64.StdEncoding.DecodeString(signedFile)
+	if err != nil {
+		return fmt.Errorf("failed to base64 decode signed XPI: %w", err)
+	}
+	opts, err := xpi.SignedFileOptions(signedXPI)
+	if err != nil {
+		return err
+	}
+	if conf.truststore == nil {
+		// COSE end-entities are always verified against a root,
+		// and the dev environment has none
+		log.Printf("Skipping verification of %d COSE signatures without a truststore", len(opts.COSEAlgorithms))
+		opts.COSEAlgorithms = nil
+	}
+	err = xpi.VerifySignedFile(signedXPI, conf.truststore, opts, time.Now().UTC())
+	if err == nil {
+		return nil
+	}
+	log.Printf("Got error %s verifying XPI signed file with rel truststore trying dep truststore", err)
+	return xpi.VerifySignedFile(signedXPI, conf.depTruststore, opts, time.Now().UTC())
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"net/url"
+
+	"github.com/mozilla-services/autograph/formats"
+	"github.com/mozilla-services/autograph/signer"
+	"github.com/mozilla-services/autograph/signer/contentsignaturepki"
+)
+
+// validateSignedFileUpload returns an error when the signed file
+// upload location of a configuration is set but is not an s3://, gs://
+// or file:// location, or when its upload options are invalid
+func validateSignedFileUpload(conf signer.Configuration) error {
+	if conf.SignedFileUploadLocation == "" {
+		if conf.SignedFileDownloadLocation != "" {
+			return fmt.Errorf("signed file download location is set without an upload location")
+		}
+		return nil
+	}
+	parsedURL, err := url.Parse(conf.SignedFileUploadLocation)
+	if err != nil {
+		return fmt.Errorf("failed to parse signed file upload location: %w", err)
+	}
+	switch parsedURL.Scheme {
+	case "s3", "gs", "file":
+	default:
+		return fmt.Errorf("unsupported signed file upload scheme %q, must be s3, gs or file", parsedURL.Scheme)
+	}
+	err = signedFileUploadOptions(conf).Validate()
+	if err != nil {
+		return fmt.Errorf("invalid signed file upload options: %w", err)
+	}
+	return nil
+}
+
+// signedFileUploadOptions returns the upload options of the signed
+// files of a signer: its S3 options, with the content type of its
+// signed files instead of the one of its chains
+func signedFileUploadOptions(conf signer.Configuration) contentsignaturepki.S3UploadOptions {
+	opts := contentsignaturepki.S3UploadOptionsFromConfig(conf)
+	opts.ContentType = conf.SignedFileContentType
+	opts.ContentDisposition = ""
+	return opts
+}
+
+// uploadSignedFile uploads a signed file to the upload location of a
+// signer and returns its manifest. Files are named after the signer
+// and their SHA256 hash, so uploading the same file again overwrites
+// it.
+func uploadSignedFile(conf signer.Configuration, sigresp formats.SignatureResponse, signedFile []byte) (*formats.SignedFileManifest, error) {
+	if conf.SignedFileUploadLocation == "" {
+		return nil, fmt.Errorf("signer %q has no signed file upload location", conf.ID)
+	}
+	manifest := &formats.SignedFileManifest{
+		Size:     len(signedFile),
+		SHA256:   fmt.Sprintf("%x", sha256.Sum256(signedFile)),
+		SHA512:   fmt.Sprintf("%x", sha512.Sum512(signedFile)),
+		SignerID: sigresp.SignerID,
+		Type:     sigresp.Type,
+		Mode:     sigresp.Mode,
+	}
+	name := fmt.Sprintf("%s-%s", conf.ID, manifest.SHA256)
+	err := contentsignaturepki.UploadWithOptions(signedFile, name, conf.SignedFileUploadLocation, signedFileUploadOptions(conf))
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload signed file: %w", err)
+	}
+	downloadLocation := conf.SignedFileDownloadLocation
+	if downloadLocation == "" {
+		downloadLocation = conf.SignedFileUploadLocation
+	}
+	manifest.URL = downloadLocation + name
+	return manifest, nil
+}
@@ -13,7 +13,10 @@
 package contentsignature // import "github.com/mozilla-services/autograph/verifier/contentsignature"
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/base64"
@@ -41,6 +44,14 @@ const (
 	// P521ECDSABYTESIZE defines the bytes length of a P521ECDSA signature
 	P521ECDSABYTESIZE = 132
 
+	// ED25519 defines an Ed25519 content signature. Ed25519 and
+	// P256ECDSA signatures have the same length, so the mode of an
+	// Ed25519 signature is set when verifying it with an Ed25519 key.
+	ED25519 = "ed25519"
+
+	// ED25519BYTESIZE defines the bytes length of an ED25519 signature
+	ED25519BYTESIZE = ed25519.SignatureSize
+
 	// SignaturePrefix is a string preprended to data prior to signing
 	SignaturePrefix = "Content-Signature:\x00"
 )
@@ -72,6 +83,28 @@ func (sig *ContentSignature) VerifyHash(hash []byte, pubKey *ecdsa.PublicKey) bo
 	return ecdsa.Verify(pubKey, hash, sig.R, sig.S)
 }
 
+// VerifyDataEd25519 verifies an Ed25519 signature on its raw,
+// untemplated, input using a public key. Unlike ECDSA, Ed25519 signs
+// the templated input itself rather than its hash.
+func (sig *ContentSignature) VerifyDataEd25519(input []byte, pubKey ed25519.PublicKey) bool {
+	if sig.Len != ED25519BYTESIZE || len(pubKey) != ed25519.PublicKeySize || sig.R == nil || sig.S == nil {
+		return false
+	}
+	return ed25519.Verify(pubKey, makeTemplatedInput(input), sig.rs())
+}
+
+// verifyDataWithKey verifies a signature on its raw, untemplated,
+// input with an ECDSA or Ed25519 public key
+func (sig *ContentSignature) verifyDataWithKey(input []byte, pubKey crypto.PublicKey) bool {
+	switch key := pubKey.(type) {
+	case *ecdsa.PublicKey:
+		return sig.VerifyData(input, key)
+	case ed25519.PublicKey:
+		return sig.VerifyDataEd25519(input, key)
+	}
+	return false
+}
+
 // Marshal returns the R||S signature is encoded in base64 URL safe,
 // following DL/ECSSA format spec from IEEE Std 1363-2000.
 func (sig *ContentSignature) Marshal() (str string, err error) {
@@ -81,6 +114,12 @@ func (sig *ContentSignature) Marshal() (str string, err error) {
 	if sig.Len != P256ECDSABYTESIZE && sig.Len != P384ECDSABYTESIZE && sig.Len != P521ECDSABYTESIZE {
 		return "", fmt.Errorf("contentsignature.Marshal: invalid signature length %d", sig.Len)
 	}
+	encodedsig := base64.RawURLEncoding.EncodeToString(sig.rs())
+	return encodedsig, nil
+}
+
+// rs returns the R||S bytes of the signature
+func (sig *ContentSignature) rs() []byte {
 	// write R and S into a slice of len
 	// both R and S are zero-padded to the left to be exactly
 	// len/2 in length
@@ -91,8 +130,7 @@ func (sig *ContentSignature) Marshal() (str string, err error) {
 	rs := make([]byte, sig.Len)
 	copy(rs[Rstart:Rend], sig.R.Bytes())
 	copy(rs[Sstart:Send], sig.S.Bytes())
-	encodedsig := base64.RawURLEncoding.EncodeToString(rs)
-	return encodedsig, nil
+	return rs
 }
 
 // Unmarshal parses a base64 url encoded content signature
@@ -136,10 +174,16 @@ func Unmarshal(signature string) (sig *ContentSignature, err error) {
 //
 // The name of the hash function is returned, followed by the hash bytes
 func makeTemplatedHash(data []byte, curvename string) (alg string, out []byte) {
-	templated := make([]byte, len(SignaturePrefix)+len(data))
-	copy(templated[:len(SignaturePrefix)], []byte(SignaturePrefix))
-	copy(templated[len(SignaturePrefix):], data)
-	var md hash.Hash
+	alg, md := newTemplatedHash(curvename)
+	md.Write(data)
+	return alg, md.Sum(nil)
+}
+
+// newTemplatedHash returns the name and a new instance of the hash
+// function of a curve, with the string "Content-Signature:\x00"
+// already written to it, so the input data can be written to it as it
+// is read
+func newTemplatedHash(curvename string) (alg string, md hash.Hash) {
 	switch curvename {
 	case P384ECDSA:
 		md = sha512.New384()
@@ -151,8 +195,17 @@ func makeTemplatedHash(data []byte, curvename string) (alg string, out []byte) {
 		md = sha256.New()
 		alg = "sha256"
 	}
-	md.Write(templated)
-	return alg, md.Sum(nil)
+	md.Write([]byte(SignaturePrefix))
+	return alg, md
+}
+
+// makeTemplatedInput returns the input data with the string
+// "Content-Signature:\x00" added before it
+func makeTemplatedInput(data []byte) []byte {
+	templated := make([]byte, len(SignaturePrefix)+len(data))
+	copy(templated[:len(SignaturePrefix)], []byte(SignaturePrefix))
+	copy(templated[len(SignaturePrefix):], data)
+	return templated
 }
 
 // getSignatureHash returns the name of the hash function used by a given mode,
@@ -168,3 +221,17 @@ func getSignatureHash(mode string) string {
 	}
 	return ""
 }
+
+// getModeFromCurve returns the mode of the content signatures of an
+// ECDSA curve, or an empty string if the curve is unknown
+func getModeFromCurve(curve elliptic.Curve) string {
+	switch curve.Params().Name {
+	case "P-256":
+		return P256ECDSA
+	case "P-384":
+		return P384ECDSA
+	case "P-521":
+		return P521ECDSA
+	}
+	return ""
+}
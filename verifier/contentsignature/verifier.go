@@ -2,58 +2,74 @@ package contentsignature // import "github.com/mozilla-services/autograph/verifi
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"strings"
 	"time"
 )
 
+var (
+	// ErrInputDecodeFailed is returned when the base64 input to
+	// verify cannot be decoded
+	ErrInputDecodeFailed = errors.New("failed to base64 decode input")
+
+	// ErrSignatureVerificationFailed is returned when the signature
+	// does not verify the input
+	ErrSignatureVerificationFailed = errors.New("ecdsa signature verification failed")
+)
+
 // ParseChain parses a PEM-encoded certificate chain.
 //
-// It parses the end entity/leaf then the intermediate then the root
-// cert. It does not validate the certificates or the chain.
+// It parses the end entity/leaf then one or more intermediates then
+// the root cert, the last cert in the chain. It does not validate the
+// certificates or the chain.
 //
-// It returns the slice of three certs or an empty slice and an error.
+// It returns the slice of certs or an empty slice and an error.
 //
 func ParseChain(chain []byte) (certs []*x509.Certificate, err error) {
-	block, rest := pem.Decode(chain)
-	if block == nil || block.Type != "CERTIFICATE" {
-		return nil, fmt.Errorf("failed to PEM decode EE/leaf certificate from chain")
-	}
-	ee, err := x509.ParseCertificate(block.Bytes)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing EE/leaf certificate from chain: %w", err)
-	}
-	certs = append(certs, ee)
-
-	// the second cert is the intermediate
-	block, rest = pem.Decode(rest)
-	if block == nil || block.Type != "CERTIFICATE" {
-		return nil, fmt.Errorf("failed to PEM decode intermediate certificate from chain")
-	}
-	inter, err := x509.ParseCertificate(block.Bytes)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse intermediate certificate from chain: %w", err)
+	rest := chain
+	// a chain has at least an EE, an intermediate and a root, and
+	// every cert after those is another intermediate or the root
+	for len(certs) < 3 || len(rest) != 0 {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil && len(certs) >= 3 {
+			return nil, fmt.Errorf("found trailing data after root certificate in chain")
+		}
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("failed to PEM decode %s certificate from chain", chainCertName(len(certs), block == nil || len(rest) == 0))
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			if len(certs) == 0 {
+				return nil, fmt.Errorf("error parsing EE/leaf certificate from chain: %w", err)
+			}
+			return nil, fmt.Errorf("failed to parse %s certificate from chain: %w", chainCertName(len(certs), len(rest) == 0), err)
+		}
+		certs = append(certs, cert)
 	}
-	certs = append(certs, inter)
+	return certs, nil
+}
 
-	// the third and last cert is the root
-	block, rest = pem.Decode(rest)
-	if block == nil || block.Type != "CERTIFICATE" {
-		return nil, fmt.Errorf("failed to PEM decode root certificate from chain")
+// chainCertName returns the name of the cert at index i of a chain in
+// parsing errors, last is true when nothing follows the cert
+func chainCertName(i int, last bool) string {
+	switch {
+	case i == 0:
+		return "EE/leaf"
+	case i >= 2 && last:
+		return "root"
+	default:
+		return "intermediate"
 	}
-	root, err := x509.ParseCertificate(block.Bytes)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse root certificate from chain: %w", err)
-	}
-	if len(rest) != 0 {
-		return nil, fmt.Errorf("found trailing data after root certificate in chain")
-	}
-	certs = append(certs, root)
-	return certs, nil
 }
 
 // verifyRoot checks that a root cert is:
@@ -66,6 +82,12 @@ func ParseChain(chain []byte) (certs []*x509.Certificate, err error) {
 // optional colons rootHash param (as from openssl x509 -noout -text
 // -fingerprint -sha256 -in ca.crt)
 func verifyRoot(rootHash string, cert *x509.Certificate) error {
+	return verifyRootWithHashes([]string{rootHash}, cert)
+}
+
+// verifyRootWithHashes performs the verifyRoot checks but accepts a
+// root whose SHA2 sum matches any of the provided rootHashes
+func verifyRootWithHashes(rootHashes []string, cert *x509.Certificate) error {
 	// this is the last cert, it should be self signed
 	if !bytes.Equal(cert.RawSubject, cert.RawIssuer) {
 		return fmt.Errorf("subject does not match issuer, should be equal")
@@ -73,15 +95,28 @@ func verifyRoot(rootHash string, cert *x509.Certificate) error {
 	if !cert.IsCA {
 		return fmt.Errorf("missing IS CA extension")
 	}
-	if rootHash == "" {
-		return fmt.Errorf("rootHash must not be empty")
+	if len(rootHashes) == 0 {
+		return fmt.Errorf("rootHashes must not be empty")
 	}
-	rhash := strings.Replace(rootHash, ":", "", -1)
-	// We're configure to check the root hash matches expected value
+	// We're configure to check the root hash matches one of the expected values
 	h := sha256.Sum256(cert.Raw)
 	certHash := fmt.Sprintf("%X", h[:])
-	if rhash != certHash {
-		return fmt.Errorf("hash does not match expected root: expected=%s; got=%s", rhash, certHash)
+	var (
+		rhashes      []string
+		matchingHash bool
+	)
+	for _, rootHash := range rootHashes {
+		if rootHash == "" {
+			return fmt.Errorf("rootHash must not be empty")
+		}
+		rhash := strings.Replace(rootHash, ":", "", -1)
+		if rhash == certHash {
+			matchingHash = true
+		}
+		rhashes = append(rhashes, rhash)
+	}
+	if !matchingHash {
+		return fmt.Errorf("hash does not match expected root: expected=%s; got=%s", strings.Join(rhashes, ","), certHash)
 	}
 	hasCodeSigningExtension := false
 	for _, ext := range cert.ExtKeyUsage {
@@ -96,15 +131,23 @@ func verifyRoot(rootHash string, cert *x509.Certificate) error {
 	return nil
 }
 
-// VerifyChain checks certs in a three certificate chain [EE, intermediate, root] are:
+// VerifyChain checks certs in a chain [EE, intermediate..., root] of
+// at least three certificates are:
 //
 // 1) signed by their parent/issuer/the next cert in the chain or all verifyRoot checks for the root
 // 2) valid for the current time i.e. cert NotBefore < current time < cert NotAfter
 // 3) the chain follows name constraints and extended key usage as checked by x509 Certificate.Verify
 //
 func VerifyChain(rootHash string, certs []*x509.Certificate, currentTime time.Time) error {
-	if len(certs) != 3 {
-		return fmt.Errorf("can only verify 3 certificate chain, got %d certs", len(certs))
+	return VerifyChainWithRoots([]string{rootHash}, certs, currentTime)
+}
+
+// VerifyChainWithRoots performs the VerifyChain checks but accepts a
+// root matching any of the provided rootHashes. This allows verifying
+// chains issued under either root during a root rotation.
+func VerifyChainWithRoots(rootHashes []string, certs []*x509.Certificate, currentTime time.Time) error {
+	if len(certs) < 3 {
+		return fmt.Errorf("can only verify chain of at least 3 certificates, got %d certs", len(certs))
 	}
 
 	var (
@@ -124,26 +167,23 @@ func VerifyChain(rootHash string, certs []*x509.Certificate, currentTime time.Ti
 			return fmt.Errorf("certificate %d %q is not yet valid: notBefore=%s",
 				i, cert.Subject.CommonName, cert.NotBefore)
 		}
-		switch i {
-		case 2: // the last cert is the root
-			err := verifyRoot(rootHash, cert)
+		if i == len(certs)-1 { // the last cert is the root
+			err := verifyRootWithHashes(rootHashes, cert)
 			if err != nil {
 				return fmt.Errorf("certificate %d %q is root but fails validation: %w",
 					i, cert.Subject.CommonName, err)
 			}
 			roots.AddCert(cert)
-		case 1:
+			continue
+		}
+		if i > 0 {
 			inters.AddCert(cert)
-			fallthrough // fall through to check intermediate is signed by root
-		case 0:
-			fallthrough // fall through to check leaf is signed by intermediate
-		default:
-			// check that cert is signed by parent
-			err := cert.CheckSignatureFrom(certs[i+1])
-			if err != nil {
-				return fmt.Errorf("certificate %d %q is not signed by parent certificate %d %q: %v",
-					i, cert.Subject.CommonName, i+1, certs[i+1].Subject.CommonName, err)
-			}
+		}
+		// check that cert is signed by parent
+		err := cert.CheckSignatureFrom(certs[i+1])
+		if err != nil {
+			return fmt.Errorf("certificate %d %q is not signed by parent certificate %d %q: %v",
+				i, cert.Subject.CommonName, i+1, certs[i+1].Subject.CommonName, err)
 		}
 	}
 	opts := x509.VerifyOptions{
@@ -174,28 +214,153 @@ func VerifyChain(rootHash string, certs []*x509.Certificate, currentTime time.Ti
 // It returns an error if it fails or nil on success.
 //
 func Verify(input, certChain []byte, signature, rootHash string) error {
-	certs, err := ParseChain(certChain)
+	return VerifyWithRoots(input, certChain, signature, []string{rootHash})
+}
+
+// VerifyWithRoots validates the signature and certificate chain of a
+// content signature response like Verify, but accepts a chain ending
+// in any of the roots matching rootHashes
+func VerifyWithRoots(input, certChain []byte, signature string, rootHashes []string) error {
+	certs, sig, err := parseChainAndSignature(certChain, signature)
 	if err != nil {
-		return fmt.Errorf("error parsing cert chain: %w", err)
+		return err
 	}
-	// Get the public key from the end-entity (certs[0] is the end entity)
-	key, ok := certs[0].PublicKey.(*ecdsa.PublicKey)
-	if !ok {
-		return fmt.Errorf("cannot verify EE/leaf cert with non-ECDSA public key type: %T", certs[0].PublicKey)
+	key := certs[0].PublicKey
+	err = verifyReader(bytes.NewReader(input), sig, key)
+	if errors.Is(err, ErrSignatureVerificationFailed) {
+		return verificationError(sig, input, key)
 	}
-	// parse the json signature
-	sig, err := Unmarshal(signature)
 	if err != nil {
-		return fmt.Errorf("error unmarshal content signature: %w", err)
+		return err
+	}
+
+	err = VerifyChainWithRoots(rootHashes, certs, time.Now())
+	if err != nil {
+		return fmt.Errorf("error verifying content signature certificate chain: %w", err)
+	}
+	return nil
+}
+
+// VerifyStream validates the signature and certificate chain of a
+// content signature response like Verify, but reads the input from r
+// and hashes it as it is read, so large inputs such as MAR files are
+// verified in constant memory. Ed25519 signatures sign the input
+// itself rather than its hash, so the input of an Ed25519 signature
+// is read in memory.
+func VerifyStream(r io.Reader, certChain []byte, signature, rootHash string) error {
+	return VerifyStreamWithRoots(r, certChain, signature, []string{rootHash})
+}
+
+// VerifyStreamWithRoots validates the signature and certificate chain
+// of a content signature response like VerifyStream, but accepts a
+// chain ending in any of the roots matching rootHashes
+func VerifyStreamWithRoots(r io.Reader, certChain []byte, signature string, rootHashes []string) error {
+	certs, sig, err := parseChainAndSignature(certChain, signature)
+	if err != nil {
+		return err
 	}
-	// make a templated hash
-	if !sig.VerifyData(input, key) {
-		return fmt.Errorf("ecdsa signature verification failed")
+	err = verifyReader(r, sig, certs[0].PublicKey)
+	if err != nil {
+		return err
 	}
 
-	err = VerifyChain(rootHash, certs, time.Now())
+	err = VerifyChainWithRoots(rootHashes, certs, time.Now())
 	if err != nil {
 		return fmt.Errorf("error verifying content signature certificate chain: %w", err)
 	}
 	return nil
 }
+
+// parseChainAndSignature parses the certificate chain and the content
+// signature of a content signature response, and checks the public
+// key of the EE/leaf cert can verify the signature
+func parseChainAndSignature(certChain []byte, signature string) (certs []*x509.Certificate, sig *ContentSignature, err error) {
+	certs, err = ParseChain(certChain)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing cert chain: %w", err)
+	}
+	// Get the public key from the end-entity (certs[0] is the end entity)
+	key := certs[0].PublicKey
+	switch key.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+	default:
+		return nil, nil, fmt.Errorf("cannot verify EE/leaf cert with non-ECDSA or Ed25519 public key type: %T", certs[0].PublicKey)
+	}
+	// parse the json signature
+	sig, err = Unmarshal(signature)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error unmarshal content signature: %w", err)
+	}
+	if ecKey, ok := key.(*ecdsa.PublicKey); ok {
+		// the mode and hash of the signature are picked from its
+		// length, which must be the one of the curve of the key
+		if mode := getModeFromCurve(ecKey.Curve); mode != sig.Mode {
+			return nil, nil, fmt.Errorf("content signature of mode %s does not match the %s curve of the EE/leaf cert", sig.Mode, ecKey.Curve.Params().Name)
+		}
+	}
+	if _, ok := key.(ed25519.PublicKey); ok {
+		// Ed25519 signatures unmarshal as P256ECDSA because both
+		// have the same length
+		if sig.Len != ED25519BYTESIZE {
+			return nil, nil, fmt.Errorf("invalid Ed25519 content signature length %d, expected %d", sig.Len, ED25519BYTESIZE)
+		}
+		sig.Mode = ED25519
+		sig.HashName = ""
+	}
+	return certs, sig, nil
+}
+
+// verifyReader verifies a signature on the raw, untemplated, input
+// read from r with an ECDSA or Ed25519 public key. It returns
+// ErrSignatureVerificationFailed when the signature does not verify
+// the input.
+func verifyReader(r io.Reader, sig *ContentSignature, pubKey crypto.PublicKey) error {
+	var verified bool
+	switch key := pubKey.(type) {
+	case *ecdsa.PublicKey:
+		_, md := newTemplatedHash(sig.Mode)
+		_, err := io.Copy(md, r)
+		if err != nil {
+			return fmt.Errorf("failed to read input: %w", err)
+		}
+		verified = sig.VerifyHash(md.Sum(nil), key)
+	case ed25519.PublicKey:
+		input, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("failed to read input: %w", err)
+		}
+		verified = sig.VerifyDataEd25519(input, key)
+	}
+	if !verified {
+		return ErrSignatureVerificationFailed
+	}
+	return nil
+}
+
+// VerifyBase64Input decodes the standard base64 encoded input, like
+// the input of a signature request, and verifies it with Verify. Its
+// errors wrap ErrInputDecodeFailed when the input does not decode and
+// ErrSignatureVerificationFailed when the signature does not verify
+// the decoded input.
+func VerifyBase64Input(b64Input string, certChain []byte, signature, rootHash string) error {
+	input, err := base64.StdEncoding.DecodeString(b64Input)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInputDecodeFailed, err)
+	}
+	return Verify(input, certChain, signature, rootHash)
+}
+
+// verificationError returns ErrSignatureVerificationFailed for an
+// input the signature does not verify. When the signature verifies the
+// base64 decoding or encoding of the input instead, the error says so
+// since the input was most likely encoded once too often or not at all.
+func verificationError(sig *ContentSignature, input []byte, key crypto.PublicKey) error {
+	decoded, err := base64.StdEncoding.DecodeString(string(input))
+	if err == nil && sig.verifyDataWithKey(decoded, key) {
+		return fmt.Errorf("%w: signature verifies the base64 decoded input, the input was likely base64 encoded twice", ErrSignatureVerificationFailed)
+	}
+	if sig.verifyDataWithKey([]byte(base64.StdEncoding.EncodeToString(input)), key) {
+		return fmt.Errorf("%w: signature verifies the base64 encoded input, the input was likely not base64 encoded before signing", ErrSignatureVerificationFailed)
+	}
+	return ErrSignatureVerificationFailed
+}
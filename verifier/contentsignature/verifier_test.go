@@ -1,21 +1,27 @@
 package contentsignature
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math/big"
 	"reflect"
 	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -297,11 +303,12 @@ BkZWS5IjC+15Uqt3yOcCMdjIJpikiD1WjXRaeFe+b3ovcoBs4ToLK7d8y0qFlkgx
 var (
 	badPEMContent = strings.Replace(testSignerP384PEM, "EC PRIVATE KEY", "CERTIFICATE", -1)
 
-	testRootKey    = generateTestKey()
-	testInterKey   = generateTestKey()
-	testLeafKey    = mustPEMToECKey(testSignerP384PEM)
-	testLeafRSAKey = generateTestRSAKey()
-	testRoot       = signTestCert(signOptions{
+	testRootKey     = generateTestKey()
+	testInterKey    = generateTestKey()
+	testSubInterKey = generateTestKey()
+	testLeafKey     = mustPEMToECKey(testSignerP384PEM)
+	testLeafRSAKey  = generateTestRSAKey()
+	testRoot        = signTestCert(signOptions{
 		commonName:   "autograph unit test self-signed root",
 		keyUsage:     x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
 		extKeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
@@ -373,6 +380,29 @@ var (
 		permittedDNSDomainsCritical: true,
 		permittedDNSDomains:         []string{".content-signature.mozilla.org", "content-signature.mozilla.org"},
 	})
+	testSubInter = signTestCert(signOptions{
+		commonName:   "autograph unit test content signing sub-intermediate",
+		extKeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		keyUsage:     x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		privateKey:   testInterKey,
+		publicKey:    &testSubInterKey.PublicKey,
+		isCA:         true,
+		issuer:       testInter,
+		notBefore:    time.Now().Add(-2 * 24 * time.Hour),
+		notAfter:     time.Now().Add(time.Hour),
+	})
+	testLeafUnderSubInter = signTestCert(signOptions{
+		commonName:   "example.content-signature.mozilla.org",
+		DNSNames:     []string{"example.content-signature.mozilla.org"},
+		extKeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		keyUsage:     x509.KeyUsageDigitalSignature,
+		privateKey:   testSubInterKey,
+		publicKey:    &testLeafKey.PublicKey,
+		isCA:         false,
+		issuer:       testSubInter,
+		notBefore:    time.Now().Add(-2 * time.Hour),
+		notAfter:     time.Now().Add(time.Hour),
+	})
 	testLeaf = signTestCert(signOptions{
 		commonName:   "example.content-signature.mozilla.org",
 		DNSNames:     []string{"example.content-signature.mozilla.org"},
@@ -986,6 +1016,12 @@ func Test_ParseChain(t *testing.T) {
 			wantCerts: WronglyOrderedChainCerts,
 			wantErr:   false,
 		},
+		{
+			name:      "chain with two intermediates parses",
+			chain:     mustCertsToChain([]*x509.Certificate{testLeafUnderSubInter, testSubInter, testInter, testRoot}),
+			wantCerts: []*x509.Certificate{testLeafUnderSubInter, testSubInter, testInter, testRoot},
+			wantErr:   false,
+		},
 		// failing test cases.
 		{
 			name:       "empty chain fails",
@@ -1044,11 +1080,11 @@ func Test_ParseChain(t *testing.T) {
 			wantErrStr: "found trailing data after root certificate in chain",
 		},
 		{
-			name:       "extra cert fails",
-			chain:      []byte(firefoxPkiStageRoot + "\n" + firefoxPkiStageRoot + "\n" + firefoxPkiStageRoot + "\n" + firefoxPkiStageRoot),
+			name:       "non-CERTIFICATE block after root fails",
+			chain:      []byte(firefoxPkiStageRoot + "\n" + firefoxPkiStageRoot + "\n" + firefoxPkiStageRoot + "\n" + testSignerP384PEM),
 			wantCerts:  []*x509.Certificate{},
 			wantErr:    true,
-			wantErrStr: "found trailing data after root certificate in chain",
+			wantErrStr: "failed to PEM decode root certificate from chain",
 		},
 	}
 	for _, tt := range tests {
@@ -1236,6 +1272,16 @@ func Test_VerifyChain(t *testing.T) {
 			wantErr:   false,
 			errSubStr: "",
 		},
+		{
+			name: "valid test chain with two intermediates passes",
+			args: args{
+				rootHash:    sha2Fingerprint(testRoot),
+				certs:       []*x509.Certificate{testLeafUnderSubInter, testSubInter, testInter, testRoot},
+				currentTime: time.Now(),
+			},
+			wantErr:   false,
+			errSubStr: "",
+		},
 		// failing test cases.
 		{
 			name: "short chain fails",
@@ -1245,22 +1291,27 @@ func Test_VerifyChain(t *testing.T) {
 				currentTime: mustParseUTC("2020-05-09T14:02:37Z"),
 			},
 			wantErr:   true,
-			errSubStr: "can only verify 3 certificate chain, got 1 certs",
+			errSubStr: "can only verify chain of at least 3 certificates, got 1 certs",
 		},
 		{
 			name: "long chain with extra root fails",
 			args: args{
-				rootHash: sha2Fingerprint(testRoot),
-				certs: []*x509.Certificate{
-					NormandyDevChain2021Certs[0],
-					NormandyDevChain2021Certs[1],
-					NormandyDevChain2021Certs[2],
-					NormandyDevChain2021Certs[2],
-				},
-				currentTime: mustParseUTC("2020-05-09T14:02:37Z"),
+				rootHash:    normandyDev2021Roothash,
+				certs:       []*x509.Certificate{testLeaf, testInter, testRoot, testRoot},
+				currentTime: time.Now(),
 			},
 			wantErr:   true,
-			errSubStr: "can only verify 3 certificate chain, got 4 certs",
+			errSubStr: "certificate 3 \"autograph unit test self-signed root\" is root but fails validation",
+		},
+		{
+			name: "chain with intermediates out of order fails",
+			args: args{
+				rootHash:    sha2Fingerprint(testRoot),
+				certs:       []*x509.Certificate{testLeafUnderSubInter, testInter, testSubInter, testRoot},
+				currentTime: time.Now(),
+			},
+			wantErr:   true,
+			errSubStr: "is not signed by parent certificate",
 		},
 		{
 			name: "wrongly ordered chain fails",
@@ -1464,3 +1515,442 @@ func TestVerify(t *testing.T) {
 		})
 	}
 }
+
+func TestVerifyWithRoots(t *testing.T) {
+	const testSignature = "qGjS1QmB2xANizjJqrGmIPoojzjBrTV5kgi01p1ELnfKwH4E3UDTZRf-9K7PCEwjt0mOzd1bBmRBKcnWZNFAMvAduBwfAPHFGpX-YKBoRSLHuA6QuiosEydnZEs5ykAR"
+	type args struct {
+		input      []byte
+		certChain  []byte
+		signature  string
+		rootHashes []string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{
+			name: "matching root first ok",
+			args: args{
+				input:      signerTestData,
+				certChain:  mustCertsToChain([]*x509.Certificate{testLeaf, testInter, testRoot}),
+				signature:  testSignature,
+				rootHashes: []string{sha2Fingerprint(testRoot), firefoxPkiProdRootHash},
+			},
+			wantErr: false,
+		},
+		{
+			name: "matching root last ok",
+			args: args{
+				input:      signerTestData,
+				certChain:  mustCertsToChain([]*x509.Certificate{testLeaf, testInter, testRoot}),
+				signature:  testSignature,
+				rootHashes: []string{firefoxPkiProdRootHash, firefoxPkiContentSignatureStageRootHash, sha2Fingerprint(testRoot)},
+			},
+			wantErr: false,
+		},
+		// failing test cases.
+		{
+			name: "no matching root fails",
+			args: args{
+				input:      signerTestData,
+				certChain:  mustCertsToChain([]*x509.Certificate{testLeaf, testInter, testRoot}),
+				signature:  testSignature,
+				rootHashes: []string{firefoxPkiProdRootHash, firefoxPkiContentSignatureStageRootHash},
+			},
+			wantErr: true,
+		},
+		{
+			name: "no root hashes fails",
+			args: args{
+				input:      signerTestData,
+				certChain:  mustCertsToChain([]*x509.Certificate{testLeaf, testInter, testRoot}),
+				signature:  testSignature,
+				rootHashes: nil,
+			},
+			wantErr: true,
+		},
+		{
+			name: "empty root hash fails",
+			args: args{
+				input:      signerTestData,
+				certChain:  mustCertsToChain([]*x509.Certificate{testLeaf, testInter, testRoot}),
+				signature:  testSignature,
+				rootHashes: []string{sha2Fingerprint(testRoot), ""},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := VerifyWithRoots(tt.args.input, tt.args.certChain, tt.args.signature, tt.args.rootHashes); (err != nil) != tt.wantErr {
+				t.Errorf("VerifyWithRoots() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// zeroReader reads an endless stream of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestVerifyStream(t *testing.T) {
+	const testSignature = "qGjS1QmB2xANizjJqrGmIPoojzjBrTV5kgi01p1ELnfKwH4E3UDTZRf-9K7PCEwjt0mOzd1bBmRBKcnWZNFAMvAduBwfAPHFGpX-YKBoRSLHuA6QuiosEydnZEs5ykAR"
+	certChain := mustCertsToChain([]*x509.Certificate{testLeaf, testInter, testRoot})
+	rootHash := sha2Fingerprint(testRoot)
+
+	// a signature of a large input that is only hashed as it is read
+	largeInput := func() io.Reader {
+		return io.LimitReader(zeroReader{}, 64<<20)
+	}
+	_, md := newTemplatedHash(P384ECDSA)
+	if _, err := io.Copy(md, largeInput()); err != nil {
+		t.Fatal(err)
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, testLeafKey, md.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	largeInputSignature, err := (&ContentSignature{R: r, S: s, Mode: P384ECDSA, Len: P384ECDSABYTESIZE, Finished: true}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		input     io.Reader
+		certChain []byte
+		signature string
+		wantErr   error
+		errSubstr string
+	}{
+		{
+			name:      "valid content signature ok",
+			input:     bytes.NewReader(signerTestData),
+			certChain: certChain,
+			signature: testSignature,
+		},
+		{
+			name:      "large input ok",
+			input:     largeInput(),
+			certChain: certChain,
+			signature: largeInputSignature,
+		},
+		// failing test cases.
+		{
+			name:      "other input fails to verify",
+			input:     strings.NewReader("some other input"),
+			certChain: certChain,
+			signature: testSignature,
+			wantErr:   ErrSignatureVerificationFailed,
+		},
+		{
+			name:      "read error fails",
+			input:     iotest.ErrReader(errors.New("connection reset")),
+			certChain: certChain,
+			signature: testSignature,
+			errSubstr: "failed to read input: connection reset",
+		},
+		{
+			name:      "signature unmarshal fails",
+			input:     bytes.NewReader(signerTestData),
+			certChain: certChain,
+			signature: "",
+			errSubstr: "error unmarshal content signature",
+		},
+		{
+			name:      "chain verification fails",
+			input:     bytes.NewReader(signerTestData),
+			certChain: mustCertsToChain([]*x509.Certificate{testLeaf, testInter, testRootExpired}),
+			signature: testSignature,
+			errSubstr: "error verifying content signature certificate chain",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyStream(tt.input, tt.certChain, tt.signature, rootHash)
+			if tt.wantErr == nil && tt.errSubstr == "" {
+				if err != nil {
+					t.Fatalf("VerifyStream() unexpected error = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("VerifyStream() expected error but succeeded")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("VerifyStream() error = %v, want %v", err, tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.errSubstr) {
+				t.Fatalf("VerifyStream() error = %v, want it to contain %q", err, tt.errSubstr)
+			}
+		})
+	}
+}
+
+func TestVerifyBase64Input(t *testing.T) {
+	const testSignature = "qGjS1QmB2xANizjJqrGmIPoojzjBrTV5kgi01p1ELnfKwH4E3UDTZRf-9K7PCEwjt0mOzd1bBmRBKcnWZNFAMvAduBwfAPHFGpX-YKBoRSLHuA6QuiosEydnZEs5ykAR"
+	certChain := mustCertsToChain([]*x509.Certificate{testLeaf, testInter, testRoot})
+	rootHash := sha2Fingerprint(testRoot)
+
+	// a signature of the base64 encoded test data
+	_, hashed := makeTemplatedHash([]byte(base64.StdEncoding.EncodeToString(signerTestData)), P384ECDSA)
+	r, s, err := ecdsa.Sign(rand.Reader, testLeafKey, hashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedInputSignature, err := (&ContentSignature{R: r, S: s, Mode: P384ECDSA, Len: P384ECDSABYTESIZE, Finished: true}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		b64Input  string
+		signature string
+		wantErr   error
+		errSubstr string
+	}{
+		{
+			name:      "valid base64 input ok",
+			b64Input:  base64.StdEncoding.EncodeToString(signerTestData),
+			signature: testSignature,
+		},
+		{
+			name:      "invalid base64 input fails to decode",
+			b64Input:  "!!not base64!!",
+			signature: testSignature,
+			wantErr:   ErrInputDecodeFailed,
+		},
+		{
+			name:      "double encoded input fails to verify",
+			b64Input:  base64.StdEncoding.EncodeToString([]byte(base64.StdEncoding.EncodeToString(signerTestData))),
+			signature: testSignature,
+			wantErr:   ErrSignatureVerificationFailed,
+			errSubstr: "base64 encoded twice",
+		},
+		{
+			name:      "input signed encoded fails to verify",
+			b64Input:  base64.StdEncoding.EncodeToString(signerTestData),
+			signature: encodedInputSignature,
+			wantErr:   ErrSignatureVerificationFailed,
+			errSubstr: "not base64 encoded before signing",
+		},
+		{
+			name:      "other input fails to verify",
+			b64Input:  base64.StdEncoding.EncodeToString([]byte("some other input")),
+			signature: testSignature,
+			wantErr:   ErrSignatureVerificationFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyBase64Input(tt.b64Input, certChain, tt.signature, rootHash)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("VerifyBase64Input() unexpected error = %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("VerifyBase64Input() error = %v, want %v", err, tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.errSubstr) {
+				t.Fatalf("VerifyBase64Input() error = %v, want it to contain %q", err, tt.errSubstr)
+			}
+		})
+	}
+}
+
+func TestVerifyEd25519(t *testing.T) {
+	leafPub, leafPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := signTestCert(signOptions{
+		commonName:   "ed25519.content-signature.mozilla.org",
+		DNSNames:     []string{"ed25519.content-signature.mozilla.org"},
+		extKeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		keyUsage:     x509.KeyUsageDigitalSignature,
+		privateKey:   testInterKey,
+		publicKey:    leafPub,
+		isCA:         false,
+		issuer:       testInter,
+		notBefore:    time.Now().Add(-2 * time.Hour),
+		notAfter:     time.Now().Add(time.Hour),
+	})
+	certChain := mustCertsToChain([]*x509.Certificate{leaf, testInter, testRoot})
+	rootHash := sha2Fingerprint(testRoot)
+	sign := func(data []byte) string {
+		return base64.RawURLEncoding.EncodeToString(ed25519.Sign(leafPriv, makeTemplatedInput(data)))
+	}
+
+	// a P-256 signature has the length of an Ed25519 signature
+	_, hashed := makeTemplatedHash(signerTestData, P256ECDSA)
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, p256Key, hashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256Signature, err := (&ContentSignature{R: r, S: s, Mode: P256ECDSA, Len: P256ECDSABYTESIZE, Finished: true}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		input     []byte
+		signature string
+		wantErr   error
+		errSubstr string
+	}{
+		{
+			name:      "valid Ed25519 signature ok",
+			input:     signerTestData,
+			signature: sign(signerTestData),
+		},
+		{
+			name:      "other input fails to verify",
+			input:     []byte("some other input"),
+			signature: sign(signerTestData),
+			wantErr:   ErrSignatureVerificationFailed,
+		},
+		{
+			name:      "base64 encoded input fails to verify",
+			input:     []byte(base64.StdEncoding.EncodeToString(signerTestData)),
+			signature: sign(signerTestData),
+			wantErr:   ErrSignatureVerificationFailed,
+			errSubstr: "base64 encoded twice",
+		},
+		{
+			name:      "P-256 ECDSA signature fails to verify",
+			input:     signerTestData,
+			signature: p256Signature,
+			wantErr:   ErrSignatureVerificationFailed,
+		},
+		{
+			name:      "P-384 ECDSA signature length fails",
+			input:     signerTestData,
+			signature: "qGjS1QmB2xANizjJqrGmIPoojzjBrTV5kgi01p1ELnfKwH4E3UDTZRf-9K7PCEwjt0mOzd1bBmRBKcnWZNFAMvAduBwfAPHFGpX-YKBoRSLHuA6QuiosEydnZEs5ykAR",
+			errSubstr: "invalid Ed25519 content signature length 96",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.input, certChain, tt.signature, rootHash)
+			if tt.wantErr == nil && tt.errSubstr == "" {
+				if err != nil {
+					t.Fatalf("Verify() unexpected error = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Verify() expected error but succeeded")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.errSubstr) {
+				t.Fatalf("Verify() error = %v, want it to contain %q", err, tt.errSubstr)
+			}
+		})
+	}
+}
+
+func TestVerifyP521(t *testing.T) {
+	leafKey, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := signTestCert(signOptions{
+		commonName:   "p521.content-signature.mozilla.org",
+		DNSNames:     []string{"p521.content-signature.mozilla.org"},
+		extKeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		keyUsage:     x509.KeyUsageDigitalSignature,
+		privateKey:   testInterKey,
+		publicKey:    &leafKey.PublicKey,
+		isCA:         false,
+		issuer:       testInter,
+		notBefore:    time.Now().Add(-2 * time.Hour),
+		notAfter:     time.Now().Add(time.Hour),
+	})
+	certChain := mustCertsToChain([]*x509.Certificate{leaf, testInter, testRoot})
+	rootHash := sha2Fingerprint(testRoot)
+	sign := func(key *ecdsa.PrivateKey, mode string, sigLen int, data []byte) string {
+		_, hashed := makeTemplatedHash(data, mode)
+		r, s, err := ecdsa.Sign(rand.Reader, key, hashed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := (&ContentSignature{R: r, S: s, Mode: mode, Len: sigLen, Finished: true}).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		input     []byte
+		signature string
+		wantErr   error
+		errSubstr string
+	}{
+		{
+			name:      "valid P-521 signature of the SHA-512 hash ok",
+			input:     signerTestData,
+			signature: sign(leafKey, P521ECDSA, P521ECDSABYTESIZE, signerTestData),
+		},
+		{
+			name:      "other input fails to verify",
+			input:     []byte("some other input"),
+			signature: sign(leafKey, P521ECDSA, P521ECDSABYTESIZE, signerTestData),
+			wantErr:   ErrSignatureVerificationFailed,
+		},
+		{
+			name:      "P-521 signature of the SHA-384 hash fails to verify",
+			input:     signerTestData,
+			signature: sign(leafKey, P384ECDSA, P521ECDSABYTESIZE, signerTestData),
+			wantErr:   ErrSignatureVerificationFailed,
+		},
+		{
+			name:      "P-384 signature fails on the curve of the key",
+			input:     signerTestData,
+			signature: sign(p384Key, P384ECDSA, P384ECDSABYTESIZE, signerTestData),
+			errSubstr: "content signature of mode p384ecdsa does not match the P-521 curve of the EE/leaf cert",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.input, certChain, tt.signature, rootHash)
+			if tt.wantErr == nil && tt.errSubstr == "" {
+				if err != nil {
+					t.Fatalf("Verify() unexpected error = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Verify() expected error but succeeded")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.errSubstr) {
+				t.Fatalf("Verify() error = %v, want it to contain %q", err, tt.errSubstr)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package verifier // import "github.com/mozilla-services/autograph/verifier"
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/autograph/formats"
+	"github.com/mozilla-services/autograph/signer/apk2"
+	"github.com/mozilla-services/autograph/signer/contentsignature"
+	"github.com/mozilla-services/autograph/signer/contentsignaturepki"
+	"github.com/mozilla-services/autograph/signer/ed25519"
+	"github.com/mozilla-services/autograph/signer/genericrsa"
+	"github.com/mozilla-services/autograph/signer/mar"
+	"github.com/mozilla-services/autograph/signer/multisig"
+	"github.com/mozilla-services/autograph/signer/rfc3161"
+	"github.com/mozilla-services/autograph/signer/xpi"
+	csigverifier "github.com/mozilla-services/autograph/verifier/contentsignature"
+)
+
+// VerifyOptions holds the trust parameters of a verification that the
+// signature response does not carry
+type VerifyOptions struct {
+	// RootHash is the hex encoded SHA256 fingerprint of the root
+	// certificate contentsignaturepki chains must chain to
+	RootHash string
+
+	// RootSPKIHash is the optional hex encoded SHA256 of the
+	// SubjectPublicKeyInfo of the root certificate that pins the key
+	// of the root contentsignaturepki chains must chain to
+	RootSPKIHash string
+
+	// FetchX5U returns the certificate chain at the x5u of a
+	// contentsignaturepki response, it defaults to fetching it
+	// with contentsignaturepki.GetX5UWithClock
+	FetchX5U func(x5u string) ([]byte, error)
+
+	// Now returns the time certificates are verified at, it
+	// defaults to time.Now
+	Now func() time.Time
+
+	// XPIRoots are the roots xpi signatures must chain to, the
+	// chain is not verified when nil
+	XPIRoots *x509.CertPool
+
+	// APKCertificate is the certificate apk2 signatures must be
+	// made with, and APKRotationCertificate the certificate their
+	// v3 signature can also be made with when the signer has a
+	// rotation key
+	APKCertificate         *x509.Certificate
+	APKRotationCertificate *x509.Certificate
+
+	// Threshold and TrustedKeys are the number of member signatures
+	// of a multisig response that must verify, and the base64 DER
+	// encoded public keys of the members they must come from
+	Threshold   int
+	TrustedKeys []string
+}
+
+// VerifyResponse verifies the signature of a /sign/data response on
+// its input with the verifier of the response type.
+//
+// The contentsignature, mar, genericrsa and ed25519 signatures, and
+// the TSA certificate of rfc3161 tokens, are verified with the public
+// key, mode and signer options of the response, so callers that know the signer should overwrite them
+// with trusted values first.
+//
+// The signed APK of apk2 responses is the base64 signed file of the
+// response, or the input when the response has none.
+func VerifyResponse(resp formats.SignatureResponse, input []byte, opts VerifyOptions) error {
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	switch resp.Type {
+	case contentsignature.Type:
+		return verifyContentSignature(input, resp.Signature, resp.PublicKey)
+	case contentsignaturepki.Type:
+		return verifyContentSignaturePKI(input, resp, opts)
+	case genericrsa.Type:
+		return genericrsa.VerifyGenericRsaSignatureResponse(input, resp)
+	case ed25519.Type:
+		return ed25519.VerifyEd25519SignatureResponse(input, resp)
+	case mar.Type:
+		return mar.VerifyMARSignatureResponse(input, resp)
+	case rfc3161.Type:
+		return rfc3161.VerifyRFC3161SignatureResponse(input, resp)
+	case multisig.Type:
+		if len(opts.TrustedKeys) == 0 {
+			return fmt.Errorf("verifier: multisig verification requires trusted keys")
+		}
+		return multisig.Verify(input, resp.Signature, opts.Threshold, opts.TrustedKeys)
+	case xpi.Type:
+		sig, err := xpi.Unmarshal(resp.Signature, input)
+		if err != nil {
+			return fmt.Errorf("verifier: failed to unmarshal xpi signature: %w", err)
+		}
+		return sig.VerifyWithChainAt(opts.XPIRoots, opts.Now())
+	case apk2.Type:
+		if opts.APKCertificate == nil {
+			return fmt.Errorf("verifier: apk2 verification requires the signer certificate")
+		}
+		signedAPK := input
+		if resp.SignedFile != "" {
+			var err error
+			signedAPK, err = base64.StdEncoding.DecodeString(resp.SignedFile)
+			if err != nil {
+				return fmt.Errorf("verifier: failed to decode signed APK: %w", err)
+			}
+		}
+		return apk2.VerifyWithRotationCert(signedAPK, opts.APKCertificate, opts.APKRotationCertificate)
+	default:
+		return fmt.Errorf("verifier: verification of %q signatures is not supported", resp.Type)
+	}
+}
+
+// verifyContentSignature verifies a content signature on the input
+// with a base64 DER encoded ECDSA public key
+func verifyContentSignature(input []byte, signature, publicKey string) error {
+	keyBytes, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return fmt.Errorf("verifier: failed to decode public key: %w", err)
+	}
+	keyInterface, err := x509.ParsePKIXPublicKey(keyBytes)
+	if err != nil {
+		return fmt.Errorf("verifier: failed to parse pkix public key: %w", err)
+	}
+	pubKey, ok := keyInterface.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("verifier: invalid public key type %T for content signature, must be ecdsa", keyInterface)
+	}
+	return verifyContentSignatureWithKey(input, signature, pubKey)
+}
+
+// verifyContentSignatureWithKey verifies a content signature on the
+// input with an ECDSA public key
+func verifyContentSignatureWithKey(input []byte, signature string, pubKey *ecdsa.PublicKey) error {
+	sig, err := csigverifier.Unmarshal(signature)
+	if err != nil {
+		return fmt.Errorf("verifier: failed to unmarshal content signature: %w", err)
+	}
+	// the mode and hash of the signature are picked from its length,
+	// which must be the one of the curve of the key
+	if mode := contentSignatureMode(pubKey); mode != sig.Mode {
+		return fmt.Errorf("verifier: content signature of mode %s does not match the %s curve of the public key", sig.Mode, pubKey.Curve.Params().Name)
+	}
+	if !sig.VerifyData(input, pubKey) {
+		return fmt.Errorf("verifier: content signature verification failed")
+	}
+	return nil
+}
+
+// contentSignatureMode returns the content signature mode of the curve
+// of an ECDSA public key, or an empty string if the curve is unknown
+func contentSignatureMode(pubKey *ecdsa.PublicKey) string {
+	switch pubKey.Curve.Params().Name {
+	case "P-256":
+		return csigverifier.P256ECDSA
+	case "P-384":
+		return csigverifier.P384ECDSA
+	case "P-521":
+		return csigverifier.P521ECDSA
+	}
+	return ""
+}
+
+// verifyContentSignaturePKI verifies a content signature on the input
+// with the end-entity of the chain at the x5u of the response, and
+// verifies the chain to the root of the options
+func verifyContentSignaturePKI(input []byte, resp formats.SignatureResponse, opts VerifyOptions) error {
+	if opts.RootHash == "" {
+		return fmt.Errorf("verifier: contentsignaturepki verification requires a root hash")
+	}
+	// an inline chain is verified like the one at the x5u, so
+	// clients that cannot fetch it can verify the response
+	var chain []byte
+	if len(resp.Chain) > 0 {
+		chain = []byte(strings.Join(resp.Chain, ""))
+	} else {
+		if resp.X5U == "" {
+			return fmt.Errorf("verifier: missing x5u or chain in contentsignaturepki response")
+		}
+		fetchX5U := opts.FetchX5U
+		if fetchX5U == nil {
+			fetchX5U = func(x5u string) ([]byte, error) {
+				client := &http.Client{Timeout: contentsignaturepki.DefaultX5UFetchTimeout}
+				chain, _, err := contentsignaturepki.GetX5UWithClock(client, x5u, contentsignaturepki.DefaultX5UMaxChainSize, opts.Now)
+				return chain, err
+			}
+		}
+		var err error
+		chain, err = fetchX5U(resp.X5U)
+		if err != nil {
+			return fmt.Errorf("verifier: failed to fetch x5u: %w", err)
+		}
+	}
+	certs, err := csigverifier.ParseChain(chain)
+	if err != nil {
+		return fmt.Errorf("verifier: failed to parse x5u chain: %w", err)
+	}
+	pubKey, ok := certs[0].PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("verifier: invalid end-entity public key type %T for content signature, must be ecdsa", certs[0].PublicKey)
+	}
+	err = verifyContentSignatureWithKey(input, resp.Signature, pubKey)
+	if err != nil {
+		return err
+	}
+	err = csigverifier.VerifyChain(opts.RootHash, certs, opts.Now())
+	if err != nil {
+		return fmt.Errorf("verifier: failed to verify x5u chain: %w", err)
+	}
+	if opts.RootSPKIHash != "" {
+		err = contentsignaturepki.VerifyRootSPKIHash(certs, opts.RootSPKIHash)
+		if err != nil {
+			return fmt.Errorf("verifier: failed to verify x5u chain: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package verifier
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"testing"
+
+	"github.com/mozilla-services/autograph/formats"
+	"github.com/mozilla-services/autograph/signer"
+	"github.com/mozilla-services/autograph/signer/apk2"
+	"github.com/mozilla-services/autograph/signer/contentsignature"
+	"github.com/mozilla-services/autograph/signer/contentsignaturepki"
+	"github.com/mozilla-services/autograph/signer/genericrsa"
+	"github.com/mozilla-services/autograph/signer/mar"
+	"github.com/mozilla-services/autograph/signer/multisig"
+)
+
+var input = []byte("foobarbaz1234abcd")
+
+func mustECDSAKeyPEM(curve elliptic.Curve) string {
+	priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	der, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		panic(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
+
+func mustRSAKeyPEM() string {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}))
+}
+
+var (
+	ecdsaKey1    = mustECDSAKeyPEM(elliptic.P384())
+	ecdsaKey2    = mustECDSAKeyPEM(elliptic.P384())
+	ecdsaP521Key = mustECDSAKeyPEM(elliptic.P521())
+	rsaKey       = mustRSAKeyPEM()
+)
+
+func newTestSigner(conf signer.Configuration) (signer.Signer, error) {
+	switch conf.Type {
+	case contentsignature.Type:
+		return contentsignature.New(conf)
+	case genericrsa.Type:
+		return genericrsa.New(conf)
+	case mar.Type:
+		return mar.New(conf)
+	case multisig.Type:
+		return multisig.New(conf, newTestSigner)
+	}
+	return nil, fmt.Errorf("unknown signer type %q", conf.Type)
+}
+
+// signResponse signs the input with a signer and returns the
+// signature response /sign/data would return
+func signResponse(t *testing.T, conf signer.Configuration) formats.SignatureResponse {
+	s, err := newTestSigner(conf)
+	if err != nil {
+		t.Fatalf("failed to initialize signer %q: %v", conf.ID, err)
+	}
+	sig, err := s.(signer.DataSigner).SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign with %q: %v", conf.ID, err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature of %q: %v", conf.ID, err)
+	}
+	signerConf := s.Config()
+	return formats.SignatureResponse{
+		Type:       signerConf.Type,
+		Mode:       signerConf.Mode,
+		SignerID:   signerConf.ID,
+		PublicKey:  signerConf.PublicKey,
+		SignerOpts: signerConf.SignerOpts,
+		Signature:  sigstr,
+	}
+}
+
+func TestVerifyResponse(t *testing.T) {
+	t.Parallel()
+
+	multisigConf := signer.Configuration{ID: "testmultisig", Type: multisig.Type, Threshold: 2, Members: []signer.Configuration{
+		{ID: "member1", Type: contentsignature.Type, PrivateKey: ecdsaKey1},
+		{ID: "member2", Type: contentsignature.Type, PrivateKey: ecdsaKey2},
+	}}
+	multisigResp := signResponse(t, multisigConf)
+	sig, err := multisig.Unmarshal(multisigResp.Signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trustedKeys []string
+	for _, memberSig := range sig.Signatures {
+		trustedKeys = append(trustedKeys, memberSig.PublicKey)
+	}
+
+	var TESTCASES = []struct {
+		resp formats.SignatureResponse
+		opts VerifyOptions
+	}{
+		{signResponse(t, signer.Configuration{ID: "testcs", Type: contentsignature.Type, PrivateKey: ecdsaKey1}), VerifyOptions{}},
+		{signResponse(t, signer.Configuration{ID: "testcsp521", Type: contentsignature.Type, PrivateKey: ecdsaP521Key}), VerifyOptions{}},
+		{signResponse(t, signer.Configuration{ID: "testmarecdsa", Type: mar.Type, PrivateKey: ecdsaKey1}), VerifyOptions{}},
+		{signResponse(t, signer.Configuration{ID: "testmarrsa", Type: mar.Type, PrivateKey: rsaKey}), VerifyOptions{}},
+		{signResponse(t, signer.Configuration{ID: "testrsa", Type: genericrsa.Type, Mode: genericrsa.ModePSS, Hash: "sha256", PrivateKey: rsaKey, PublicKey: "unused"}), VerifyOptions{}},
+		{multisigResp, VerifyOptions{Threshold: 2, TrustedKeys: trustedKeys}},
+	}
+	for _, testcase := range TESTCASES {
+		err := VerifyResponse(testcase.resp, input, testcase.opts)
+		if err != nil {
+			t.Fatalf("failed to verify response of %q: %v", testcase.resp.SignerID, err)
+		}
+		err = VerifyResponse(testcase.resp, []byte("some other input"), testcase.opts)
+		if err == nil {
+			t.Fatalf("expected verification of %q on another input to fail but it succeeded", testcase.resp.SignerID)
+		}
+	}
+}
+
+func TestVerifyResponseErrs(t *testing.T) {
+	t.Parallel()
+
+	csResp := signResponse(t, signer.Configuration{ID: "testcs", Type: contentsignature.Type, PrivateKey: ecdsaKey1})
+	otherKeyResp := csResp
+	otherKeyResp.PublicKey = signResponse(t, signer.Configuration{ID: "testcs2", Type: contentsignature.Type, PrivateKey: ecdsaKey2}).PublicKey
+	otherCurveResp := csResp
+	otherCurveResp.PublicKey = signResponse(t, signer.Configuration{ID: "testcsp521", Type: contentsignature.Type, PrivateKey: ecdsaP521Key}).PublicKey
+	pkiResp := formats.SignatureResponse{Type: contentsignaturepki.Type, X5U: "https://example.net/chain.pem", Signature: csResp.Signature}
+	failingFetch := func(x5u string) ([]byte, error) {
+		return nil, fmt.Errorf("x5u unavailable")
+	}
+
+	var TESTCASES = []struct {
+		desc string
+		resp formats.SignatureResponse
+		opts VerifyOptions
+	}{
+		{"content signature with another public key", otherKeyResp, VerifyOptions{}},
+		{"content signature with a public key on another curve", otherCurveResp, VerifyOptions{}},
+		{"unsupported type", formats.SignatureResponse{Type: "gpg2"}, VerifyOptions{}},
+		{"multisig without trusted keys", formats.SignatureResponse{Type: multisig.Type}, VerifyOptions{Threshold: 1}},
+		{"contentsignaturepki without root hash", pkiResp, VerifyOptions{FetchX5U: failingFetch}},
+		{"contentsignaturepki without x5u", formats.SignatureResponse{Type: contentsignaturepki.Type}, VerifyOptions{RootHash: "AA"}},
+		{"contentsignaturepki failing to fetch its x5u", pkiResp, VerifyOptions{RootHash: "AA", FetchX5U: failingFetch}},
+		{"contentsignaturepki with an invalid chain", pkiResp, VerifyOptions{RootHash: "AA", FetchX5U: func(x5u string) ([]byte, error) {
+			return []byte("not a chain"), nil
+		}}},
+		{"apk2 without certificate", formats.SignatureResponse{Type: apk2.Type}, VerifyOptions{}},
+		{"apk2 with an invalid signed file", formats.SignatureResponse{Type: apk2.Type, SignedFile: "not base64"}, VerifyOptions{APKCertificate: &x509.Certificate{}}},
+		{"apk2 of an unsigned input", formats.SignatureResponse{Type: apk2.Type}, VerifyOptions{APKCertificate: &x509.Certificate{}}},
+		{"contentsignaturepki with an invalid inline chain", formats.SignatureResponse{Type: contentsignaturepki.Type, Chain: []string{"not a chain"}, Signature: csResp.Signature}, VerifyOptions{RootHash: "AA", FetchX5U: failingFetch}},
+	}
+	for _, testcase := range TESTCASES {
+		err := VerifyResponse(testcase.resp, input, testcase.opts)
+		if err == nil {
+			t.Fatalf("expected verification of %s to fail but it succeeded", testcase.desc)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mozilla-services/autograph/formats"
+	"github.com/mozilla-services/autograph/signer"
+	"github.com/mozilla-services/autograph/signer/apk2"
+	"github.com/mozilla-services/autograph/signer/contentsignature"
+	"github.com/mozilla-services/autograph/signer/contentsignaturepki"
+	"github.com/mozilla-services/autograph/signer/ed25519"
+	"github.com/mozilla-services/autograph/signer/genericrsa"
+	"github.com/mozilla-services/autograph/signer/mar"
+	"github.com/mozilla-services/autograph/signer/multisig"
+	"github.com/mozilla-services/autograph/signer/rfc3161"
+	"github.com/mozilla-services/autograph/signer/xpi"
+	"github.com/mozilla-services/autograph/verifier"
+)
+
+const (
+	// maxVerificationRequests is the largest number of signature
+	// responses a single request to /verify can verify
+	maxVerificationRequests = 10000
+
+	// verificationConcurrency is the number of signature responses
+	// of a single request to /verify verified in parallel
+	verificationConcurrency = 8
+)
+
+// handleVerification verifies a batch of signature responses on
+// their inputs and returns the result of each verification
+func (a *autographer) handleVerification(w http.ResponseWriter, r *http.Request) {
+	rid := getRequestID(r)
+	starttime := getRequestStartTime(r)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "failed to read request body: %s", err)
+		return
+	}
+	userid, err := a.authorize(r, body)
+	if err != nil {
+		httpError(w, r, http.StatusUnauthorized, "authorization verification failed: %v", err)
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/json" {
+		httpError(w, r, http.StatusBadRequest, "invalid content type, expected application/json")
+		return
+	}
+	var verreqs []formats.VerificationRequest
+	err = json.Unmarshal(body, &verreqs)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "failed to parse request body: %v", err)
+		return
+	}
+	if len(verreqs) == 0 {
+		httpError(w, r, http.StatusBadRequest, "no signature responses to verify")
+		return
+	}
+	if len(verreqs) > maxVerificationRequests {
+		httpError(w, r, http.StatusBadRequest, "received too many signature responses to verify (max is %d)", maxVerificationRequests)
+		return
+	}
+
+	var (
+		verresps = make([]formats.VerificationResponse, len(verreqs))
+		wg       sync.WaitGroup
+		slots    = make(chan struct{}, verificationConcurrency)
+	)
+	for i, verreq := range verreqs {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, verreq formats.VerificationRequest) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			verresps[i] = formats.VerificationResponse{
+				Ref:      verreq.SignatureResponse().Ref,
+				SignerID: verreq.SignatureResponse().SignerID,
+			}
+			err := a.verifySignatureResponse(userid, verreq)
+			if err != nil {
+				verresps[i].Error = err.Error()
+				return
+			}
+			verresps[i].Verified = true
+		}(i, verreq)
+	}
+	wg.Wait()
+
+	verifiedCount := 0
+	for _, verresp := range verresps {
+		if verresp.Verified {
+			verifiedCount++
+		}
+	}
+	respdata, err := json.Marshal(verresps)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, "verification failed with error: %v", err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respdata)
+	log.WithFields(log.Fields{
+		"rid":                       rid,
+		"user_id":                   userid,
+		"num_verification_requests": len(verreqs),
+		"num_verified":              verifiedCount,
+		"t":                         int32(time.Since(starttime) / time.Millisecond), //  request processing time in ms
+	}).Info("verification request completed")
+}
+
+// verifySignatureResponse verifies a signature response on its input
+// with the keys of the signer that returned it. Users can only verify
+// responses of the signers they are allowed to sign with.
+func (a *autographer) verifySignatureResponse(userid string, verreq formats.VerificationRequest) error {
+	response := verreq.SignatureResponse()
+	if response.SignerID == "" {
+		return fmt.Errorf("missing signer_id in signature response")
+	}
+	input, err := base64.StdEncoding.DecodeString(verreq.Input)
+	if err != nil {
+		return fmt.Errorf("failed to base64 decode input: %w", err)
+	}
+	requestedSigner, err := a.authBackend.getSignerForUser(userid, response.SignerID)
+	if err != nil {
+		return err
+	}
+	signerConf := requestedSigner.Config()
+	if response.Type != signerConf.Type {
+		return fmt.Errorf("signature response type %q does not match signer type %q", response.Type, signerConf.Type)
+	}
+	// verify with the keys of the signer rather than the ones
+	// in the response
+	responseSignerOpts := response.SignerOpts
+	response.Mode = signerConf.Mode
+	response.PublicKey = signerConf.PublicKey
+	response.SignerOpts = signerConf.SignerOpts
+	opts := verifier.VerifyOptions{Now: a.now}
+	switch signerConf.Type {
+	case contentsignature.Type, ed25519.Type, mar.Type, rfc3161.Type:
+	case genericrsa.Type:
+		// signatures may use one of the allowed hashes of the signer
+		// chosen by the request options
+		if rsaSigner, ok := signer.Unwrap(requestedSigner).(*genericrsa.RSASigner); ok && responseSignerOpts != nil {
+			response.SignerOpts, err = rsaSigner.ResponseSignerOpts(responseSignerOpts)
+			if err != nil {
+				return err
+			}
+		}
+	case contentsignaturepki.Type:
+		// the signer configuration holds the base location chains are
+		// uploaded to, while the initialized signer has the full x5u
+		x5uBase := signerConf.X5U
+		if initConf, ok := a.getSignerConf(signerConf.ID); ok {
+			x5uBase = initConf.X5U
+		}
+		if !isUnderX5ULocation(response.X5U, x5uBase) {
+			return fmt.Errorf("signature response x5u %q is not under the signer x5u location %q", response.X5U, x5uBase)
+		}
+		block, _ := pem.Decode([]byte(signerConf.CaCert))
+		if block == nil {
+			return fmt.Errorf("failed to parse the root certificate of the signer")
+		}
+		rootHash := sha256.Sum256(block.Bytes)
+		opts.RootHash = fmt.Sprintf("%X", rootHash[:])
+		opts.FetchX5U = func(x5u string) ([]byte, error) {
+			return a.getX5U(x5u, signerConf.X5UMaxChainSize)
+		}
+	case xpi.Type:
+		// the end-entity certificates of xpi signatures are issued
+		// by the certificate of the signer
+		issuerCert, err := parsePEMCertificate(signerConf.Certificate)
+		if err != nil {
+			return fmt.Errorf("failed to parse the certificate of the signer: %w", err)
+		}
+		opts.XPIRoots = x509.NewCertPool()
+		opts.XPIRoots.AddCert(issuerCert)
+	case apk2.Type:
+		opts.APKCertificate, err = parsePEMCertificate(signerConf.Certificate)
+		if err != nil {
+			return fmt.Errorf("failed to parse the certificate of the signer: %w", err)
+		}
+		if signerConf.RotationCert != "" {
+			opts.APKRotationCertificate, err = parsePEMCertificate(signerConf.RotationCert)
+			if err != nil {
+				return fmt.Errorf("failed to parse the rotation certificate of the signer: %w", err)
+			}
+		}
+	case multisig.Type:
+		opts.Threshold = signerConf.Threshold
+		for _, member := range signerConf.Members {
+			opts.TrustedKeys = append(opts.TrustedKeys, member.PublicKey)
+		}
+	default:
+		return fmt.Errorf("verification of %q signatures is not supported", signerConf.Type)
+	}
+	return verifier.VerifyResponse(response, input, opts)
+}
+
+// parsePEMCertificate parses the PEM certificate of a signer
+// configuration
+func parsePEMCertificate(certPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// isUnderX5ULocation returns whether an x5u is at or under the x5u
+// location of a signer. It must have the scheme and host of the
+// location, and its path must be the one of the location or under it
+// by whole path segments, so a location without a trailing slash does
+// not match other hosts or sibling directories. Dot segments, which
+// fetching would resolve out of the location, are refused.
+func isUnderX5ULocation(x5u, location string) bool {
+	if x5u == "" {
+		return false
+	}
+	x5uURL, err := url.Parse(x5u)
+	if err != nil {
+		return false
+	}
+	locationURL, err := url.Parse(location)
+	if err != nil {
+		return false
+	}
+	if x5uURL.Scheme != locationURL.Scheme || !strings.EqualFold(x5uURL.Host, locationURL.Host) ||
+		x5uURL.User != nil || x5uURL.Opaque != "" {
+		return false
+	}
+	for _, segment := range strings.Split(x5uURL.Path, "/") {
+		if segment == "." || segment == ".." {
+			return false
+		}
+	}
+	base := locationURL.Path
+	if base == "" || strings.HasSuffix(base, "/") {
+		return strings.HasPrefix(x5uURL.Path, base)
+	}
+	return x5uURL.Path == base || strings.HasPrefix(x5uURL.Path, base+"/")
+}
+
+// setX5UCacheTTL replaces the cache of the x5u chains fetched to
+// verify content signatures with one keeping them for ttl, or
+// contentsignaturepki.DefaultX5UCacheTTL when ttl is zero
+func (a *autographer) setX5UCacheTTL(ttl time.Duration) error {
+	if ttl < 0 {
+		return fmt.Errorf("x5u cache ttl must not be negative, got %s", ttl)
+	}
+	a.x5uCache = contentsignaturepki.NewX5UCacheWithClock(ttl, func() time.Time {
+		return a.now()
+	})
+	return nil
+}
+
+// getX5U returns the certificate chain at an x5u from the cache, which
+// fetches it when it is missing, expired or no longer verifies
+func (a *autographer) getX5U(x5u string, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		maxSize = contentsignaturepki.DefaultX5UMaxChainSize
+	}
+	// GetX5UWithMaxSize can replace the transport of the client,
+	// so each fetch uses its own
+	client := &http.Client{Timeout: contentsignaturepki.DefaultX5UFetchTimeout}
+	chain, _, err := a.x5uCache.Get(client, x5u, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch x5u: %w", err)
+	}
+	return chain, nil
+}
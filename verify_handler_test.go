@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/autograph/formats"
+	"github.com/mozilla-services/autograph/signer"
+)
+
+// signForVerification signs the input with a signer on /sign/data
+// as alice and returns the signature response
+func signForVerification(t *testing.T, input []byte, keyID string) formats.SignatureResponse {
+	return signWithOptionsForVerification(t, input, keyID, nil)
+}
+
+// signWithOptionsForVerification signs the input like
+// signForVerification with the request options
+func signWithOptionsForVerification(t *testing.T, input []byte, keyID string, options interface{}) formats.SignatureResponse {
+	body, err := json.Marshal([]formats.SignatureRequest{
+		formats.SignatureRequest{
+			Input:   base64.StdEncoding.EncodeToString(input),
+			KeyID:   keyID,
+			Options: options,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", getAuthHeader(req, conf.Authorizations[0].ID, conf.Authorizations[0].Key,
+		sha256.New, id(), "application/json", body))
+	w := httptest.NewRecorder()
+	ag.handleSignature(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("failed to sign with %q: %d %s", keyID, w.Code, w.Body.String())
+	}
+	var responses []formats.SignatureResponse
+	err = json.Unmarshal(w.Body.Bytes(), &responses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return responses[0]
+}
+
+func verificationRequest(t *testing.T, user, key string, verreqs []formats.VerificationRequest) *httptest.ResponseRecorder {
+	body, err := json.Marshal(verreqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "http://foo.bar/verify", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", getAuthHeader(req, user, key, sha256.New, id(), "application/json", body))
+	w := httptest.NewRecorder()
+	ag.handleVerification(w, req)
+	return w
+}
+
+func TestVerification(t *testing.T) {
+	t.Parallel()
+
+	input := []byte("foobarbaz1234abcd")
+	otherInput := []byte("some other input")
+	b64Input := base64.StdEncoding.EncodeToString(input)
+
+	var TESTCASES = []struct {
+		keyID    string
+		input    []byte
+		verified bool
+	}{
+		{"appkey1", input, true},
+		{"appkey1", otherInput, false},
+		{"normandy", input, true},
+		{"normandy", otherInput, false},
+		{"testmar", input, true},
+		{"testmar", otherInput, false},
+		{"dummyrsapss", input, true},
+		{"dummyrsa", otherInput, false},
+		{"dummyed25519", input, true},
+		{"dummyed25519", otherInput, false},
+		{"testtsa", input, true},
+		{"testtsa", otherInput, false},
+		// pgp signatures cannot be verified
+		{"randompgp", input, false},
+	}
+	var verreqs []formats.VerificationRequest
+	for _, testcase := range TESTCASES {
+		verreqs = append(verreqs, formats.VerificationRequest{
+			Input:    base64.StdEncoding.EncodeToString(testcase.input),
+			Response: signForVerification(t, input, testcase.keyID),
+		})
+	}
+	// the type of the response must match the signer
+	mismatched := verreqs[0]
+	mismatched.Response.Type = "genericrsa"
+	verreqs = append(verreqs, mismatched)
+
+	w := verificationRequest(t, conf.Authorizations[0].ID, conf.Authorizations[0].Key, verreqs)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected verification status %d but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var verresps []formats.VerificationResponse
+	err := json.Unmarshal(w.Body.Bytes(), &verresps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verresps) != len(verreqs) {
+		t.Fatalf("expected %d verification responses but got %d", len(verreqs), len(verresps))
+	}
+	for i, verresp := range verresps {
+		expected := i < len(TESTCASES) && TESTCASES[i].verified
+		if verresp.Verified != expected {
+			t.Fatalf("verification %d of signer %q expected verified %t but got %t: %s",
+				i, verresp.SignerID, expected, verresp.Verified, verresp.Error)
+		}
+		if verresp.Ref != verreqs[i].Response.Ref {
+			t.Fatalf("verification %d expected ref %q but got %q", i, verreqs[i].Response.Ref, verresp.Ref)
+		}
+		if !verresp.Verified && verresp.Error == "" {
+			t.Fatalf("verification %d failed without an error", i)
+		}
+	}
+
+	// the chain of the normandy signature was cached
+	if ag.x5uCache.Len() == 0 {
+		t.Fatalf("expected the x5u of the content signature pki response to be cached")
+	}
+
+	// bob is not allowed to use appkey1, so cannot verify its signatures
+	verreqs = []formats.VerificationRequest{{Input: b64Input, Response: signForVerification(t, input, "appkey1")}}
+	w = verificationRequest(t, conf.Authorizations[1].ID, conf.Authorizations[1].Key, verreqs)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected verification status %d but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &verresps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verresps[0].Verified {
+		t.Fatalf("expected verification of a signer bob cannot use to fail but it succeeded")
+	}
+}
+
+func TestVerificationAllowedHash(t *testing.T) {
+	t.Parallel()
+
+	input := []byte("foobarbaz1234abcd")
+	b64Input := base64.StdEncoding.EncodeToString(input)
+	sha256Resp := signForVerification(t, input, "dummyrsa")
+	sha384Resp := signWithOptionsForVerification(t, input, "dummyrsa", map[string]interface{}{"hash": "sha384"})
+	if sha256Resp.SignerOpts.(map[string]interface{})["Hash"] != float64(crypto.SHA256) {
+		t.Fatalf("expected signer options with the sha256 hash of the signer but got %v", sha256Resp.SignerOpts)
+	}
+	if sha384Resp.SignerOpts.(map[string]interface{})["Hash"] != float64(crypto.SHA384) {
+		t.Fatalf("expected signer options with the sha384 hash of the options but got %v", sha384Resp.SignerOpts)
+	}
+	// the hash of a response must be allowed by the signer
+	disallowedResp := sha384Resp
+	disallowedResp.SignerOpts = map[string]interface{}{"Hash": float64(crypto.SHA512), "SaltLength": -1}
+	// the hash of a response must match its signature
+	mismatchedResp := sha384Resp
+	mismatchedResp.SignerOpts = sha256Resp.SignerOpts
+
+	verreqs := []formats.VerificationRequest{
+		{Input: b64Input, Response: sha256Resp},
+		{Input: b64Input, Response: sha384Resp},
+		{Input: b64Input, Response: disallowedResp},
+		{Input: b64Input, Response: mismatchedResp},
+	}
+	expected := []bool{true, true, false, false}
+	w := verificationRequest(t, conf.Authorizations[0].ID, conf.Authorizations[0].Key, verreqs)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected verification status %d but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var verresps []formats.VerificationResponse
+	err := json.Unmarshal(w.Body.Bytes(), &verresps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, verresp := range verresps {
+		if verresp.Verified != expected[i] {
+			t.Fatalf("verification %d expected verified %t but got %t: %s", i, expected[i], verresp.Verified, verresp.Error)
+		}
+	}
+}
+
+func TestVerificationFlatRequest(t *testing.T) {
+	t.Parallel()
+
+	input := []byte("foobarbaz1234abcd")
+	b64Input := base64.StdEncoding.EncodeToString(input)
+	flatRequest := func(input string, resp formats.SignatureResponse) formats.VerificationRequest {
+		return formats.VerificationRequest{
+			Input:     input,
+			Type:      resp.Type,
+			SignerID:  resp.SignerID,
+			Signature: resp.Signature,
+			X5U:       resp.X5U,
+			PublicKey: resp.PublicKey,
+		}
+	}
+	csResp := signForVerification(t, input, "appkey1")
+	xpiResp := signWithOptionsForVerification(t, input, "webextensions-rsa", map[string]interface{}{"id": "test@example.net"})
+	otherXPIResp := signWithOptionsForVerification(t, input, "extensions-ecdsa", map[string]interface{}{"id": "test@example.net"})
+	// xpi signatures must be issued by the certificate of the signer
+	mismatchedXPIResp := otherXPIResp
+	mismatchedXPIResp.SignerID = xpiResp.SignerID
+
+	verreqs := []formats.VerificationRequest{
+		flatRequest(b64Input, csResp),
+		flatRequest(base64.StdEncoding.EncodeToString([]byte("some other input")), csResp),
+		flatRequest(b64Input, signForVerification(t, input, "testmar")),
+		flatRequest(b64Input, signForVerification(t, input, "normandy")),
+		flatRequest(b64Input, xpiResp),
+		flatRequest(b64Input, otherXPIResp),
+		flatRequest(b64Input, mismatchedXPIResp),
+		// the input of apk2 verifications is the signed APK
+		{Input: b64Input, Type: "apk2", SignerID: "testapp-android"},
+	}
+	expected := []bool{true, false, true, true, true, true, false, false}
+	w := verificationRequest(t, conf.Authorizations[0].ID, conf.Authorizations[0].Key, verreqs)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected verification status %d but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var verresps []formats.VerificationResponse
+	err := json.Unmarshal(w.Body.Bytes(), &verresps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, verresp := range verresps {
+		if verresp.Verified != expected[i] {
+			t.Fatalf("verification %d of signer %q expected verified %t but got %t: %s",
+				i, verresp.SignerID, expected[i], verresp.Verified, verresp.Error)
+		}
+		if verresp.SignerID != verreqs[i].SignerID {
+			t.Fatalf("verification %d expected signer %q but got %q", i, verreqs[i].SignerID, verresp.SignerID)
+		}
+	}
+}
+
+func TestVerificationErrs(t *testing.T) {
+	t.Parallel()
+
+	w := verificationRequest(t, conf.Authorizations[0].ID, conf.Authorizations[0].Key, []formats.VerificationRequest{})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected empty verification request status %d but got %d", http.StatusBadRequest, w.Code)
+	}
+	w = verificationRequest(t, conf.Authorizations[0].ID, "wrongkey", []formats.VerificationRequest{{}})
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected unauthorized verification request status %d but got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestVerificationClock(t *testing.T) {
+	t.Parallel()
+
+	var pkiConf signer.Configuration
+	for _, signerConf := range conf.Signers {
+		if signerConf.ID == "normandy" {
+			pkiConf = signerConf
+		}
+	}
+	tmpag := newAutographer(1)
+	err := tmpag.addSigners([]signer.Configuration{pkiConf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpag.addAuthorizations([]authorization{{ID: "alice", Key: "alicekey", Signers: []string{pkiConf.ID}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := []byte("foobarbaz1234abcd")
+	verreq := formats.VerificationRequest{
+		Input:    base64.StdEncoding.EncodeToString(input),
+		Response: signForVerification(t, input, pkiConf.ID),
+	}
+	now := time.Now()
+	var TESTCASES = []struct {
+		desc     string
+		now      time.Time
+		verified bool
+	}{
+		{"now", now, true},
+		{"ten years from now", now.AddDate(10, 0, 0), false},
+		{"ten years ago", now.AddDate(-10, 0, 0), false},
+	}
+	for _, testcase := range TESTCASES {
+		tmpag.now = func() time.Time { return testcase.now }
+		err = tmpag.verifySignatureResponse("alice", verreq)
+		if testcase.verified && err != nil {
+			t.Fatalf("expected verification %s to succeed but got: %v", testcase.desc, err)
+		}
+		if !testcase.verified && err == nil {
+			t.Fatalf("expected verification %s to fail but it succeeded", testcase.desc)
+		}
+	}
+}
+
+func TestIsUnderX5ULocation(t *testing.T) {
+	t.Parallel()
+
+	var testcases = []struct {
+		x5u, location string
+		expected      bool
+	}{
+		{"https://cdn.example.com/chains/normandy.chain", "https://cdn.example.com/chains/", true},
+		{"https://cdn.example.com/chains/normandy.chain", "https://cdn.example.com/chains", true},
+		{"https://cdn.example.com/chains/normandy.chain", "https://cdn.example.com", true},
+		{"https://CDN.example.com/chains/normandy.chain", "https://cdn.example.com/chains/", true},
+		{"https://cdn.example.com/chains/normandy.chain", "https://cdn.example.com/chains/normandy.chain", true},
+		{"file:///tmp/chains/normandy.chain", "file:///tmp/chains/", true},
+		{"", "https://cdn.example.com/chains/", false},
+		{"https://cdn.example.com.attacker.net/chains/normandy.chain", "https://cdn.example.com", false},
+		{"https://cdn.example.com:8443/chains/normandy.chain", "https://cdn.example.com", false},
+		{"https://cdn.example.com@attacker.net/chains/normandy.chain", "https://cdn.example.com", false},
+		{"https://attacker.net/https://cdn.example.com/chains/", "https://cdn.example.com/chains/", false},
+		{"http://cdn.example.com/chains/normandy.chain", "https://cdn.example.com/chains/", false},
+		{"https://cdn.example.com/chainsfoo/normandy.chain", "https://cdn.example.com/chains", false},
+		{"https://cdn.example.com/chains/../private/key.pem", "https://cdn.example.com/chains/", false},
+		{"https://cdn.example.com/chains/%2e%2e/private/key.pem", "https://cdn.example.com/chains/", false},
+		{"%gh&%ij", "https://cdn.example.com/chains/", false},
+	}
+	for _, testcase := range testcases {
+		if isUnderX5ULocation(testcase.x5u, testcase.location) != testcase.expected {
+			t.Fatalf("expected x5u %q under location %q to be %t", testcase.x5u, testcase.location, testcase.expected)
+		}
+	}
+}
+
+func TestSetX5UCacheTTL(t *testing.T) {
+	t.Parallel()
+
+	var pkiConf signer.Configuration
+	for _, signerConf := range conf.Signers {
+		if signerConf.ID == "normandy" {
+			pkiConf = signerConf
+		}
+	}
+	tmpag := newAutographer(1)
+	err := tmpag.setX5UCacheTTL(-time.Minute)
+	if err == nil {
+		t.Fatal("expected negative x5u cache ttl to fail but it succeeded")
+	}
+	err = tmpag.setX5UCacheTTL(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpag.addSigners([]signer.Configuration{pkiConf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpag.addAuthorizations([]authorization{{ID: "alice", Key: "alicekey", Signers: []string{pkiConf.ID}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := []byte("foobarbaz1234abcd")
+	verreq := formats.VerificationRequest{
+		Input:    base64.StdEncoding.EncodeToString(input),
+		Response: signForVerification(t, input, pkiConf.ID),
+	}
+	err = tmpag.verifySignatureResponse("alice", verreq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tmpag.x5uCache.Len() != 1 {
+		t.Fatalf("expected the x5u of the response to be cached but the cache has %d chains", tmpag.x5uCache.Len())
+	}
+	tmpag.x5uCache.Clear()
+	if tmpag.x5uCache.Len() != 0 {
+		t.Fatalf("expected the x5u cache to be empty after clearing it but it has %d chains", tmpag.x5uCache.Len())
+	}
+}